@@ -0,0 +1,73 @@
+// Command fhir-validate checks FHIR JSON files against the profiles bundled
+// with the API, offline. Bundles go through the same rules as POST /fhir, so
+// a hospital can check an export before sending it.
+//
+// Usage:
+//
+//	go run ./cmd/fhir-validate file.json...
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/fhir"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: fhir-validate file.json...")
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, name := range os.Args[1:] {
+		issues, err := validate(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		for _, issue := range issues {
+			fmt.Printf("%s: %s %s %s: %s\n", name, issue.Severity, issue.Code, strings.Join(issue.Expression, ", "), issue.Diagnostics)
+		}
+		if fhir.HasErrors(issues) {
+			failed = true
+		} else {
+			fmt.Printf("%s: OK\n", name)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func validate(name string) ([]fhir.Issue, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if header.ResourceType != "Bundle" {
+		return fhir.Validate(data), nil
+	}
+
+	var bundle fhir.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, err
+	}
+	imported, issues := fhir.Import(&bundle, time.Now())
+	for _, patient := range imported {
+		issues = append(issues, patient.Issues...)
+	}
+	return issues, nil
+}
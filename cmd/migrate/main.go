@@ -0,0 +1,71 @@
+// Command migrate runs one-off data migrations against the configured database.
+//
+// Usage:
+//
+//	go run ./cmd/migrate backfill-patient-owner -owner <user id> [-access none|read|write]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/piyawat001/user-auth-api/migrations"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	// .env is optional here; the variables may come from the environment
+	godotenv.Load()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(os.Getenv("MONGODB_URI")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	db := client.Database(os.Getenv("DATABASE_NAME"))
+
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "backfill-patient-owner":
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		owner := fs.String("owner", "", "user ID that becomes owner of patients without one")
+		access := fs.String("access", "none", "hospital access for backfilled patients: none, read or write")
+		fs.Parse(args)
+
+		ownerID, err := primitive.ObjectIDFromHex(*owner)
+		if err != nil {
+			log.Fatalf("invalid -owner: %v", err)
+		}
+		if *access != "none" && *access != "read" && *access != "write" {
+			log.Fatalf("invalid -access %q", *access)
+		}
+
+		n, err := migrations.BackfillPatientOwner(ctx, db, ownerID, *access)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("backfilled owner on %d patients\n", n)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: migrate backfill-patient-owner -owner <user id> [-access none|read|write]")
+	os.Exit(2)
+}
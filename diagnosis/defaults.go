@@ -0,0 +1,98 @@
+package diagnosis
+
+import "github.com/piyawat001/user-auth-api/models"
+
+func age(from, to int, weight float64, label string) models.DiagnosisFactor {
+	return models.DiagnosisFactor{Field: "age", Min: &from, Max: &to, Weight: weight, Label: label}
+}
+
+func is(field string, values []string, weight float64, label string) models.DiagnosisFactor {
+	return models.DiagnosisFactor{Field: field, Values: values, Weight: weight, Label: label}
+}
+
+// Default is the rule set the API starts with, version 1, covering the
+// common odontogenic and non-odontogenic lesions of the jaws. Weights are a
+// starting point for faculty to tune, not validated probabilities.
+func Default() models.DiagnosisRuleSet {
+	noParesthesia := is("paresthesia", []string{"true"}, -1, "Paresthesia is uncommon in benign lesions")
+	single := []string{models.LesionsSingle}
+	slow := []string{models.DurationMonths, models.DurationYears}
+
+	return models.DiagnosisRuleSet{
+		Version: 1,
+		Note:    "Built-in rules",
+		Diagnoses: []models.DiagnosisRule{
+			{
+				Name:  "Radicular cyst",
+				Prior: 1.5, // Most common cyst of the jaws
+				Factors: []models.DiagnosisFactor{
+					age(30, 60, 1, "Usually found in the 4th–6th decades"),
+					is("number_of_lesions", single, 1, "Usually a single lesion at a non-vital tooth"),
+					is("expansion", []string{""}, 0.5, "Usually small with little expansion"),
+					noParesthesia,
+				},
+			},
+			{
+				Name:  "Dentigerous cyst",
+				Prior: 1,
+				Factors: []models.DiagnosisFactor{
+					age(10, 30, 1.5, "Peaks in the 2nd–3rd decades"),
+					is("gender", []string{models.GenderMale}, 0.5, "Slight male predominance"),
+					is("number_of_lesions", single, 1, "Usually a single lesion around an unerupted tooth"),
+					is("duration_of_lesion", slow, 0.5, "Slow, painless growth"),
+					noParesthesia,
+				},
+			},
+			{
+				Name:  "Odontogenic keratocyst",
+				Prior: 1,
+				Factors: []models.DiagnosisFactor{
+					age(10, 40, 1.5, "Peaks in the 2nd–4th decades"),
+					is("expansion", []string{models.ExpansionAnteroposterior}, 2, "Grows along the medullary bone with little buccolingual expansion"),
+					is("number_of_lesions", []string{models.LesionsMultiple}, 2, "Multiple keratocysts suggest nevoid basal cell carcinoma syndrome"),
+					is("gender", []string{models.GenderMale}, 0.5, "Slight male predominance"),
+				},
+			},
+			{
+				Name:  "Ameloblastoma",
+				Prior: 1,
+				Factors: []models.DiagnosisFactor{
+					age(30, 60, 1.5, "Most cases present in the 4th–6th decades"),
+					is("expansion", []string{models.ExpansionBuccolingual}, 2, "Marked buccolingual expansion is typical"),
+					is("duration_of_lesion", slow, 1, "Slow, painless growth"),
+					is("number_of_lesions", single, 0.5, "Solitary lesion"),
+					noParesthesia,
+				},
+			},
+			{
+				Name:  "Central giant cell granuloma",
+				Prior: 0.5,
+				Factors: []models.DiagnosisFactor{
+					age(0, 30, 1.5, "Most cases occur before 30"),
+					is("gender", []string{models.GenderFemale}, 1, "Female predominance"),
+					is("expansion", []string{models.ExpansionBuccolingual}, 1, "Often expands the cortex"),
+					is("duration_of_lesion", []string{models.DurationWeeks, models.DurationMonths}, 1, "Aggressive variants grow quickly"),
+				},
+			},
+			{
+				Name:  "Simple bone cyst",
+				Prior: 0.5,
+				Factors: []models.DiagnosisFactor{
+					age(10, 20, 2, "Typically found in the 2nd decade"),
+					is("expansion", []string{""}, 1.5, "Rarely expands the cortex"),
+					is("number_of_lesions", single, 0.5, "Solitary lesion"),
+					noParesthesia,
+				},
+			},
+			{
+				Name:  "Malignant neoplasm",
+				Prior: 0.2,
+				Factors: []models.DiagnosisFactor{
+					is("paresthesia", []string{"true"}, 3, "Paresthesia raises concern for malignancy"),
+					is("duration_of_lesion", []string{models.DurationWeeks}, 1.5, "Rapid growth"),
+					age(40, 120, 1, "Metastatic and primary malignancies are more common in older patients"),
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,106 @@
+// Package diagnosis ranks candidate diagnoses of a jaw lesion from the
+// clinical fields of a patient, using rules kept as data (see
+// models.DiagnosisRuleSet) so they can be tuned without a release. The
+// result supports, and never replaces, clinical and histopathological
+// diagnosis.
+package diagnosis
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/piyawat001/user-auth-api/models"
+)
+
+// Fields are the patient JSON keys a factor may test.
+var Fields = []string{"age", "gender", "duration_of_lesion", "expansion", "paresthesia", "number_of_lesions"}
+
+// Candidate is one ranked diagnosis with the factors that made its score.
+type Candidate struct {
+	Diagnosis  string         `json:"diagnosis"`
+	Score      float64        `json:"score"`
+	Likelihood float64        `json:"likelihood"` // Share of the positive scores of all candidates, 0–1
+	Factors    []Contribution `json:"factors"`
+}
+
+// Contribution is a factor the patient matched.
+type Contribution struct {
+	Field  string  `json:"field"`
+	Value  string  `json:"value"` // The patient's value
+	Label  string  `json:"label"`
+	Weight float64 `json:"weight"`
+}
+
+// value returns the patient's value of field as factors compare it, and
+// false when the field is not recorded.
+func value(patient *models.Patient, field string) (string, bool) {
+	switch field {
+	case "age":
+		return strconv.Itoa(patient.Age), true
+	case "gender":
+		return patient.Gender, patient.Gender != ""
+	case "duration_of_lesion":
+		return patient.DurationOfLesion, patient.DurationOfLesion != ""
+	case "expansion":
+		return patient.Expansion, true // Empty means the lesion shows none
+	case "paresthesia":
+		return strconv.FormatBool(patient.Paresthesia), true
+	case "number_of_lesions":
+		return patient.NumberOfLesions, patient.NumberOfLesions != ""
+	}
+	return "", false
+}
+
+// Matches reports whether patient meets factor.
+func Matches(factor models.DiagnosisFactor, patient *models.Patient) bool {
+	v, ok := value(patient, factor.Field)
+	if !ok {
+		return false
+	}
+	if factor.Field == "age" {
+		return (factor.Min == nil || patient.Age >= *factor.Min) && (factor.Max == nil || patient.Age <= *factor.Max)
+	}
+	for _, allowed := range factor.Values {
+		if v == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Rank scores every diagnosis of rules for patient, highest first. Ties keep
+// the order of the rule set.
+func Rank(rules models.DiagnosisRuleSet, patient *models.Patient) []Candidate {
+	candidates := make([]Candidate, 0, len(rules.Diagnoses))
+	positive := 0.0
+	for _, rule := range rules.Diagnoses {
+		candidate := Candidate{Diagnosis: rule.Name, Score: rule.Prior, Factors: []Contribution{}}
+		for _, factor := range rule.Factors {
+			if !Matches(factor, patient) {
+				continue
+			}
+			v, _ := value(patient, factor.Field)
+			candidate.Score += factor.Weight
+			candidate.Factors = append(candidate.Factors, Contribution{
+				Field:  factor.Field,
+				Value:  v,
+				Label:  factor.Label,
+				Weight: factor.Weight,
+			})
+		}
+		if candidate.Score > 0 {
+			positive += candidate.Score
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	for i := range candidates {
+		if positive > 0 && candidates[i].Score > 0 {
+			candidates[i].Likelihood = candidates[i].Score / positive
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return candidates
+}
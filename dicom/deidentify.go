@@ -0,0 +1,245 @@
+package dicom
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+)
+
+// identifyingTags are the top-level attributes blanked by Deidentify, taken
+// from the PS3.15 basic profile. UIDs, dates and times are handled
+// separately according to the Profile.
+var identifyingTags = map[Tag]bool{
+	0x00080050: true, // Accession Number
+	0x00080080: true, // Institution Name
+	0x00080081: true, // Institution Address
+	0x00080090: true, // Referring Physician's Name
+	0x00080092: true, // Referring Physician's Address
+	0x00080094: true, // Referring Physician's Telephone Numbers
+	0x00081010: true, // Station Name
+	0x00081030: true, // Study Description
+	0x0008103E: true, // Series Description
+	0x00081040: true, // Institutional Department Name
+	0x00081048: true, // Physician(s) of Record
+	0x00081050: true, // Performing Physician's Name
+	0x00081060: true, // Name of Physician(s) Reading Study
+	0x00081070: true, // Operators' Name
+	0x00081080: true, // Admitting Diagnoses Description
+	0x00100010: true, // Patient's Name
+	0x00100020: true, // Patient ID
+	0x00100030: true, // Patient's Birth Date
+	0x00100032: true, // Patient's Birth Time
+	0x00101000: true, // Other Patient IDs
+	0x00101001: true, // Other Patient Names
+	0x00101010: true, // Patient's Age
+	0x00101020: true, // Patient's Size
+	0x00101030: true, // Patient's Weight
+	0x00101040: true, // Patient's Address
+	0x00102000: true, // Medical Alerts
+	0x00102110: true, // Allergies
+	0x00102154: true, // Patient's Telephone Numbers
+	0x00102160: true, // Ethnic Group
+	0x00102180: true, // Occupation
+	0x001021B0: true, // Additional Patient History
+	0x00104000: true, // Patient Comments
+	0x00181000: true, // Device Serial Number
+	0x00181030: true, // Protocol Name
+	0x00200010: true, // Study ID
+	0x00204000: true, // Image Comments
+	0x00321032: true, // Requesting Physician
+	0x00321060: true, // Requested Procedure Description
+	0x00324000: true, // Study Comments
+	0x00380010: true, // Admission ID
+	0x00400253: true, // Performed Procedure Step ID
+	0x00400254: true, // Performed Procedure Step Description
+	0x00401001: true, // Requested Procedure ID
+}
+
+// keptUIDs are UI attributes that name a standard, not an instance, and so
+// are never replaced.
+var keptUIDs = map[Tag]bool{
+	0x00020002:           true, // Media Storage SOP Class UID
+	TagTransferSyntaxUID: true,
+	0x00020012:           true, // Implementation Class UID
+	0x00080016:           true, // SOP Class UID
+}
+
+// Profile chooses what Deidentify does beyond emptying identifying
+// attributes and dropping private tags and sequences.
+type Profile struct {
+	// UIDKey keys the HMAC the replacement UIDs are derived from, so the
+	// same key maps the UIDs of a study to the same replacements and its
+	// series still group together
+	UIDKey    []byte
+	KeepUIDs  bool // Keep instance UIDs rather than replacing them
+	KeepDates bool // Keep dates and times rather than truncating them to the year
+}
+
+// Deidentify returns a copy of the file following the PS3.15 basic profile:
+// identifying attributes are emptied, private tags and sequences dropped,
+// instance UIDs replaced and dates truncated to the year (unless profile
+// keeps them), and Patient Identity Removed set to YES. In implicit VR files
+// only the UIDs and dates known to implicitVR are recognised.
+func (f *File) Deidentify(profile Profile) []byte {
+	var out bytes.Buffer
+	out.Grow(len(f.Data))
+	f.writeMeta(&out, profile)
+
+	marked := false
+	for _, el := range f.Elements {
+		if !marked && el.Tag >= TagPatientIdentityRemoved {
+			f.writeElement(&out, f.explicit, TagPatientIdentityRemoved, "CS", []byte("YES "))
+			marked = true
+			if el.Tag == TagPatientIdentityRemoved {
+				continue
+			}
+		}
+		if uint32(el.Tag)>>16%2 == 1 || f.isSequence(el) {
+			continue
+		}
+		if identifyingTags[el.Tag] {
+			f.writeElement(&out, f.explicit, el.Tag, el.VR, nil)
+			continue
+		}
+		if value, ok := profile.replace(el, f.Data[el.ValueOffset:el.End]); ok {
+			f.writeElement(&out, f.explicit, el.Tag, el.VR, value)
+			continue
+		}
+		out.Write(f.Data[el.Offset:el.End])
+	}
+	if !marked {
+		f.writeElement(&out, f.explicit, TagPatientIdentityRemoved, "CS", []byte("YES "))
+	}
+
+	return out.Bytes()
+}
+
+// writeMeta copies the preamble and file meta group, replacing the Media
+// Storage SOP Instance UID like the SOP Instance UID it repeats and
+// recomputing the group length to match.
+func (f *File) writeMeta(out *bytes.Buffer, profile Profile) {
+	out.Write(f.Data[:132])
+
+	var group bytes.Buffer
+	for pos := 132; pos < f.DatasetOffset; {
+		el, err := f.readElement(pos, true)
+		if err != nil {
+			// Parse read the same bytes, so this can't happen
+			out.Write(f.Data[pos:f.DatasetOffset])
+			return
+		}
+		pos = el.End
+		switch value, ok := profile.replace(el, f.Data[el.ValueOffset:el.End]); {
+		case el.Tag == 0x00020000:
+		case ok:
+			f.writeElement(&group, true, el.Tag, el.VR, value)
+		default:
+			group.Write(f.Data[el.Offset:el.End])
+		}
+	}
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(group.Len()))
+	f.writeElement(out, true, 0x00020000, "UL", length[:])
+	out.Write(group.Bytes())
+}
+
+// isSequence reports whether el holds items rather than a value: an SQ, or
+// in implicit VR any undefined-length element but the pixel data or a value
+// that starts with an item tag.
+func (f *File) isSequence(el Element) bool {
+	switch {
+	case el.VR == "SQ":
+		return true
+	case el.Tag == TagPixelData:
+		return false
+	case el.Length == undefinedLength:
+		return true
+	}
+	if el.VR != "" && el.VR != "UN" || el.End-el.ValueOffset < 4 {
+		return false
+	}
+	return Tag(uint32(binary.LittleEndian.Uint16(f.Data[el.ValueOffset:]))<<16|
+		uint32(binary.LittleEndian.Uint16(f.Data[el.ValueOffset+2:]))) == tagItem
+}
+
+// replace returns the value the profile puts in place of an instance UID,
+// date, time or date time, and false for anything else.
+func (p Profile) replace(el Element, value []byte) ([]byte, bool) {
+	switch el.VR {
+	case "UI":
+		if p.KeepUIDs || keptUIDs[el.Tag] {
+			return nil, false
+		}
+		return ReplaceUID(p.UIDKey, trimValue(value)), true
+	case "DA":
+		if p.KeepDates {
+			return nil, false
+		}
+		if year := leadingYear(value); year != "" {
+			return []byte(year + "0101"), true
+		}
+		return nil, true
+	case "DT":
+		if p.KeepDates {
+			return nil, false
+		}
+		return []byte(leadingYear(value)), true
+	case "TM":
+		if p.KeepDates {
+			return nil, false
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+func leadingYear(value []byte) string {
+	if len(value) < 4 {
+		return ""
+	}
+	for _, b := range value[:4] {
+		if b < '0' || b > '9' {
+			return ""
+		}
+	}
+	return string(value[:4])
+}
+
+// ReplaceUID derives the UID that stands in for uid under key: a 2.25 UID
+// made of 128 bits of HMAC-SHA256, padded to an even length.
+func ReplaceUID(key []byte, uid string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("uid:" + uid))
+	n := new(big.Int).SetBytes(mac.Sum(nil)[:16])
+	replaced := []byte("2.25." + n.String())
+	if len(replaced)%2 == 1 {
+		replaced = append(replaced, 0)
+	}
+	return replaced
+}
+
+// writeElement encodes a short-form element in explicit or implicit VR.
+func (f *File) writeElement(out *bytes.Buffer, explicit bool, tag Tag, vr string, value []byte) {
+	var header [8]byte
+	binary.LittleEndian.PutUint16(header[0:], uint16(tag>>16))
+	binary.LittleEndian.PutUint16(header[2:], uint16(tag))
+	switch {
+	case !explicit:
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(value)))
+		out.Write(header[:])
+	case vrWithLongLength[vr]:
+		copy(header[4:], vr)
+		out.Write(header[:])
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(value)))
+		out.Write(length[:])
+	default:
+		copy(header[4:], vr)
+		binary.LittleEndian.PutUint16(header[6:], uint16(len(value)))
+		out.Write(header[:])
+	}
+	out.Write(value)
+}
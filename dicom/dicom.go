@@ -0,0 +1,321 @@
+// Package dicom reads the parts of DICOM Part 10 files that the API needs:
+// a handful of descriptive tags, the pixel data for previews, and the
+// patient-identifying tags so they can be de-identified. Only little endian
+// transfer syntaxes are supported, which covers what dental scanners emit.
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotDICOM    = errors.New("not a DICOM file")
+	ErrUnsupported = errors.New("unsupported DICOM encoding")
+)
+
+const (
+	ImplicitVRLittleEndian = "1.2.840.10008.1.2"
+	ExplicitVRLittleEndian = "1.2.840.10008.1.2.1"
+	ExplicitVRBigEndian    = "1.2.840.10008.1.2.2"
+	DeflatedExplicitVR     = "1.2.840.10008.1.2.1.99"
+	JPEGBaseline           = "1.2.840.10008.1.2.4.50"
+)
+
+// Tag is (group << 16) | element.
+type Tag uint32
+
+func (t Tag) String() string { return fmt.Sprintf("(%04X,%04X)", uint32(t)>>16, uint32(t)&0xFFFF) }
+
+const (
+	TagTransferSyntaxUID         Tag = 0x00020010
+	TagStudyDate                 Tag = 0x00080020
+	TagModality                  Tag = 0x00080060
+	TagBodyPartExamined          Tag = 0x00180015
+	TagImagerPixelSpacing        Tag = 0x00181164
+	TagPatientIdentityRemoved    Tag = 0x00120062
+	TagSamplesPerPixel           Tag = 0x00280002
+	TagPhotometricInterpretation Tag = 0x00280004
+	TagPlanarConfiguration       Tag = 0x00280006
+	TagNumberOfFrames            Tag = 0x00280008
+	TagRows                      Tag = 0x00280010
+	TagColumns                   Tag = 0x00280011
+	TagPixelSpacing              Tag = 0x00280030
+	TagBitsAllocated             Tag = 0x00280100
+	TagPixelRepresentation       Tag = 0x00280103
+	TagWindowCenter              Tag = 0x00281050
+	TagWindowWidth               Tag = 0x00281051
+	TagRescaleIntercept          Tag = 0x00281052
+	TagRescaleSlope              Tag = 0x00281053
+	TagPixelData                 Tag = 0x7FE00010
+	tagItem                      Tag = 0xFFFEE000
+	tagItemDelimitation          Tag = 0xFFFEE00D
+	tagSequenceDelimitation      Tag = 0xFFFEE0DD
+	undefinedLength                  = 0xFFFFFFFF
+)
+
+// Element is one top-level data element, kept as offsets into File.Data.
+type Element struct {
+	Tag         Tag
+	VR          string
+	Offset      int // Start of the element header
+	ValueOffset int
+	Length      uint32 // Value length, or 0xFFFFFFFF when undefined
+	End         int    // End of the whole element, including nested items
+}
+
+type File struct {
+	Data           []byte
+	TransferSyntax string
+	DatasetOffset  int // Where the dataset starts after the file meta group
+	Elements       []Element
+	explicit       bool
+}
+
+// IsDICOM reports whether data starts with the Part 10 preamble and magic.
+func IsDICOM(data []byte) bool {
+	return len(data) >= 132 && string(data[128:132]) == "DICM"
+}
+
+func Parse(data []byte) (*File, error) {
+	if !IsDICOM(data) {
+		return nil, ErrNotDICOM
+	}
+
+	f := &File{Data: data, explicit: true}
+
+	// The file meta group is always explicit VR little endian
+	pos := 132
+	for pos+4 <= len(data) && binary.LittleEndian.Uint16(data[pos:]) == 0x0002 {
+		el, err := f.readElement(pos, true)
+		if err != nil {
+			return nil, err
+		}
+		if el.Tag == TagTransferSyntaxUID {
+			f.TransferSyntax = trimValue(data[el.ValueOffset:el.End])
+		}
+		pos = el.End
+	}
+	f.DatasetOffset = pos
+
+	switch f.TransferSyntax {
+	case ExplicitVRBigEndian, DeflatedExplicitVR:
+		return nil, fmt.Errorf("%w: transfer syntax %s", ErrUnsupported, f.TransferSyntax)
+	case ImplicitVRLittleEndian:
+		f.explicit = false
+	}
+
+	for pos < len(data) {
+		el, err := f.readElement(pos, f.explicit)
+		if err != nil {
+			return nil, err
+		}
+		f.Elements = append(f.Elements, el)
+		pos = el.End
+	}
+
+	return f, nil
+}
+
+// vrWithLongLength are the explicit VRs that use 2 reserved bytes and a 4-byte length.
+var vrWithLongLength = map[string]bool{
+	"OB": true, "OD": true, "OF": true, "OL": true, "OV": true, "OW": true,
+	"SQ": true, "SV": true, "UC": true, "UN": true, "UR": true, "UT": true, "UV": true,
+}
+
+func (f *File) readElement(pos int, explicit bool) (Element, error) {
+	data := f.Data
+	if pos+8 > len(data) {
+		return Element{}, fmt.Errorf("%w: truncated element at %d", ErrUnsupported, pos)
+	}
+
+	tag := Tag(uint32(binary.LittleEndian.Uint16(data[pos:]))<<16 | uint32(binary.LittleEndian.Uint16(data[pos+2:])))
+	el := Element{Tag: tag, Offset: pos}
+
+	switch {
+	case uint32(tag)>>16 == 0xFFFE || !explicit:
+		el.Length = binary.LittleEndian.Uint32(data[pos+4:])
+		el.ValueOffset = pos + 8
+		el.VR = implicitVR[tag]
+	default:
+		el.VR = string(data[pos+4 : pos+6])
+		if vrWithLongLength[el.VR] {
+			if pos+12 > len(data) {
+				return Element{}, fmt.Errorf("%w: truncated element at %d", ErrUnsupported, pos)
+			}
+			el.Length = binary.LittleEndian.Uint32(data[pos+8:])
+			el.ValueOffset = pos + 12
+		} else {
+			el.Length = uint32(binary.LittleEndian.Uint16(data[pos+6:]))
+			el.ValueOffset = pos + 8
+		}
+	}
+
+	if el.Length == undefinedLength {
+		end, err := f.skipUndefined(el.ValueOffset, explicit)
+		if err != nil {
+			return Element{}, err
+		}
+		el.End = end
+		return el, nil
+	}
+
+	// Values are padded to an even length, so an odd one means a corrupt file
+	if el.Length%2 == 1 {
+		return Element{}, fmt.Errorf("%w: element %s has odd length %d", ErrUnsupported, tag, el.Length)
+	}
+	el.End = el.ValueOffset + int(el.Length)
+	if el.End > len(data) || el.End < el.ValueOffset {
+		return Element{}, fmt.Errorf("%w: element %s overruns file", ErrUnsupported, tag)
+	}
+	return el, nil
+}
+
+// skipUndefined walks the items of an undefined-length value (a sequence or
+// encapsulated pixel data) and returns the offset after its delimiter.
+func (f *File) skipUndefined(pos int, explicit bool) (int, error) {
+	for pos < len(f.Data) {
+		el, err := f.readElement(pos, explicit)
+		if err != nil {
+			return 0, err
+		}
+		switch el.Tag {
+		case tagSequenceDelimitation, tagItemDelimitation:
+			return el.ValueOffset, nil
+		}
+		pos = el.End
+	}
+	return 0, fmt.Errorf("%w: missing delimiter", ErrUnsupported)
+}
+
+func (f *File) Element(tag Tag) (Element, bool) {
+	for _, el := range f.Elements {
+		if el.Tag == tag {
+			return el, true
+		}
+	}
+	return Element{}, false
+}
+
+func (f *File) value(tag Tag) []byte {
+	el, ok := f.Element(tag)
+	if !ok || el.Length == undefinedLength {
+		return nil
+	}
+	return f.Data[el.ValueOffset:el.End]
+}
+
+// String returns a text value with DICOM padding removed.
+func (f *File) String(tag Tag) string {
+	return trimValue(f.value(tag))
+}
+
+// Uint16 returns a US value, or 0 when missing.
+func (f *File) Uint16(tag Tag) int {
+	v := f.value(tag)
+	if len(v) < 2 {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint16(v))
+}
+
+// Floats parses a multi-valued DS or IS value such as "0.1\0.1".
+func (f *File) Floats(tag Tag) []float64 {
+	s := f.String(tag)
+	if s == "" {
+		return nil
+	}
+	var out []float64
+	for _, part := range strings.Split(s, `\`) {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func trimValue(b []byte) string {
+	return strings.TrimRight(string(bytes.TrimRight(b, "\x00")), " ")
+}
+
+// Info holds the descriptive tags of a file.
+type Info struct {
+	Modality       string
+	StudyDate      *time.Time
+	BodyPart       string
+	PixelSpacing   []float64 // mm between rows, then between columns
+	Rows           int
+	Columns        int
+	Frames         int
+	TransferSyntax string
+}
+
+func (f *File) Info() Info {
+	info := Info{
+		Modality:       f.String(TagModality),
+		BodyPart:       f.String(TagBodyPartExamined),
+		PixelSpacing:   f.Floats(TagPixelSpacing),
+		Rows:           f.Uint16(TagRows),
+		Columns:        f.Uint16(TagColumns),
+		Frames:         1,
+		TransferSyntax: f.TransferSyntax,
+	}
+	// Projection radiographs (panoramic, periapical) often only carry the
+	// detector spacing
+	if len(info.PixelSpacing) == 0 {
+		info.PixelSpacing = f.Floats(TagImagerPixelSpacing)
+	}
+	if frames := f.Floats(TagNumberOfFrames); len(frames) == 1 && frames[0] > 1 {
+		info.Frames = int(frames[0])
+	}
+	if d, err := time.Parse("20060102", f.String(TagStudyDate)); err == nil {
+		info.StudyDate = &d
+	}
+	return info
+}
+
+// implicitVR gives the VR of the tags this package reads or Deidentify
+// rewrites when the file uses implicit VR; everything else is treated as
+// unknown.
+var implicitVR = map[Tag]string{
+	0x00080012:                   "DA", // Instance Creation Date
+	0x00080013:                   "TM", // Instance Creation Time
+	0x00080014:                   "UI", // Instance Creator UID
+	0x00080018:                   "UI", // SOP Instance UID
+	TagStudyDate:                 "DA",
+	0x00080021:                   "DA", // Series Date
+	0x00080022:                   "DA", // Acquisition Date
+	0x00080023:                   "DA", // Content Date
+	0x0008002A:                   "DT", // Acquisition DateTime
+	0x00080030:                   "TM", // Study Time
+	0x00080031:                   "TM", // Series Time
+	0x00080032:                   "TM", // Acquisition Time
+	0x00080033:                   "TM", // Content Time
+	0x0020000D:                   "UI", // Study Instance UID
+	0x0020000E:                   "UI", // Series Instance UID
+	0x00200052:                   "UI", // Frame of Reference UID
+	TagModality:                  "CS",
+	TagBodyPartExamined:          "CS",
+	TagImagerPixelSpacing:        "DS",
+	TagSamplesPerPixel:           "US",
+	TagPhotometricInterpretation: "CS",
+	TagPlanarConfiguration:       "US",
+	TagNumberOfFrames:            "IS",
+	TagRows:                      "US",
+	TagColumns:                   "US",
+	TagPixelSpacing:              "DS",
+	TagBitsAllocated:             "US",
+	TagPixelRepresentation:       "US",
+	TagWindowCenter:              "DS",
+	TagWindowWidth:               "DS",
+	TagRescaleIntercept:          "DS",
+	TagRescaleSlope:              "DS",
+	TagPixelData:                 "OW",
+}
@@ -0,0 +1,337 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"testing"
+)
+
+// element is a data element of a test fixture.
+type element struct {
+	tag   Tag
+	vr    string
+	value []byte
+	items [][]element // Sequence items, encoded with undefined lengths
+}
+
+const (
+	sopClass    = "1.2.840.10008.5.1.4.1.1.1.1" // Digital X-Ray Image Storage
+	sopInstance = "1.2.826.0.1.3680043.2.1125.1.1"
+	study       = "1.2.826.0.1.3680043.2.1125.1.2"
+	series      = "1.2.826.0.1.3680043.2.1125.1.3"
+	frame       = "1.2.826.0.1.3680043.2.1125.1.4"
+)
+
+// encode writes elements independently of the package's own writer, in
+// explicit VR little endian or, when explicit is false, implicit VR.
+func encode(buf *bytes.Buffer, explicit bool, elements []element) {
+	for _, el := range elements {
+		binary.Write(buf, binary.LittleEndian, uint16(el.tag>>16))
+		binary.Write(buf, binary.LittleEndian, uint16(el.tag))
+		length := uint32(len(el.value))
+		if el.items != nil {
+			length = undefinedLength
+		}
+		switch {
+		case !explicit:
+			binary.Write(buf, binary.LittleEndian, length)
+		case vrWithLongLength[el.vr]:
+			buf.WriteString(el.vr + "\x00\x00")
+			binary.Write(buf, binary.LittleEndian, length)
+		default:
+			buf.WriteString(el.vr)
+			binary.Write(buf, binary.LittleEndian, uint16(length))
+		}
+		if el.items == nil {
+			buf.Write(el.value)
+			continue
+		}
+		for _, item := range el.items {
+			binary.Write(buf, binary.LittleEndian, []uint16{0xFFFE, 0xE000})
+			binary.Write(buf, binary.LittleEndian, uint32(undefinedLength))
+			encode(buf, explicit, item)
+			binary.Write(buf, binary.LittleEndian, []uint16{0xFFFE, 0xE00D, 0, 0})
+		}
+		binary.Write(buf, binary.LittleEndian, []uint16{0xFFFE, 0xE0DD, 0, 0})
+	}
+}
+
+// fixture builds a Part 10 file in the given transfer syntax holding every
+// attribute the basic profile names, UIDs, dates, a private tag, sequences
+// and a 2×2 image.
+func fixture(syntax string) []byte {
+	explicit := syntax != ImplicitVRLittleEndian
+
+	var meta bytes.Buffer
+	encode(&meta, true, []element{
+		{tag: 0x00020001, vr: "OB", value: []byte{0, 1}},
+		{tag: 0x00020002, vr: "UI", value: pad(sopClass, 0)},
+		{tag: 0x00020003, vr: "UI", value: pad(sopInstance, 0)},
+		{tag: TagTransferSyntaxUID, vr: "UI", value: pad(syntax, 0)},
+	})
+
+	dataset := []element{
+		{tag: 0x00080016, vr: "UI", value: pad(sopClass, 0)},
+		{tag: 0x00080018, vr: "UI", value: pad(sopInstance, 0)},
+		{tag: TagStudyDate, vr: "DA", value: []byte("20240315")},
+		{tag: 0x00080021, vr: "DA", value: []byte("20240315")},
+		{tag: 0x0008002A, vr: "DT", value: []byte("20240315101500")},
+		{tag: 0x00080030, vr: "TM", value: []byte("101500")},
+		{tag: TagModality, vr: "CS", value: []byte("PX")},
+		{tag: 0x00081110, vr: "SQ", items: [][]element{{{tag: 0x00081155, vr: "UI", value: pad(study, 0)}}}}, // Referenced Study Sequence
+		{tag: 0x00090010, vr: "LO", value: []byte("ACME 1.0")},                                               // Private creator
+		{tag: 0x00091001, vr: "LO", value: []byte("Somchai Jaidee")},
+		{tag: TagBodyPartExamined, vr: "CS", value: []byte("JAW ")},
+		{tag: 0x0020000D, vr: "UI", value: pad(study, 0)},
+		{tag: 0x0020000E, vr: "UI", value: pad(series, 0)},
+		{tag: 0x00200052, vr: "UI", value: pad(frame, 0)},
+		{tag: TagSamplesPerPixel, vr: "US", value: []byte{1, 0}},
+		{tag: TagPhotometricInterpretation, vr: "CS", value: []byte("MONOCHROME2 ")},
+		{tag: TagRows, vr: "US", value: []byte{2, 0}},
+		{tag: TagColumns, vr: "US", value: []byte{2, 0}},
+		{tag: TagPixelSpacing, vr: "DS", value: []byte(`0.1\0.2 `)},
+		{tag: TagBitsAllocated, vr: "US", value: []byte{8, 0}},
+		{tag: TagPixelData, vr: "OW", value: []byte{0, 64, 128, 255}},
+	}
+	for tag := range identifyingTags {
+		dataset = append(dataset, element{tag: tag, vr: "LO", value: []byte("Somchai Jaidee")})
+	}
+	sort.Slice(dataset, func(i, j int) bool { return dataset[i].tag < dataset[j].tag })
+
+	var out bytes.Buffer
+	out.Write(make([]byte, 128))
+	out.WriteString("DICM")
+	encode(&out, true, []element{{tag: 0x00020000, vr: "UL", value: binary.LittleEndian.AppendUint32(nil, uint32(meta.Len()))}})
+	out.Write(meta.Bytes())
+	encode(&out, explicit, dataset)
+	return out.Bytes()
+}
+
+// pad pads a value to an even length with b.
+func pad(value string, b byte) []byte {
+	if len(value)%2 == 1 {
+		return append([]byte(value), b)
+	}
+	return []byte(value)
+}
+
+var syntaxes = []struct {
+	name   string
+	syntax string
+}{
+	{"explicit VR little endian", ExplicitVRLittleEndian},
+	{"implicit VR little endian", ImplicitVRLittleEndian},
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range syntaxes {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Parse(fixture(tt.syntax))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.TransferSyntax != tt.syntax {
+				t.Errorf("TransferSyntax = %q, want %q", f.TransferSyntax, tt.syntax)
+			}
+			// The fixture's dataset: 21 attributes plus the identifying ones
+			if want := 21 + len(identifyingTags); len(f.Elements) != want {
+				t.Errorf("%d elements, want %d", len(f.Elements), want)
+			}
+			if seq, ok := f.Element(0x00081110); !ok || seq.Length != undefinedLength || !f.isSequence(seq) {
+				t.Errorf("Referenced Study Sequence = %+v, %v", seq, ok)
+			}
+
+			info := f.Info()
+			if info.Modality != "PX" || info.BodyPart != "JAW" || info.Rows != 2 || info.Columns != 2 || info.Frames != 1 {
+				t.Errorf("Info = %+v", info)
+			}
+			if len(info.PixelSpacing) != 2 || info.PixelSpacing[0] != 0.1 || info.PixelSpacing[1] != 0.2 {
+				t.Errorf("PixelSpacing = %v", info.PixelSpacing)
+			}
+			if info.StudyDate == nil || info.StudyDate.Format("2006-01-02") != "2024-03-15" {
+				t.Errorf("StudyDate = %v", info.StudyDate)
+			}
+
+			img, err := f.Image()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+				t.Errorf("image is %v, want 2×2", b)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := fixture(ExplicitVRLittleEndian)
+	f, err := Parse(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := f.Element(TagRows)
+	pixels, _ := f.Element(TagPixelData)
+	seq, _ := f.Element(0x00081110)
+
+	// with returns valid with its bytes from off replaced by b
+	with := func(off int, b ...byte) []byte {
+		data := append([]byte{}, valid...)
+		copy(data[off:], b)
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrNotDICOM},
+		{"no magic", with(128, 'D', 'I', 'C', 'X'), ErrNotDICOM},
+		{"big endian", bytes.Replace(valid, pad(ExplicitVRLittleEndian, 0), pad(ExplicitVRBigEndian, 0), 1), ErrUnsupported},
+		{"truncated header", valid[:rows.Offset+5], ErrUnsupported},
+		{"truncated long header", valid[:pixels.Offset+10], ErrUnsupported},
+		{"truncated value", valid[:len(valid)-1], ErrUnsupported},
+		{"length past the end", with(rows.Offset+6, 0xFE, 0xFF), ErrUnsupported},
+		{"odd length", with(rows.Offset+6, 3), ErrUnsupported},
+		{"odd length in the file meta", with(132+6, 3), ErrUnsupported},
+		{"undefined length without delimiter", valid[:seq.End-8], ErrUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("Parse error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTruncatedNeverPanics(t *testing.T) {
+	for _, tt := range syntaxes {
+		data := fixture(tt.syntax)
+		for n := range data {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%s: Parse of the first %d bytes panicked: %v", tt.name, n, r)
+					}
+				}()
+				if f, err := Parse(data[:n]); err == nil {
+					f.Deidentify(Profile{})
+					f.Image()
+				}
+			}()
+		}
+	}
+}
+
+func TestDeidentify(t *testing.T) {
+	key := []byte("study key")
+	tests := []struct {
+		name    string
+		profile Profile
+	}{
+		{"basic profile", Profile{UIDKey: key}},
+		{"keep UIDs", Profile{UIDKey: key, KeepUIDs: true}},
+		{"keep dates", Profile{UIDKey: key, KeepDates: true}},
+	}
+	for _, syntax := range syntaxes {
+		for _, tt := range tests {
+			t.Run(syntax.name+" "+tt.name, func(t *testing.T) {
+				original, err := Parse(fixture(syntax.syntax))
+				if err != nil {
+					t.Fatal(err)
+				}
+				f, err := Parse(original.Deidentify(tt.profile))
+				if err != nil {
+					t.Fatalf("Parse of the de-identified file: %v", err)
+				}
+
+				// Every basic profile attribute is emptied
+				for tag := range identifyingTags {
+					if el, ok := f.Element(tag); ok && el.Length != 0 {
+						t.Errorf("%s = %q, want it empty", tag, f.String(tag))
+					}
+				}
+				for _, el := range f.Elements {
+					if uint32(el.Tag)>>16%2 == 1 {
+						t.Errorf("private tag %s kept", el.Tag)
+					}
+					if f.isSequence(el) {
+						t.Errorf("sequence %s kept", el.Tag)
+					}
+				}
+				if got := f.String(TagPatientIdentityRemoved); got != "YES" {
+					t.Errorf("Patient Identity Removed = %q, want YES", got)
+				}
+
+				uid := func(uid string) string {
+					if tt.profile.KeepUIDs {
+						return uid
+					}
+					return trimValue(ReplaceUID(key, uid))
+				}
+				for tag, want := range map[Tag]string{
+					0x00020002:           sopClass,
+					0x00020003:           uid(sopInstance),
+					TagTransferSyntaxUID: syntax.syntax,
+					0x00080016:           sopClass,
+					0x00080018:           uid(sopInstance),
+					0x0020000D:           uid(study),
+					0x0020000E:           uid(series),
+					0x00200052:           uid(frame),
+				} {
+					if tag>>16 == 0x0002 {
+						if got := metaValue(t, f, tag); got != want {
+							t.Errorf("%s = %q, want %q", tag, got, want)
+						}
+					} else if got := f.String(tag); got != want {
+						t.Errorf("%s = %q, want %q", tag, got, want)
+					}
+				}
+
+				dates := map[Tag]string{TagStudyDate: "20240101", 0x00080021: "20240101", 0x0008002A: "2024", 0x00080030: ""}
+				if tt.profile.KeepDates {
+					dates = map[Tag]string{TagStudyDate: "20240315", 0x00080021: "20240315", 0x0008002A: "20240315101500", 0x00080030: "101500"}
+				}
+				for tag, want := range dates {
+					if got := f.String(tag); got != want {
+						t.Errorf("%s = %q, want %q", tag, got, want)
+					}
+				}
+
+				if f.String(TagModality) != "PX" || f.Uint16(TagRows) != 2 {
+					t.Errorf("Modality, Rows = %q, %d", f.String(TagModality), f.Uint16(TagRows))
+				}
+				if got := f.value(TagPixelData); !bytes.Equal(got, []byte{0, 64, 128, 255}) {
+					t.Errorf("pixel data = %v", got)
+				}
+			})
+		}
+	}
+}
+
+// metaValue returns a text value of the file meta group, checking on the way
+// that its group length matches.
+func metaValue(t *testing.T, f *File, tag Tag) string {
+	t.Helper()
+	pos := 132
+	length, err := f.readElement(pos, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(f.Data[length.ValueOffset:]); int(got) != f.DatasetOffset-length.End {
+		t.Errorf("group length = %d, want %d", got, f.DatasetOffset-length.End)
+	}
+	for pos = length.End; pos < f.DatasetOffset; {
+		el, err := f.readElement(pos, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if el.Tag == tag {
+			return trimValue(f.Data[el.ValueOffset:el.End])
+		}
+		pos = el.End
+	}
+	return ""
+}
@@ -0,0 +1,160 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+)
+
+// Image decodes the first frame for display. Uncompressed 8/16-bit grayscale
+// and 8-bit RGB are supported, as is baseline JPEG; other compressed
+// transfer syntaxes return ErrUnsupported.
+func (f *File) Image() (image.Image, error) {
+	el, ok := f.Element(TagPixelData)
+	if !ok {
+		return nil, fmt.Errorf("%w: no pixel data", ErrUnsupported)
+	}
+
+	if el.Length == undefinedLength {
+		if f.TransferSyntax != JPEGBaseline {
+			return nil, fmt.Errorf("%w: compressed transfer syntax %s", ErrUnsupported, f.TransferSyntax)
+		}
+		frame, err := f.firstFrame(el)
+		if err != nil {
+			return nil, err
+		}
+		return jpeg.Decode(bytes.NewReader(frame))
+	}
+
+	rows, cols := f.Uint16(TagRows), f.Uint16(TagColumns)
+	if rows == 0 || cols == 0 {
+		return nil, fmt.Errorf("%w: missing image size", ErrUnsupported)
+	}
+	samples := f.Uint16(TagSamplesPerPixel)
+	if samples == 0 {
+		samples = 1
+	}
+	bits := f.Uint16(TagBitsAllocated)
+	pixels := f.Data[el.ValueOffset:el.End]
+
+	switch {
+	case samples == 1 && (bits == 8 || bits == 16):
+		if len(pixels) < rows*cols*bits/8 {
+			return nil, fmt.Errorf("%w: pixel data is too short", ErrUnsupported)
+		}
+		return f.grayImage(pixels, rows, cols, bits), nil
+	case samples == 3 && bits == 8:
+		if len(pixels) < rows*cols*3 {
+			return nil, fmt.Errorf("%w: pixel data is too short", ErrUnsupported)
+		}
+		return f.rgbImage(pixels, rows, cols), nil
+	default:
+		return nil, fmt.Errorf("%w: %d samples of %d bits", ErrUnsupported, samples, bits)
+	}
+}
+
+// firstFrame joins the fragments of the first encapsulated frame, skipping
+// the basic offset table item.
+func (f *File) firstFrame(el Element) ([]byte, error) {
+	var frame []byte
+	pos := el.ValueOffset
+	first := true
+	for pos+8 <= el.End {
+		item, err := f.readElement(pos, f.explicit)
+		if err != nil {
+			return nil, err
+		}
+		if item.Tag != tagItem {
+			break
+		}
+		pos = item.End
+		if first {
+			first = false
+			continue
+		}
+		fragment := f.Data[item.ValueOffset:item.End]
+		frame = append(frame, fragment...)
+		// A frame ends with the JPEG end-of-image marker (fragments are padded
+		// to even length)
+		if end := bytes.TrimRight(fragment, "\x00"); bytes.HasSuffix(end, []byte{0xFF, 0xD9}) {
+			break
+		}
+	}
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("%w: empty pixel data", ErrUnsupported)
+	}
+	return frame, nil
+}
+
+// grayImage applies the modality rescale and the stored window (or the full
+// range when there is none) to produce an 8-bit image.
+func (f *File) grayImage(pixels []byte, rows, cols, bits int) *image.Gray {
+	signed := f.Uint16(TagPixelRepresentation) == 1
+	slope, intercept := 1.0, 0.0
+	if v := f.Floats(TagRescaleSlope); len(v) > 0 && v[0] != 0 {
+		slope = v[0]
+	}
+	if v := f.Floats(TagRescaleIntercept); len(v) > 0 {
+		intercept = v[0]
+	}
+
+	values := make([]float64, rows*cols)
+	low, high := math.Inf(1), math.Inf(-1)
+	for i := range values {
+		var raw float64
+		switch {
+		case bits == 8 && signed:
+			raw = float64(int8(pixels[i]))
+		case bits == 8:
+			raw = float64(pixels[i])
+		case signed:
+			raw = float64(int16(binary.LittleEndian.Uint16(pixels[2*i:])))
+		default:
+			raw = float64(binary.LittleEndian.Uint16(pixels[2*i:]))
+		}
+		v := raw*slope + intercept
+		values[i] = v
+		low, high = math.Min(low, v), math.Max(high, v)
+	}
+
+	center, width := f.Floats(TagWindowCenter), f.Floats(TagWindowWidth)
+	if len(center) > 0 && len(width) > 0 && width[0] > 1 {
+		low, high = center[0]-width[0]/2, center[0]+width[0]/2
+	}
+	span := high - low
+	if span <= 0 {
+		span = 1
+	}
+
+	invert := f.String(TagPhotometricInterpretation) == "MONOCHROME1"
+	img := image.NewGray(image.Rect(0, 0, cols, rows))
+	for i, v := range values {
+		level := math.Round((v - low) / span * 255)
+		level = math.Max(0, math.Min(255, level))
+		if invert {
+			level = 255 - level
+		}
+		img.Pix[i] = uint8(level)
+	}
+	return img
+}
+
+func (f *File) rgbImage(pixels []byte, rows, cols int) *image.RGBA {
+	planar := f.Uint16(TagPlanarConfiguration) == 1
+	n := rows * cols
+	img := image.NewRGBA(image.Rect(0, 0, cols, rows))
+	for i := 0; i < n; i++ {
+		var c color.RGBA
+		if planar {
+			c = color.RGBA{pixels[i], pixels[n+i], pixels[2*n+i], 0xFF}
+		} else {
+			c = color.RGBA{pixels[3*i], pixels[3*i+1], pixels[3*i+2], 0xFF}
+		}
+		img.SetRGBA(i%cols, i/cols, c)
+	}
+	return img
+}
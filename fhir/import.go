@@ -0,0 +1,353 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/models"
+)
+
+// Imported is a patient read from a bundle. Issues concern this patient
+// only, so a batch can store the others.
+type Imported struct {
+	Patient  models.Patient
+	Consents []models.ConsentRecord // One per active Consent with a known scope, to store once the patient is
+	Entry    int                    // Index of the Patient entry
+	Related  []int                  // Observation and Consent entries about the patient
+	Issues   []Issue
+}
+
+type relatedObservation struct {
+	entry       int
+	observation Observation
+}
+
+type relatedConsent struct {
+	entry   int
+	consent Consent
+}
+
+type resourceHeader struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+}
+
+func entryIssue(i int, code, format string, args ...interface{}) Issue {
+	return Issue{
+		Severity:    SeverityError,
+		Code:        code,
+		Diagnostics: fmt.Sprintf(format, args...),
+		Expression:  []string{fmt.Sprintf("Bundle.entry[%d]", i)},
+	}
+}
+
+// inEntry points issues of a validated resource into the bundle.
+func inEntry(i int, issues []Issue) []Issue {
+	for n := range issues {
+		for e, expression := range issues[n].Expression {
+			_, path, _ := strings.Cut(expression, ".")
+			issues[n].Expression[e] = strings.TrimSuffix(fmt.Sprintf("Bundle.entry[%d].resource.%s", i, path), ".")
+		}
+	}
+	return issues
+}
+
+// Import reads the patients of a transaction, batch or collection bundle
+// of Patient, Observation and Consent resources. Every resource is checked
+// against its profile first. Findings come from Observations with the codes
+// of ToObservations; age may instead come from Patient.birthDate. Each
+// patient needs an active Consent; those whose scope is treatment, teaching
+// or research become consent records. Issues returned beside the patients
+// are about the bundle as a whole.
+func Import(bundle *Bundle, now time.Time) ([]Imported, []Issue) {
+	var issues []Issue
+	if bundle.ResourceType != "Bundle" {
+		return nil, []Issue{{Severity: SeverityError, Code: IssueStructure, Diagnostics: "Expected a Bundle"}}
+	}
+	switch bundle.Type {
+	case "transaction", "batch", "collection":
+	default:
+		return nil, []Issue{{Severity: SeverityError, Code: IssueNotSupported, Diagnostics: "Bundle type must be transaction, batch or collection", Expression: []string{"Bundle.type"}}}
+	}
+
+	headers := make([]resourceHeader, len(bundle.Entry))
+	entryIssues := make([][]Issue, len(bundle.Entry))
+	patients := map[string]int{} // fullUrl or Patient/id → entry
+	var imported []Imported
+	for i, entry := range bundle.Entry {
+		if err := json.Unmarshal(entry.Resource, &headers[i]); err != nil || len(entry.Resource) == 0 {
+			issues = append(issues, entryIssue(i, IssueStructure, "Entry has no resource"))
+			continue
+		}
+		entryIssues[i] = inEntry(i, Validate(entry.Resource))
+		if headers[i].ResourceType == "Patient" {
+			if entry.FullURL != "" {
+				patients[entry.FullURL] = len(imported)
+			}
+			if headers[i].ID != "" {
+				patients["Patient/"+headers[i].ID] = len(imported)
+			}
+			imported = append(imported, Imported{Entry: i, Issues: entryIssues[i]})
+		}
+	}
+
+	// resolve finds the patient a reference points to: a fullUrl in the
+	// bundle, or Patient/id, possibly as the end of an absolute URL
+	resolve := func(reference string) (int, bool) {
+		if n, ok := patients[reference]; ok {
+			return n, true
+		}
+		if at := strings.LastIndex(reference, "Patient/"); at >= 0 {
+			n, ok := patients[reference[at:]]
+			return n, ok
+		}
+		return 0, false
+	}
+
+	observations := make([][]relatedObservation, len(imported))
+	consents := make([][]relatedConsent, len(imported))
+	for i, entry := range bundle.Entry {
+		var reference *Reference
+		var observation Observation
+		var consent Consent
+		switch headers[i].ResourceType {
+		case "", "Patient":
+			continue
+		case "Observation":
+			if err := json.Unmarshal(entry.Resource, &observation); err != nil {
+				issues = append(issues, entryIssue(i, IssueStructure, "Cannot read Observation: %v", err))
+				continue
+			}
+			reference = observation.Subject
+		case "Consent":
+			if err := json.Unmarshal(entry.Resource, &consent); err != nil {
+				issues = append(issues, entryIssue(i, IssueStructure, "Cannot read Consent: %v", err))
+				continue
+			}
+			reference = consent.Patient
+		default:
+			issues = append(issues, entryIssue(i, IssueNotSupported, "%s resources can't be imported", headers[i].ResourceType))
+			continue
+		}
+
+		if reference == nil {
+			issues = append(issues, entryIssues[i]...)
+			continue
+		}
+		n, ok := resolve(reference.Reference)
+		if !ok {
+			issues = append(issues, entryIssue(i, IssueNotFound, "Reference %q is not a Patient in this bundle", reference.Reference))
+			continue
+		}
+		imported[n].Related = append(imported[n].Related, i)
+		imported[n].Issues = append(imported[n].Issues, entryIssues[i]...)
+		if headers[i].ResourceType == "Observation" {
+			observations[n] = append(observations[n], relatedObservation{i, observation})
+		} else {
+			consents[n] = append(consents[n], relatedConsent{i, consent})
+		}
+	}
+
+	for n := range imported {
+		record := &imported[n]
+		var patient Patient
+		json.Unmarshal(bundle.Entry[record.Entry].Resource, &patient)
+		record.Issues = append(record.Issues, toPatient(record, &patient, observations[n], consents[n], now)...)
+	}
+	return imported, issues
+}
+
+// toPatient fills in record.Patient from the resources about it.
+func toPatient(record *Imported, patient *Patient, observations []relatedObservation, consents []relatedConsent, now time.Time) []Issue {
+	var issues []Issue
+	at := record.Entry
+	p := &record.Patient
+
+	switch patient.Gender {
+	case "male":
+		p.Gender = models.GenderMale
+	case "female":
+		p.Gender = models.GenderFemale
+	case "":
+	default:
+		issues = append(issues, entryIssue(at, IssueCodeInvalid, "Gender %q can't be stored, only male and female", patient.Gender))
+	}
+
+	seen := map[string]bool{}
+	hasAge := false
+	for _, related := range observations {
+		observation, at := related.observation, related.entry
+		var code Coding
+		for _, coding := range observation.Code.Coding {
+			if coding.System == LOINCSystem && coding.Code == AgeCode || coding.System == FeatureSystem {
+				code = coding
+				break
+			}
+		}
+		if code.Code == "" {
+			issues = append(issues, Issue{Severity: SeverityWarning, Code: IssueNotSupported, Diagnostics: "Observation code is not stored and was ignored", Expression: []string{fmt.Sprintf("Bundle.entry[%d].resource.code", at)}})
+			continue
+		}
+		if seen[code.Code] {
+			issues = append(issues, entryIssue(at, IssueInvalid, "More than one Observation of %s", code.Code))
+			continue
+		}
+		seen[code.Code] = true
+
+		switch code.Code {
+		case AgeCode:
+			if q := observation.ValueQuantity; q == nil || (q.Code != "" && q.Code != "a") {
+				issues = append(issues, entryIssue(at, IssueValue, "Age must be a valueQuantity in years (UCUM a)"))
+			} else {
+				p.Age, hasAge = int(q.Value), true
+			}
+		case FeatureParesthesia:
+			if observation.ValueBoolean == nil {
+				issues = append(issues, entryIssue(at, IssueValue, "Paresthesia must be a valueBoolean"))
+			} else {
+				p.Paresthesia = *observation.ValueBoolean
+			}
+		default:
+			issues = append(issues, codedValue(at, code.Code, observation.ValueCodeableConcept, p)...)
+		}
+	}
+
+	if !hasAge && patient.BirthDate != "" {
+		age, err := ageAt(patient.BirthDate, now)
+		if err != nil {
+			issues = append(issues, entryIssue(at, IssueValue, "Cannot read birthDate: %v", err))
+		} else {
+			p.Age, hasAge = age, true
+		}
+	}
+	if !hasAge {
+		issues = append(issues, entryIssue(at, IssueRequired, "Age is required: an Observation of LOINC %s or Patient.birthDate", AgeCode))
+	}
+
+	for _, related := range consents {
+		consent, at := related.consent, related.entry
+		if consent.Status != "active" {
+			continue
+		}
+		p.Confirmation = models.ConfirmationAgree
+
+		scope := consentScope(consent.Scope)
+		if scope == "" {
+			issues = append(issues, Issue{Severity: SeverityWarning, Code: IssueNotSupported, Diagnostics: "Consent scope is not treatment, teaching or research, so it only allows storing the patient", Expression: []string{fmt.Sprintf("Bundle.entry[%d].resource.scope", at)}})
+			continue
+		}
+		record.Consents = append(record.Consents, toConsentRecord(at, scope, consent, now, &issues))
+	}
+	if p.Confirmation == "" {
+		if len(consents) > 0 {
+			p.Confirmation = models.ConfirmationDisagree
+		}
+		issues = append(issues, entryIssue(at, IssueRequired, "Patient data can only be stored with an active Consent"))
+	}
+	return issues
+}
+
+func codedValue(at int, code string, value *CodeableConcept, p *models.Patient) []Issue {
+	for _, feature := range codedFeatures {
+		if feature.code != code {
+			continue
+		}
+		if value != nil {
+			for _, coding := range value.Coding {
+				for _, allowed := range feature.values {
+					if coding.System == FeatureSystem && coding.Code == allowed.code {
+						*feature.field(p) = allowed.stored
+						return nil
+					}
+				}
+			}
+		}
+		codes := make([]string, len(feature.values))
+		for i, allowed := range feature.values {
+			codes[i] = allowed.code
+		}
+		return []Issue{entryIssue(at, IssueCodeInvalid, "%s must be a valueCodeableConcept with one of: %s", code, strings.Join(codes, ", "))}
+	}
+	return []Issue{{Severity: SeverityWarning, Code: IssueNotSupported, Diagnostics: fmt.Sprintf("Observation code %s is not stored and was ignored", code), Expression: []string{fmt.Sprintf("Bundle.entry[%d].resource.code", at)}}}
+}
+
+// ageAt returns the age in whole years of someone born on date (a FHIR
+// date: year, year-month or full date).
+// consentScope returns the models.ConsentScope* a Consent.scope stands for,
+// or "" for none.
+func consentScope(scope CodeableConcept) string {
+	for _, coding := range scope.Coding {
+		switch {
+		case coding.System == ConsentSystem && (coding.Code == models.ConsentScopeTreatment || coding.Code == models.ConsentScopeTeaching || coding.Code == models.ConsentScopeResearch):
+			return coding.Code
+		case coding.System == consentSystem && coding.Code == "treatment":
+			return models.ConsentScopeTreatment
+		case coding.System == consentSystem && coding.Code == "research":
+			return models.ConsentScopeResearch
+		}
+	}
+	return ""
+}
+
+// toConsentRecord reads an active Consent at entry at. The signer is its
+// first performer, the patient unless it points elsewhere; it was signed at
+// its dateTime, or now without one.
+func toConsentRecord(at int, scope string, consent Consent, now time.Time, issues *[]Issue) models.ConsentRecord {
+	record := models.ConsentRecord{
+		Scope:          scope,
+		TextVersion:    "FHIR Consent",
+		SignerRelation: models.SignerSelf,
+		SignedAt:       now,
+	}
+	if consent.ID != "" {
+		record.TextVersion += "/" + consent.ID
+	}
+	if len(consent.Performer) > 0 {
+		signer := consent.Performer[0]
+		record.SignerName = models.Sensitive(strings.TrimSpace(signer.Display))
+		if signer.Reference != "" && signer.Reference != consent.Patient.Reference {
+			record.SignerRelation = models.SignerRepresentative
+		}
+	}
+	if consent.DateTime != "" {
+		signedAt, err := parseDateTime(consent.DateTime)
+		switch {
+		case err != nil:
+			*issues = append(*issues, entryIssue(at, IssueValue, "Cannot read dateTime: %v", err))
+		case signedAt.After(now):
+			*issues = append(*issues, entryIssue(at, IssueValue, "Consent dateTime %s is in the future", consent.DateTime))
+		default:
+			record.SignedAt = signedAt
+		}
+	}
+	return record
+}
+
+func parseDateTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a FHIR dateTime", value)
+}
+
+func ageAt(date string, now time.Time) (int, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		born, err := time.Parse(layout, date)
+		if err != nil {
+			continue
+		}
+		age := now.Year() - born.Year()
+		if now.Month() < born.Month() || now.Month() == born.Month() && now.Day() < born.Day() {
+			age--
+		}
+		if age < 0 {
+			return 0, fmt.Errorf("%s is in the future", date)
+		}
+		return age, nil
+	}
+	return 0, fmt.Errorf("%q is not a date", date)
+}
@@ -0,0 +1,315 @@
+package fhir
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/models"
+)
+
+// CanonicalBase names the code systems and profiles defined by this API.
+// Canonical URLs identify things; they aren't fetched.
+const CanonicalBase = "https://github.com/piyawat001/user-auth-api/fhir"
+
+const (
+	FeatureSystem   = CanonicalBase + "/CodeSystem/lesion-feature"
+	ViewSystem      = CanonicalBase + "/CodeSystem/image-view"
+	PatientIDSystem = CanonicalBase + "/NamingSystem/patient-id"
+	ConsentSystem   = CanonicalBase + "/CodeSystem/consent-scope" // The uses of models.ConsentRecord, teaching included
+
+	LOINCSystem     = "http://loinc.org"
+	UCUMSystem      = "http://unitsofmeasure.org"
+	DICOMSystem     = "http://dicom.nema.org/resources/ontology/DCM"
+	categorySystem  = "http://terminology.hl7.org/CodeSystem/observation-category"
+	consentSystem   = "http://terminology.hl7.org/CodeSystem/consentscope"
+	mediaTypeSystem = "http://terminology.hl7.org/CodeSystem/media-type"
+	uriSystem       = "urn:ietf:rfc:3986"
+
+	ProfilePatient      = CanonicalBase + "/StructureDefinition/lesion-patient"
+	ProfileObservation  = CanonicalBase + "/StructureDefinition/lesion-observation"
+	ProfileImagingStudy = CanonicalBase + "/StructureDefinition/lesion-imagingstudy"
+	ProfileMedia        = CanonicalBase + "/StructureDefinition/lesion-media"
+)
+
+// Observation codes: age is LOINC, the lesion findings are local codes.
+const (
+	AgeCode            = "30525-0"
+	FeatureDuration    = "duration-of-lesion"
+	FeatureExpansion   = "expansion"
+	FeatureParesthesia = "paresthesia"
+	FeatureLesions     = "number-of-lesions"
+)
+
+type valueCode struct {
+	stored  string // Spelling in models.Patient
+	code    string
+	display string
+}
+
+// codedFeature is a finding stored as one of a few strings and exchanged as
+// a valueCodeableConcept.
+type codedFeature struct {
+	code    string
+	display string
+	values  []valueCode
+	field   func(p *models.Patient) *string
+}
+
+var codedFeatures = []codedFeature{
+	{FeatureDuration, "Duration of lesion", []valueCode{
+		{models.DurationWeeks, "weeks", "Weeks"},
+		{models.DurationMonths, "months", "Months"},
+		{models.DurationYears, "years", "Years"},
+	}, func(p *models.Patient) *string { return &p.DurationOfLesion }},
+	{FeatureExpansion, "Cortical expansion", []valueCode{
+		{models.ExpansionBuccolingual, "buccolingual", "Buccolingual"},
+		{models.ExpansionAnteroposterior, "anteroposterior", "Anteroposterior"},
+		{"", "none", "No expansion"},
+	}, func(p *models.Patient) *string { return &p.Expansion }},
+	{FeatureLesions, "Number of lesions", []valueCode{
+		{models.LesionsSingle, "single", "Single lesion"},
+		{models.LesionsMultiple, "multiple", "Multiple lesions"},
+	}, func(p *models.Patient) *string { return &p.NumberOfLesions }},
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func patientMeta(p *models.Patient, profile string) *Meta {
+	meta := &Meta{LastUpdated: timestamp(p.UpdatedAt), Profile: []string{profile}}
+	if p.Revision > 0 {
+		meta.VersionID = strconv.Itoa(p.Revision)
+	}
+	return meta
+}
+
+func patientReference(p *models.Patient) *Reference {
+	return &Reference{Reference: "Patient/" + p.ID.Hex()}
+}
+
+func ToPatient(p *models.Patient) Patient {
+	active := true
+	patient := Patient{
+		ResourceType: "Patient",
+		ID:           p.ID.Hex(),
+		Meta:         patientMeta(p, ProfilePatient),
+		Identifier:   []Identifier{{System: PatientIDSystem, Value: p.ID.Hex()}},
+		Active:       &active,
+		Gender:       strings.ToLower(p.Gender),
+	}
+	if p.Hospital != "" {
+		patient.ManagingOrganization = &Reference{Display: p.Hospital}
+	}
+	return patient
+}
+
+// ObservationID names the observation of one finding of a patient.
+func ObservationID(patientID, code string) string {
+	return patientID + "-" + code
+}
+
+// ParseObservationID splits an ObservationID.
+func ParseObservationID(id string) (patientID, code string, ok bool) {
+	return strings.Cut(id, "-")
+}
+
+// ToObservations returns the findings of a patient: age and the lesion
+// features, in that order.
+func ToObservations(p *models.Patient) []Observation {
+	base := func(code Coding) Observation {
+		return Observation{
+			ResourceType: "Observation",
+			ID:           ObservationID(p.ID.Hex(), code.Code),
+			Meta:         patientMeta(p, ProfileObservation),
+			Status:       "final",
+			Category:     []CodeableConcept{{Coding: []Coding{{System: categorySystem, Code: "exam", Display: "Exam"}}}},
+			Code:         CodeableConcept{Coding: []Coding{code}},
+			Subject:      patientReference(p),
+			// The record doesn't say when the patient was examined
+			EffectiveDateTime: timestamp(p.CreatedAt),
+		}
+	}
+
+	age := base(Coding{System: LOINCSystem, Code: AgeCode, Display: "Age"})
+	age.ID = ObservationID(p.ID.Hex(), "age")
+	age.ValueQuantity = &Quantity{Value: float64(p.Age), Unit: "years", System: UCUMSystem, Code: "a"}
+	observations := []Observation{age}
+
+	for _, feature := range codedFeatures {
+		observation := base(Coding{System: FeatureSystem, Code: feature.code, Display: feature.display})
+		stored := *feature.field(p)
+		for _, value := range feature.values {
+			if value.stored == stored {
+				observation.ValueCodeableConcept = &CodeableConcept{Coding: []Coding{{System: FeatureSystem, Code: value.code, Display: value.display}}}
+			}
+		}
+		if observation.ValueCodeableConcept == nil {
+			// Records from before validation may hold other spellings
+			observation.ValueCodeableConcept = &CodeableConcept{Text: stored}
+		}
+		observations = append(observations, observation)
+	}
+
+	paresthesia := base(Coding{System: FeatureSystem, Code: FeatureParesthesia, Display: "Paresthesia"})
+	paresthesia.ValueBoolean = &p.Paresthesia
+	return append(observations, paresthesia)
+}
+
+// Image is a stored upload with its place in the series and a download URL.
+type Image struct {
+	models.PatientImage
+	Entry models.PatientImageEntry
+	URL   string
+}
+
+// modality is the DICOM modality of an image: the file's own for DICOM
+// uploads, otherwise a best guess from the view type.
+func modality(img Image) string {
+	if img.DICOM != nil && img.DICOM.Modality != "" {
+		return img.DICOM.Modality
+	}
+	switch img.Entry.ViewType {
+	case models.ViewPanoramic:
+		return "PX"
+	case models.ViewPeriapical, models.ViewBitewing, models.ViewOcclusal:
+		return "IO"
+	case models.ViewCephalometric:
+		return "DX"
+	case models.ViewCBCT:
+		return "CT"
+	case models.ViewClinicalPhoto:
+		return "XC"
+	}
+	return "OT"
+}
+
+var modalityNames = map[string]string{
+	"PX": "Panoramic X-Ray",
+	"IO": "Intra-Oral Radiography",
+	"DX": "Digital Radiography",
+	"CT": "Computed Tomography",
+	"XC": "External-camera Photography",
+	"OT": "Other",
+}
+
+// sopClass is a storage SOP class to go with the modality. The class of
+// DICOM uploads isn't stored, and other uploads would be secondary captures.
+func sopClass(img Image, modality string) Coding {
+	uid := "1.2.840.10008.5.1.4.1.1.7" // Secondary Capture Image Storage
+	if img.DICOM != nil {
+		switch modality {
+		case "DX", "PX":
+			uid = "1.2.840.10008.5.1.4.1.1.1.1"
+		case "IO":
+			uid = "1.2.840.10008.5.1.4.1.1.1.3"
+		case "CT":
+			uid = "1.2.840.10008.5.1.4.1.1.2"
+		}
+	}
+	return Coding{System: uriSystem, Code: "urn:oid:" + uid}
+}
+
+// uid makes a DICOM UID of the 2.25 (UUID-derived) form from up to 16 bytes.
+func uid(b []byte) string {
+	return "2.25." + new(big.Int).SetBytes(b).String()
+}
+
+func acquired(img Image) time.Time {
+	switch {
+	case img.Entry.AcquiredAt != nil:
+		return *img.Entry.AcquiredAt
+	case img.DICOM != nil && img.DICOM.StudyDate != nil:
+		return *img.DICOM.StudyDate
+	}
+	return img.CreatedAt
+}
+
+// ToImagingStudy describes all images of a patient as one study, with a
+// series per modality. UIDs are derived from the IDs here, since the ones in
+// DICOM uploads aren't stored. It returns nil when there are no images.
+func ToImagingStudy(p *models.Patient, images []Image) *ImagingStudy {
+	if len(images) == 0 {
+		return nil
+	}
+	study := &ImagingStudy{
+		ResourceType:      "ImagingStudy",
+		ID:                p.ID.Hex(),
+		Meta:              patientMeta(p, ProfileImagingStudy),
+		Identifier:        []Identifier{{System: uriSystem, Value: "urn:oid:" + uid(p.ID[:])}},
+		Status:            "available",
+		Subject:           *patientReference(p),
+		NumberOfInstances: len(images),
+	}
+
+	var started time.Time
+	series := map[string]int{}
+	for _, img := range images {
+		code := modality(img)
+		i, ok := series[code]
+		if !ok {
+			sum := sha256.Sum256([]byte(p.ID.Hex() + "/" + code))
+			i = len(study.Series)
+			series[code] = i
+			study.Series = append(study.Series, ImagingSeries{
+				UID:      uid(sum[:16]),
+				Number:   i + 1,
+				Modality: Coding{System: DICOMSystem, Code: code, Display: modalityNames[code]},
+			})
+		}
+		s := &study.Series[i]
+		s.NumberOfInstances++
+		s.Instance = append(s.Instance, ImagingInstance{
+			UID:      uid(img.ID[:]),
+			SOPClass: sopClass(img, code),
+			Number:   s.NumberOfInstances,
+			Title:    string(img.Entry.Caption),
+		})
+
+		at := acquired(img)
+		if started.IsZero() || at.Before(started) {
+			started = at
+		}
+		if s.Started == "" || timestamp(at) < s.Started {
+			s.Started = timestamp(at)
+		}
+	}
+	study.NumberOfSeries = len(study.Series)
+	study.Started = timestamp(started)
+	return study
+}
+
+func ToMedia(p *models.Patient, img Image) Media {
+	code := modality(img)
+	media := Media{
+		ResourceType:    "Media",
+		ID:              img.ID.Hex(),
+		Meta:            &Meta{LastUpdated: timestamp(img.CreatedAt), Profile: []string{ProfileMedia}},
+		PartOf:          []Reference{{Reference: "ImagingStudy/" + p.ID.Hex()}},
+		Status:          "completed",
+		Type:            &CodeableConcept{Coding: []Coding{{System: mediaTypeSystem, Code: "image", Display: "Image"}}},
+		Modality:        &CodeableConcept{Coding: []Coding{{System: DICOMSystem, Code: code, Display: modalityNames[code]}}},
+		Subject:         patientReference(p),
+		CreatedDateTime: timestamp(acquired(img)),
+		Height:          img.Height,
+		Width:           img.Width,
+		Content: Attachment{
+			ContentType: img.ContentType,
+			URL:         img.URL,
+			Size:        img.Size,
+			// Original file names often carry the patient's name
+			Title:    string(img.Entry.Caption),
+			Creation: timestamp(img.CreatedAt),
+		},
+	}
+	if img.Entry.ViewType != "" {
+		media.View = &CodeableConcept{Coding: []Coding{{System: ViewSystem, Code: img.Entry.ViewType}}}
+	}
+	if img.DICOM != nil {
+		media.Height, media.Width, media.Frames = img.DICOM.Rows, img.DICOM.Columns, img.DICOM.Frames
+	}
+	return media
+}
@@ -0,0 +1,232 @@
+// Package fhir maps patient cases to and from HL7 FHIR R4 resources and
+// validates resources against the profiles bundled in profiles/, without
+// a terminology server or network access.
+package fhir
+
+import "encoding/json"
+
+// ContentType is the FHIR JSON media type.
+const ContentType = "application/fhir+json"
+
+// Only the elements this API reads or writes are declared.
+
+type Meta struct {
+	VersionID   string   `json:"versionId,omitempty"`
+	LastUpdated string   `json:"lastUpdated,omitempty"`
+	Profile     []string `json:"profile,omitempty"`
+}
+
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+type Quantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	System string  `json:"system,omitempty"`
+	Code   string  `json:"code,omitempty"`
+}
+
+type Attachment struct {
+	ContentType string `json:"contentType,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Creation    string `json:"creation,omitempty"`
+}
+
+type Patient struct {
+	ResourceType         string       `json:"resourceType"`
+	ID                   string       `json:"id,omitempty"`
+	Meta                 *Meta        `json:"meta,omitempty"`
+	Identifier           []Identifier `json:"identifier,omitempty"`
+	Active               *bool        `json:"active,omitempty"`
+	Gender               string       `json:"gender,omitempty"`
+	BirthDate            string       `json:"birthDate,omitempty"`
+	ManagingOrganization *Reference   `json:"managingOrganization,omitempty"`
+}
+
+type Observation struct {
+	ResourceType         string            `json:"resourceType"`
+	ID                   string            `json:"id,omitempty"`
+	Meta                 *Meta             `json:"meta,omitempty"`
+	Status               string            `json:"status"`
+	Category             []CodeableConcept `json:"category,omitempty"`
+	Code                 CodeableConcept   `json:"code"`
+	Subject              *Reference        `json:"subject,omitempty"`
+	EffectiveDateTime    string            `json:"effectiveDateTime,omitempty"`
+	ValueQuantity        *Quantity         `json:"valueQuantity,omitempty"`
+	ValueCodeableConcept *CodeableConcept  `json:"valueCodeableConcept,omitempty"`
+	ValueBoolean         *bool             `json:"valueBoolean,omitempty"`
+}
+
+type ImagingStudy struct {
+	ResourceType      string          `json:"resourceType"`
+	ID                string          `json:"id,omitempty"`
+	Meta              *Meta           `json:"meta,omitempty"`
+	Identifier        []Identifier    `json:"identifier,omitempty"`
+	Status            string          `json:"status"`
+	Subject           Reference       `json:"subject"`
+	Started           string          `json:"started,omitempty"`
+	NumberOfSeries    int             `json:"numberOfSeries"`
+	NumberOfInstances int             `json:"numberOfInstances"`
+	Series            []ImagingSeries `json:"series,omitempty"`
+}
+
+type ImagingSeries struct {
+	UID               string            `json:"uid"`
+	Number            int               `json:"number,omitempty"`
+	Modality          Coding            `json:"modality"`
+	NumberOfInstances int               `json:"numberOfInstances"`
+	BodySite          *Coding           `json:"bodySite,omitempty"`
+	Started           string            `json:"started,omitempty"`
+	Instance          []ImagingInstance `json:"instance,omitempty"`
+}
+
+type ImagingInstance struct {
+	UID      string `json:"uid"`
+	SOPClass Coding `json:"sopClass"`
+	Number   int    `json:"number,omitempty"`
+	Title    string `json:"title,omitempty"`
+}
+
+type Media struct {
+	ResourceType    string           `json:"resourceType"`
+	ID              string           `json:"id,omitempty"`
+	Meta            *Meta            `json:"meta,omitempty"`
+	PartOf          []Reference      `json:"partOf,omitempty"`
+	Status          string           `json:"status"`
+	Type            *CodeableConcept `json:"type,omitempty"`
+	Modality        *CodeableConcept `json:"modality,omitempty"`
+	View            *CodeableConcept `json:"view,omitempty"`
+	Subject         *Reference       `json:"subject,omitempty"`
+	CreatedDateTime string           `json:"createdDateTime,omitempty"`
+	Height          int              `json:"height,omitempty"`
+	Width           int              `json:"width,omitempty"`
+	Frames          int              `json:"frames,omitempty"`
+	Content         Attachment       `json:"content"`
+}
+
+// Consent is only read, when bundles are imported.
+type Consent struct {
+	ResourceType string            `json:"resourceType"`
+	ID           string            `json:"id,omitempty"`
+	Status       string            `json:"status"`
+	Scope        CodeableConcept   `json:"scope"`
+	Category     []CodeableConcept `json:"category"`
+	Patient      *Reference        `json:"patient,omitempty"`
+	DateTime     string            `json:"dateTime,omitempty"`
+	Performer    []Reference       `json:"performer,omitempty"` // Who signed
+}
+
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	ID           string        `json:"id,omitempty"`
+	Type         string        `json:"type"`
+	Total        *int          `json:"total,omitempty"`
+	Link         []BundleLink  `json:"link,omitempty"`
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+type BundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+type BundleEntry struct {
+	FullURL  string          `json:"fullUrl,omitempty"`
+	Resource json.RawMessage `json:"resource,omitempty"`
+	Search   *EntrySearch    `json:"search,omitempty"`
+	Request  *EntryRequest   `json:"request,omitempty"`
+	Response *EntryResponse  `json:"response,omitempty"`
+}
+
+type EntrySearch struct {
+	Mode string `json:"mode"`
+}
+
+type EntryRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type EntryResponse struct {
+	Status   string            `json:"status"`
+	Location string            `json:"location,omitempty"`
+	Outcome  *OperationOutcome `json:"outcome,omitempty"`
+}
+
+type OperationOutcome struct {
+	ResourceType string  `json:"resourceType"`
+	Issue        []Issue `json:"issue"`
+}
+
+// Issue severities and the codes used here, from the FHIR issue-type value set.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+
+	IssueInvalid      = "invalid"
+	IssueRequired     = "required"
+	IssueValue        = "value"
+	IssueStructure    = "structure"
+	IssueCodeInvalid  = "code-invalid"
+	IssueNotSupported = "not-supported"
+	IssueNotFound     = "not-found"
+	IssueTooCostly    = "too-costly"
+	IssueException    = "exception"
+	IssueLogin        = "login"
+	IssueInformation  = "informational"
+)
+
+type Issue struct {
+	Severity    string   `json:"severity"`
+	Code        string   `json:"code"`
+	Diagnostics string   `json:"diagnostics,omitempty"`
+	Expression  []string `json:"expression,omitempty"`
+}
+
+// Outcome wraps issues in an OperationOutcome. FHIR requires at least one
+// issue, so an empty list becomes an informational "All OK".
+func Outcome(issues ...Issue) *OperationOutcome {
+	if len(issues) == 0 {
+		issues = []Issue{{Severity: "information", Code: IssueInformation, Diagnostics: "All OK"}}
+	}
+	return &OperationOutcome{ResourceType: "OperationOutcome", Issue: issues}
+}
+
+// HasErrors reports whether any issue is an error.
+func HasErrors(issues []Issue) bool {
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Entry wraps a resource for a Bundle.
+func Entry(fullURL string, resource interface{}) (BundleEntry, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return BundleEntry{}, err
+	}
+	return BundleEntry{FullURL: fullURL, Resource: data}, nil
+}
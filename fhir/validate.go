@@ -0,0 +1,364 @@
+package fhir
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The profiles are a subset of FHIR StructureDefinitions: the validator
+// reads the differential's cardinality, types and bindings, and the value
+// sets' enumerated codes. Nothing else in them is checked.
+//
+//go:embed profiles/*.json
+var profileFiles embed.FS
+
+type elementDefinition struct {
+	Path string `json:"path"`
+	Min  int    `json:"min"`
+	Max  string `json:"max"`
+	Type []struct {
+		Code string `json:"code"`
+	} `json:"type"`
+	Binding *struct {
+		Strength string `json:"strength"`
+		ValueSet string `json:"valueSet"`
+	} `json:"binding"`
+}
+
+type structureDefinition struct {
+	URL          string `json:"url"`
+	Type         string `json:"type"`
+	Differential struct {
+		Element []elementDefinition `json:"element"`
+	} `json:"differential"`
+}
+
+type valueSet struct {
+	URL     string `json:"url"`
+	Compose struct {
+		Include []struct {
+			System  string `json:"system"`
+			Concept []struct {
+				Code string `json:"code"`
+			} `json:"concept"`
+		} `json:"include"`
+	} `json:"compose"`
+}
+
+var (
+	profiles  = map[string]*structureDefinition{} // By resource type
+	valueSets = map[string]map[string]bool{}      // By URL, holding "system|code"
+)
+
+func init() {
+	files, err := profileFiles.ReadDir("profiles")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		data, err := profileFiles.ReadFile("profiles/" + file.Name())
+		if err != nil {
+			panic(err)
+		}
+		var header resourceHeader
+		if err := json.Unmarshal(data, &header); err != nil {
+			panic(fmt.Sprintf("fhir: %s: %v", file.Name(), err))
+		}
+		switch header.ResourceType {
+		case "StructureDefinition":
+			var profile structureDefinition
+			json.Unmarshal(data, &profile)
+			profiles[profile.Type] = &profile
+		case "ValueSet":
+			var set valueSet
+			json.Unmarshal(data, &set)
+			codes := map[string]bool{}
+			for _, include := range set.Compose.Include {
+				for _, concept := range include.Concept {
+					codes[include.System+"|"+concept.Code] = true
+				}
+			}
+			valueSets[set.URL] = codes
+		}
+	}
+}
+
+// Definition returns a bundled StructureDefinition or ValueSet by id.
+func Definition(resourceType, id string) ([]byte, bool) {
+	data, err := profileFiles.ReadFile(path.Join("profiles", resourceType+"-"+path.Base(id)+".json"))
+	return data, err == nil
+}
+
+// Profile returns the canonical URL of the profile for a resource type.
+func Profile(resourceType string) (string, bool) {
+	profile, ok := profiles[resourceType]
+	if !ok {
+		return "", false
+	}
+	return profile.URL, true
+}
+
+var (
+	idPattern       = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+	datePattern     = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+	dateTimePattern = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2}(T\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:\d{2}))?)?)?$`)
+)
+
+// node is a value in the resource with the FHIRPath-like expression that
+// points to it.
+type node struct {
+	value      interface{}
+	expression string
+}
+
+// Validate checks a resource in FHIR JSON against the bundled profile for
+// its type.
+func Validate(data []byte) []Issue {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var resource map[string]interface{}
+	if err := decoder.Decode(&resource); err != nil {
+		return []Issue{{Severity: SeverityError, Code: IssueStructure, Diagnostics: "Not a JSON object: " + err.Error()}}
+	}
+
+	resourceType, _ := resource["resourceType"].(string)
+	profile, ok := profiles[resourceType]
+	if !ok {
+		return []Issue{{Severity: SeverityError, Code: IssueNotSupported, Diagnostics: fmt.Sprintf("No profile for resource type %q", resourceType)}}
+	}
+
+	var issues []Issue
+	if id, ok := resource["id"]; ok {
+		if s, _ := id.(string); !idPattern.MatchString(s) {
+			issues = append(issues, Issue{Severity: SeverityError, Code: IssueValue, Diagnostics: "id must be 1-64 letters, digits, '-' or '.'", Expression: []string{resourceType + ".id"}})
+		}
+	}
+
+	for _, element := range profile.Differential.Element {
+		segments := strings.Split(element.Path, ".")
+		if len(segments) < 2 {
+			continue
+		}
+		parents := []node{{resource, resourceType}}
+		for _, segment := range segments[1 : len(segments)-1] {
+			parents = children(parents, segment)
+		}
+		for _, parent := range parents {
+			issues = append(issues, checkElement(parent, segments[len(segments)-1], element)...)
+		}
+	}
+	return issues
+}
+
+// children returns the values of name in each object of nodes, one node per
+// array item.
+func children(nodes []node, name string) []node {
+	var out []node
+	for _, n := range nodes {
+		object, ok := n.value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch v := object[name].(type) {
+		case nil:
+		case []interface{}:
+			for i, item := range v {
+				out = append(out, node{item, fmt.Sprintf("%s.%s[%d]", n.expression, name, i)})
+			}
+		default:
+			out = append(out, node{v, n.expression + "." + name})
+		}
+	}
+	return out
+}
+
+func checkElement(parent node, name string, element elementDefinition) []Issue {
+	object, ok := parent.value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	issue := func(code, expression, format string, args ...interface{}) Issue {
+		return Issue{Severity: SeverityError, Code: code, Diagnostics: fmt.Sprintf(format, args...), Expression: []string{expression}}
+	}
+
+	// A choice element (value[x]) appears as valueQuantity, valueBoolean, ...
+	type field struct {
+		key, typ string
+		value    interface{}
+	}
+	var fields []field
+	var issues []Issue
+	if prefix, choice := strings.CutSuffix(name, "[x]"); choice {
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := object[key]
+			suffix, ok := strings.CutPrefix(key, prefix)
+			if !ok || suffix == "" || !unicode.IsUpper(rune(suffix[0])) {
+				continue
+			}
+			typ := ""
+			for _, allowed := range element.Type {
+				if strings.EqualFold(allowed.Code, suffix) {
+					typ = allowed.Code
+				}
+			}
+			if typ == "" {
+				issues = append(issues, issue(IssueStructure, parent.expression+"."+key, "%s is not an allowed type for %s", suffix, name))
+				continue
+			}
+			fields = append(fields, field{key, typ, value})
+		}
+	} else if value, ok := object[name]; ok {
+		typ := ""
+		if len(element.Type) > 0 {
+			typ = element.Type[0].Code
+		}
+		fields = append(fields, field{name, typ, value})
+	}
+
+	count := 0
+	for _, f := range fields {
+		expression := parent.expression + "." + f.key
+		items, isArray := f.value.([]interface{})
+		switch {
+		case isArray && element.Max == "1":
+			issues = append(issues, issue(IssueStructure, expression, "%s must not be an array", f.key))
+		case !isArray && element.Max != "" && element.Max != "1":
+			issues = append(issues, issue(IssueStructure, expression, "%s must be an array", f.key))
+		}
+		if !isArray {
+			items = []interface{}{f.value}
+		}
+		count += len(items)
+
+		for i, item := range items {
+			itemExpression := expression
+			if isArray {
+				itemExpression = fmt.Sprintf("%s[%d]", expression, i)
+			}
+			if f.typ != "" && !hasType(item, f.typ) {
+				issues = append(issues, issue(IssueValue, itemExpression, "%s must be a valid %s", f.key, f.typ))
+				continue
+			}
+			if element.Binding != nil {
+				issues = append(issues, checkBinding(item, itemExpression, element)...)
+			}
+		}
+	}
+
+	if count < element.Min {
+		issues = append(issues, issue(IssueRequired, parent.expression+"."+name, "%s is required", name))
+	}
+	if element.Max == "1" && len(fields) > 1 {
+		issues = append(issues, issue(IssueStructure, parent.expression+"."+name, "Only one %s is allowed", name))
+	}
+	return issues
+}
+
+// hasType checks the JSON form of a FHIR data type. Complex types only need
+// to be objects; their own elements are profiled separately.
+func hasType(value interface{}, typ string) bool {
+	switch typ {
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "integer", "positiveInt", "unsignedInt":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		i, err := n.Int64()
+		return err == nil && (typ == "integer" || i > 0 || typ == "unsignedInt" && i == 0)
+	case "decimal":
+		_, ok := value.(json.Number)
+		return ok
+	}
+
+	if unicode.IsUpper(rune(typ[0])) || typ == "BackboneElement" {
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return false
+	}
+	switch typ {
+	case "code":
+		return strings.TrimSpace(s) == s
+	case "id":
+		return idPattern.MatchString(s)
+	case "date":
+		return datePattern.MatchString(s)
+	case "dateTime":
+		return dateTimePattern.MatchString(s)
+	case "instant":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	}
+	return true
+}
+
+// checkBinding checks a code, Coding or CodeableConcept against the value
+// set of a required (error) or extensible (warning) binding.
+func checkBinding(value interface{}, expression string, element elementDefinition) []Issue {
+	codes, ok := valueSets[element.Binding.ValueSet]
+	if !ok {
+		return nil
+	}
+
+	var codings []map[string]interface{}
+	switch v := value.(type) {
+	case string:
+		// A bare code: the value set says which system it's from
+		for key := range codes {
+			if strings.HasSuffix(key, "|"+v) {
+				return nil
+			}
+		}
+	case map[string]interface{}:
+		if list, ok := v["coding"].([]interface{}); ok {
+			for _, item := range list {
+				if coding, ok := item.(map[string]interface{}); ok {
+					codings = append(codings, coding)
+				}
+			}
+		} else {
+			codings = append(codings, v)
+		}
+	}
+	for _, coding := range codings {
+		system, _ := coding["system"].(string)
+		code, _ := coding["code"].(string)
+		if codes[system+"|"+code] {
+			return nil
+		}
+	}
+
+	severity := SeverityError
+	switch element.Binding.Strength {
+	case "required":
+	case "extensible":
+		severity = SeverityWarning
+	default:
+		return nil
+	}
+	return []Issue{{
+		Severity:    severity,
+		Code:        IssueCodeInvalid,
+		Diagnostics: fmt.Sprintf("Code is not in value set %s", element.Binding.ValueSet),
+		Expression:  []string{expression},
+	}}
+}
@@ -0,0 +1,165 @@
+package fhir
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidate(t *testing.T) {
+	const (
+		patient = `"subject": {"reference": "Patient/1"}`
+		ageCode = `"code": {"coding": [{"system": "http://loinc.org", "code": "30525-0"}]}`
+	)
+	tests := []struct {
+		name     string
+		resource string
+		want     []string // "severity expression" of each issue
+	}{
+		{
+			name:     "patient",
+			resource: `{"resourceType": "Patient", "id": "p-1", "active": true, "gender": "female", "birthDate": "1990-04"}`,
+		},
+		{
+			name:     "not an object",
+			resource: `[]`,
+			want:     []string{"error "},
+		},
+		{
+			name:     "unknown resource type",
+			resource: `{"resourceType": "Encounter"}`,
+			want:     []string{"error "},
+		},
+		{
+			name:     "bad id",
+			resource: `{"resourceType": "Patient", "id": "p_1", "gender": "male"}`,
+			want:     []string{"error Patient.id"},
+		},
+		{
+			name:     "missing gender",
+			resource: `{"resourceType": "Patient"}`,
+			want:     []string{"error Patient.gender"},
+		},
+		{
+			name:     "gender outside the required binding",
+			resource: `{"resourceType": "Patient", "gender": "unknown"}`,
+			want:     []string{"error Patient.gender"},
+		},
+		{
+			name:     "array for a single value",
+			resource: `{"resourceType": "Patient", "gender": ["male"]}`,
+			want:     []string{"error Patient.gender"},
+		},
+		{
+			name:     "malformed primitives",
+			resource: `{"resourceType": "Patient", "gender": "male", "active": "yes", "birthDate": "04/1990"}`,
+			want:     []string{"error Patient.active", "error Patient.birthDate"},
+		},
+		{
+			name:     "observation",
+			resource: `{"resourceType": "Observation", "status": "final", ` + ageCode + `, ` + patient + `, "effectiveDateTime": "2024-01-02T03:04:05Z", "valueQuantity": {"value": 42, "unit": "years"}}`,
+		},
+		{
+			name:     "observation with two values",
+			resource: `{"resourceType": "Observation", "status": "final", ` + ageCode + `, ` + patient + `, "valueBoolean": true, "valueQuantity": {"value": 1}}`,
+			want:     []string{"error Observation.value[x]"},
+		},
+		{
+			name:     "observation value of a type not in the profile",
+			resource: `{"resourceType": "Observation", "status": "final", ` + ageCode + `, ` + patient + `, "valueString": "42"}`,
+			want:     []string{"error Observation.valueString", "error Observation.value[x]"},
+		},
+		{
+			name:     "quantity without a value",
+			resource: `{"resourceType": "Observation", "status": "final", ` + ageCode + `, ` + patient + `, "valueQuantity": {"unit": "years"}}`,
+			want:     []string{"error Observation.valueQuantity.value"},
+		},
+		{
+			name:     "code outside an extensible binding",
+			resource: `{"resourceType": "Observation", "status": "final", "code": {"coding": [{"system": "http://loinc.org", "code": "8302-2"}]}, ` + patient + `, "valueBoolean": true}`,
+			want:     []string{"warning Observation.code"},
+		},
+		{
+			name:     "consent",
+			resource: `{"resourceType": "Consent", "status": "active", "scope": {"coding": [{"system": "` + ConsentSystem + `", "code": "teaching"}]}, "category": [{"text": "teaching"}], "patient": {"reference": "Patient/1"}, "dateTime": "2024-01-02"}`,
+		},
+		{
+			name:     "consent without category or patient reference",
+			resource: `{"resourceType": "Consent", "status": "active", "scope": {"coding": [{"system": "` + ConsentSystem + `", "code": "marketing"}]}, "patient": {"display": "x"}}`,
+			want:     []string{"warning Consent.scope", "error Consent.category", "error Consent.patient.reference"},
+		},
+		{
+			name:     "imaging study",
+			resource: `{"resourceType": "ImagingStudy", "status": "available", ` + patient + `, "numberOfSeries": 1, "numberOfInstances": 0, "series": [{"uid": "1.2.3", "modality": {"system": "http://dicom.nema.org/resources/ontology/DCM", "code": "IO"}, "instance": [{"uid": "1.2.3.4", "sopClass": {"code": "1.2"}}]}]}`,
+		},
+		{
+			name:     "imaging study with bad series",
+			resource: `{"resourceType": "ImagingStudy", "status": "available", ` + patient + `, "numberOfSeries": -1, "series": [{"modality": {"system": "http://dicom.nema.org/resources/ontology/DCM", "code": "MR"}, "instance": [{"uid": "1.2.3.4"}]}]}`,
+			want: []string{
+				"error ImagingStudy.numberOfSeries",
+				"error ImagingStudy.series[0].uid",
+				"warning ImagingStudy.series[0].modality",
+				"error ImagingStudy.series[0].instance[0].sopClass",
+			},
+		},
+		{
+			name:     "media",
+			resource: `{"resourceType": "Media", "status": "completed", ` + patient + `, "createdDateTime": "2024", "width": 640, "height": 480, "content": {"contentType": "image/png"}}`,
+		},
+		{
+			name:     "media with zero size and no content type",
+			resource: `{"resourceType": "Media", "status": "done", ` + patient + `, "width": 0, "content": {}}`,
+			want:     []string{"error Media.status", "error Media.width", "error Media.content.contentType"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, issue := range Validate([]byte(tt.resource)) {
+				got = append(got, issue.Severity+" "+strings.Join(issue.Expression, ","))
+			}
+			sort.Strings(got)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("issues = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestMappedResourcesValidate checks that what the API serves conforms to
+// the profiles it claims.
+func TestMappedResourcesValidate(t *testing.T) {
+	p := &models.Patient{
+		ID:        primitive.NewObjectID(),
+		Gender:    "Female",
+		Age:       42,
+		Hospital:  "Hospital A",
+		Revision:  3,
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		UpdatedAt: time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC),
+	}
+
+	resources := []interface{}{ToPatient(p)}
+	for _, observation := range ToObservations(p) {
+		resources = append(resources, observation)
+	}
+	for _, resource := range resources {
+		data, err := json.Marshal(resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, issue := range Validate(data) {
+			if issue.Severity == SeverityError {
+				t.Errorf("%s: %s %v", data, issue.Diagnostics, issue.Expression)
+			}
+		}
+	}
+}
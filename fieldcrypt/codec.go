@@ -0,0 +1,93 @@
+package fieldcrypt
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var tEmpty = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// Register makes reg seal values of the given string types when they are
+// written and unseal them when read, so the rest of the code never sees
+// ciphertext. Plain strings, written before encryption was enabled, are
+// still read. Sealed values decoded into interface{} (bson.M, revision
+// changes) come back as strings too.
+func (k *Keyring) Register(reg *bsoncodec.Registry, types ...reflect.Type) {
+	for _, t := range types {
+		reg.RegisterTypeEncoder(t, bsoncodec.ValueEncoderFunc(k.encode))
+		reg.RegisterTypeDecoder(t, bsoncodec.ValueDecoderFunc(k.decode))
+	}
+
+	generic, err := reg.LookupDecoder(tEmpty)
+	if err != nil {
+		panic(err)
+	}
+	reg.RegisterTypeDecoder(tEmpty, bsoncodec.ValueDecoderFunc(func(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+		if vr.Type() != bsontype.Binary {
+			return generic.DecodeValue(dc, vr, val)
+		}
+		data, subtype, err := vr.ReadBinary()
+		if err != nil {
+			return err
+		}
+		if subtype != Subtype {
+			// The reader is spent, so the generic decoder gets a copy
+			return generic.DecodeValue(dc, bsonrw.NewBSONValueReader(bsontype.Binary, bsoncore.AppendBinary(nil, subtype, data)), val)
+		}
+		plain, err := k.Unseal(data)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(string(plain)))
+		return nil
+	}))
+}
+
+func (k *Keyring) encode(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Kind() != reflect.String {
+		return fmt.Errorf("fieldcrypt: cannot seal a %s", val.Type())
+	}
+	sealed, err := k.Seal([]byte(val.String()))
+	if err != nil {
+		return err
+	}
+	return vw.WriteBinaryWithSubtype(sealed, Subtype)
+}
+
+func (k *Keyring) decode(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Kind() != reflect.String {
+		return fmt.Errorf("fieldcrypt: cannot unseal into a %s", val.Type())
+	}
+	switch vr.Type() {
+	case bsontype.Binary:
+		data, subtype, err := vr.ReadBinary()
+		if err != nil {
+			return err
+		}
+		if subtype != Subtype {
+			return fmt.Errorf("fieldcrypt: binary subtype %#x is not a sealed value", subtype)
+		}
+		plain, err := k.Unseal(data)
+		if err != nil {
+			return err
+		}
+		val.SetString(string(plain))
+	case bsontype.String:
+		s, err := vr.ReadString()
+		if err != nil {
+			return err
+		}
+		val.SetString(s)
+	case bsontype.Null:
+		val.SetString("")
+		return vr.ReadNull()
+	default:
+		return fmt.Errorf("fieldcrypt: cannot unseal a BSON %s", vr.Type())
+	}
+	return nil
+}
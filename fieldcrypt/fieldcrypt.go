@@ -0,0 +1,366 @@
+// Package fieldcrypt encrypts sensitive document fields at the application
+// layer with envelope encryption: values are sealed with AES-256-GCM data
+// keys, which are stored in Mongo wrapped by a master key that never is.
+//
+// The newest data key seals new values; older ones stay readable until a
+// background job has resealed everything with the newest (see Reseal).
+// Rotating the master key only rewraps the data keys.
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Subtype is the BSON binary subtype of sealed values, from the
+// user-defined range.
+const Subtype byte = 0x8c
+
+const (
+	formatVersion = 1
+	keyIDSize     = 12 // A data key's ObjectID
+	dataKeySize   = 32
+)
+
+var (
+	ErrNotLoaded  = errors.New("fieldcrypt: keyring is not loaded")
+	ErrUnknownKey = errors.New("fieldcrypt: unknown data key")
+	ErrMalformed  = errors.New("fieldcrypt: malformed sealed value")
+)
+
+// MasterKey wraps data keys. A KMS client can implement it; Keyfile keeps the
+// master keys in a local file.
+type MasterKey interface {
+	// CurrentID names the master key Wrap uses.
+	CurrentID() string
+	Wrap(ctx context.Context, key []byte) (wrapped []byte, err error)
+	Unwrap(ctx context.Context, id string, wrapped []byte) ([]byte, error)
+}
+
+// dataKey is a data key as stored, in the encryption_keys collection.
+type dataKey struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	MasterKeyID string             `bson:"master_key_id"`
+	Wrapped     []byte             `bson:"wrapped"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	RetiredAt   *time.Time         `bson:"retired_at,omitempty"` // Set once nothing was found sealed with it
+}
+
+// KeyInfo describes a data key, without the key.
+type KeyInfo struct {
+	ID          primitive.ObjectID `json:"id"`
+	MasterKeyID string             `json:"master_key_id"`
+	CreatedAt   time.Time          `json:"created_at"`
+	RetiredAt   *time.Time         `json:"retired_at,omitempty"`
+	Current     bool               `json:"current"`
+}
+
+// Keyring holds the unwrapped data keys. It is created before the Mongo
+// client, so its codecs can be registered, and loaded once connected.
+type Keyring struct {
+	master MasterKey
+	keys   *mongo.Collection
+
+	mu      sync.RWMutex
+	aeads   map[primitive.ObjectID]cipher.AEAD
+	current primitive.ObjectID
+}
+
+func NewKeyring(master MasterKey) *Keyring {
+	return &Keyring{master: master, aeads: map[primitive.ObjectID]cipher.AEAD{}}
+}
+
+// Load reads the data keys from keys, creating the first one if there is
+// none, and rewraps those wrapped by another master key than the current.
+func (k *Keyring) Load(ctx context.Context, keys *mongo.Collection) error {
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+
+	if err := k.Refresh(ctx); err != nil {
+		return err
+	}
+	if k.Current().IsZero() {
+		if _, err := k.Rotate(ctx); err != nil {
+			return err
+		}
+	}
+	return k.rewrap(ctx)
+}
+
+// Refresh picks up data keys other replicas created.
+func (k *Keyring) Refresh(ctx context.Context) error {
+	stored, err := k.stored(ctx)
+	if err != nil {
+		return err
+	}
+
+	k.mu.RLock()
+	var missing []dataKey
+	for _, key := range stored {
+		if _, ok := k.aeads[key.ID]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	k.mu.RUnlock()
+
+	// Unwrapping may call a KMS, so it's done without the lock
+	aeads := map[primitive.ObjectID]cipher.AEAD{}
+	for _, key := range missing {
+		aead, err := k.unwrap(ctx, key)
+		if err != nil {
+			return err
+		}
+		aeads[key.ID] = aead
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for id, aead := range aeads {
+		k.aeads[id] = aead
+	}
+	if len(stored) > 0 {
+		k.current = stored[0].ID
+	}
+	return nil
+}
+
+// Watch refreshes the keyring every interval until ctx is cancelled, so a
+// rotation on one replica reaches the others.
+func (k *Keyring) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := k.Refresh(ctx); err != nil {
+			log.Printf("fieldcrypt: cannot refresh keyring: %v", err)
+		}
+	}
+}
+
+// stored returns the data keys, newest first.
+func (k *Keyring) stored(ctx context.Context) ([]dataKey, error) {
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+	if keys == nil {
+		return nil, ErrNotLoaded
+	}
+
+	cursor, err := keys.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	var stored []dataKey
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (k *Keyring) unwrap(ctx context.Context, key dataKey) (cipher.AEAD, error) {
+	plain, err := k.master.Unwrap(ctx, key.MasterKeyID, key.Wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("fieldcrypt: cannot unwrap data key %s: %w", key.ID.Hex(), err)
+	}
+	return newAEAD(plain)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// rewrap wraps every data key that isn't under the current master key with
+// it. The data keys themselves don't change, so nothing needs resealing.
+func (k *Keyring) rewrap(ctx context.Context) error {
+	stored, err := k.stored(ctx)
+	if err != nil {
+		return err
+	}
+	masterID := k.master.CurrentID()
+	for _, key := range stored {
+		if key.MasterKeyID == masterID {
+			continue
+		}
+		plain, err := k.master.Unwrap(ctx, key.MasterKeyID, key.Wrapped)
+		if err != nil {
+			return fmt.Errorf("fieldcrypt: cannot unwrap data key %s: %w", key.ID.Hex(), err)
+		}
+		wrapped, err := k.master.Wrap(ctx, plain)
+		if err != nil {
+			return err
+		}
+		// Only if no other replica rewrapped it in the meantime
+		_, err = k.keys.UpdateOne(ctx,
+			bson.M{"_id": key.ID, "master_key_id": key.MasterKeyID},
+			bson.M{"$set": bson.M{"master_key_id": masterID, "wrapped": wrapped}},
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("fieldcrypt: data key %s rewrapped from master key %s to %s", key.ID.Hex(), key.MasterKeyID, masterID)
+	}
+	return nil
+}
+
+// Rotate creates a data key, which seals every new value from now on.
+func (k *Keyring) Rotate(ctx context.Context) (KeyInfo, error) {
+	plain := make([]byte, dataKeySize)
+	if _, err := rand.Read(plain); err != nil {
+		return KeyInfo{}, err
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	wrapped, err := k.master.Wrap(ctx, plain)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+	if keys == nil {
+		return KeyInfo{}, ErrNotLoaded
+	}
+	key := dataKey{
+		ID:          primitive.NewObjectID(),
+		MasterKeyID: k.master.CurrentID(),
+		Wrapped:     wrapped,
+		CreatedAt:   time.Now(),
+	}
+	if _, err := keys.InsertOne(ctx, key); err != nil {
+		return KeyInfo{}, err
+	}
+
+	k.mu.Lock()
+	k.aeads[key.ID] = aead
+	k.current = key.ID
+	k.mu.Unlock()
+	return KeyInfo{ID: key.ID, MasterKeyID: key.MasterKeyID, CreatedAt: key.CreatedAt, Current: true}, nil
+}
+
+// Current returns the ID of the data key new values are sealed with.
+func (k *Keyring) Current() primitive.ObjectID {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// Keys lists the data keys, newest first.
+func (k *Keyring) Keys(ctx context.Context) ([]KeyInfo, error) {
+	stored, err := k.stored(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current := k.Current()
+	infos := make([]KeyInfo, len(stored))
+	for i, key := range stored {
+		infos[i] = KeyInfo{
+			ID:          key.ID,
+			MasterKeyID: key.MasterKeyID,
+			CreatedAt:   key.CreatedAt,
+			RetiredAt:   key.RetiredAt,
+			Current:     key.ID == current,
+		}
+	}
+	return infos, nil
+}
+
+// Retire marks data keys older than the current one as no longer sealing
+// anything. They stay readable, in case a replica that hadn't refreshed yet
+// used one since.
+func (k *Keyring) Retire(ctx context.Context, ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := k.keys.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids, "$ne": k.Current()}, "retired_at": nil},
+		bson.M{"$set": bson.M{"retired_at": time.Now()}},
+	)
+	return err
+}
+
+// Seal encrypts plaintext with the current data key.
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	k.mu.RLock()
+	id := k.current
+	aead := k.aeads[id]
+	k.mu.RUnlock()
+	if aead == nil {
+		return nil, ErrNotLoaded
+	}
+
+	sealed := make([]byte, 1+keyIDSize+aead.NonceSize(), 1+keyIDSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	sealed[0] = formatVersion
+	copy(sealed[1:], id[:])
+	nonce := sealed[1+keyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, nonce, plaintext, sealed[:1+keyIDSize]), nil
+}
+
+// Unseal decrypts a value sealed with any known data key, looking for keys
+// created since the last refresh if needed.
+func (k *Keyring) Unseal(sealed []byte) ([]byte, error) {
+	id, ok := KeyID(sealed)
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	k.mu.RLock()
+	aead := k.aeads[id]
+	k.mu.RUnlock()
+	if aead == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := k.Refresh(ctx); err != nil {
+			return nil, err
+		}
+		k.mu.RLock()
+		aead = k.aeads[id]
+		k.mu.RUnlock()
+		if aead == nil {
+			return nil, ErrUnknownKey
+		}
+	}
+
+	header := 1 + keyIDSize
+	if len(sealed) < header+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrMalformed
+	}
+	nonce := sealed[header : header+aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[header+aead.NonceSize():], sealed[:header])
+}
+
+// KeyID returns the data key a value was sealed with.
+func KeyID(sealed []byte) (primitive.ObjectID, bool) {
+	var id primitive.ObjectID
+	if len(sealed) < 1+keyIDSize || sealed[0] != formatVersion {
+		return id, false
+	}
+	copy(id[:], sealed[1:])
+	return id, true
+}
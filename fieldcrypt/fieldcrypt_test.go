@@ -0,0 +1,327 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testKeyring returns a keyring holding a fresh data key, without Mongo.
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	k := NewKeyring(nil)
+	addKey(t, k)
+	return k
+}
+
+// addKey adds a data key to k and makes it current, as Rotate would.
+func addKey(t *testing.T, k *Keyring) primitive.ObjectID {
+	t.Helper()
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := primitive.NewObjectID()
+	k.aeads[id] = aead
+	k.current = id
+	return id
+}
+
+func seal(t *testing.T, k *Keyring, s string) primitive.Binary {
+	t.Helper()
+	data, err := k.Seal([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return primitive.Binary{Subtype: Subtype, Data: data}
+}
+
+func TestSealUnseal(t *testing.T) {
+	k := testKeyring(t)
+	plain := []byte("ก้อนที่เหงือกล่างขวา")
+
+	a, err := k.Seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, b) {
+		t.Error("sealing twice gave the same ciphertext")
+	}
+	if id, ok := KeyID(a); !ok || id != k.Current() {
+		t.Errorf("KeyID = %s, %v; want the current key %s", id.Hex(), ok, k.Current().Hex())
+	}
+
+	got, err := k.Unseal(a)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("Unseal = %q, %v; want %q", got, err, plain)
+	}
+
+	// Older keys stay readable after a rotation
+	addKey(t, k)
+	if got, err := k.Unseal(a); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("Unseal after rotation = %q, %v; want %q", got, err, plain)
+	}
+}
+
+func TestUnsealRejectsTampering(t *testing.T) {
+	k := testKeyring(t)
+	other := k.Current()
+	addKey(t, k)
+	sealed, err := k.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), sealed...))
+	}
+
+	tests := map[string][]byte{
+		"ciphertext": change(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }),
+		"nonce":      change(func(b []byte) []byte { b[1+keyIDSize] ^= 1; return b }),
+		// The header is authenticated, so naming another key fails too
+		"key id":    change(func(b []byte) []byte { copy(b[1:], other[:]); return b }),
+		"truncated": sealed[:1+keyIDSize+4],
+	}
+	for name, data := range tests {
+		if _, err := k.Unseal(data); err == nil {
+			t.Errorf("Unseal accepted a changed %s", name)
+		}
+	}
+
+	if _, err := k.Unseal(change(func(b []byte) []byte { b[0] = 2; return b })); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Unseal of an unknown format = %v, want ErrMalformed", err)
+	}
+	if _, err := k.Unseal(sealed[:5]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Unseal of a short value = %v, want ErrMalformed", err)
+	}
+}
+
+func TestSealNotLoaded(t *testing.T) {
+	if _, err := NewKeyring(nil).Seal([]byte("x")); !errors.Is(err, ErrNotLoaded) {
+		t.Errorf("Seal = %v, want ErrNotLoaded", err)
+	}
+}
+
+func TestReseal(t *testing.T) {
+	k := testKeyring(t)
+	old := map[string]primitive.Binary{
+		"note":             seal(t, k, "note"),
+		"images.0.caption": seal(t, k, "first"),
+		"meta.comment":     seal(t, k, "comment"),
+	}
+	addKey(t, k)
+	current := seal(t, k, "current")
+
+	doc, err := bson.Marshal(bson.D{
+		{Key: "note", Value: old["note"]},
+		{Key: "plain", Value: "not sealed"},
+		{Key: "images", Value: bson.A{
+			bson.M{"caption": old["images.0.caption"]},
+			bson.M{"caption": current},
+		}},
+		{Key: "meta", Value: bson.M{"comment": old["meta.comment"], "blob": primitive.Binary{Data: []byte{1}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, resealed, err := k.Reseal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != len(old) || len(resealed) != len(old) {
+		t.Fatalf("Reseal found %v, want %v", stale, old)
+	}
+	for path, value := range old {
+		if !reflect.DeepEqual(stale[path], value) {
+			t.Errorf("stale[%s] = %v, want the stored value", path, stale[path])
+		}
+		data := resealed[path].(primitive.Binary).Data
+		if id, _ := KeyID(data); id != k.Current() {
+			t.Errorf("resealed[%s] uses key %s, want %s", path, id.Hex(), k.Current().Hex())
+		}
+		want, _ := k.Unseal(value.Data)
+		if got, err := k.Unseal(data); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("resealed[%s] = %q, %v; want %q", path, got, err, want)
+		}
+	}
+}
+
+func TestSealPlaintext(t *testing.T) {
+	k := testKeyring(t)
+	doc, err := bson.Marshal(bson.D{
+		{Key: "notes", Value: "plain notes"},
+		{Key: "age", Value: 42},
+		{Key: "images", Value: bson.A{
+			bson.M{"caption": "first", "annotations": bson.A{"a", seal(t, k, "b")}},
+			bson.M{"caption": seal(t, k, "second")},
+			bson.M{"name": "no caption"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, sealed, err := k.SealPlaintext(doc, []string{"notes", "age", "missing", "images.*.caption", "images.*.annotations.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"notes": "plain notes", "images.0.caption": "first", "images.0.annotations.0": "a"}
+	if !reflect.DeepEqual(plain, want) {
+		t.Errorf("plain = %v, want %v", plain, want)
+	}
+	for path, value := range want {
+		got, err := k.Unseal(sealed[path].(primitive.Binary).Data)
+		if err != nil || string(got) != value {
+			t.Errorf("sealed[%s] = %q, %v; want %q", path, got, err, value)
+		}
+	}
+	if len(sealed) != len(want) {
+		t.Errorf("sealed %d values, want %d", len(sealed), len(want))
+	}
+}
+
+type secret string
+
+func TestCodec(t *testing.T) {
+	k := testKeyring(t)
+	registry := bson.NewRegistry()
+	k.Register(registry, reflect.TypeOf(secret("")))
+
+	marshal := func(v interface{}) bson.Raw {
+		t.Helper()
+		buf := new(bytes.Buffer)
+		vw, err := bsonrw.NewBSONValueWriter(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder, err := bson.NewEncoder(vw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder.SetRegistry(registry)
+		if err := encoder.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	unmarshal := func(doc bson.Raw, v interface{}) {
+		t.Helper()
+		decoder, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder.SetRegistry(registry)
+		if err := decoder.Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type record struct {
+		Name  string `bson:"name"`
+		Notes secret `bson:"notes"`
+	}
+	doc := marshal(record{Name: "visible", Notes: "hidden"})
+
+	if subtype, data, ok := doc.Lookup("notes").BinaryOK(); !ok || subtype != Subtype || bytes.Contains(data, []byte("hidden")) {
+		t.Errorf("notes stored as %s, want a sealed binary", doc.Lookup("notes"))
+	}
+	if doc.Lookup("name").StringValue() != "visible" {
+		t.Errorf("name stored as %s, want a plain string", doc.Lookup("name"))
+	}
+
+	var got record
+	unmarshal(doc, &got)
+	if got.Notes != "hidden" {
+		t.Errorf("decoded notes = %q, want hidden", got.Notes)
+	}
+
+	// Generic documents see the plaintext too, and other binaries unchanged
+	var m bson.M
+	unmarshal(marshal(bson.M{"notes": secret("hidden"), "blob": primitive.Binary{Subtype: 0, Data: []byte{1}}}), &m)
+	if m["notes"] != "hidden" {
+		t.Errorf("bson.M notes = %#v, want \"hidden\"", m["notes"])
+	}
+	if !reflect.DeepEqual(m["blob"], primitive.Binary{Subtype: 0, Data: []byte{1}}) {
+		t.Errorf("bson.M blob = %#v", m["blob"])
+	}
+
+	// Values written before encryption was enabled are still read
+	var old record
+	unmarshal(marshal(bson.M{"name": "visible", "notes": "plain"}), &old)
+	if old.Notes != "plain" {
+		t.Errorf("plain notes decoded as %q", old.Notes)
+	}
+}
+
+func TestKeyfile(t *testing.T) {
+	key := func() string {
+		b := make([]byte, dataKeySize)
+		rand.Read(b)
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ctx := context.Background()
+	first, second := key(), key()
+
+	old, err := LoadKeyfile(write(`{"current": "1", "keys": {"1": "` + first + `"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := old.Wrap(ctx, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := LoadKeyfile(write(`{"current": "2", "keys": {"1": "` + first + `", "2": "` + second + `"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.CurrentID() != "2" {
+		t.Errorf("CurrentID = %q, want 2", rotated.CurrentID())
+	}
+	if got, err := rotated.Unwrap(ctx, "1", wrapped); err != nil || string(got) != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("Unwrap with the old master key = %q, %v", got, err)
+	}
+	// The master key ID is authenticated with the wrapped key
+	if _, err := rotated.Unwrap(ctx, "2", wrapped); err == nil {
+		t.Error("Unwrap accepted a key wrapped by another master key")
+	}
+	if _, err := rotated.Unwrap(ctx, "3", wrapped); err == nil {
+		t.Error("Unwrap accepted an unknown master key")
+	}
+
+	for name, content := range map[string]string{
+		"missing current": `{"current": "2", "keys": {"1": "` + first + `"}}`,
+		"short key":       `{"current": "1", "keys": {"1": "c2hvcnQ="}}`,
+		"not json":        `current: 1`,
+	} {
+		if _, err := LoadKeyfile(write(content)); err == nil {
+			t.Errorf("LoadKeyfile accepted a keyfile with %s", name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Keyfile is a MasterKey read from a local JSON file:
+//
+//	{"current": "2026-10", "keys": {"2026-01": "<base64>", "2026-10": "<base64>"}}
+//
+// Each key is 32 random bytes. To rotate the master key, add a key, make it
+// current and restart; old keys can go once the log says every data key was
+// rewrapped.
+type Keyfile struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+func LoadKeyfile(path string) (*Keyfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("fieldcrypt: %s: %w", path, err)
+	}
+
+	k := &Keyfile{current: file.Current, aeads: map[string]cipher.AEAD{}}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("fieldcrypt: %s: key %q must be %d bytes in base64", path, id, dataKeySize)
+		}
+		if k.aeads[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+	if k.aeads[k.current] == nil {
+		return nil, fmt.Errorf("fieldcrypt: %s: current key %q is not in keys", path, file.Current)
+	}
+	return k, nil
+}
+
+func (k *Keyfile) CurrentID() string {
+	return k.current
+}
+
+func (k *Keyfile) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, []byte(k.current)), nil
+}
+
+func (k *Keyfile) Unwrap(ctx context.Context, id string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not in the keyfile", id)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(id))
+}
+
+// FromEnv builds a keyring over the master keys in FIELD_ENCRYPTION_KEYFILE.
+// It returns nil when encryption is not configured; fields are then stored
+// in plaintext.
+func FromEnv() (*Keyring, error) {
+	path := os.Getenv("FIELD_ENCRYPTION_KEYFILE")
+	if path == "" {
+		return nil, nil
+	}
+	master, err := LoadKeyfile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(master), nil
+}
@@ -0,0 +1,118 @@
+package fieldcrypt
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Reseal finds the values in doc sealed with another data key than the
+// current one and seals them again. Both maps are keyed by dotted path:
+// stale holds the values as stored, to match on so a concurrent write isn't
+// overwritten, and resealed the values to $set.
+func (k *Keyring) Reseal(doc bson.Raw) (stale, resealed bson.M, err error) {
+	stale, resealed = bson.M{}, bson.M{}
+	err = k.reseal(doc, "", k.Current(), stale, resealed)
+	return stale, resealed, err
+}
+
+func (k *Keyring) reseal(doc bson.Raw, prefix string, current primitive.ObjectID, stale, resealed bson.M) error {
+	elements, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		path := prefix + element.Key()
+		value := element.Value()
+		switch value.Type {
+		case bsontype.EmbeddedDocument:
+			if err := k.reseal(value.Document(), path+".", current, stale, resealed); err != nil {
+				return err
+			}
+		case bsontype.Array:
+			// Arrays are documents keyed "0", "1", ..., which is also how
+			// their items are addressed in a path
+			if err := k.reseal(bson.Raw(value.Array()), path+".", current, stale, resealed); err != nil {
+				return err
+			}
+		case bsontype.Binary:
+			subtype, data := value.Binary()
+			if subtype != Subtype {
+				continue
+			}
+			if id, ok := KeyID(data); ok && id == current {
+				continue
+			}
+			plain, err := k.Unseal(data)
+			if err != nil {
+				return err
+			}
+			sealed, err := k.Seal(plain)
+			if err != nil {
+				return err
+			}
+			stale[path] = primitive.Binary{Subtype: Subtype, Data: data}
+			resealed[path] = primitive.Binary{Subtype: Subtype, Data: sealed}
+		}
+	}
+	return nil
+}
+
+// SealPlaintext finds the strings in doc at paths, written before field
+// encryption was enabled, and seals them. Paths are dotted, with * for any
+// array index or key. Like Reseal, plain holds the values as stored and
+// sealed the values to $set, keyed by the dotted path of each value.
+func (k *Keyring) SealPlaintext(doc bson.Raw, paths []string) (plain, sealed bson.M, err error) {
+	plain, sealed = bson.M{}, bson.M{}
+	root := bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc}
+	for _, path := range paths {
+		if err := k.sealPlaintext(root, "", strings.Split(path, "."), plain, sealed); err != nil {
+			return nil, nil, err
+		}
+	}
+	return plain, sealed, nil
+}
+
+func (k *Keyring) sealPlaintext(value bson.RawValue, path string, segments []string, plain, sealed bson.M) error {
+	if len(segments) == 0 {
+		if value.Type != bsontype.String {
+			return nil
+		}
+		data, err := k.Seal([]byte(value.StringValue()))
+		if err != nil {
+			return err
+		}
+		plain[path] = value.StringValue()
+		sealed[path] = primitive.Binary{Subtype: Subtype, Data: data}
+		return nil
+	}
+
+	var elements []bson.RawElement
+	var err error
+	switch value.Type {
+	case bsontype.EmbeddedDocument:
+		elements, err = value.Document().Elements()
+	case bsontype.Array:
+		elements, err = bson.Raw(value.Array()).Elements()
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		if segments[0] != "*" && segments[0] != element.Key() {
+			continue
+		}
+		next := element.Key()
+		if path != "" {
+			next = path + "." + next
+		}
+		if err := k.sealPlaintext(element.Value(), next, segments[1:], plain, sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
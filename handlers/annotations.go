@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// annotationInput is the part of an annotation a client sends; versions,
+// authorship and measurements are filled in by the server.
+type annotationInput struct {
+	Type     string         `json:"type"`
+	Label    string         `json:"label"`
+	Points   []models.Point `json:"points"`
+	Center   *models.Point  `json:"center"`
+	RadiusX  float64        `json:"radius_x"`
+	RadiusY  float64        `json:"radius_y"`
+	Rotation float64        `json:"rotation"`
+	Text     string         `json:"text"`
+}
+
+const defaultAnnotationLabel = "lesion"
+
+// problem describes what is wrong with the input, or returns "" when it is
+// a valid shape.
+func (in annotationInput) problem() string {
+	for _, p := range in.Points {
+		if p.X < 0 || p.Y < 0 || math.IsNaN(p.X) || math.IsNaN(p.Y) {
+			return "Points must have non-negative coordinates"
+		}
+	}
+
+	switch in.Type {
+	case models.AnnotationPolygon:
+		if len(in.Points) < 3 {
+			return "A polygon needs at least 3 points"
+		}
+	case models.AnnotationEllipse:
+		if in.Center == nil || in.RadiusX <= 0 || in.RadiusY <= 0 {
+			return "An ellipse needs a center and positive radius_x and radius_y"
+		}
+	case models.AnnotationArrow, models.AnnotationMeasurement:
+		if len(in.Points) != 2 {
+			return "Arrows and measurements need exactly 2 points"
+		}
+	case models.AnnotationText:
+		if len(in.Points) != 1 || in.Text == "" {
+			return "A text label needs 1 point and text"
+		}
+	default:
+		return "Type must be polygon, ellipse, arrow, text or measurement"
+	}
+	return ""
+}
+
+// pixelSpacing returns the mm per pixel along x (columns) and y (rows), when
+// the image carries calibration.
+func pixelSpacing(image *models.PatientImage) (x, y float64, ok bool) {
+	if image.DICOM == nil || len(image.DICOM.PixelSpacing) == 0 {
+		return 0, 0, false
+	}
+	spacing := image.DICOM.PixelSpacing
+	y, x = spacing[0], spacing[0]
+	if len(spacing) > 1 {
+		x = spacing[1]
+	}
+	return x, y, x > 0 && y > 0
+}
+
+// measure fills in lengths and areas from the geometry.
+func measure(a *models.ImageAnnotation, image *models.PatientImage) {
+	a.LengthPx, a.AreaPx, a.LengthMM, a.AreaMM2 = 0, 0, nil, nil
+	sx, sy, calibrated := pixelSpacing(image)
+
+	switch a.Type {
+	case models.AnnotationArrow, models.AnnotationMeasurement:
+		dx, dy := a.Points[1].X-a.Points[0].X, a.Points[1].Y-a.Points[0].Y
+		a.LengthPx = math.Hypot(dx, dy)
+		if calibrated {
+			mm := math.Hypot(dx*sx, dy*sy)
+			a.LengthMM = &mm
+		}
+	case models.AnnotationPolygon:
+		// Shoelace formula
+		var area float64
+		for i, p := range a.Points {
+			q := a.Points[(i+1)%len(a.Points)]
+			area += p.X*q.Y - q.X*p.Y
+		}
+		a.AreaPx = math.Abs(area) / 2
+	case models.AnnotationEllipse:
+		a.AreaPx = math.Pi * a.RadiusX * a.RadiusY
+	}
+
+	if a.AreaPx > 0 && calibrated {
+		mm2 := a.AreaPx * sx * sy
+		a.AreaMM2 = &mm2
+	}
+}
+
+func (in annotationInput) apply(a *models.ImageAnnotation) {
+	a.Type = in.Type
+	a.Label = in.Label
+	if a.Label == "" {
+		a.Label = defaultAnnotationLabel
+	}
+	a.Points, a.Center, a.RadiusX, a.RadiusY, a.Rotation, a.Text = nil, nil, 0, 0, 0, in.Text
+	switch in.Type {
+	case models.AnnotationEllipse:
+		a.Center, a.RadiusX, a.RadiusY, a.Rotation = in.Center, in.RadiusX, in.RadiusY, in.Rotation
+	default:
+		a.Points = in.Points
+	}
+}
+
+// GetImageAnnotations ดึงคำอธิบายประกอบล่าสุดบนภาพ (?author= เพื่อดูเฉพาะของผู้ใช้)
+func (h *Handler) GetImageAnnotations(c *fiber.Ctx) error {
+	image, err := h.findPatientImage(c, false)
+	if err != nil || image == nil {
+		return err
+	}
+
+	filter := bson.M{"image_id": image.ID, "latest": true, "deleted": bson.M{"$ne": true}}
+	if author := c.Query("author"); author != "" {
+		authorID, err := primitive.ObjectIDFromHex(author)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid author ID"})
+		}
+		filter["author"] = authorID
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("image_annotations")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch annotations"})
+	}
+	defer cursor.Close(ctx)
+
+	annotations := []models.ImageAnnotation{}
+	if err := cursor.All(ctx, &annotations); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode annotations"})
+	}
+
+	return c.JSON(annotations)
+}
+
+// CreateImageAnnotation วาดรูปร่าง/ข้อความ/การวัดบนภาพ (ผู้ที่ดูผู้ป่วยได้สามารถเพิ่มได้)
+func (h *Handler) CreateImageAnnotation(c *fiber.Ctx) error {
+	var input annotationInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+	if problem := input.problem(); problem != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": problem})
+	}
+
+	image, err := h.findPatientImage(c, false)
+	if err != nil || image == nil {
+		return err
+	}
+	userID, err := currentUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	annotation := models.ImageAnnotation{
+		AnnotationID: primitive.NewObjectID(),
+		Version:      1,
+		Latest:       true,
+		PatientID:    image.PatientID,
+		ImageID:      image.ID,
+		Author:       userID,
+		CreatedAt:    time.Now(),
+	}
+	input.apply(&annotation)
+	measure(&annotation, image)
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("image_annotations")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := collection.InsertOne(ctx, annotation)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot save annotation"})
+	}
+	annotation.ID = result.InsertedID.(primitive.ObjectID)
+
+	return c.Status(fiber.StatusCreated).JSON(annotation)
+}
+
+// UpdateImageAnnotation แก้ไขคำอธิบายประกอบของตัวเอง (เก็บเป็นเวอร์ชันใหม่)
+func (h *Handler) UpdateImageAnnotation(c *fiber.Ctx) error {
+	var input annotationInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+	if problem := input.problem(); problem != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": problem})
+	}
+
+	image, err := h.findPatientImage(c, false)
+	if err != nil || image == nil {
+		return err
+	}
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	return h.addAnnotationVersion(c, image, user, false, func(a *models.ImageAnnotation) {
+		input.apply(a)
+		measure(a, image)
+	})
+}
+
+// DeleteImageAnnotation ลบคำอธิบายประกอบ (เจ้าของหรือ admin; ประวัติยังคงอยู่)
+func (h *Handler) DeleteImageAnnotation(c *fiber.Ctx) error {
+	image, err := h.findPatientImage(c, false)
+	if err != nil || image == nil {
+		return err
+	}
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	return h.addAnnotationVersion(c, image, user, isAdmin(user), func(a *models.ImageAnnotation) {
+		a.Deleted = true
+	})
+}
+
+// addAnnotationVersion stores edit applied to the latest version of
+// :annotationId as the next version. Only the author may edit unless
+// anyAuthor is set.
+func (h *Handler) addAnnotationVersion(c *fiber.Ctx, image *models.PatientImage, user *models.User, anyAuthor bool, edit func(*models.ImageAnnotation)) error {
+	annotationID, err := primitive.ObjectIDFromHex(c.Params("annotationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid annotation ID"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("image_annotations")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"annotation_id": annotationID, "image_id": image.ID, "latest": true, "deleted": bson.M{"$ne": true}}
+	if !anyAuthor {
+		filter["author"] = user.ID
+	}
+
+	// Retiring the current version first means concurrent edits can't both
+	// build on it
+	var previous models.ImageAnnotation
+	err = collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"latest": false}}).Decode(&previous)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Annotation not found or not yours"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update annotation"})
+	}
+
+	next := previous
+	next.ID = primitive.NilObjectID
+	next.Version = previous.Version + 1
+	next.Latest = true
+	next.CreatedAt = time.Now()
+	edit(&next)
+
+	result, err := collection.InsertOne(ctx, next)
+	if err != nil {
+		collection.UpdateOne(ctx, bson.M{"_id": previous.ID}, bson.M{"$set": bson.M{"latest": true}})
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update annotation"})
+	}
+	next.ID = result.InsertedID.(primitive.ObjectID)
+
+	if next.Deleted {
+		return c.JSON(fiber.Map{"message": "Annotation deleted successfully"})
+	}
+	return c.JSON(next)
+}
+
+// GetImageAnnotationHistory ดูทุกเวอร์ชันของคำอธิบายประกอบ
+func (h *Handler) GetImageAnnotationHistory(c *fiber.Ctx) error {
+	image, err := h.findPatientImage(c, false)
+	if err != nil || image == nil {
+		return err
+	}
+	annotationID, err := primitive.ObjectIDFromHex(c.Params("annotationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid annotation ID"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("image_annotations")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx,
+		bson.M{"annotation_id": annotationID, "image_id": image.ID},
+		options.Find().SetSort(bson.D{{Key: "version", Value: 1}}),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch annotation history"})
+	}
+	defer cursor.Close(ctx)
+
+	versions := []models.ImageAnnotation{}
+	if err := cursor.All(ctx, &versions); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode annotation history"})
+	}
+	if len(versions) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Annotation not found"})
+	}
+
+	return c.JSON(versions)
+}
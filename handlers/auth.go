@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/trash"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// currentUserID returns the user ID that middleware.Auth stored from the JWT.
+func currentUserID(c *fiber.Ctx) (primitive.ObjectID, error) {
+	id, ok := c.Locals("user_id").(string)
+	if !ok || id == "" {
+		return primitive.NilObjectID, errors.New("missing user in token")
+	}
+	return primitive.ObjectIDFromHex(id)
+}
+
+// currentUser loads the authenticated user, for handlers that need the role or hospital.
+func (h *Handler) currentUser(c *fiber.Ctx) (*models.User, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := collection.FindOne(ctx, trash.NotDeleted(bson.M{"_id": userID})).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func isAdmin(user *models.User) bool {
+	return strings.EqualFold(user.Role, "admin")
+}
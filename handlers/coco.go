@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// COCO object detection format, see https://cocodataset.org/#format-data.
+// Shapes without an area (arrows, measurements, text) are exported with an
+// empty segmentation and their details under "attributes".
+type cocoDataset struct {
+	Info        cocoInfo         `json:"info"`
+	Images      []cocoImage      `json:"images"`
+	Categories  []cocoCategory   `json:"categories"`
+	Annotations []cocoAnnotation `json:"annotations"`
+}
+
+type cocoInfo struct {
+	Description string `json:"description"`
+	Version     string `json:"version"`
+	DateCreated string `json:"date_created"`
+}
+
+type cocoImage struct {
+	ID       int    `json:"id"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	FileName string `json:"file_name"`
+}
+
+type cocoCategory struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Supercategory string `json:"supercategory"`
+}
+
+type cocoAnnotation struct {
+	ID           int            `json:"id"`
+	ImageID      int            `json:"image_id"`
+	CategoryID   int            `json:"category_id"`
+	Segmentation [][]float64    `json:"segmentation"`
+	Area         float64        `json:"area"`
+	BBox         [4]float64     `json:"bbox"`
+	IsCrowd      int            `json:"iscrowd"`
+	Attributes   cocoAttributes `json:"attributes"`
+}
+
+type cocoAttributes struct {
+	Type         string    `json:"type"`
+	Text         string    `json:"text,omitempty"`
+	LengthPx     float64   `json:"length_px,omitempty"`
+	LengthMM     *float64  `json:"length_mm,omitempty"`
+	AreaMM2      *float64  `json:"area_mm2,omitempty"`
+	Keypoints    []float64 `json:"keypoints,omitempty"` // Start and end of arrows and measurements
+	AnnotationID string    `json:"annotation_id"`
+	Version      int       `json:"version"`
+	Author       string    `json:"author"`
+}
+
+// ellipseSegments is how many points approximate an ellipse outline.
+const ellipseSegments = 32
+
+// outline returns the polygon of an annotation's region, if it has one.
+func outline(a models.ImageAnnotation) []models.Point {
+	switch a.Type {
+	case models.AnnotationPolygon:
+		return a.Points
+	case models.AnnotationEllipse:
+		theta := a.Rotation * math.Pi / 180
+		points := make([]models.Point, ellipseSegments)
+		for i := range points {
+			t := 2 * math.Pi * float64(i) / ellipseSegments
+			x, y := a.RadiusX*math.Cos(t), a.RadiusY*math.Sin(t)
+			points[i] = models.Point{
+				X: a.Center.X + x*math.Cos(theta) - y*math.Sin(theta),
+				Y: a.Center.Y + x*math.Sin(theta) + y*math.Cos(theta),
+			}
+		}
+		return points
+	}
+	return nil
+}
+
+func boundingBox(points []models.Point) [4]float64 {
+	if len(points) == 0 {
+		return [4]float64{}
+	}
+	minX, minY, maxX, maxY := points[0].X, points[0].Y, points[0].X, points[0].Y
+	for _, p := range points[1:] {
+		minX, maxX = math.Min(minX, p.X), math.Max(maxX, p.X)
+		minY, maxY = math.Min(minY, p.Y), math.Max(maxY, p.Y)
+	}
+	return [4]float64{minX, minY, maxX - minX, maxY - minY}
+}
+
+func flatten(points []models.Point) []float64 {
+	flat := make([]float64, 0, 2*len(points))
+	for _, p := range points {
+		flat = append(flat, p.X, p.Y)
+	}
+	return flat
+}
+
+func cocoFileName(img models.PatientImage) string {
+	switch img.ContentType {
+	case "image/png":
+		return img.ID.Hex() + ".png"
+	case "image/jpeg":
+		return img.ID.Hex() + ".jpg"
+	case dicomContentType:
+		return img.ID.Hex() + ".dcm"
+	}
+	return img.ID.Hex()
+}
+
+// imageSize returns the stored size, decoding the header of PNG and JPEG
+// uploads that predate it.
+func (h *Handler) imageSize(ctx context.Context, img models.PatientImage) (int, int) {
+	if img.Width > 0 || !allowedImageTypes[img.ContentType] {
+		return img.Width, img.Height
+	}
+	reader, err := h.blobs.Get(ctx, img.StorageKey)
+	if err != nil {
+		return 0, 0
+	}
+	defer reader.Close()
+	config, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// ExportPatientAnnotationsCOCO ส่งออกคำอธิบายประกอบล่าสุดของทุกภาพของผู้ป่วยในรูปแบบ COCO JSON
+func (h *Handler) ExportPatientAnnotationsCOCO(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	patient, err := h.findPatient(ctx, patientID, user, false)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+	// Annotation datasets are made to train and evaluate models
+	if !hasConsent(patient, models.ConsentScopeResearch) {
+		return consentRequired(c, models.ConsentScopeResearch)
+	}
+
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	cursor, err := db.Collection("patient_images").Find(ctx,
+		bson.M{"patient_id": patientID},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch images"})
+	}
+	var images []models.PatientImage
+	if err := cursor.All(ctx, &images); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode images"})
+	}
+
+	cursor, err = db.Collection("image_annotations").Find(ctx,
+		bson.M{"patient_id": patientID, "latest": true, "deleted": bson.M{"$ne": true}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch annotations"})
+	}
+	var annotations []models.ImageAnnotation
+	if err := cursor.All(ctx, &annotations); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode annotations"})
+	}
+
+	dataset := cocoDataset{
+		Info: cocoInfo{
+			Description: fmt.Sprintf("Annotations of patient %s", patientID.Hex()),
+			Version:     "1.0",
+			DateCreated: time.Now().Format(time.RFC3339),
+		},
+		Images:      []cocoImage{},
+		Categories:  []cocoCategory{},
+		Annotations: []cocoAnnotation{},
+	}
+
+	imageIDs := map[primitive.ObjectID]int{}
+	for _, view := range orderedImages(patient.Images, images) {
+		id := len(dataset.Images) + 1
+		imageIDs[view.PatientImage.ID] = id
+		width, height := h.imageSize(ctx, view.PatientImage)
+		dataset.Images = append(dataset.Images, cocoImage{
+			ID:       id,
+			Width:    width,
+			Height:   height,
+			FileName: cocoFileName(view.PatientImage),
+		})
+	}
+
+	categoryIDs := map[string]int{}
+	for _, a := range annotations {
+		imageID, ok := imageIDs[a.ImageID]
+		if !ok {
+			continue
+		}
+		categoryID, ok := categoryIDs[a.Label]
+		if !ok {
+			categoryID = len(categoryIDs) + 1
+			categoryIDs[a.Label] = categoryID
+			dataset.Categories = append(dataset.Categories, cocoCategory{ID: categoryID, Name: a.Label, Supercategory: "finding"})
+		}
+
+		entry := cocoAnnotation{
+			ID:           len(dataset.Annotations) + 1,
+			ImageID:      imageID,
+			CategoryID:   categoryID,
+			Segmentation: [][]float64{},
+			BBox:         boundingBox(a.Points),
+			Attributes: cocoAttributes{
+				Type:         a.Type,
+				Text:         a.Text,
+				LengthPx:     a.LengthPx,
+				LengthMM:     a.LengthMM,
+				AreaMM2:      a.AreaMM2,
+				AnnotationID: a.AnnotationID.Hex(),
+				Version:      a.Version,
+				Author:       a.Author.Hex(),
+			},
+		}
+		if region := outline(a); region != nil {
+			entry.Segmentation = [][]float64{flatten(region)}
+			entry.BBox = boundingBox(region)
+			entry.Area = a.AreaPx
+		} else if a.Type != models.AnnotationText {
+			entry.Attributes.Keypoints = flatten(a.Points)
+		}
+		dataset.Annotations = append(dataset.Annotations, entry)
+	}
+
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="patient-%s-coco.json"`, patientID.Hex()))
+	return c.JSON(dataset)
+}
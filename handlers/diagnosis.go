@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/diagnosis"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// facultyRole may edit the diagnosis rules along with admins.
+const facultyRole = "Faculty of Dentistry"
+
+func canEditDiagnosisRules(user *models.User) bool {
+	return isAdmin(user) || strings.EqualFold(user.Role, facultyRole)
+}
+
+// EnsureDiagnosisIndexes makes rule set versions unique, so two saves based
+// on the same version can't both succeed.
+func (h *Handler) EnsureDiagnosisIndexes(ctx context.Context) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("diagnosis_rules")
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "version", Value: -1}},
+		Options: options.Index().SetName("version").SetUnique(true),
+	})
+	return err
+}
+
+// diagnosisRules loads the given version of the rules, or the one in use
+// when version is 0. The built-in rules are stored as version 1 the first
+// time they are needed.
+func (h *Handler) diagnosisRules(ctx context.Context, version int) (*models.DiagnosisRuleSet, error) {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("diagnosis_rules")
+
+	var rules models.DiagnosisRuleSet
+	if version > 0 {
+		if err := collection.FindOne(ctx, bson.M{"version": version}).Decode(&rules); err != nil {
+			return nil, err
+		}
+		return &rules, nil
+	}
+
+	opts := options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})
+	err := collection.FindOne(ctx, bson.M{}, opts).Decode(&rules)
+	if err != mongo.ErrNoDocuments {
+		if err != nil {
+			return nil, err
+		}
+		return &rules, nil
+	}
+
+	rules = diagnosis.Default()
+	rules.CreatedAt = time.Now()
+	_, err = collection.UpdateOne(ctx,
+		bson.M{"version": rules.Version},
+		bson.M{"$setOnInsert": rules},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+	return h.diagnosisRules(ctx, rules.Version)
+}
+
+// validateDiagnosisRules checks a rule set sent by a client and normalises
+// factor values to their stored spelling.
+func validateDiagnosisRules(rules *models.DiagnosisRuleSet) fieldErrors {
+	var errs fieldErrors
+	if len(rules.Diagnoses) == 0 {
+		errs.add("diagnoses", "At least one diagnosis is required")
+	}
+
+	known := map[string]bool{}
+	for _, field := range diagnosis.Fields {
+		known[field] = true
+	}
+
+	names := map[string]bool{}
+	for i := range rules.Diagnoses {
+		rule := &rules.Diagnoses[i]
+		path := fmt.Sprintf("diagnoses[%d]", i)
+		rule.Name = strings.TrimSpace(rule.Name)
+		if rule.Name == "" {
+			errs.add(path+".name", "Is required")
+		} else if names[strings.ToLower(rule.Name)] {
+			errs.add(path+".name", "Is used by another diagnosis")
+		}
+		names[strings.ToLower(rule.Name)] = true
+
+		for j := range rule.Factors {
+			factor := &rule.Factors[j]
+			path := fmt.Sprintf("%s.factors[%d]", path, j)
+			if strings.TrimSpace(factor.Label) == "" {
+				errs.add(path+".label", "Is required")
+			}
+
+			switch {
+			case !known[factor.Field]:
+				errs.add(path+".field", "Must be one of: "+strings.Join(diagnosis.Fields, ", "))
+			case factor.Field == "age":
+				if factor.Min == nil && factor.Max == nil {
+					errs.add(path, "Age factors need min, max or both")
+				}
+				if len(factor.Values) > 0 {
+					errs.add(path+".values", "Age factors use min and max")
+				}
+				for _, bound := range []*int{factor.Min, factor.Max} {
+					if bound != nil && (*bound < 0 || *bound > maxPatientAge) {
+						errs.add(path, "Age bounds must be between 0 and 120")
+					}
+				}
+				if factor.Min != nil && factor.Max != nil && *factor.Min > *factor.Max {
+					errs.add(path, "min must not be greater than max")
+				}
+			default:
+				if factor.Min != nil || factor.Max != nil {
+					errs.add(path, "Only age factors use min and max")
+				}
+				if len(factor.Values) == 0 {
+					errs.add(path+".values", "At least one value is required")
+				}
+				for k := range factor.Values {
+					if message := normaliseFactorValue(factor.Field, &factor.Values[k]); message != "" {
+						errs.add(fmt.Sprintf("%s.values[%d]", path, k), message)
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// normaliseFactorValue returns what is wrong with value for field, or
+// rewrites it to the stored spelling.
+func normaliseFactorValue(field string, value *string) string {
+	*value = strings.TrimSpace(*value)
+	if field == "paresthesia" {
+		v, err := strconv.ParseBool(*value)
+		if err != nil {
+			return "Must be true or false"
+		}
+		*value = strconv.FormatBool(v)
+		return ""
+	}
+	if field == "expansion" && *value == "" {
+		return "" // No expansion
+	}
+	for _, allowed := range patientEnums[field] {
+		if strings.EqualFold(*value, allowed) {
+			*value = allowed
+			return ""
+		}
+	}
+	return "Must be one of: " + strings.Join(patientEnums[field], ", ")
+}
+
+// GetDiagnosisRules ดูชุดกฎการวินิจฉัยแยกโรคที่ใช้อยู่
+func (h *Handler) GetDiagnosisRules(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rules, err := h.diagnosisRules(ctx, 0)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch diagnosis rules"})
+	}
+	return c.JSON(rules)
+}
+
+// GetDiagnosisRuleHistory ดูรายการทุกเวอร์ชันของชุดกฎ (ใคร เมื่อไร หมายเหตุ)
+func (h *Handler) GetDiagnosisRuleHistory(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := h.diagnosisRules(ctx, 0); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch diagnosis rules"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("diagnosis_rules")
+	opts := options.Find().
+		SetSort(bson.D{{Key: "version", Value: -1}}).
+		SetProjection(bson.M{"diagnoses": 0})
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch diagnosis rules"})
+	}
+	defer cursor.Close(ctx)
+
+	versions := []models.DiagnosisRuleSet{}
+	if err := cursor.All(ctx, &versions); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode diagnosis rules"})
+	}
+
+	return c.JSON(versions)
+}
+
+// GetDiagnosisRuleVersion ดูชุดกฎตามเวอร์ชันที่ระบุ
+func (h *Handler) GetDiagnosisRuleVersion(c *fiber.Ctx) error {
+	version, err := strconv.Atoi(c.Params("version"))
+	if err != nil || version < 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid version"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rules, err := h.diagnosisRules(ctx, version)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Version not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch diagnosis rules"})
+	}
+	return c.JSON(rules)
+}
+
+// SaveDiagnosisRules บันทึกชุดกฎใหม่เป็นเวอร์ชันถัดไป (คณาจารย์หรือ admin)
+func (h *Handler) SaveDiagnosisRules(c *fiber.Ctx) error {
+	var body struct {
+		BaseVersion int                    `json:"base_version"` // Version the edit started from
+		Note        string                 `json:"note"`
+		Diagnoses   []models.DiagnosisRule `json:"diagnoses"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !canEditDiagnosisRules(user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only faculty or admins can edit diagnosis rules"})
+	}
+
+	rules := models.DiagnosisRuleSet{
+		Note:      strings.TrimSpace(body.Note),
+		Diagnoses: body.Diagnoses,
+		CreatedBy: user.ID,
+		CreatedAt: time.Now(),
+	}
+	if errs := validateDiagnosisRules(&rules); len(errs) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid diagnosis rules", "fields": errs})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	current, err := h.diagnosisRules(ctx, 0)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch diagnosis rules"})
+	}
+	if body.BaseVersion != current.Version {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Rules were changed by someone else, please retry", "version": current.Version})
+	}
+
+	rules.Version = current.Version + 1
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("diagnosis_rules")
+	result, err := collection.InsertOne(ctx, rules)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Rules were changed by someone else, please retry"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot save diagnosis rules"})
+	}
+	rules.ID = result.InsertedID.(primitive.ObjectID)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Diagnosis rules saved successfully", "rules": rules})
+}
+
+// GetPatientDifferential จัดอันดับการวินิจฉัยแยกโรคของผู้ป่วยพร้อมปัจจัยที่มีผล (?version= เพื่อใช้กฎเวอร์ชันเก่า)
+func (h *Handler) GetPatientDifferential(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+	version, err := strconv.Atoi(c.Query("version", "0"))
+	if err != nil || version < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid version"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	patient, err := h.findPatient(ctx, patientID, user, false)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	rules, err := h.diagnosisRules(ctx, version)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Version not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch diagnosis rules"})
+	}
+
+	return c.JSON(fiber.Map{
+		"patient_id":    patient.ID,
+		"rules_version": rules.Version,
+		"candidates":    diagnosis.Rank(*rules, patient),
+		"disclaimer":    "Suggestions to support clinical and histopathological diagnosis, not a diagnosis",
+	})
+}
@@ -0,0 +1,750 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/imagehash"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/trash"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// minFeatureSimilarity is how alike the clinical fields of two patients must
+// be to count: every field the same, with the ages at most two years apart.
+// Few enough combinations exist that this alone only flags patients of the
+// same hospital; elsewhere it backs up a matching image.
+const minFeatureSimilarity = 0.9
+
+var duplicateStatuses = []string{models.DuplicateOpen, models.DuplicateMerged, models.DuplicateDismissed}
+
+// duplicateWindow reads DUPLICATE_WINDOW_DAYS (default 90), how far back
+// patients are compared on their clinical fields. Images are compared
+// against every stored image.
+func duplicateWindow() time.Duration {
+	days := 90
+	if v, err := strconv.Atoi(os.Getenv("DUPLICATE_WINDOW_DAYS")); err == nil && v > 0 {
+		days = v
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// duplicateImageDistance reads DUPLICATE_IMAGE_DISTANCE (default 6), the
+// most bits two perceptual hashes may differ in for the images to count as
+// the same. It can't go above what a band lookup is sure to find.
+func duplicateImageDistance() int {
+	limit := 64/imagehash.BandBits - 1
+	if v, err := strconv.Atoi(os.Getenv("DUPLICATE_IMAGE_DISTANCE")); err == nil && v >= 0 {
+		if v > limit {
+			return limit
+		}
+		return v
+	}
+	return 6
+}
+
+// EnsureDuplicateIndexes creates the indexes duplicate detection relies on.
+func (h *Handler) EnsureDuplicateIndexes(ctx context.Context) error {
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	if _, err := db.Collection("patient_images").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "phash_bands", Value: 1}},
+		Options: options.Index().SetName("phash_bands"),
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("patient_duplicates").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "patient_id", Value: 1}, {Key: "candidate_id", Value: 1}},
+			Options: options.Index().SetName("pair").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "candidate_id", Value: 1}},
+			Options: options.Index().SetName("candidate"),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "detected_at", Value: -1}},
+			Options: options.Index().SetName("status_detected"),
+		},
+	})
+	return err
+}
+
+// duplicateWarning tells a user about another record that may be the same
+// case. Records the user can't read are reported without their ID, hospital
+// or date, for an admin to review.
+type duplicateWarning struct {
+	DuplicateID       primitive.ObjectID  `json:"duplicate_id"` // Of the models.DuplicateCandidate
+	PatientID         *primitive.ObjectID `json:"patient_id,omitempty"`
+	Hospital          string              `json:"hospital,omitempty"`
+	CreatedAt         *time.Time          `json:"created_at,omitempty"`
+	FeatureSimilarity float64             `json:"feature_similarity,omitempty"`
+	ImageDistance     *int                `json:"image_distance,omitempty"`
+}
+
+// createdPatient is the response to CreatePatient.
+type createdPatient struct {
+	models.Patient
+	PossibleDuplicates []duplicateWarning `json:"possible_duplicates,omitempty"`
+}
+
+// uploadedImage is the response to UploadPatientImage.
+type uploadedImage struct {
+	patientImageView
+	PossibleDuplicates []duplicateWarning `json:"possible_duplicates,omitempty"`
+}
+
+// featureSimilarity compares the clinical fields of two patients, from 0
+// (nothing alike, or a different gender) to 1.
+func featureSimilarity(a, b *models.Patient) float64 {
+	if a.Gender != b.Gender {
+		return 0
+	}
+	score := 0.0
+	switch a.Age - b.Age {
+	case -1, 0, 1:
+		score++
+	case -2, 2:
+		score += 0.5
+	}
+	for _, same := range []bool{
+		a.DurationOfLesion == b.DurationOfLesion,
+		a.Expansion == b.Expansion,
+		a.Paresthesia == b.Paresthesia,
+		a.NumberOfLesions == b.NumberOfLesions,
+	} {
+		if same {
+			score++
+		}
+	}
+	return score / 5
+}
+
+// newerFirst orders two patient IDs by creation, newest first.
+func newerFirst(a, b primitive.ObjectID) (primitive.ObjectID, primitive.ObjectID) {
+	if bytes.Compare(a[:], b[:]) < 0 {
+		return b, a
+	}
+	return a, b
+}
+
+// featureDuplicates finds recent patients of the same hospital whose
+// clinical fields are close to those of patient.
+func (h *Handler) featureDuplicates(ctx context.Context, patient *models.Patient) ([]models.DuplicateCandidate, error) {
+	if patient.Hospital == "" {
+		return nil, nil
+	}
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	filter := trash.NotDeleted(bson.M{
+		"_id":       bson.M{"$ne": patient.ID},
+		"hospital":  patient.Hospital,
+		"gender":    patient.Gender,
+		"age":       bson.M{"$gte": patient.Age - 2, "$lte": patient.Age + 2},
+		"createdAt": bson.M{"$gte": time.Now().Add(-duplicateWindow())},
+	})
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(50)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var others []models.Patient
+	if err := cursor.All(ctx, &others); err != nil {
+		return nil, err
+	}
+
+	var candidates []models.DuplicateCandidate
+	for i := range others {
+		if similarity := featureSimilarity(patient, &others[i]); similarity >= minFeatureSimilarity {
+			candidates = append(candidates, models.DuplicateCandidate{
+				PatientID:         patient.ID,
+				CandidateID:       others[i].ID,
+				FeatureSimilarity: similarity,
+			})
+		}
+	}
+	return candidates, nil
+}
+
+// imageDuplicates finds patients with an image whose perceptual hash is close
+// to that of image, noting how alike their clinical fields are too.
+func (h *Handler) imageDuplicates(ctx context.Context, image *models.PatientImage) ([]models.DuplicateCandidate, error) {
+	if image.PHash == "" {
+		return nil, nil
+	}
+	hash, err := imagehash.Parse(image.PHash)
+	if err != nil {
+		return nil, err
+	}
+
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	cursor, err := db.Collection("patient_images").Find(ctx,
+		bson.M{"phash_bands": bson.M{"$in": image.PHashBands}, "patient_id": bson.M{"$ne": image.PatientID}},
+		options.Find().SetProjection(bson.M{"patient_id": 1, "phash": 1}).SetLimit(500),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var matches []models.PatientImage
+	if err := cursor.All(ctx, &matches); err != nil {
+		return nil, err
+	}
+
+	maxDistance := duplicateImageDistance()
+	closest := map[primitive.ObjectID]int{}
+	for _, match := range matches {
+		other, err := imagehash.Parse(match.PHash)
+		if err != nil {
+			continue
+		}
+		distance := imagehash.Distance(hash, other)
+		if best, ok := closest[match.PatientID]; distance <= maxDistance && (!ok || distance < best) {
+			closest[match.PatientID] = distance
+		}
+	}
+	if len(closest) == 0 {
+		return nil, nil
+	}
+
+	// Images stay with a patient in the recycle bin, which isn't a duplicate
+	ids := make([]primitive.ObjectID, 0, len(closest))
+	for id := range closest {
+		ids = append(ids, id)
+	}
+	var live []models.Patient
+	cursor, err = db.Collection("patients").Find(ctx, trash.NotDeleted(bson.M{"_id": bson.M{"$in": ids}}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &live); err != nil {
+		return nil, err
+	}
+	var patient models.Patient
+	if err := db.Collection("patients").FindOne(ctx, bson.M{"_id": image.PatientID}).Decode(&patient); err != nil {
+		return nil, err
+	}
+
+	candidates := make([]models.DuplicateCandidate, 0, len(live))
+	for i := range live {
+		distance := closest[live[i].ID]
+		candidate := models.DuplicateCandidate{
+			PatientID:     image.PatientID,
+			CandidateID:   live[i].ID,
+			ImageDistance: &distance,
+		}
+		if similarity := featureSimilarity(&patient, &live[i]); similarity >= minFeatureSimilarity {
+			candidate.FeatureSimilarity = similarity
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// flagDuplicates stores candidates, merging them into the flags already
+// raised for the same pair, and returns the flags that are still open.
+func (h *Handler) flagDuplicates(ctx context.Context, candidates []models.DuplicateCandidate) ([]models.DuplicateCandidate, error) {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_duplicates")
+	var open []models.DuplicateCandidate
+	for _, candidate := range candidates {
+		newer, older := newerFirst(candidate.PatientID, candidate.CandidateID)
+		update := bson.M{"$setOnInsert": bson.M{"status": models.DuplicateOpen, "detected_at": time.Now()}}
+		if candidate.FeatureSimilarity > 0 {
+			update["$max"] = bson.M{"feature_similarity": candidate.FeatureSimilarity}
+		}
+		if candidate.ImageDistance != nil {
+			update["$min"] = bson.M{"image_distance": *candidate.ImageDistance}
+		}
+
+		var flag models.DuplicateCandidate
+		err := collection.FindOneAndUpdate(ctx,
+			bson.M{"patient_id": newer, "candidate_id": older},
+			update,
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&flag)
+		if err != nil {
+			return open, err
+		}
+		if flag.Status == models.DuplicateOpen {
+			open = append(open, flag)
+		}
+	}
+	return open, nil
+}
+
+// duplicateWarnings describes the other patient of each flag raised on
+// patientID to user.
+func (h *Handler) duplicateWarnings(ctx context.Context, patientID primitive.ObjectID, flags []models.DuplicateCandidate, user *models.User) ([]duplicateWarning, error) {
+	if len(flags) == 0 {
+		return nil, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(flags))
+	for _, flag := range flags {
+		other := flag.CandidateID
+		if other == patientID {
+			other = flag.PatientID
+		}
+		ids = append(ids, other)
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "hospital": 1, "createdAt": 1})
+	cursor, err := collection.Find(ctx, trash.NotDeleted(bson.M{"_id": bson.M{"$in": ids}}), opts)
+	if err != nil {
+		return nil, err
+	}
+	var others []models.Patient
+	if err := cursor.All(ctx, &others); err != nil {
+		return nil, err
+	}
+	cursor, err = collection.Find(ctx, withPatientAccess(bson.M{"_id": bson.M{"$in": ids}}, user, false), opts)
+	if err != nil {
+		return nil, err
+	}
+	var readable []models.Patient
+	if err := cursor.All(ctx, &readable); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[primitive.ObjectID]models.Patient, len(others))
+	for _, other := range others {
+		byID[other.ID] = other
+	}
+	canRead := make(map[primitive.ObjectID]bool, len(readable))
+	for _, other := range readable {
+		canRead[other.ID] = true
+	}
+
+	var warnings []duplicateWarning
+	for i, flag := range flags {
+		other, ok := byID[ids[i]]
+		if !ok {
+			continue
+		}
+		warning := duplicateWarning{
+			DuplicateID:       flag.ID,
+			FeatureSimilarity: flag.FeatureSimilarity,
+			ImageDistance:     flag.ImageDistance,
+		}
+		if canRead[other.ID] {
+			id, createdAt := other.ID, other.CreatedAt
+			warning.PatientID, warning.Hospital, warning.CreatedAt = &id, other.Hospital, &createdAt
+		}
+		warnings = append(warnings, warning)
+	}
+	return warnings, nil
+}
+
+// detectPatientDuplicates flags the patients that look like patient and
+// returns the warnings for user. Detection is advisory: failures are logged
+// and leave the warnings out.
+func (h *Handler) detectPatientDuplicates(ctx context.Context, patient *models.Patient, user *models.User) []duplicateWarning {
+	candidates, err := h.featureDuplicates(ctx, patient)
+	if err == nil {
+		candidates, err = h.flagDuplicates(ctx, candidates)
+	}
+	var warnings []duplicateWarning
+	if err == nil {
+		warnings, err = h.duplicateWarnings(ctx, patient.ID, candidates, user)
+	}
+	if err != nil {
+		fmt.Printf("Error detecting duplicates of patient %s: %v\n", patient.ID.Hex(), err)
+	}
+	return warnings
+}
+
+// detectImageDuplicates does the same as detectPatientDuplicates for a new
+// image, comparing it with the images of other patients.
+func (h *Handler) detectImageDuplicates(ctx context.Context, image *models.PatientImage, user *models.User) []duplicateWarning {
+	candidates, err := h.imageDuplicates(ctx, image)
+	if err == nil {
+		candidates, err = h.flagDuplicates(ctx, candidates)
+	}
+	var warnings []duplicateWarning
+	if err == nil {
+		warnings, err = h.duplicateWarnings(ctx, image.PatientID, candidates, user)
+	}
+	if err != nil {
+		fmt.Printf("Error detecting duplicates of image %s: %v\n", image.ID.Hex(), err)
+	}
+	return warnings
+}
+
+// GetPatientDuplicates ดึงรายการผู้ป่วยที่อาจเป็นรายเดียวกันกับ :id ที่ยังไม่ได้ตรวจสอบ
+func (h *Handler) GetPatientDuplicates(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := h.findPatient(ctx, patientID, user, false); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_duplicates")
+	cursor, err := collection.Find(ctx, bson.M{
+		"status": models.DuplicateOpen,
+		"$or":    []bson.M{{"patient_id": patientID}, {"candidate_id": patientID}},
+	}, options.Find().SetSort(bson.D{{Key: "detected_at", Value: -1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch duplicates"})
+	}
+	var flags []models.DuplicateCandidate
+	if err := cursor.All(ctx, &flags); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode duplicates"})
+	}
+
+	warnings, err := h.duplicateWarnings(ctx, patientID, flags, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch duplicates"})
+	}
+	if warnings == nil {
+		warnings = []duplicateWarning{}
+	}
+	return c.JSON(warnings)
+}
+
+// AdminGetDuplicates ดึงรายการผู้ป่วยที่อาจซ้ำกัน (?status=open|merged|dismissed ค่าเริ่มต้น open) เรียงจากที่พบล่าสุด
+func (h *Handler) AdminGetDuplicates(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can review duplicates"})
+	}
+
+	status := c.Query("status", models.DuplicateOpen)
+	if !containsString(duplicateStatuses, status) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Status must be open, merged or dismissed"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_duplicates")
+	cursor, err := collection.Find(ctx, bson.M{"status": status}, options.Find().SetSort(bson.D{{Key: "detected_at", Value: -1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch duplicates"})
+	}
+	flags := []models.DuplicateCandidate{}
+	if err := cursor.All(ctx, &flags); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode duplicates"})
+	}
+	return c.JSON(flags)
+}
+
+// AdminDismissDuplicate ยืนยันว่าผู้ป่วยคู่นี้ไม่ใช่รายเดียวกัน (จะไม่แจ้งเตือนคู่นี้อีก)
+func (h *Handler) AdminDismissDuplicate(c *fiber.Ctx) error {
+	flagID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can review duplicates"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_duplicates")
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": flagID, "status": models.DuplicateOpen},
+		bson.M{"$set": bson.M{"status": models.DuplicateDismissed, "resolved_by": user.ID, "resolved_at": time.Now()}},
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot dismiss duplicate"})
+	}
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Open duplicate not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Duplicate dismissed successfully"})
+}
+
+// AdminMergePatients รวมผู้ป่วยที่ส่งซ้ำ (duplicate_id) เข้ากับผู้ป่วย :id: ภาพ คำอธิบายประกอบ ความยินยอม คำถาม และประวัติย้ายมาที่ :id ส่วนรายการซ้ำย้ายไปถังขยะ
+func (h *Handler) AdminMergePatients(c *fiber.Ctx) error {
+	targetID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+	var body struct {
+		DuplicateID string `json:"duplicate_id"` // Patient to merge into :id
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+	duplicateID, err := primitive.ObjectIDFromHex(body.DuplicateID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid duplicate_id"})
+	}
+	if duplicateID == targetID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "A patient cannot be merged into itself"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can merge patients"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	target, err := h.findPatient(ctx, targetID, user, true)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	// A merge that stopped halfway is finished by merging again
+	var duplicate models.Patient
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	err = collection.FindOne(ctx, bson.M{
+		"_id": duplicateID,
+		"$or": []bson.M{{"deleted_at": nil}, {"merged_into": targetID}},
+	}).Decode(&duplicate)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Duplicate patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	if err := h.mergePatient(ctx, target, &duplicate, user); err != nil {
+		if err == errPatientChanged {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient was changed by someone else, please retry"})
+		}
+		fmt.Printf("Error merging patient %s into %s: %v\n", duplicateID.Hex(), targetID.Hex(), err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot merge patients, please retry"})
+	}
+	fmt.Printf("Patient %s merged into %s by %s\n", duplicateID.Hex(), targetID.Hex(), user.ID.Hex())
+
+	if target, err = h.findPatient(ctx, targetID, user, false); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+	return c.JSON(fiber.Map{"message": "Patients merged successfully", "patient": target})
+}
+
+// mergePatient folds duplicate into target. The duplicate goes to the
+// recycle bin marked as merged, which keeps its revisions when it is purged;
+// its images, annotations, consents and questions move to target, and its
+// series, predictions, follow-ups and (if target has none) outcome are added
+// to target as a new revision. Every step can be repeated.
+func (h *Handler) mergePatient(ctx context.Context, target, duplicate *models.Patient, admin *models.User) error {
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	patients := db.Collection("patients")
+
+	if duplicate.MergedInto == nil {
+		if duplicate.Revision == 0 {
+			if err := h.recordBaseline(ctx, duplicate); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		filter := trash.NotDeleted(bson.M{"_id": duplicate.ID, "updatedAt": patientVersion(duplicate)})
+		next := *duplicate
+		next.DeletedAt, next.DeletedBy, next.MergedInto = &now, &admin.ID, &target.ID
+		next.UpdatedAt = now
+		next.Revision++
+		changes := []models.FieldChange{{Field: "merged_into", To: target.ID}}
+		err := h.recordRevision(ctx, &next, models.RevisionMerge, changes, admin.ID, nil, func() error {
+			result, err := patients.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+				"deleted_at":  now,
+				"deleted_by":  admin.ID,
+				"merged_into": target.ID,
+				"updatedAt":   now,
+				"revision":    next.Revision,
+			}})
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errPatientChanged
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		*duplicate = next
+	}
+
+	for _, name := range []string{"patient_images", "image_annotations", "patient_consents", "questions"} {
+		if _, err := db.Collection(name).UpdateMany(ctx,
+			bson.M{"patient_id": duplicate.ID},
+			bson.M{"$set": bson.M{"patient_id": target.ID}},
+		); err != nil {
+			return fmt.Errorf("cannot move %s: %w", name, err)
+		}
+	}
+	// Records merged into the duplicate before now lead to target
+	if _, err := patients.UpdateMany(ctx,
+		bson.M{"merged_into": duplicate.ID},
+		bson.M{"$set": bson.M{"merged_into": target.ID}},
+	); err != nil {
+		return err
+	}
+
+	for attempt := 0; !containsID(target.MergedFrom, duplicate.ID); attempt++ {
+		err := h.saveMergedPatient(ctx, target, duplicate, admin)
+		if err != errPatientChanged || attempt == 2 {
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if target, err = h.findPatient(ctx, target.ID, admin, true); err != nil {
+			return err
+		}
+	}
+	h.invalidatePatientStats(ctx)
+
+	if err := h.syncConsentScopes(ctx, target, admin); err != nil {
+		return err
+	}
+	return h.resolveMergedDuplicates(ctx, target.ID, duplicate.ID, admin.ID)
+}
+
+// saveMergedPatient adds what duplicate brings to target, provided nobody
+// changed target since it was read.
+func (h *Handler) saveMergedPatient(ctx context.Context, target, duplicate *models.Patient, admin *models.User) error {
+	if target.Revision == 0 {
+		if err := h.recordBaseline(ctx, target); err != nil {
+			return err
+		}
+	}
+
+	next := *target
+	next.UpdatedAt = time.Now()
+	next.Revision = target.Revision + 1
+	next.MergedFrom = append(append(append([]primitive.ObjectID{}, target.MergedFrom...), duplicate.ID), duplicate.MergedFrom...)
+	set := bson.M{"merged_from": next.MergedFrom, "updatedAt": next.UpdatedAt, "revision": next.Revision}
+
+	next.Images = append([]models.PatientImageEntry{}, target.Images...)
+	for _, entry := range duplicate.Images {
+		if !seriesHasImage(next.Images, entry.ImageID) {
+			next.Images = append(next.Images, entry)
+		}
+	}
+	if len(next.Images) > 0 {
+		next.ImageName = next.Images[0].ImageID.Hex()
+		set["images"], set["image_name"] = next.Images, next.ImageName
+	}
+	if len(duplicate.Predictions) > 0 {
+		next.Predictions = append(append([]models.ImagePrediction{}, target.Predictions...), duplicate.Predictions...)
+		set["predictions"] = next.Predictions
+	}
+	if len(duplicate.FollowUps) > 0 {
+		next.FollowUps = append(append([]models.FollowUp{}, target.FollowUps...), duplicate.FollowUps...)
+		sort.SliceStable(next.FollowUps, func(i, j int) bool { return next.FollowUps[i].Date.Before(next.FollowUps[j].Date) })
+		set["follow_ups"] = next.FollowUps
+	}
+	if next.Outcome == nil && duplicate.Outcome != nil {
+		next.Outcome = duplicate.Outcome
+		set["outcome"] = next.Outcome
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	filter := trash.NotDeleted(bson.M{"_id": target.ID, "updatedAt": patientVersion(target)})
+	changes := []models.FieldChange{{Field: "merged_from", To: duplicate.ID}}
+	err := h.recordRevision(ctx, &next, models.RevisionMerge, changes, admin.ID, nil, func() error {
+		result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errPatientChanged
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*target = next
+	return nil
+}
+
+// resolveMergedDuplicates closes the flags between target and the duplicate
+// merged into it, and moves the duplicate's other open flags to target.
+func (h *Handler) resolveMergedDuplicates(ctx context.Context, targetID, duplicateID, adminID primitive.ObjectID) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_duplicates")
+	newer, older := newerFirst(targetID, duplicateID)
+	if _, err := collection.UpdateMany(ctx,
+		bson.M{"patient_id": newer, "candidate_id": older, "status": models.DuplicateOpen},
+		bson.M{"$set": bson.M{"status": models.DuplicateMerged, "resolved_by": adminID, "resolved_at": time.Now()}},
+	); err != nil {
+		return err
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"status": models.DuplicateOpen,
+		"$or":    []bson.M{{"patient_id": duplicateID}, {"candidate_id": duplicateID}},
+	})
+	if err != nil {
+		return err
+	}
+	var flags []models.DuplicateCandidate
+	if err := cursor.All(ctx, &flags); err != nil {
+		return err
+	}
+	for _, flag := range flags {
+		other := flag.CandidateID
+		if other == duplicateID {
+			other = flag.PatientID
+		}
+		if other != targetID {
+			moved := models.DuplicateCandidate{PatientID: targetID, CandidateID: other, FeatureSimilarity: flag.FeatureSimilarity, ImageDistance: flag.ImageDistance}
+			if _, err := h.flagDuplicates(ctx, []models.DuplicateCandidate{moved}); err != nil {
+				return err
+			}
+		}
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": flag.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func seriesHasImage(series []models.PatientImageEntry, imageID primitive.ObjectID) bool {
+	for _, entry := range series {
+		if entry.ImageID == imageID {
+			return true
+		}
+	}
+	return false
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
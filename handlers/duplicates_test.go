@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/imagehash"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFeatureSimilarity(t *testing.T) {
+	base := models.Patient{
+		Age: 40, Gender: models.GenderMale, DurationOfLesion: models.DurationMonths,
+		Expansion: models.ExpansionBuccolingual, Paresthesia: false, NumberOfLesions: models.LesionsSingle,
+	}
+	tests := []struct {
+		name      string
+		change    func(p *models.Patient)
+		want      float64
+		duplicate bool
+	}{
+		{"same", func(p *models.Patient) {}, 1, true},
+		{"a year older", func(p *models.Patient) { p.Age++ }, 1, true},
+		{"two years younger", func(p *models.Patient) { p.Age -= 2 }, 0.9, true},
+		{"three years older", func(p *models.Patient) { p.Age += 3 }, 0.8, false},
+		{"other duration", func(p *models.Patient) { p.DurationOfLesion = models.DurationYears }, 0.8, false},
+		{"other expansion", func(p *models.Patient) { p.Expansion = models.ExpansionAnteroposterior }, 0.8, false},
+		{"paresthesia", func(p *models.Patient) { p.Paresthesia = true }, 0.8, false},
+		{"multiple lesions", func(p *models.Patient) { p.NumberOfLesions = models.LesionsMultiple }, 0.8, false},
+		{"other gender", func(p *models.Patient) { p.Gender = models.GenderFemale }, 0, false},
+		{"nothing alike", func(p *models.Patient) {
+			p.Age, p.DurationOfLesion, p.Expansion, p.Paresthesia, p.NumberOfLesions = 70, models.DurationWeeks, "", true, models.LesionsMultiple
+		}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := base
+			tt.change(&other)
+			got := featureSimilarity(&base, &other)
+			if got < tt.want-1e-9 || got > tt.want+1e-9 {
+				t.Errorf("featureSimilarity = %v, want %v", got, tt.want)
+			}
+			if reverse := featureSimilarity(&other, &base); reverse != got {
+				t.Errorf("featureSimilarity is %v one way and %v the other", got, reverse)
+			}
+			if duplicate := got >= minFeatureSimilarity; duplicate != tt.duplicate {
+				t.Errorf("flagged = %v, want %v", duplicate, tt.duplicate)
+			}
+		})
+	}
+}
+
+func TestDuplicateImageDistance(t *testing.T) {
+	limit := 64/imagehash.BandBits - 1
+	for value, want := range map[string]int{"": 6, "0": 0, "3": 3, "20": limit, "-1": 6, "six": 6} {
+		t.Setenv("DUPLICATE_IMAGE_DISTANCE", value)
+		if got := duplicateImageDistance(); got != want {
+			t.Errorf("DUPLICATE_IMAGE_DISTANCE=%q: %d, want %d", value, got, want)
+		}
+	}
+}
+
+// testRadiograph draws a small grayscale picture with a bright square at
+// (x, y) percent of its size over a gradient.
+func testRadiograph(x, y int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 128, 96))
+	square := image.Rect(x*128/100, y*96/100, x*128/100+24, y*96/100+24)
+	for py := 0; py < 96; py++ {
+		for px := 0; px < 128; px++ {
+			v := uint8(30 + px/2)
+			if image.Pt(px, py).In(square) {
+				v = 230
+			}
+			img.SetGray(px, py, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+// reexport saves img as a JPEG at half size, as a second upload of the same
+// film might be.
+func reexport(t *testing.T, img *image.Gray) image.Image {
+	t.Helper()
+	half := image.NewGray(image.Rect(0, 0, img.Rect.Dx()/2, img.Rect.Dy()/2))
+	for y := range half.Rect.Dy() {
+		for x := range half.Rect.Dx() {
+			half.SetGray(x, y, img.GrayAt(2*x, 2*y))
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, half, &jpeg.Options{Quality: 75}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+// sharesBand reports whether the band lookup imageDuplicates runs would find b
+// for a.
+func sharesBand(a, b uint64) bool {
+	bands := map[string]bool{}
+	for _, band := range imagehash.Bands(a) {
+		bands[band] = true
+	}
+	for _, band := range imagehash.Bands(b) {
+		if bands[band] {
+			return true
+		}
+	}
+	return false
+}
+
+func TestImageDistanceThreshold(t *testing.T) {
+	maxDistance := duplicateImageDistance()
+	original := testRadiograph(20, 30)
+	hash := imagehash.PHash(original)
+
+	same := imagehash.PHash(reexport(t, original))
+	if d := imagehash.Distance(hash, same); d > maxDistance || !sharesBand(hash, same) {
+		t.Errorf("re-exported image: distance %d (limit %d), shares a band = %v", d, maxDistance, sharesBand(hash, same))
+	}
+	for name, img := range map[string]image.Image{
+		"square elsewhere": testRadiograph(70, 60),
+		"no square":        testRadiograph(200, 200),
+	} {
+		if d := imagehash.Distance(hash, imagehash.PHash(img)); d <= maxDistance {
+			t.Errorf("%s: distance %d is within the limit of %d", name, d, maxDistance)
+		}
+	}
+}
+
+func TestImageDuplicates(t *testing.T) {
+	client, db := testDatabase(t)
+	ctx := context.Background()
+	h := NewHandler(client)
+
+	patient := func(age int, deleted bool) models.Patient {
+		p := models.Patient{
+			ID: primitive.NewObjectID(), Age: age, Gender: models.GenderFemale, DurationOfLesion: models.DurationMonths,
+			Expansion: models.ExpansionBuccolingual, NumberOfLesions: models.LesionsSingle, Hospital: "Siriraj", CreatedAt: time.Now(),
+		}
+		if deleted {
+			now := time.Now()
+			p.DeletedAt = &now
+		}
+		return p
+	}
+	uploader, twin, lookalike, stranger, binned := patient(40, false), patient(41, false), patient(65, false), patient(40, false), patient(40, true)
+	for _, p := range []models.Patient{uploader, twin, lookalike, stranger, binned} {
+		if _, err := db.Collection("patients").InsertOne(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	original := testRadiograph(20, 30)
+	stored := func(patientID primitive.ObjectID, img image.Image) models.PatientImage {
+		hash := imagehash.PHash(img)
+		return models.PatientImage{
+			ID: primitive.NewObjectID(), PatientID: patientID,
+			PHash: imagehash.Format(hash), PHashBands: imagehash.Bands(hash),
+		}
+	}
+	for _, img := range []models.PatientImage{
+		stored(twin.ID, reexport(t, original)),
+		stored(lookalike.ID, original),
+		stored(stranger.ID, testRadiograph(70, 60)),
+		stored(binned.ID, original),
+	} {
+		if _, err := db.Collection("patient_images").InsertOne(ctx, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upload := stored(uploader.ID, original)
+	candidates, err := h.imageDuplicates(ctx, &upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[primitive.ObjectID]models.DuplicateCandidate{}
+	for _, c := range candidates {
+		found[c.CandidateID] = c
+	}
+	if len(found) != 2 {
+		t.Errorf("candidates = %+v, want the twin and the lookalike", candidates)
+	}
+	if c, ok := found[twin.ID]; !ok || c.ImageDistance == nil || c.FeatureSimilarity != 1 {
+		t.Errorf("twin = %+v, want a close image and matching fields", c)
+	}
+	if c, ok := found[lookalike.ID]; !ok || c.ImageDistance == nil || *c.ImageDistance != 0 || c.FeatureSimilarity != 0 {
+		t.Errorf("lookalike = %+v, want the same image and no feature similarity", c)
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AdminGetEncryptionKeys ดึงรายการ data key ที่ใช้เข้ารหัสข้อมูลผู้ป่วย (ไม่รวมตัวกุญแจ)
+func (h *Handler) AdminGetEncryptionKeys(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can list encryption keys"})
+	}
+	if h.keyring == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Field encryption is not configured"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	keys, err := h.keyring.Keys(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch encryption keys"})
+	}
+	return c.JSON(keys)
+}
+
+// AdminRotateEncryptionKey สร้าง data key ใหม่ ข้อมูลเดิมจะถูกเข้ารหัสใหม่ในเบื้องหลัง
+func (h *Handler) AdminRotateEncryptionKey(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can rotate encryption keys"})
+	}
+	if h.keyring == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Field encryption is not configured"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key, err := h.keyring.Rotate(ctx)
+	if err != nil {
+		fmt.Printf("Error rotating data key: %v\n", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot rotate encryption key"})
+	}
+	fmt.Printf("Data key %s created by %s\n", key.ID.Hex(), user.ID.Hex())
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Encryption key rotated, existing data is being re-encrypted", "key": key})
+}
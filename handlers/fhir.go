@@ -0,0 +1,870 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/fhir"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultFHIRCount = 50
+	maxFHIRCount     = 200
+)
+
+// fhirBaseURL is FHIR_BASE_URL, or /fhir on the URL the request came in on.
+func fhirBaseURL(c *fiber.Ctx) string {
+	if base := os.Getenv("FHIR_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return c.BaseURL() + "/fhir"
+}
+
+// sendFHIR writes a resource as application/fhir+json.
+func sendFHIR(c *fiber.Ctx, status int, resource interface{}) error {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot encode resource"})
+	}
+	c.Set(fiber.HeaderContentType, fhir.ContentType+"; charset=utf-8")
+	return c.Status(status).Send(data)
+}
+
+// fhirError answers with an OperationOutcome, as FHIR clients expect.
+func fhirError(c *fiber.Ctx, status int, code, diagnostics string) error {
+	return sendFHIR(c, status, fhir.Outcome(fhir.Issue{Severity: fhir.SeverityError, Code: code, Diagnostics: diagnostics}))
+}
+
+func fhirParamIssue(param, message string) fhir.Issue {
+	return fhir.Issue{Severity: fhir.SeverityError, Code: fhir.IssueInvalid, Diagnostics: fmt.Sprintf("%s: %s", param, message)}
+}
+
+// fhirPaging reads _count and _offset.
+func fhirPaging(c *fiber.Ctx) (offset, count int, issues []fhir.Issue) {
+	count = defaultFHIRCount
+	if raw := c.Query("_count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			issues = append(issues, fhirParamIssue("_count", "Must be a whole number"))
+		} else if n < maxFHIRCount {
+			count = n
+		} else {
+			count = maxFHIRCount
+		}
+	}
+	if raw := c.Query("_offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			issues = append(issues, fhirParamIssue("_offset", "Must be a whole number"))
+		}
+		offset = n
+	}
+	return offset, count, issues
+}
+
+// searchBundle wraps one page of matches, with links to its neighbours.
+func searchBundle(c *fiber.Ctx, total, offset, count int, entries []fhir.BundleEntry) fhir.Bundle {
+	base := fhirBaseURL(c)
+	page := func(offset int) string {
+		query, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+		query.Set("_offset", strconv.Itoa(offset))
+		query.Set("_count", strconv.Itoa(count))
+		return base + strings.TrimPrefix(c.Path(), "/fhir") + "?" + query.Encode()
+	}
+
+	for i := range entries {
+		entries[i].Search = &fhir.EntrySearch{Mode: "match"}
+	}
+	bundle := fhir.Bundle{
+		ResourceType: "Bundle",
+		Type:         "searchset",
+		Total:        &total,
+		Link:         []fhir.BundleLink{{Relation: "self", URL: page(offset)}},
+		Entry:        entries,
+	}
+	if count > 0 && offset+count < total {
+		bundle.Link = append(bundle.Link, fhir.BundleLink{Relation: "next", URL: page(offset + count)})
+	}
+	if offset > 0 {
+		previous := offset - count
+		if previous < 0 {
+			previous = 0
+		}
+		bundle.Link = append(bundle.Link, fhir.BundleLink{Relation: "previous", URL: page(previous)})
+	}
+	return bundle
+}
+
+// pageBounds returns the part of a list of n matches, searched in memory,
+// that is on the requested page.
+func pageBounds(n, offset, count int) (start, end int) {
+	start, end = offset, offset+count
+	if start > n {
+		start = n
+	}
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// appendEntry wraps a resource for a Bundle.
+func appendEntry(c *fiber.Ctx, entries []fhir.BundleEntry, resourceType, id string, resource interface{}) ([]fhir.BundleEntry, error) {
+	entry, err := fhir.Entry(fhirBaseURL(c)+"/"+resourceType+"/"+id, resource)
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, entry), nil
+}
+
+// fhirPatientParam reads the patient (or subject) search parameter: a
+// comma-separated list of ids or Patient/id references.
+func fhirPatientParam(c *fiber.Ctx) ([]primitive.ObjectID, *fhir.Issue) {
+	raw := c.Query("patient", c.Query("subject"))
+	if raw == "" {
+		issue := fhir.Issue{Severity: fhir.SeverityError, Code: fhir.IssueTooCostly, Diagnostics: "Search by patient (or subject) is required"}
+		return nil, &issue
+	}
+	var ids []primitive.ObjectID
+	for _, value := range strings.Split(raw, ",") {
+		id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(strings.TrimSpace(value), "Patient/"))
+		if err != nil {
+			issue := fhirParamIssue("patient", fmt.Sprintf("%q is not a patient id", value))
+			return nil, &issue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// fhirPatients loads the given patients the user may read, in id order.
+func (h *Handler) fhirPatients(ctx context.Context, user *models.User, ids []primitive.ObjectID) ([]models.Patient, error) {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	cursor, err := collection.Find(ctx,
+		withPatientAccess(bson.M{"_id": bson.M{"$in": ids}}, user, false),
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var patients []models.Patient
+	err = cursor.All(ctx, &patients)
+	return patients, err
+}
+
+// fhirImages returns the images of each patient in series order, with
+// signed download URLs.
+func (h *Handler) fhirImages(ctx context.Context, c *fiber.Ctx, patients []models.Patient) (map[primitive.ObjectID][]fhir.Image, error) {
+	ids := make([]primitive.ObjectID, len(patients))
+	for i, patient := range patients {
+		ids[i] = patient.ID
+	}
+	cursor, err := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images").Find(ctx,
+		bson.M{"patient_id": bson.M{"$in": ids}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var images []models.PatientImage
+	if err := cursor.All(ctx, &images); err != nil {
+		return nil, err
+	}
+	byPatient := map[primitive.ObjectID][]models.PatientImage{}
+	for _, img := range images {
+		byPatient[img.PatientID] = append(byPatient[img.PatientID], img)
+	}
+
+	out := map[primitive.ObjectID][]fhir.Image{}
+	for _, patient := range patients {
+		for _, view := range orderedImages(patient.Images, byPatient[patient.ID]) {
+			path, _ := signedFileURL(view.ID, "")
+			out[patient.ID] = append(out[patient.ID], fhir.Image{
+				PatientImage: view.PatientImage,
+				Entry:        view.PatientImageEntry,
+				URL:          c.BaseURL() + path,
+			})
+		}
+	}
+	return out, nil
+}
+
+// fhirFindPatient reads one patient for a FHIR read, answering 404 and other
+// failures itself (it then returns nil).
+func (h *Handler) fhirFindPatient(ctx context.Context, c *fiber.Ctx, user *models.User, rawID string) (*models.Patient, error) {
+	id, err := primitive.ObjectIDFromHex(rawID)
+	if err != nil {
+		return nil, fhirError(c, fiber.StatusNotFound, fhir.IssueNotFound, "Resource not found")
+	}
+	patient, err := h.findPatient(ctx, id, user, false)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fhirError(c, fiber.StatusNotFound, fhir.IssueNotFound, "Resource not found")
+		}
+		return nil, fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch patient")
+	}
+	return patient, nil
+}
+
+// fhirSearchParams lists the search parameters of each resource type.
+var fhirSearchParams = []struct {
+	resourceType string
+	params       [][2]string // Name and type
+}{
+	{"Patient", [][2]string{{"_id", "token"}, {"identifier", "token"}, {"gender", "token"}, {"_lastUpdated", "date"}}},
+	{"Observation", [][2]string{{"patient", "reference"}, {"subject", "reference"}, {"code", "token"}}},
+	{"ImagingStudy", [][2]string{{"patient", "reference"}, {"subject", "reference"}}},
+	{"Media", [][2]string{{"patient", "reference"}, {"subject", "reference"}}},
+}
+
+// FHIRMetadata อธิบายความสามารถของ FHIR API (CapabilityStatement)
+func (h *Handler) FHIRMetadata(c *fiber.Ctx) error {
+	var resources []fiber.Map
+	for _, r := range fhirSearchParams {
+		var params []fiber.Map
+		for _, p := range r.params {
+			params = append(params, fiber.Map{"name": p[0], "type": p[1]})
+		}
+		profile, _ := fhir.Profile(r.resourceType)
+		resources = append(resources, fiber.Map{
+			"type":        r.resourceType,
+			"profile":     profile,
+			"interaction": []fiber.Map{{"code": "read"}, {"code": "search-type"}},
+			"searchParam": params,
+			"operation":   []fiber.Map{{"name": "validate", "definition": "http://hl7.org/fhir/OperationDefinition/Resource-validate"}},
+		})
+	}
+	consent, _ := fhir.Profile("Consent")
+
+	return sendFHIR(c, fiber.StatusOK, fiber.Map{
+		"resourceType": "CapabilityStatement",
+		"status":       "active",
+		"date":         time.Now().UTC().Format("2006-01-02"),
+		"kind":         "instance",
+		"fhirVersion":  "4.0.1",
+		"format":       []string{"json"},
+		"implementation": fiber.Map{
+			"description": "Oral lesion cases (read-only; patients are imported as bundles)",
+			"url":         fhirBaseURL(c),
+		},
+		"rest": []fiber.Map{{
+			"mode": "server",
+			"documentation": "Bundles for POST / are transaction or batch bundles of Patient, Observation and Consent (" +
+				consent + ") resources. Each patient needs an active Consent.",
+			"security":    fiber.Map{"description": "Bearer token from POST /login"},
+			"resource":    resources,
+			"interaction": []fiber.Map{{"code": "transaction"}, {"code": "batch"}},
+		}},
+	})
+}
+
+// FHIRGetStructureDefinition ดึง profile ที่ใช้ตรวจสอบข้อมูล FHIR
+func (h *Handler) FHIRGetStructureDefinition(c *fiber.Ctx) error {
+	return fhirDefinition(c, "StructureDefinition")
+}
+
+// FHIRGetValueSet ดึงชุดรหัสที่ใช้ตรวจสอบข้อมูล FHIR
+func (h *Handler) FHIRGetValueSet(c *fiber.Ctx) error {
+	return fhirDefinition(c, "ValueSet")
+}
+
+func fhirDefinition(c *fiber.Ctx, resourceType string) error {
+	data, ok := fhir.Definition(resourceType, c.Params("id"))
+	if !ok {
+		return fhirError(c, fiber.StatusNotFound, fhir.IssueNotFound, "Resource not found")
+	}
+	c.Set(fiber.HeaderContentType, fhir.ContentType+"; charset=utf-8")
+	return c.Send(data)
+}
+
+// FHIRReadPatient ดึงผู้ป่วยเป็น FHIR Patient
+func (h *Handler) FHIRReadPatient(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	patient, err := h.fhirFindPatient(ctx, c, user, c.Params("id"))
+	if patient == nil {
+		return err
+	}
+	return sendFHIR(c, fiber.StatusOK, fhir.ToPatient(patient))
+}
+
+// fhirDatePrefixes are the comparisons of date search parameters.
+var fhirDatePrefixes = map[string]string{"eq": "$eq", "ge": "$gte", "gt": "$gt", "le": "$lte", "lt": "$lt"}
+
+// FHIRSearchPatients ค้นหาผู้ป่วยที่มีสิทธิ์เข้าถึง (_id, identifier, gender, _lastUpdated)
+func (h *Handler) FHIRSearchPatients(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+
+	offset, count, issues := fhirPaging(c)
+	filter := bson.M{}
+
+	var ids []primitive.ObjectID
+	for _, param := range []string{"_id", "identifier"} {
+		raw := c.Query(param)
+		if raw == "" {
+			continue
+		}
+		for _, value := range strings.Split(raw, ",") {
+			if param == "identifier" {
+				system, code, hasSystem := strings.Cut(value, "|")
+				if hasSystem && system != fhir.PatientIDSystem {
+					// Identifiers of other systems aren't stored, so nothing matches
+					code = ""
+				} else if !hasSystem {
+					code = system
+				}
+				value = code
+			}
+			id, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				id = primitive.NilObjectID
+			}
+			ids = append(ids, id)
+		}
+	}
+	if ids != nil {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+
+	if raw := c.Query("gender"); raw != "" {
+		var genders []string
+		for _, value := range strings.Split(raw, ",") {
+			switch value {
+			case "male":
+				genders = append(genders, models.GenderMale)
+			case "female":
+				genders = append(genders, models.GenderFemale)
+			case "other", "unknown":
+			default:
+				issues = append(issues, fhirParamIssue("gender", "Must be male, female, other or unknown"))
+			}
+		}
+		filter["gender"] = bson.M{"$in": genders}
+	}
+
+	updated := bson.M{}
+	for _, raw := range c.Context().QueryArgs().PeekMulti("_lastUpdated") {
+		value, op := string(raw), "$eq"
+		if len(value) > 2 {
+			if prefixed, ok := fhirDatePrefixes[value[:2]]; ok {
+				value, op = value[2:], prefixed
+			}
+		}
+		at, err := parseAcquiredAt(value)
+		if err != nil {
+			issues = append(issues, fhirParamIssue("_lastUpdated", "Must be a date or dateTime, optionally prefixed with ge, gt, le, lt or eq"))
+			continue
+		}
+		if op == "$eq" && len(value) == len("2006-01-02") {
+			// A date is a whole day
+			updated["$gte"], updated["$lt"] = *at, at.AddDate(0, 0, 1)
+			continue
+		}
+		updated[op] = *at
+	}
+	if len(updated) > 0 {
+		filter["updatedAt"] = updated
+	}
+
+	if len(issues) > 0 {
+		return sendFHIR(c, fiber.StatusBadRequest, fhir.Outcome(issues...))
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter = withPatientAccess(filter, user, false)
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot count patients")
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(count)),
+	)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch patients")
+	}
+	var patients []models.Patient
+	if err := cursor.All(ctx, &patients); err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot decode patients")
+	}
+
+	var entries []fhir.BundleEntry
+	for i := range patients {
+		entries, err = appendEntry(c, entries, "Patient", patients[i].ID.Hex(), fhir.ToPatient(&patients[i]))
+		if err != nil {
+			return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot encode patients")
+		}
+	}
+	return sendFHIR(c, fiber.StatusOK, searchBundle(c, int(total), offset, count, entries))
+}
+
+// FHIRReadObservation ดึงข้อมูลทางคลินิกหนึ่งรายการของผู้ป่วยเป็น FHIR Observation
+func (h *Handler) FHIRReadObservation(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	patientID, _, _ := fhir.ParseObservationID(c.Params("id"))
+	patient, err := h.fhirFindPatient(ctx, c, user, patientID)
+	if patient == nil {
+		return err
+	}
+	for _, observation := range fhir.ToObservations(patient) {
+		if observation.ID == c.Params("id") {
+			return sendFHIR(c, fiber.StatusOK, observation)
+		}
+	}
+	return fhirError(c, fiber.StatusNotFound, fhir.IssueNotFound, "Resource not found")
+}
+
+// FHIRSearchObservations ค้นหาข้อมูลทางคลินิกของผู้ป่วย (patient จำเป็น, code)
+func (h *Handler) FHIRSearchObservations(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+
+	offset, count, issues := fhirPaging(c)
+	ids, issue := fhirPatientParam(c)
+	if issue != nil {
+		issues = append(issues, *issue)
+	}
+	if len(issues) > 0 {
+		return sendFHIR(c, fiber.StatusBadRequest, fhir.Outcome(issues...))
+	}
+
+	var codes []string
+	if raw := c.Query("code"); raw != "" {
+		codes = strings.Split(raw, ",")
+	}
+	matches := func(o fhir.Observation) bool {
+		if codes == nil {
+			return true
+		}
+		for _, token := range codes {
+			system, code, hasSystem := strings.Cut(token, "|")
+			for _, coding := range o.Code.Coding {
+				if hasSystem && (system == "" || coding.System == system) && coding.Code == code || !hasSystem && coding.Code == system {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	patients, err := h.fhirPatients(ctx, user, ids)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch patients")
+	}
+
+	var observations []fhir.Observation
+	for i := range patients {
+		for _, observation := range fhir.ToObservations(&patients[i]) {
+			if matches(observation) {
+				observations = append(observations, observation)
+			}
+		}
+	}
+	var entries []fhir.BundleEntry
+	start, end := pageBounds(len(observations), offset, count)
+	for _, observation := range observations[start:end] {
+		entries, err = appendEntry(c, entries, "Observation", observation.ID, observation)
+		if err != nil {
+			return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot encode observations")
+		}
+	}
+	return sendFHIR(c, fiber.StatusOK, searchBundle(c, len(observations), offset, count, entries))
+}
+
+// FHIRReadImagingStudy ดึงชุดภาพของผู้ป่วยเป็น FHIR ImagingStudy (id เดียวกับผู้ป่วย)
+func (h *Handler) FHIRReadImagingStudy(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	patient, err := h.fhirFindPatient(ctx, c, user, c.Params("id"))
+	if patient == nil {
+		return err
+	}
+	images, err := h.fhirImages(ctx, c, []models.Patient{*patient})
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch images")
+	}
+	study := fhir.ToImagingStudy(patient, images[patient.ID])
+	if study == nil {
+		return fhirError(c, fiber.StatusNotFound, fhir.IssueNotFound, "Resource not found")
+	}
+	return sendFHIR(c, fiber.StatusOK, study)
+}
+
+// FHIRSearchImagingStudies ค้นหาชุดภาพของผู้ป่วย (patient จำเป็น)
+func (h *Handler) FHIRSearchImagingStudies(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+
+	offset, count, issues := fhirPaging(c)
+	ids, issue := fhirPatientParam(c)
+	if issue != nil {
+		issues = append(issues, *issue)
+	}
+	if len(issues) > 0 {
+		return sendFHIR(c, fiber.StatusBadRequest, fhir.Outcome(issues...))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	patients, err := h.fhirPatients(ctx, user, ids)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch patients")
+	}
+	images, err := h.fhirImages(ctx, c, patients)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch images")
+	}
+
+	var studies []*fhir.ImagingStudy
+	for i := range patients {
+		if study := fhir.ToImagingStudy(&patients[i], images[patients[i].ID]); study != nil {
+			studies = append(studies, study)
+		}
+	}
+	var entries []fhir.BundleEntry
+	start, end := pageBounds(len(studies), offset, count)
+	for _, study := range studies[start:end] {
+		entries, err = appendEntry(c, entries, "ImagingStudy", study.ID, study)
+		if err != nil {
+			return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot encode imaging studies")
+		}
+	}
+	return sendFHIR(c, fiber.StatusOK, searchBundle(c, len(studies), offset, count, entries))
+}
+
+// FHIRReadMedia ดึงภาพหนึ่งภาพเป็น FHIR Media พร้อมลิงก์ดาวน์โหลดชั่วคราว
+func (h *Handler) FHIRReadMedia(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+	imageID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fhirError(c, fiber.StatusNotFound, fhir.IssueNotFound, "Resource not found")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var img models.PatientImage
+	err = h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images").FindOne(ctx, bson.M{"_id": imageID}).Decode(&img)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fhirError(c, fiber.StatusNotFound, fhir.IssueNotFound, "Resource not found")
+		}
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch image")
+	}
+	patient, err := h.fhirFindPatient(ctx, c, user, img.PatientID.Hex())
+	if patient == nil {
+		return err
+	}
+	images, err := h.fhirImages(ctx, c, []models.Patient{*patient})
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch images")
+	}
+	for _, image := range images[patient.ID] {
+		if image.ID == imageID {
+			return sendFHIR(c, fiber.StatusOK, fhir.ToMedia(patient, image))
+		}
+	}
+	return fhirError(c, fiber.StatusNotFound, fhir.IssueNotFound, "Resource not found")
+}
+
+// FHIRSearchMedia ค้นหาภาพของผู้ป่วย (patient จำเป็น)
+func (h *Handler) FHIRSearchMedia(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+
+	offset, count, issues := fhirPaging(c)
+	ids, issue := fhirPatientParam(c)
+	if issue != nil {
+		issues = append(issues, *issue)
+	}
+	if len(issues) > 0 {
+		return sendFHIR(c, fiber.StatusBadRequest, fhir.Outcome(issues...))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	patients, err := h.fhirPatients(ctx, user, ids)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch patients")
+	}
+	images, err := h.fhirImages(ctx, c, patients)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot fetch images")
+	}
+
+	var media []fhir.Media
+	for i := range patients {
+		for _, image := range images[patients[i].ID] {
+			media = append(media, fhir.ToMedia(&patients[i], image))
+		}
+	}
+	var entries []fhir.BundleEntry
+	start, end := pageBounds(len(media), offset, count)
+	for _, m := range media[start:end] {
+		entries, err = appendEntry(c, entries, "Media", m.ID, m)
+		if err != nil {
+			return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot encode media")
+		}
+	}
+	return sendFHIR(c, fiber.StatusOK, searchBundle(c, len(media), offset, count, entries))
+}
+
+// FHIRValidate ตรวจสอบ resource กับ profile ของระบบโดยไม่บันทึก ($validate)
+func (h *Handler) FHIRValidate(c *fiber.Ctx) error {
+	body := c.Body()
+
+	// The resource may come wrapped in Parameters
+	var parameters struct {
+		ResourceType string `json:"resourceType"`
+		Parameter    []struct {
+			Name     string          `json:"name"`
+			Resource json.RawMessage `json:"resource"`
+		} `json:"parameter"`
+	}
+	if err := json.Unmarshal(body, &parameters); err != nil {
+		return fhirError(c, fiber.StatusBadRequest, fhir.IssueStructure, "Cannot parse JSON")
+	}
+	if parameters.ResourceType == "Parameters" {
+		body = nil
+		for _, p := range parameters.Parameter {
+			if p.Name == "resource" {
+				body = p.Resource
+			}
+		}
+		if body == nil {
+			return fhirError(c, fiber.StatusBadRequest, fhir.IssueRequired, "Parameters has no resource")
+		}
+	}
+
+	var header struct {
+		ResourceType string `json:"resourceType"`
+	}
+	json.Unmarshal(body, &header)
+	if header.ResourceType != c.Params("type") {
+		return fhirError(c, fiber.StatusBadRequest, fhir.IssueInvalid, fmt.Sprintf("Expected a %s resource", c.Params("type")))
+	}
+	return sendFHIR(c, fiber.StatusOK, fhir.Outcome(fhir.Validate(body)...))
+}
+
+// issuesAt returns the issues whose expression points into one bundle entry.
+func issuesAt(issues []fhir.Issue, entry int) []fhir.Issue {
+	prefix := fmt.Sprintf("Bundle.entry[%d]", entry)
+	var out []fhir.Issue
+	for _, issue := range issues {
+		for _, expression := range issue.Expression {
+			if expression == prefix || strings.HasPrefix(expression, prefix+".") {
+				out = append(out, issue)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// FHIRImportBundle นำเข้าผู้ป่วยจาก FHIR Bundle (transaction ทั้งหมดหรือไม่มีเลย, batch ทีละราย; นับโควต้า)
+func (h *Handler) FHIRImportBundle(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return fhirError(c, fiber.StatusUnauthorized, fhir.IssueLogin, "Invalid token claims")
+	}
+
+	var bundle fhir.Bundle
+	if err := json.Unmarshal(c.Body(), &bundle); err != nil {
+		return fhirError(c, fiber.StatusBadRequest, fhir.IssueStructure, "Cannot parse JSON")
+	}
+
+	if bundle.Type != "transaction" && bundle.Type != "batch" {
+		return fhirError(c, fiber.StatusBadRequest, fhir.IssueNotSupported, "Bundle type must be transaction or batch")
+	}
+
+	imported, issues := fhir.Import(&bundle, time.Now())
+	failed := fhir.HasErrors(issues)
+	for i := range imported {
+		record := &imported[i]
+		for _, e := range validatePatient(&record.Patient) {
+			// Consent problems are already reported in FHIR terms
+			if e.Field == "confirm" {
+				continue
+			}
+			record.Issues = append(record.Issues, fhir.Issue{
+				Severity:    fhir.SeverityError,
+				Code:        fhir.IssueInvalid,
+				Diagnostics: fmt.Sprintf("%s: %s", e.Field, e.Message),
+				Expression:  []string{fmt.Sprintf("Bundle.entry[%d]", record.Entry)},
+			})
+		}
+		if fhir.HasErrors(record.Issues) {
+			failed = true
+		}
+	}
+
+	if len(imported) == 0 && !failed {
+		return fhirError(c, fiber.StatusBadRequest, fhir.IssueRequired, "Bundle has no Patient")
+	}
+	if failed && bundle.Type == "transaction" {
+		for _, record := range imported {
+			issues = append(issues, record.Issues...)
+		}
+		return sendFHIR(c, fiber.StatusUnprocessableEntity, fhir.Outcome(issues...))
+	}
+
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	responses := make([]fhir.BundleEntry, len(bundle.Entry))
+	for i := range responses {
+		responses[i].Response = &fhir.EntryResponse{Status: "400 Bad Request", Outcome: fhir.Outcome(issuesAt(issues, i)...)}
+	}
+
+	var stored []*models.Patient
+	remove := func(patient *models.Patient) {
+		db.Collection("patients").DeleteOne(ctx, bson.M{"_id": patient.ID})
+		db.Collection("patient_revisions").DeleteMany(ctx, bson.M{"patient_id": patient.ID})
+		db.Collection("patient_consents").DeleteMany(ctx, bson.M{"patient_id": patient.ID})
+		h.releaseQuota(ctx, user.ID, usagePatients)
+	}
+	// undo removes what a failed transaction stored so far
+	undo := func() {
+		for _, patient := range stored {
+			remove(patient)
+		}
+		if len(stored) > 0 {
+			h.invalidatePatientStats(ctx)
+		}
+	}
+
+	for i := range imported {
+		record := &imported[i]
+		entries := append([]int{record.Entry}, record.Related...)
+		if fhir.HasErrors(record.Issues) {
+			for _, entry := range entries {
+				responses[entry].Response = &fhir.EntryResponse{Status: "422 Unprocessable Entity", Outcome: fhir.Outcome(record.Issues...)}
+			}
+			continue
+		}
+
+		patient := &record.Patient
+		newPatient(patient, user)
+
+		if err := h.reserveQuota(ctx, user.ID, usagePatients); err != nil {
+			code, message := fiber.StatusInternalServerError, "Cannot check quota"
+			if err == errQuotaExceeded {
+				code, message = fiber.StatusTooManyRequests, "Monthly quota exceeded for your package"
+			}
+			status := fmt.Sprintf("%d %s", code, http.StatusText(code))
+			if bundle.Type == "transaction" {
+				undo()
+				return fhirError(c, code, fhir.IssueTooCostly, message)
+			}
+			for _, entry := range entries {
+				responses[entry].Response = &fhir.EntryResponse{Status: status, Outcome: fhir.Outcome(fhir.Issue{Severity: fhir.SeverityError, Code: fhir.IssueTooCostly, Diagnostics: message})}
+			}
+			continue
+		}
+
+		patient.ID = primitive.NewObjectID()
+		err := h.recordRevision(ctx, patient, models.RevisionCreate, nil, user.ID, nil, func() error {
+			_, err := db.Collection("patients").InsertOne(ctx, patient)
+			return err
+		})
+		if err != nil {
+			h.releaseQuota(ctx, user.ID, usagePatients)
+			if bundle.Type == "transaction" {
+				undo()
+				return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot insert patient")
+			}
+			for _, entry := range entries {
+				responses[entry].Response = &fhir.EntryResponse{Status: "500 Internal Server Error", Outcome: fhir.Outcome(fhir.Issue{Severity: fhir.SeverityError, Code: fhir.IssueException, Diagnostics: "Cannot insert patient"})}
+			}
+			continue
+		}
+		stored = append(stored, patient)
+
+		if err := h.storeImportedConsents(ctx, patient, record.Consents, user); err != nil {
+			fmt.Printf("Error storing consents of patient %s: %v\n", patient.ID.Hex(), err)
+			if bundle.Type == "transaction" {
+				undo()
+				return fhirError(c, fiber.StatusInternalServerError, fhir.IssueException, "Cannot store consents")
+			}
+			remove(patient)
+			stored = stored[:len(stored)-1]
+			for _, entry := range entries {
+				responses[entry].Response = &fhir.EntryResponse{Status: "500 Internal Server Error", Outcome: fhir.Outcome(fhir.Issue{Severity: fhir.SeverityError, Code: fhir.IssueException, Diagnostics: "Cannot store consents"})}
+			}
+			continue
+		}
+
+		responses[record.Entry].Response = &fhir.EntryResponse{Status: "201 Created", Location: fmt.Sprintf("Patient/%s/_history/%d", patient.ID.Hex(), patient.Revision)}
+		observations := map[string]string{}
+		for _, observation := range fhir.ToObservations(patient) {
+			for _, coding := range observation.Code.Coding {
+				observations[coding.Code] = observation.ID
+			}
+		}
+		for _, entry := range record.Related {
+			response := &fhir.EntryResponse{Status: "201 Created"}
+			var related fhir.Observation
+			if json.Unmarshal(bundle.Entry[entry].Resource, &related) == nil && related.ResourceType == "Observation" {
+				for _, coding := range related.Code.Coding {
+					if id, ok := observations[coding.Code]; ok {
+						response.Location = "Observation/" + id
+					}
+				}
+			}
+			responses[entry].Response = response
+		}
+	}
+
+	if len(stored) > 0 {
+		h.invalidatePatientStats(ctx)
+	}
+	return sendFHIR(c, fiber.StatusOK, fhir.Bundle{ResourceType: "Bundle", Type: bundle.Type + "-response", Entry: responses})
+}
@@ -11,7 +11,13 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/fieldcrypt"
+	"github.com/piyawat001/user-auth-api/inference"
 	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/payments"
+	"github.com/piyawat001/user-auth-api/pdf"
+	"github.com/piyawat001/user-auth-api/storage"
+	"github.com/piyawat001/user-auth-api/trash"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -20,18 +26,52 @@ import (
 )
 
 type Handler struct {
-	client *mongo.Client
+	client          *mongo.Client
+	paymentProvider payments.Provider
+	blobs           storage.Storage
+	classifier      inference.Provider
+	keyring         *fieldcrypt.Keyring
+	pdfFont         *pdf.Font
+	stats           *statsCache
 }
 
 func NewHandler(client *mongo.Client) *Handler {
-	return &Handler{client: client}
+	return &Handler{client: client, stats: newStatsCache()}
+}
+
+// SetPaymentProvider enables package checkout; without it payment routes reply 503.
+func (h *Handler) SetPaymentProvider(provider payments.Provider) {
+	h.paymentProvider = provider
+}
+
+// SetStorage sets where uploaded patient images are kept.
+func (h *Handler) SetStorage(blobs storage.Storage) {
+	h.blobs = blobs
+}
+
+// SetInferenceProvider runs the lesion classifier on new images; without it
+// uploads get no predictions.
+func (h *Handler) SetInferenceProvider(provider inference.Provider) {
+	h.classifier = provider
+}
+
+// SetKeyring enables the field encryption admin routes; without it they
+// reply 503.
+func (h *Handler) SetKeyring(keyring *fieldcrypt.Keyring) {
+	h.keyring = keyring
+}
+
+// SetPDFFont embeds font in invoices so Thai names show; without it they use
+// Helvetica, which cannot.
+func (h *Handler) SetPDFFont(font *pdf.Font) {
+	h.pdfFont = font
 }
 func (h *Handler) GetAllUsers(c *fiber.Ctx) error {
 	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, bson.M{})
+	cursor, err := collection.Find(ctx, trash.NotDeleted(bson.M{}))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch users"})
 	}
@@ -111,6 +151,7 @@ func (h *Handler) Login(c *fiber.Ctx) error {
 			{"email": loginUser.Identifier},
 			{"username": loginUser.Identifier},
 		},
+		"deleted_at": nil, // ผู้ใช้ที่อยู่ในถังขยะเข้าสู่ระบบไม่ได้
 	}
 
 	// ดึงข้อมูลผู้ใช้ที่ตรงกับ email หรือ username
@@ -176,7 +217,7 @@ func (h *Handler) ApproveUser(c *fiber.Ctx) error {
 		},
 	}
 
-	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	result, err := collection.UpdateOne(ctx, trash.NotDeleted(bson.M{"_id": objectID}), update)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update user"})
 	}
@@ -207,6 +248,7 @@ func (h *Handler) GetPackages(c *fiber.Ctx) error {
 	return c.JSON(packages)
 }
 
+// DeleteUser ย้ายผู้ใช้ไปถังขยะ (กู้คืนได้จนกว่าจะถูกลบถาวร)
 func (h *Handler) DeleteUser(c *fiber.Ctx) error {
 	userID := c.Params("id")
 
@@ -219,12 +261,12 @@ func (h *Handler) DeleteUser(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := collection.DeleteOne(ctx, bson.M{"_id": objectID})
+	result, err := collection.UpdateOne(ctx, trash.NotDeleted(bson.M{"_id": objectID}), softDelete(c))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot delete user"})
 	}
 
-	if result.DeletedCount == 0 {
+	if result.MatchedCount == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
 	}
 
@@ -233,10 +275,12 @@ func (h *Handler) DeleteUser(c *fiber.Ctx) error {
 
 func (h *Handler) AdminSetPackage(c *fiber.Ctx) error {
 	var setPackageRequest struct {
-		UserID     string `json:"user_id"`
-		Package    string `json:"package"`
-		Role       string `json:"role"`
-		ExpiryDays int    `json:"expiry_days"` // Days until package expires
+		UserID           string   `json:"user_id"`
+		Package          string   `json:"package"`
+		Role             string   `json:"role"`
+		ExpiryDays       int      `json:"expiry_days"`                 // Days until package expires
+		Price            *float64 `json:"price,omitempty"`             // Defaults to the package price
+		PaymentReference string   `json:"payment_reference,omitempty"` // e.g. bank transfer slip number
 	}
 
 	if err := c.BodyParser(&setPackageRequest); err != nil {
@@ -248,6 +292,15 @@ func (h *Handler) AdminSetPackage(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
 	}
 
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can set packages and roles"})
+	}
+	adminID := admin.ID
+
 	var expiryDate *time.Time
 	if setPackageRequest.Package == "plus" {
 		// Set expiry based on the number of days specified by the admin
@@ -258,29 +311,32 @@ func (h *Handler) AdminSetPackage(c *fiber.Ctx) error {
 		expiryDate = nil
 	}
 
-	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	update := bson.M{
-		"$set": bson.M{
-			"package":   setPackageRequest.Package,
-			"role":      setPackageRequest.Role,
-			"expiry":    expiryDate,
-			"updatedAt": time.Now(),
-		},
+	// บันทึกประวัติแพ็กเกจและออกใบแจ้งหนี้ (ถ้ามีค่าใช้จ่าย)
+	sub, invoice, err := h.changePackage(ctx, packageChange{
+		UserID:           objectID,
+		Package:          setPackageRequest.Package,
+		ExpiresAt:        expiryDate,
+		Price:            setPackageRequest.Price,
+		GrantedBy:        adminID,
+		PaymentReference: setPackageRequest.PaymentReference,
+		Reason:           "admin_set",
+		Set:              bson.M{"role": setPackageRequest.Role},
+	})
+	if err == errUserNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
 	}
-
-	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update user"})
 	}
 
-	if result.ModifiedCount == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
-	}
-
-	return c.JSON(fiber.Map{"message": "User package and role updated successfully"})
+	return c.JSON(fiber.Map{
+		"message":      "User package and role updated successfully",
+		"subscription": sub,
+		"invoice":      invoice,
+	})
 }
 
 func (h *Handler) CreatePatient(c *fiber.Ctx) error {
@@ -289,56 +345,70 @@ func (h *Handler) CreatePatient(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
 	}
 
-	patient.CreatedAt = time.Now()
-	patient.UpdatedAt = time.Now()
-
-	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	result, err := collection.InsertOne(ctx, patient)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot insert patient"})
-	}
-
-	patient.ID = result.InsertedID.(primitive.ObjectID)
-
-	return c.Status(fiber.StatusCreated).JSON(patient)
-}
-
-func (h *Handler) UpdatePatient(c *fiber.Ctx) error {
-	patientID := c.Params("id")
-	objectID, err := primitive.ObjectIDFromHex(patientID)
+	user, err := h.currentUser(c)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
 	}
+	userID := user.ID
 
-	var patient models.Patient
-	if err := c.BodyParser(&patient); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	if errs := validatePatient(&patient); len(errs) > 0 {
+		return errs.respond(c)
 	}
 
-	patient.UpdatedAt = time.Now()
+	newPatient(&patient, user)
 
 	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	update := bson.M{
-		"$set": patient,
+	// ตรวจสอบโควต้าของแพ็กเกจก่อนบันทึก
+	if err := h.reserveQuota(ctx, userID, usagePatients); err != nil {
+		return quotaError(c, err)
 	}
 
-	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	patient.ID = primitive.NewObjectID()
+	err = h.recordRevision(ctx, &patient, models.RevisionCreate, nil, userID, nil, func() error {
+		_, err := collection.InsertOne(ctx, patient)
+		return err
+	})
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update patient"})
+		h.releaseQuota(ctx, userID, usagePatients)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot insert patient"})
 	}
+	h.invalidatePatientStats(ctx)
 
-	if result.ModifiedCount == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
-	}
+	// เตือนเมื่อพบผู้ป่วยที่อาจเป็นรายเดียวกัน (เช่น ส่งจากทั้งคลินิกและโรงพยาบาล) บันทึกไว้ให้ admin ตรวจสอบ/รวม
+	duplicates := h.detectPatientDuplicates(ctx, &patient, user)
+
+	return c.Status(fiber.StatusCreated).JSON(createdPatient{Patient: patient, PossibleDuplicates: duplicates})
+}
+
+// newPatient sets what a patient gets from being created by user.
+func newPatient(patient *models.Patient, user *models.User) {
+	// ภาพเพิ่มได้ผ่าน /patients/:id/images เท่านั้น
+	patient.Images = nil
+	// ความยินยอมบันทึกได้ผ่าน /patients/:id/consents เท่านั้น
+	patient.ConsentScopes = nil
+
+	// ผู้สร้างเป็นเจ้าของข้อมูล และผูกกับโรงพยาบาลของผู้สร้าง
+	patient.CreatedBy = user.ID
+	patient.Hospital = user.Hospital
+	patient.CreatedAt = time.Now()
+	patient.UpdatedAt = time.Now()
+	patient.Revision = 1
+}
+
+// UpdatePatient แทนที่ข้อมูลผู้ป่วยทั้งหมด (ต้องส่งทุกฟิลด์ทางคลินิก)
+func (h *Handler) UpdatePatient(c *fiber.Ctx) error {
+	return h.updatePatient(c, true)
+}
 
-	return c.JSON(fiber.Map{"message": "Patient updated successfully"})
+// PatchPatient แก้ไขข้อมูลผู้ป่วยบางฟิลด์ (JSON Merge Patch; null คือการลบค่า)
+func (h *Handler) PatchPatient(c *fiber.Ctx) error {
+	return h.updatePatient(c, false)
 }
+
+// DeletePatient ย้ายข้อมูลผู้ป่วยไปถังขยะ (กู้คืนได้จนกว่าจะถูกลบถาวร)
 func (h *Handler) DeletePatient(c *fiber.Ctx) error {
 	patientID := c.Params("id")
 	objectID, err := primitive.ObjectIDFromHex(patientID)
@@ -346,30 +416,45 @@ func (h *Handler) DeletePatient(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
 	}
 
-	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := collection.DeleteOne(ctx, bson.M{"_id": objectID})
+	patient, err := h.findPatient(ctx, objectID, user, true)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot delete patient"})
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
 	}
 
-	if result.DeletedCount == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+	if err := h.setPatientDeleted(ctx, patient, user.ID, true); err != nil {
+		if err == errPatientChanged {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient was changed by someone else, please retry"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot delete patient"})
 	}
 
 	return c.JSON(fiber.Map{"message": "Patient deleted successfully"})
 }
 
 func (h *Handler) GetAllPatients(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
 	// เชื่อมต่อกับ collection "patients"
 	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// ค้นหาข้อมูลผู้ป่วยทั้งหมด
-	cursor, err := collection.Find(ctx, bson.M{})
+	// ค้นหาข้อมูลผู้ป่วยที่ผู้ใช้มีสิทธิ์เข้าถึง
+	cursor, err := collection.Find(ctx, patientAccessFilter(user, false))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patients"})
 	}
@@ -396,6 +481,18 @@ func (h *Handler) CreateQuestion(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Title and content are required"})
 	}
 
+	// The asker is always the authenticated user, not whatever the body says
+	userID, err := currentUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	question.UserID = userID
+
+	// คำถามที่อ้างถึงผู้ป่วย (และภาพ) ผู้ถามต้องมีสิทธิ์ดูข้อมูลผู้ป่วยรายนั้น
+	if ok, err := h.checkQuestionPatient(c, &question); !ok {
+		return err
+	}
+
 	// Set default values
 	question.CreatedAt = time.Now()
 	question.UpdatedAt = time.Now()
@@ -411,8 +508,14 @@ func (h *Handler) CreateQuestion(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// ตรวจสอบโควต้าของแพ็กเกจก่อนบันทึก
+	if err := h.reserveQuota(ctx, userID, usageQuestions); err != nil {
+		return quotaError(c, err)
+	}
+
 	result, err := collection.InsertOne(ctx, question)
 	if err != nil {
+		h.releaseQuota(ctx, userID, usageQuestions)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot create question"})
 	}
 
@@ -466,7 +569,7 @@ func (h *Handler) GetMyQuestions(c *fiber.Ctx) error {
 	defer cancel()
 
 	opts := options.Find().SetSkip(int64((pageInt - 1) * pageSizeInt)).SetLimit(int64(pageSizeInt)).SetSort(bson.D{{Key: "created_at", Value: -1}})
-	cursor, err := collection.Find(ctx, bson.M{"user_id": objectID}, opts)
+	cursor, err := collection.Find(ctx, trash.NotDeleted(bson.M{"user_id": objectID}), opts)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch questions"})
 	}
@@ -498,7 +601,7 @@ func (h *Handler) GetQuestionDetail(c *fiber.Ctx) error {
 	defer cancel()
 
 	var question models.Question
-	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&question)
+	err = collection.FindOne(ctx, trash.NotDeleted(bson.M{"_id": objectID})).Decode(&question)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Question not found"})
@@ -520,7 +623,13 @@ func (h *Handler) GetQuestionDetail(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(question)
+	// สรุปข้อมูลผู้ป่วยที่อ้างถึง แสดงเฉพาะผู้ที่เข้าสู่ระบบและมีสิทธิ์ดูผู้ป่วยรายนั้น
+	detail := questionDetail{Question: question}
+	if question.PatientID != nil {
+		detail.Patient = h.questionPatientSummary(ctx, c, &question)
+	}
+
+	return c.JSON(detail)
 }
 
 func (h *Handler) GetAllQuestions(c *fiber.Ctx) error {
@@ -528,7 +637,7 @@ func (h *Handler) GetAllQuestions(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, bson.M{})
+	cursor, err := collection.Find(ctx, trash.NotDeleted(bson.M{}))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch questions"})
 	}
@@ -553,7 +662,7 @@ func (h *Handler) GetQuestionsByUser(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, bson.M{"user_id": objectID})
+	cursor, err := collection.Find(ctx, trash.NotDeleted(bson.M{"user_id": objectID}))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch questions"})
 	}
@@ -582,7 +691,7 @@ func (h *Handler) UpdateNotificationBellStatus(c *fiber.Ctx) error {
 	// อัพเดตทุกคำถามของผู้ใช้
 	result, err := collection.UpdateMany(
 		ctx,
-		bson.M{"user_id": objectID},
+		trash.NotDeleted(bson.M{"user_id": objectID}),
 		bson.M{
 			"$set": bson.M{
 				"read_status.notification_bell": true,
@@ -602,7 +711,7 @@ func (h *Handler) UpdateNotificationBellStatus(c *fiber.Ctx) error {
 	})
 }
 
-// / DeleteQuestion ลบคำถาม
+// / DeleteQuestion ย้ายคำถามไปถังขยะ (กู้คืนได้จนกว่าจะถูกลบถาวร)
 func (h *Handler) DeleteQuestion(c *fiber.Ctx) error {
 	questionID := c.Params("id")
 	objectID, err := primitive.ObjectIDFromHex(questionID)
@@ -614,13 +723,13 @@ func (h *Handler) DeleteQuestion(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// ลบคำถามตาม ID ที่ระบุ
-	result, err := collection.DeleteOne(ctx, bson.M{"_id": objectID})
+	// ย้ายคำถามตาม ID ที่ระบุไปถังขยะ
+	result, err := collection.UpdateOne(ctx, trash.NotDeleted(bson.M{"_id": objectID}), softDelete(c))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot delete question"})
 	}
 
-	if result.DeletedCount == 0 {
+	if result.MatchedCount == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Question not found"})
 	}
 
@@ -730,7 +839,8 @@ func (h *Handler) GetPendingQuestions(c *fiber.Ctx) error {
 
 	// ค้นหาคำถามที่มีสถานะเป็น "pending" หรือ "inProgress"
 	cursor, err := collection.Find(ctx, bson.M{
-		"status": bson.M{"$in": []string{"pending", "inProgress"}},
+		"status":     bson.M{"$in": []string{"pending", "inProgress"}},
+		"deleted_at": nil,
 	})
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch questions"})
@@ -798,7 +908,7 @@ func (h *Handler) UpdateQuestion(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No valid fields to update"})
 	}
 
-	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	result, err := collection.UpdateOne(ctx, trash.NotDeleted(bson.M{"_id": objectID}), update)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update question"})
 	}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase connects to MONGODB_TEST_URI and points DATABASE_NAME at a
+// fresh database that is dropped when the test ends. Tests that need MongoDB
+// are skipped when the variable is not set.
+func testDatabase(t *testing.T) (*mongo.Client, *mongo.Database) {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "test_" + primitive.NewObjectID().Hex()
+	t.Setenv("DATABASE_NAME", name)
+	db := client.Database(name)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return client, db
+}
+
+// asUser is middleware standing in for middleware.Auth: it authenticates
+// every request as userID.
+func asUser(userID primitive.ObjectID) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("user_id", userID.Hex())
+		return c.Next()
+	}
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var validViewTypes = map[string]bool{
+	"":                       true,
+	models.ViewPanoramic:     true,
+	models.ViewPeriapical:    true,
+	models.ViewBitewing:      true,
+	models.ViewOcclusal:      true,
+	models.ViewCephalometric: true,
+	models.ViewCBCT:          true,
+	models.ViewClinicalPhoto: true,
+	models.ViewOther:         true,
+}
+
+// patientImageView is an upload together with its entry in the patient's
+// series.
+type patientImageView struct {
+	models.PatientImage
+	models.PatientImageEntry
+}
+
+// parseAcquiredAt accepts a date (2006-01-02) or an RFC 3339 timestamp.
+func parseAcquiredAt(value string) (*time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// addToSeries appends an uploaded image to the end of the patient's series.
+func (h *Handler) addToSeries(ctx context.Context, patientID primitive.ObjectID, user *models.User, entry models.PatientImageEntry) error {
+	return h.changeSeries(ctx, patientID, user, func(patient *models.Patient) bool {
+		if seriesHasImage(patient.Images, entry.ImageID) {
+			return false
+		}
+		patient.Images = append(patient.Images, entry)
+		return true
+	})
+}
+
+// changeSeries lets edit change the image series (and predictions) of the
+// patient and saves the result, starting over when the patient changes in
+// between. edit returns false when there is nothing to change.
+func (h *Handler) changeSeries(ctx context.Context, patientID primitive.ObjectID, user *models.User, edit func(next *models.Patient) bool) error {
+	for attempt := 0; ; attempt++ {
+		patient, err := h.findPatient(ctx, patientID, user, true)
+		if err != nil {
+			return err
+		}
+		next := *patient
+		next.Images = append([]models.PatientImageEntry{}, patient.Images...)
+		next.Predictions = append([]models.ImagePrediction{}, patient.Predictions...)
+		if !edit(&next) {
+			return nil
+		}
+		err = h.saveSeries(ctx, patient, &next, user)
+		if err != errPatientChanged || attempt == 2 {
+			return err
+		}
+	}
+}
+
+// saveSeries saves the image series and predictions of next, provided
+// nobody changed the patient since it was read as current, and logs them as
+// the next revision. image_name points at the first image so that clients
+// reading the single image field keep working.
+func (h *Handler) saveSeries(ctx context.Context, current, next *models.Patient, user *models.User) error {
+	next.ImageName = ""
+	if len(next.Images) > 0 {
+		next.ImageName = next.Images[0].ImageID.Hex()
+	}
+	changes := []models.FieldChange{{Field: "images", From: current.Images, To: next.Images}}
+	if next.ImageName != current.ImageName {
+		changes = append(changes, models.FieldChange{Field: "image_name", From: current.ImageName, To: next.ImageName})
+	}
+	if len(next.Predictions) != len(current.Predictions) {
+		changes = append(changes, models.FieldChange{Field: "predictions", From: current.Predictions, To: next.Predictions})
+	}
+	return h.setPatientFields(ctx, next, user, changes)
+}
+
+// orderedImages returns the patient's uploads in series order. Uploads that
+// predate the series come last, oldest first, with an empty entry.
+func orderedImages(series []models.PatientImageEntry, images []models.PatientImage) []patientImageView {
+	position := make(map[primitive.ObjectID]int, len(series))
+	for i, entry := range series {
+		position[entry.ImageID] = i
+	}
+
+	views := make([]patientImageView, 0, len(images))
+	for _, image := range images {
+		view := patientImageView{PatientImage: image, PatientImageEntry: models.PatientImageEntry{ImageID: image.ID}}
+		if i, ok := position[image.ID]; ok {
+			view.PatientImageEntry = series[i]
+		}
+		views = append(views, view)
+	}
+
+	sort.SliceStable(views, func(a, b int) bool {
+		pa, okA := position[views[a].ID]
+		pb, okB := position[views[b].ID]
+		switch {
+		case okA && okB:
+			return pa < pb
+		default:
+			return okA && !okB
+		}
+	})
+	return views
+}
+
+// ReorderPatientImages จัดลำดับภาพของผู้ป่วยใหม่ (ส่ง image_ids ครบทุกภาพตามลำดับที่ต้องการ)
+func (h *Handler) ReorderPatientImages(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	var body struct {
+		ImageIDs []primitive.ObjectID `json:"image_ids"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	patient, err := h.findPatient(ctx, patientID, user, true)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	images := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images")
+	ids, err := images.Distinct(ctx, "_id", bson.M{"patient_id": patientID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch images"})
+	}
+
+	// The new order must list every image of the patient exactly once
+	uploaded := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			uploaded[oid] = true
+		}
+	}
+	seen := make(map[primitive.ObjectID]bool, len(body.ImageIDs))
+	for _, id := range body.ImageIDs {
+		if !uploaded[id] || seen[id] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "image_ids must list each image of the patient once"})
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(uploaded) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "image_ids must list each image of the patient once"})
+	}
+
+	entries := make(map[primitive.ObjectID]models.PatientImageEntry, len(patient.Images))
+	for _, entry := range patient.Images {
+		entries[entry.ImageID] = entry
+	}
+	series := make([]models.PatientImageEntry, 0, len(body.ImageIDs))
+	for _, id := range body.ImageIDs {
+		entry, ok := entries[id]
+		if !ok {
+			entry = models.PatientImageEntry{ImageID: id}
+		}
+		series = append(series, entry)
+	}
+
+	// Only apply the order to the series it was computed from
+	next := *patient
+	next.Images = series
+	if err := h.saveSeries(ctx, patient, &next, user); err != nil {
+		if err == errPatientChanged {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Images changed while reordering, please retry"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot reorder images"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Images reordered successfully", "images": series})
+}
+
+// UpdatePatientImageEntry แก้ไขชนิดภาพ วันที่ถ่าย คำบรรยาย และหมายเหตุของภาพในชุดภาพ
+func (h *Handler) UpdatePatientImageEntry(c *fiber.Ctx) error {
+	var body struct {
+		ViewType    *string             `json:"view_type"`
+		AcquiredAt  *string             `json:"acquired_at"`
+		Caption     *models.Sensitive   `json:"caption"`
+		Annotations *[]models.Sensitive `json:"annotations"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	if body.ViewType != nil && !validViewTypes[*body.ViewType] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown view type"})
+	}
+	var acquiredAt *time.Time
+	if body.AcquiredAt != nil && *body.AcquiredAt != "" {
+		var err error
+		if acquiredAt, err = parseAcquiredAt(*body.AcquiredAt); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "acquired_at must be a date (YYYY-MM-DD) or RFC 3339 time"})
+		}
+	}
+
+	image, err := h.findPatientImage(c, true)
+	if err != nil || image == nil {
+		return err
+	}
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = h.changeSeries(ctx, image.PatientID, user, func(next *models.Patient) bool {
+		// Uploads that predate the series get their entry on first edit
+		at := -1
+		for i, entry := range next.Images {
+			if entry.ImageID == image.ID {
+				at = i
+			}
+		}
+		if at < 0 {
+			next.Images = append(next.Images, models.PatientImageEntry{ImageID: image.ID})
+			at = len(next.Images) - 1
+		}
+
+		entry := &next.Images[at]
+		if body.ViewType != nil {
+			entry.ViewType = *body.ViewType
+		}
+		if body.AcquiredAt != nil {
+			entry.AcquiredAt = acquiredAt
+		}
+		if body.Caption != nil {
+			entry.Caption = *body.Caption
+		}
+		if body.Annotations != nil {
+			entry.Annotations = *body.Annotations
+		}
+		return true
+	})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update image"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Image updated successfully"})
+}
@@ -0,0 +1,490 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/dicom"
+	"github.com/piyawat001/user-auth-api/imagehash"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// allowedImageTypes are the sniffed content types accepted for radiographs.
+var allowedImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+}
+
+const dicomContentType = "application/dicom"
+
+// Download variants of an image besides the original upload
+const (
+	variantPreview   = "preview"
+	variantThumbnail = "thumbnail"
+	variantHeatmap   = "heatmap"
+)
+
+// maxUploadSize reads MAX_UPLOAD_MB (default 20 MB).
+func maxUploadSize() int64 {
+	if mb, err := strconv.Atoi(os.Getenv("MAX_UPLOAD_MB")); err == nil && mb > 0 {
+		return int64(mb) << 20
+	}
+	return 20 << 20
+}
+
+func fileURLTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("FILE_URL_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+func fileURLSecret() []byte {
+	if secret := os.Getenv("FILE_URL_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(os.Getenv("JWT_SECRET"))
+}
+
+func fileSignature(imageID, variant string, expires int64) string {
+	mac := hmac.New(sha256.New, fileURLSecret())
+	fmt.Fprintf(mac, "%s:%s:%d", imageID, variant, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedFileURL returns a download path for an image (or one of its
+// variants) that works without a token until it expires.
+func signedFileURL(imageID primitive.ObjectID, variant string) (string, time.Time) {
+	expires := time.Now().Add(fileURLTTL())
+	id := imageID.Hex()
+	url := fmt.Sprintf("/files/%s?expires=%d&signature=%s", id, expires.Unix(), fileSignature(id, variant, expires.Unix()))
+	if variant != "" {
+		url += "&variant=" + variant
+	}
+	return url, expires
+}
+
+// imageVariant picks the blob served for a variant. PNG and JPEG uploads are
+// their own preview.
+func imageVariant(image *models.PatientImage, variant string) (key, contentType string, ok bool) {
+	switch variant {
+	case "":
+		return image.StorageKey, image.ContentType, true
+	case variantPreview:
+		if image.PreviewKey != "" {
+			return image.PreviewKey, "image/png", true
+		}
+		if allowedImageTypes[image.ContentType] {
+			return image.StorageKey, image.ContentType, true
+		}
+	case variantThumbnail:
+		if image.ThumbnailKey != "" {
+			return image.ThumbnailKey, "image/png", true
+		}
+	case variantHeatmap:
+		if image.HeatmapKey != "" {
+			return image.HeatmapKey, "image/png", true
+		}
+	}
+	return "", "", false
+}
+
+func blobKey(sum string) string {
+	return fmt.Sprintf("images/sha256/%s/%s", sum[:2], sum)
+}
+
+// UploadPatientImage อัปโหลดภาพรังสีของผู้ป่วยต่อท้ายชุดภาพ (multipart field "file", PNG/JPEG/DICOM; view_type, caption, acquired_at ไม่บังคับ; deidentify=true เพื่อลบข้อมูลระบุตัวตนใน DICOM)
+func (h *Handler) UploadPatientImage(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "File is required"})
+	}
+	if fileHeader.Size > maxUploadSize() {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": fmt.Sprintf("File is larger than %d MB", maxUploadSize()>>20)})
+	}
+
+	entry := models.PatientImageEntry{ViewType: c.FormValue("view_type"), Caption: models.Sensitive(c.FormValue("caption"))}
+	if !validViewTypes[entry.ViewType] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown view type"})
+	}
+	if value := c.FormValue("acquired_at"); value != "" {
+		if entry.AcquiredAt, err = parseAcquiredAt(value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "acquired_at must be a date (YYYY-MM-DD) or RFC 3339 time"})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if _, err := h.findPatient(ctx, patientID, user, true); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot read file"})
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadSize()))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot read file"})
+	}
+
+	// Trust the bytes, not the client's Content-Type header. DICOM has its
+	// magic after a 128-byte preamble, which DetectContentType doesn't know.
+	var dcm *dicom.File
+	deidentify, _ := strconv.ParseBool(c.FormValue("deidentify"))
+	contentType := http.DetectContentType(data)
+	switch {
+	case dicom.IsDICOM(data):
+		contentType = dicomContentType
+		dcm, err = dicom.Parse(data)
+		if err == nil && deidentify {
+			// The stored file stays in its study and keeps the dates images
+			// are ordered by; research exports strip those too
+			data = dcm.Deidentify(dicom.Profile{KeepUIDs: true, KeepDates: true})
+			dcm, err = dicom.Parse(data)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "Cannot read DICOM file: " + err.Error()})
+		}
+	case !allowedImageTypes[contentType]:
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": "Only PNG, JPEG and DICOM files are accepted"})
+	}
+
+	hash := sha256.Sum256(data)
+	sum := hex.EncodeToString(hash[:])
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images")
+
+	// The same file uploaded twice to a patient is the same image
+	var existing models.PatientImage
+	err = collection.FindOne(ctx, bson.M{"patient_id": patientID, "sha256": sum}).Decode(&existing)
+	if err == nil {
+		return c.JSON(existing)
+	}
+	if err != mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot check existing images"})
+	}
+
+	image := models.PatientImage{
+		PatientID:    patientID,
+		StorageKey:   blobKey(sum),
+		SHA256:       sum,
+		ContentType:  contentType,
+		Size:         int64(len(data)),
+		OriginalName: fileHeader.Filename,
+		UploadedBy:   user.ID,
+		CreatedAt:    time.Now(),
+		Deidentified: dcm != nil && deidentify,
+	}
+	if dcm != nil {
+		info := dcm.Info()
+		image.DICOM = &models.DICOMMetadata{
+			Modality:       info.Modality,
+			StudyDate:      info.StudyDate,
+			BodyPart:       info.BodyPart,
+			PixelSpacing:   info.PixelSpacing,
+			Rows:           info.Rows,
+			Columns:        info.Columns,
+			Frames:         info.Frames,
+			TransferSyntax: info.TransferSyntax,
+		}
+		image.Width, image.Height = info.Columns, info.Rows
+	}
+
+	// Identical bytes from other patients share the stored blob
+	exists, err := h.blobs.Exists(ctx, image.StorageKey)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot reach file storage"})
+	}
+	if !exists {
+		if err := h.blobs.Put(ctx, image.StorageKey, bytes.NewReader(data), image.Size, contentType); err != nil {
+			fmt.Printf("Error storing image: %v\n", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot store file"})
+		}
+	}
+	src := h.storePreviews(ctx, &image, data, dcm)
+	if src != nil {
+		phash := imagehash.PHash(src)
+		image.PHash, image.PHashBands = imagehash.Format(phash), imagehash.Bands(phash)
+	}
+
+	result, err := collection.InsertOne(ctx, image)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot save image"})
+	}
+	image.ID = result.InsertedID.(primitive.ObjectID)
+
+	// New uploads go to the end of the series; DICOM files know their date
+	entry.ImageID = image.ID
+	if entry.AcquiredAt == nil && image.DICOM != nil {
+		entry.AcquiredAt = image.DICOM.StudyDate
+	}
+	if err := h.addToSeries(ctx, patientID, user, entry); err != nil {
+		fmt.Printf("Error adding image to series: %v\n", err)
+		// Outside the series nobody would see the image, so don't keep it
+		if err := h.discardImage(ctx, &image); err != nil {
+			fmt.Printf("Error discarding image %s: %v\n", image.ID.Hex(), err)
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot add image to series"})
+	}
+
+	if h.classifier != nil && src != nil {
+		go h.runInference(image, src)
+	}
+
+	// The same radiograph under another patient suggests the case was submitted twice
+	duplicates := h.detectImageDuplicates(ctx, &image, user)
+
+	return c.Status(fiber.StatusCreated).JSON(uploadedImage{
+		patientImageView:   patientImageView{PatientImage: image, PatientImageEntry: entry},
+		PossibleDuplicates: duplicates,
+	})
+}
+
+// GetPatientImages ดึงรายการภาพของผู้ป่วยตามลำดับในชุดภาพ
+func (h *Handler) GetPatientImages(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	patient, err := h.findPatient(ctx, patientID, user, false)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images")
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{"patient_id": patientID}, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch images"})
+	}
+	defer cursor.Close(ctx)
+
+	images := []models.PatientImage{}
+	if err = cursor.All(ctx, &images); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode images"})
+	}
+
+	return c.JSON(orderedImages(patient.Images, images))
+}
+
+// GetPatientImageURL ขอลิงก์ดาวน์โหลดภาพแบบมีลายเซ็นและหมดอายุ (?variant=preview|thumbnail|heatmap)
+func (h *Handler) GetPatientImageURL(c *fiber.Ctx) error {
+	image, err := h.findPatientImage(c, false)
+	if err != nil || image == nil {
+		return err
+	}
+
+	variant := c.Query("variant")
+	if variant == "original" {
+		variant = ""
+	}
+	if _, _, ok := imageVariant(image, variant); !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Image variant not available"})
+	}
+
+	url, expires := signedFileURL(image.ID, variant)
+	return c.JSON(fiber.Map{"url": url, "expires_at": expires})
+}
+
+// DeletePatientImage ลบภาพออกจากผู้ป่วย (ลบไฟล์เมื่อไม่มีผู้ป่วยอื่นใช้ไฟล์เดียวกัน)
+func (h *Handler) DeletePatientImage(c *fiber.Ctx) error {
+	image, err := h.findPatientImage(c, true)
+	if err != nil || image == nil {
+		return err
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Out of the series first, so the removal is in the patient's history
+	err = h.changeSeries(ctx, image.PatientID, user, func(next *models.Patient) bool {
+		images, predictions := next.Images[:0], next.Predictions[:0]
+		for _, entry := range next.Images {
+			if entry.ImageID != image.ID {
+				images = append(images, entry)
+			}
+		}
+		for _, prediction := range next.Predictions {
+			if prediction.ImageID != image.ID {
+				predictions = append(predictions, prediction)
+			}
+		}
+		changed := len(images) != len(next.Images) || len(predictions) != len(next.Predictions)
+		next.Images, next.Predictions = images, predictions
+		return changed
+	})
+	if err != nil {
+		fmt.Printf("Error removing image from series: %v\n", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot delete image"})
+	}
+
+	if err := h.discardImage(ctx, image); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot delete image"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Image deleted successfully"})
+}
+
+// discardImage deletes an image record and, once no other record shares
+// them, its stored file and renderings.
+func (h *Handler) discardImage(ctx context.Context, image *models.PatientImage) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images")
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": image.ID}); err != nil {
+		return err
+	}
+
+	remaining, err := collection.CountDocuments(ctx, bson.M{"storage_key": image.StorageKey})
+	if err == nil && remaining == 0 {
+		for _, key := range []string{image.StorageKey, image.PreviewKey, image.ThumbnailKey, image.HeatmapKey} {
+			if key == "" {
+				continue
+			}
+			if err := h.blobs.Delete(ctx, key); err != nil {
+				fmt.Printf("Error deleting blob %s: %v\n", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// findPatientImage loads the image in :imageId of the patient in :id after
+// checking the caller's access. A nil image means the response was written.
+func (h *Handler) findPatientImage(c *fiber.Ctx, write bool) (*models.PatientImage, error) {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+	imageID, err := primitive.ObjectIDFromHex(c.Params("imageId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid image ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := h.findPatient(ctx, patientID, user, write); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images")
+	var image models.PatientImage
+	err = collection.FindOne(ctx, bson.M{"_id": imageID, "patient_id": patientID}).Decode(&image)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Image not found"})
+		}
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch image"})
+	}
+
+	return &image, nil
+}
+
+// DownloadFile ส่งไฟล์ภาพตามลิงก์ที่มีลายเซ็น (ไม่ต้องใช้ token)
+func (h *Handler) DownloadFile(c *fiber.Ctx) error {
+	id := c.Params("id")
+	variant := c.Query("variant")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Invalid or expired link"})
+	}
+	signature, err := hex.DecodeString(c.Query("signature"))
+	expected, _ := hex.DecodeString(fileSignature(id, variant, expires))
+	if err != nil || !hmac.Equal(signature, expected) || time.Now().Unix() > expires {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Invalid or expired link"})
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid image ID"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var image models.PatientImage
+	if err := collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&image); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Image not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch image"})
+	}
+
+	key, contentType, ok := imageVariant(&image, variant)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	// The stream outlives this handler, so it gets its own context
+	reader, err := h.blobs.Get(context.Background(), key)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot read file"})
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderCacheControl, "private, max-age=300")
+	if variant != "" {
+		return c.SendStream(reader)
+	}
+	return c.SendStream(reader, int(image.Size))
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// inferenceTimeout reads INFERENCE_TIMEOUT (default 2m).
+func inferenceTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("INFERENCE_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 2 * time.Minute
+}
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// runInference classifies a stored image and keeps the result on its
+// patient, replacing an earlier prediction of the same model version. It
+// runs after the upload has been answered, so failures are only logged.
+func (h *Handler) runInference(img models.PatientImage, src image.Image) {
+	ctx, cancel := context.WithTimeout(context.Background(), inferenceTimeout())
+	defer cancel()
+
+	result, err := h.classifier.Predict(ctx, src)
+	if err != nil {
+		fmt.Printf("Error running %s inference on image %s: %v\n", h.classifier.Name(), img.ID.Hex(), err)
+		return
+	}
+	if len(result.Scores) == 0 {
+		fmt.Printf("Error running %s inference on image %s: no scores\n", h.classifier.Name(), img.ID.Hex())
+		return
+	}
+
+	prediction := models.ImagePrediction{
+		ImageID:      img.ID,
+		Label:        result.Scores[0].Label,
+		Confidence:   result.Scores[0].Confidence,
+		Provider:     h.classifier.Name(),
+		ModelVersion: result.ModelVersion,
+		CreatedAt:    time.Now(),
+	}
+	for _, score := range result.Scores {
+		prediction.Scores = append(prediction.Scores, models.LabelScore{Label: score.Label, Confidence: score.Confidence})
+	}
+
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+
+	if result.Heatmap != nil {
+		key := derivedKey(img.SHA256, "heatmap-"+unsafeKeyChars.ReplaceAllString(result.ModelVersion, "_")+".png")
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, result.Heatmap); err != nil {
+			fmt.Printf("Error encoding heatmap %s: %v\n", key, err)
+		} else if err := h.blobs.Put(ctx, key, &buf, int64(buf.Len()), "image/png"); err != nil {
+			fmt.Printf("Error storing heatmap %s: %v\n", key, err)
+		} else {
+			prediction.HeatmapKey = key
+			_, err := db.Collection("patient_images").UpdateOne(ctx,
+				bson.M{"_id": img.ID},
+				bson.M{"$set": bson.M{"heatmap_key": key}},
+			)
+			if err != nil {
+				fmt.Printf("Error saving heatmap of image %s: %v\n", img.ID.Hex(), err)
+			}
+		}
+	}
+
+	// Predictions aren't edits, so updatedAt stays and concurrent edits
+	// of the patient don't conflict with them
+	patients := db.Collection("patients")
+	_, err = patients.UpdateOne(ctx,
+		bson.M{"_id": img.PatientID},
+		bson.M{"$pull": bson.M{"predictions": bson.M{"image_id": img.ID, "model_version": prediction.ModelVersion}}},
+	)
+	if err == nil {
+		_, err = patients.UpdateOne(ctx,
+			bson.M{"_id": img.PatientID},
+			bson.M{"$push": bson.M{"predictions": prediction}},
+		)
+	}
+	if err != nil {
+		fmt.Printf("Error saving prediction of image %s: %v\n", img.ID.Hex(), err)
+	}
+}
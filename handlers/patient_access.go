@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"os"
+
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/trash"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// patientAccessFilter limits a patients query to the records user may read,
+// or modify when write is true: their own records, records shared with their
+// hospital, or everything for admins. Records in the recycle bin are left
+// out for everyone.
+func patientAccessFilter(user *models.User, write bool) bson.M {
+	if isAdmin(user) {
+		return trash.NotDeleted(bson.M{})
+	}
+
+	shared := []string{models.HospitalAccessWrite}
+	if !write {
+		shared = append(shared, models.HospitalAccessRead)
+	}
+
+	or := []bson.M{{"created_by": user.ID}}
+	if user.Hospital != "" {
+		or = append(or, bson.M{
+			"hospital":        user.Hospital,
+			"hospital_access": bson.M{"$in": shared},
+		})
+	}
+	return trash.NotDeleted(bson.M{"$or": or})
+}
+
+// withPatientAccess adds the access restriction to filter.
+func withPatientAccess(filter bson.M, user *models.User, write bool) bson.M {
+	return bson.M{"$and": []bson.M{filter, patientAccessFilter(user, write)}}
+}
+
+func validHospitalAccess(access string) bool {
+	return access == "" || access == models.HospitalAccessNone || access == models.HospitalAccessRead || access == models.HospitalAccessWrite
+}
+
+// findPatient loads a patient that user may read (or modify when write is
+// true). It returns mongo.ErrNoDocuments both when the patient doesn't exist
+// and when user has no access, so callers don't leak which one it was.
+func (h *Handler) findPatient(ctx context.Context, patientID primitive.ObjectID, user *models.User, write bool) (*models.Patient, error) {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+
+	var patient models.Patient
+	err := collection.FindOne(ctx, withPatientAccess(bson.M{"_id": patientID}, user, write)).Decode(&patient)
+	if err != nil {
+		return nil, err
+	}
+	return &patient, nil
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	consentScopes   = []string{models.ConsentScopeTreatment, models.ConsentScopeTeaching, models.ConsentScopeResearch}
+	signerRelations = []string{models.SignerSelf, models.SignerParent, models.SignerGuardian, models.SignerRepresentative}
+)
+
+// EnsureConsentIndexes creates the index consent history and the active
+// scope lookups rely on.
+func (h *Handler) EnsureConsentIndexes(ctx context.Context) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_consents")
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "patient_id", Value: 1}, {Key: "signed_at", Value: -1}},
+		Options: options.Index().SetName("patient_signed"),
+	})
+	return err
+}
+
+// hasConsent reports whether the patient has an active consent for scope.
+// The Agree of models.Patient.Confirmation alone doesn't count: it has no
+// scope.
+func hasConsent(patient *models.Patient, scope string) bool {
+	return containsString(patient.ConsentScopes, scope)
+}
+
+// consentRequired answers that the patient's data can't be used for scope.
+func consentRequired(c *fiber.Ctx, scope string) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error":         fmt.Sprintf("Patient has not consented to the use of their data for %s, or has withdrawn consent", scope),
+		"consent_scope": scope,
+	})
+}
+
+// matchOption normalises value to the spelling of one of allowed, ignoring
+// case and surrounding spaces, or returns "".
+func matchOption(value string, allowed []string) string {
+	value = strings.TrimSpace(value)
+	for _, option := range allowed {
+		if strings.EqualFold(value, option) {
+			return option
+		}
+	}
+	return ""
+}
+
+// syncConsentScopes stores the scopes that have an active consent record on
+// the patient, as a revision. A concurrent edit of the patient is retried
+// with a fresh copy, since the consent records are already saved.
+func (h *Handler) syncConsentScopes(ctx context.Context, patient *models.Patient, user *models.User) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_consents")
+	active, err := collection.Distinct(ctx, "scope", bson.M{"patient_id": patient.ID, "withdrawn_at": nil})
+	if err != nil {
+		return err
+	}
+	var scopes []string
+	for _, scope := range consentScopes {
+		for _, value := range active {
+			if value == scope {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if strings.Join(patient.ConsentScopes, ",") == strings.Join(scopes, ",") {
+			return nil
+		}
+		previous := patient.ConsentScopes
+		patient.ConsentScopes = scopes
+		err := h.setPatientField(ctx, patient, user, "consent_scopes", previous, scopes)
+		if err != errPatientChanged || attempt == 2 {
+			return err
+		}
+		if patient, err = h.findPatient(ctx, patient.ID, user, true); err != nil {
+			return err
+		}
+	}
+}
+
+// GetPatientConsents ดึงประวัติความยินยอมทั้งหมดของผู้ป่วย (รวมที่ถอนแล้ว) และขอบเขตที่ยังมีผล
+func (h *Handler) GetPatientConsents(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	patient, err := h.findPatient(ctx, patientID, user, false)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_consents")
+	cursor, err := collection.Find(ctx,
+		bson.M{"patient_id": patientID},
+		options.Find().SetSort(bson.D{{Key: "signed_at", Value: -1}, {Key: "_id", Value: -1}}),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch consents"})
+	}
+	consents := []models.ConsentRecord{}
+	if err := cursor.All(ctx, &consents); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode consents"})
+	}
+
+	active := patient.ConsentScopes
+	if active == nil {
+		active = []string{}
+	}
+	return c.JSON(fiber.Map{"active_scopes": active, "consents": consents})
+}
+
+// storeImportedConsents saves the consents a FHIR import read for patient
+// and sets its active scopes from them.
+func (h *Handler) storeImportedConsents(ctx context.Context, patient *models.Patient, consents []models.ConsentRecord, user *models.User) error {
+	if len(consents) == 0 {
+		return nil
+	}
+	documents := make([]interface{}, len(consents))
+	for i, consent := range consents {
+		consent.ID = primitive.NewObjectID()
+		consent.PatientID = patient.ID
+		consent.RecordedBy = user.ID
+		consent.RecordedAt = time.Now()
+		documents[i] = consent
+	}
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_consents")
+	if _, err := collection.InsertMany(ctx, documents); err != nil {
+		return err
+	}
+	return h.syncConsentScopes(ctx, patient, user)
+}
+
+// RecordPatientConsent บันทึกความยินยอมของผู้ป่วย (scope: treatment, teaching, research) พร้อมเวอร์ชันเอกสาร ผู้ลงนาม และวันที่ลงนาม
+func (h *Handler) RecordPatientConsent(c *fiber.Ctx) error {
+	var body struct {
+		Scope          string `json:"scope"`
+		TextVersion    string `json:"text_version"`
+		SignerName     string `json:"signer_name"`
+		SignerRelation string `json:"signer_relation"` // Default self
+		SignedAt       string `json:"signed_at"`       // YYYY-MM-DD or RFC 3339
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	consent := models.ConsentRecord{
+		ID:             primitive.NewObjectID(),
+		Scope:          matchOption(body.Scope, consentScopes),
+		TextVersion:    strings.TrimSpace(body.TextVersion),
+		SignerName:     models.Sensitive(strings.TrimSpace(body.SignerName)),
+		SignerRelation: models.SignerSelf,
+		RecordedAt:     time.Now(),
+	}
+	var errs fieldErrors
+	if consent.Scope == "" {
+		errs.add("scope", "Must be one of: "+strings.Join(consentScopes, ", "))
+	}
+	if consent.TextVersion == "" {
+		errs.add("text_version", "Is required")
+	}
+	if consent.SignerName == "" {
+		errs.add("signer_name", "Is required")
+	}
+	if strings.TrimSpace(body.SignerRelation) != "" {
+		if consent.SignerRelation = matchOption(body.SignerRelation, signerRelations); consent.SignerRelation == "" {
+			errs.add("signer_relation", "Must be one of: "+strings.Join(signerRelations, ", "))
+		}
+	}
+	if body.SignedAt == "" {
+		errs.add("signed_at", "Is required")
+	} else if signedAt, err := parseAcquiredAt(body.SignedAt); err != nil {
+		errs.add("signed_at", "Must be a date (YYYY-MM-DD) or RFC 3339 time")
+	} else if signedAt.After(consent.RecordedAt) {
+		errs.add("signed_at", "Must not be in the future")
+	} else {
+		consent.SignedAt = *signedAt
+	}
+	if len(errs) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid consent data", "fields": errs})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	patient, user, err := h.writablePatient(ctx, c)
+	if err != nil || patient == nil {
+		return err
+	}
+	consent.PatientID = patient.ID
+	consent.RecordedBy = user.ID
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_consents")
+	if _, err := collection.InsertOne(ctx, consent); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot save consent"})
+	}
+	if err := h.syncConsentScopes(ctx, patient, user); err != nil {
+		fmt.Printf("Error updating consent scopes of patient %s: %v\n", patient.ID.Hex(), err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Consent was saved but the patient could not be updated, please retry"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Consent recorded successfully", "consent": consent})
+}
+
+// WithdrawPatientConsent ถอนความยินยอมของผู้ป่วยในขอบเขตที่ระบุ (ข้อมูลจะไม่ถูกใช้ในขอบเขตนั้นอีก)
+func (h *Handler) WithdrawPatientConsent(c *fiber.Ctx) error {
+	var body struct {
+		Scope  string `json:"scope"`
+		Reason string `json:"reason"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+	scope := matchOption(body.Scope, consentScopes)
+	if scope == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "scope must be one of: " + strings.Join(consentScopes, ", ")})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	patient, user, err := h.writablePatient(ctx, c)
+	if err != nil || patient == nil {
+		return err
+	}
+
+	// Every active record of the scope ends, including earlier versions of the form
+	now := time.Now()
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_consents")
+	result, err := collection.UpdateMany(ctx,
+		bson.M{"patient_id": patient.ID, "scope": scope, "withdrawn_at": nil},
+		bson.M{"$set": bson.M{
+			"withdrawn_at":      now,
+			"withdrawn_by":      user.ID,
+			"withdrawal_reason": models.Sensitive(strings.TrimSpace(body.Reason)),
+		}},
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot withdraw consent"})
+	}
+	if result.ModifiedCount == 0 && !hasConsent(patient, scope) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient has no active consent for " + scope})
+	}
+	if err := h.syncConsentScopes(ctx, patient, user); err != nil {
+		fmt.Printf("Error updating consent scopes of patient %s: %v\n", patient.ID.Hex(), err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Consent was withdrawn but the patient could not be updated, please retry"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Consent withdrawn successfully", "scope": scope, "withdrawn": result.ModifiedCount})
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// patientDiff lists the editable fields that differ between two versions.
+func patientDiff(before, after *models.Patient) []models.FieldChange {
+	var changes []models.FieldChange
+	for _, field := range []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"image_name", before.ImageName, after.ImageName},
+		{"confirm", before.Confirmation, after.Confirmation},
+		{"age", before.Age, after.Age},
+		{"gender", before.Gender, after.Gender},
+		{"duration_of_lesion", before.DurationOfLesion, after.DurationOfLesion},
+		{"expansion", before.Expansion, after.Expansion},
+		{"paresthesia", before.Paresthesia, after.Paresthesia},
+		{"number_of_lesions", before.NumberOfLesions, after.NumberOfLesions},
+		{"hospital_access", before.HospitalAccess, after.HospitalAccess},
+	} {
+		if field.from != field.to {
+			changes = append(changes, models.FieldChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+	return changes
+}
+
+// recordRevision appends patient, as apply leaves it, to its change log and
+// then runs apply, the write that makes the change. The revision goes first
+// so a change never lands without one, and is taken out again when apply
+// fails.
+func (h *Handler) recordRevision(ctx context.Context, patient *models.Patient, action string, changes []models.FieldChange, userID primitive.ObjectID, restoredFrom *int, apply func() error) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_revisions")
+	snapshot := *patient
+	result, err := collection.InsertOne(ctx, models.PatientRevision{
+		PatientID:    patient.ID,
+		Revision:     patient.Revision,
+		Action:       action,
+		Changes:      changes,
+		Snapshot:     &snapshot,
+		RestoredFrom: restoredFrom,
+		ChangedBy:    userID,
+		ChangedAt:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		if _, dropErr := collection.DeleteOne(ctx, bson.M{"_id": result.InsertedID}); dropErr != nil {
+			fmt.Printf("Error removing revision %d of unchanged patient %s: %v\n", patient.Revision, patient.ID.Hex(), dropErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// recordBaseline saves a record from before the log as revision 0, once, so
+// its original state stays restorable after the first change.
+func (h *Handler) recordBaseline(ctx context.Context, patient *models.Patient) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_revisions")
+	snapshot := *patient
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"patient_id": patient.ID, "revision": 0},
+		bson.M{"$setOnInsert": models.PatientRevision{
+			PatientID: patient.ID,
+			Action:    models.RevisionBaseline,
+			Snapshot:  &snapshot,
+			ChangedBy: patient.CreatedBy,
+			ChangedAt: patient.UpdatedAt,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// GetPatientHistory ดูประวัติการแก้ไขข้อมูลผู้ป่วย (ใคร เมื่อไร เปลี่ยนฟิลด์ใด) รวมประวัติของรายการซ้ำที่ถูกรวมเข้ามา
+func (h *Handler) GetPatientHistory(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	patient, err := h.findPatient(ctx, patientID, user, false)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	// Duplicates merged into the patient keep their own revisions, which
+	// are interleaved by time (each entry says which record it belongs to)
+	order := bson.D{{Key: "revision", Value: -1}}
+	if len(patient.MergedFrom) > 0 {
+		order = bson.D{{Key: "changed_at", Value: -1}, {Key: "revision", Value: -1}}
+	}
+	ids := append([]primitive.ObjectID{patientID}, patient.MergedFrom...)
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_revisions")
+	opts := options.Find().
+		SetSort(order).
+		SetProjection(bson.M{"snapshot": 0})
+	cursor, err := collection.Find(ctx, bson.M{"patient_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch history"})
+	}
+	defer cursor.Close(ctx)
+
+	revisions := []models.PatientRevision{}
+	if err := cursor.All(ctx, &revisions); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode history"})
+	}
+
+	return c.JSON(revisions)
+}
+
+// GetPatientRevision ดูข้อมูลผู้ป่วยทั้งชุดตามเวอร์ชันที่ระบุ
+func (h *Handler) GetPatientRevision(c *fiber.Ctx) error {
+	revision, err := h.findPatientRevision(c, false)
+	if err != nil || revision == nil {
+		return err
+	}
+	return c.JSON(revision)
+}
+
+// RestorePatientRevision คืนค่าข้อมูลผู้ป่วยเป็นเวอร์ชันที่ระบุ (บันทึกเป็นเวอร์ชันใหม่)
+func (h *Handler) RestorePatientRevision(c *fiber.Ctx) error {
+	revision, err := h.findPatientRevision(c, true)
+	if err != nil || revision == nil {
+		return err
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	current, err := h.findPatient(ctx, revision.PatientID, user, true)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	// Only the clinical fields go back; ownership and images stay as they are
+	old := revision.Snapshot
+	next := *current
+	next.Confirmation = old.Confirmation
+	next.Age = old.Age
+	next.Gender = old.Gender
+	next.DurationOfLesion = old.DurationOfLesion
+	next.Expansion = old.Expansion
+	next.Paresthesia = old.Paresthesia
+	next.NumberOfLesions = old.NumberOfLesions
+	if len(current.Images) == 0 {
+		next.ImageName = old.ImageName
+	}
+	if current.CreatedBy == user.ID || isAdmin(user) {
+		next.HospitalAccess = old.HospitalAccess
+	}
+
+	if errs := validatePatient(&next); len(errs) > 0 {
+		return errs.respond(c)
+	}
+
+	if err := h.savePatient(ctx, current, &next, user, models.RevisionRestore, &revision.Revision); err != nil {
+		if err == errPatientChanged {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient was changed by someone else, please retry"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot restore patient"})
+	}
+
+	return c.JSON(fiber.Map{"message": fmt.Sprintf("Patient restored to revision %d successfully", revision.Revision), "patient": next})
+}
+
+// findPatientRevision loads revision :revision of the patient in :id after
+// checking the caller's access. A nil revision means the response was written.
+func (h *Handler) findPatientRevision(c *fiber.Ctx, write bool) (*models.PatientRevision, error) {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+	number, err := strconv.Atoi(c.Params("revision"))
+	if err != nil || number < 0 {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid revision"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := h.findPatient(ctx, patientID, user, write); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_revisions")
+	var revision models.PatientRevision
+	err = collection.FindOne(ctx, bson.M{"patient_id": patientID, "revision": number}).Decode(&revision)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Revision not found"})
+		}
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch revision"})
+	}
+	if revision.Snapshot == nil {
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Revision has no snapshot"})
+	}
+
+	return &revision, nil
+}
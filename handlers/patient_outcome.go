@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/diagnosis"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ruleSuggestionCount is how many differential diagnoses are kept with an
+// outcome, enough for a top-3 agreement.
+const ruleSuggestionCount = 3
+
+var followUpStatuses = []string{models.FollowUpHealing, models.FollowUpNoRecurrence, models.FollowUpRecurrence, models.FollowUpLost}
+
+// diagnosisKey normalises a diagnosis name the way people type them:
+// ignoring case, underscores and extra spaces.
+func diagnosisKey(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(strings.ReplaceAll(name, "_", " "))), " ")
+}
+
+func sameDiagnosis(a, b string) bool {
+	return a != "" && diagnosisKey(a) == diagnosisKey(b)
+}
+
+// topPrediction is the classifier's most confident prediction for any image
+// of patient.
+func topPrediction(patient *models.Patient) *models.ImagePrediction {
+	var top *models.ImagePrediction
+	for i := range patient.Predictions {
+		if top == nil || patient.Predictions[i].Confidence > top.Confidence {
+			top = &patient.Predictions[i]
+		}
+	}
+	return top
+}
+
+// setPatientField $sets one field of current that isn't edited through
+// PUT/PATCH, provided nobody changed the patient since it was read, and logs
+// it as the next revision. current must already hold the new value.
+func (h *Handler) setPatientField(ctx context.Context, current *models.Patient, user *models.User, field string, from, to interface{}) error {
+	return h.setPatientFields(ctx, current, user, []models.FieldChange{{Field: field, From: from, To: to}})
+}
+
+// setPatientFields is setPatientField for fields that change together, in
+// one revision.
+func (h *Handler) setPatientFields(ctx context.Context, current *models.Patient, user *models.User, changes []models.FieldChange) error {
+	if current.Revision == 0 {
+		if err := h.recordBaseline(ctx, current); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	filter := withPatientAccess(bson.M{"_id": current.ID, "updatedAt": patientVersion(current)}, user, true)
+	set := bson.M{"updatedAt": now, "revision": current.Revision + 1}
+	for _, change := range changes {
+		set[change.Field] = change.To
+	}
+
+	updatedAt, revision := current.UpdatedAt, current.Revision
+	current.UpdatedAt = now
+	current.Revision++
+	err := h.recordRevision(ctx, current, models.RevisionUpdate, changes, user.ID, nil, func() error {
+		result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errPatientChanged
+		}
+		return nil
+	})
+	if err != nil {
+		current.UpdatedAt, current.Revision = updatedAt, revision
+	}
+	return err
+}
+
+// writablePatient loads the patient in :id for a change by the current user.
+// A nil patient means the response was written.
+func (h *Handler) writablePatient(ctx context.Context, c *fiber.Ctx) (*models.Patient, *models.User, error) {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return nil, nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	patient, err := h.findPatient(ctx, patientID, user, true)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+	return patient, user, nil
+}
+
+// SetPatientOutcome บันทึกการวินิจฉัยสุดท้าย ผลชิ้นเนื้อ และการรักษา (บันทึกผู้ยืนยันและคำแนะนำ ณ เวลานั้น)
+func (h *Handler) SetPatientOutcome(c *fiber.Ctx) error {
+	var body struct {
+		FinalDiagnosis string  `json:"final_diagnosis"`
+		BiopsyResult   string  `json:"biopsy_result"`
+		BiopsyDate     *string `json:"biopsy_date"` // YYYY-MM-DD or RFC 3339
+		Treatment      string  `json:"treatment"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	outcome := models.PatientOutcome{
+		FinalDiagnosis: models.Sensitive(strings.TrimSpace(body.FinalDiagnosis)),
+		BiopsyResult:   models.Sensitive(strings.TrimSpace(body.BiopsyResult)),
+		Treatment:      models.Sensitive(strings.TrimSpace(body.Treatment)),
+		ConfirmedAt:    time.Now(),
+	}
+	if outcome.FinalDiagnosis == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "final_diagnosis is required"})
+	}
+	if body.BiopsyDate != nil && *body.BiopsyDate != "" {
+		date, err := parseAcquiredAt(*body.BiopsyDate)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "biopsy_date must be a date (YYYY-MM-DD) or RFC 3339 time"})
+		}
+		outcome.BiopsyDate = date
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	patient, user, err := h.writablePatient(ctx, c)
+	if err != nil || patient == nil {
+		return err
+	}
+	outcome.ConfirmedBy = user.ID
+
+	// Keep what was suggested now; the rules and models will change
+	if rules, err := h.diagnosisRules(ctx, 0); err != nil {
+		fmt.Printf("Error loading diagnosis rules: %v\n", err)
+	} else {
+		outcome.RulesVersion = rules.Version
+		for _, candidate := range diagnosis.Rank(*rules, patient) {
+			if len(outcome.RuleSuggestions) == ruleSuggestionCount {
+				break
+			}
+			outcome.RuleSuggestions = append(outcome.RuleSuggestions, candidate.Diagnosis)
+		}
+	}
+	if top := topPrediction(patient); top != nil {
+		outcome.ModelLabel, outcome.ModelVersion = top.Label, top.ModelVersion
+	}
+
+	previous := patient.Outcome
+	patient.Outcome = &outcome
+	if err := h.setPatientField(ctx, patient, user, "outcome", previous, &outcome); err != nil {
+		if err == errPatientChanged {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient was changed by someone else, please retry"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot save outcome"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Outcome saved successfully", "outcome": outcome})
+}
+
+// AddPatientFollowUp บันทึกผลการติดตามการรักษา (status: healing, no_recurrence, recurrence, lost_to_follow_up)
+func (h *Handler) AddPatientFollowUp(c *fiber.Ctx) error {
+	var body struct {
+		Date   string `json:"date"` // YYYY-MM-DD or RFC 3339, default now
+		Status string `json:"status"`
+		Notes  string `json:"notes"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	followUp := models.FollowUp{
+		ID:         primitive.NewObjectID(),
+		Date:       time.Now(),
+		Notes:      models.Sensitive(strings.TrimSpace(body.Notes)),
+		RecordedAt: time.Now(),
+	}
+	for _, status := range followUpStatuses {
+		if strings.EqualFold(strings.TrimSpace(body.Status), status) {
+			followUp.Status = status
+		}
+	}
+	if followUp.Status == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "status must be one of: " + strings.Join(followUpStatuses, ", ")})
+	}
+	if body.Date != "" {
+		date, err := parseAcquiredAt(body.Date)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "date must be a date (YYYY-MM-DD) or RFC 3339 time"})
+		}
+		followUp.Date = *date
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	patient, user, err := h.writablePatient(ctx, c)
+	if err != nil || patient == nil {
+		return err
+	}
+	followUp.RecordedBy = user.ID
+
+	// Kept in date order
+	followUps := append(append([]models.FollowUp{}, patient.FollowUps...), followUp)
+	sort.SliceStable(followUps, func(i, j int) bool {
+		return followUps[i].Date.Before(followUps[j].Date)
+	})
+
+	previous := patient.FollowUps
+	patient.FollowUps = followUps
+	if err := h.setPatientField(ctx, patient, user, "follow_ups", previous, followUps); err != nil {
+		if err == errPatientChanged {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient was changed by someone else, please retry"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot save follow-up"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Follow-up added successfully", "follow_up": followUp})
+}
+
+type diagnosisAgreement struct {
+	Diagnosis string `json:"diagnosis"`
+	Confirmed int    `json:"confirmed"`
+
+	RulesTop1    int `json:"rules_top1"`      // Confirmed cases the rules ranked first
+	RulesTop3    int `json:"rules_top3"`      // Confirmed cases among the rules' top three
+	RulesSuggest int `json:"rules_suggested"` // Cases the rules ranked first, confirmed or not
+	ModelCorrect int `json:"model_correct"`
+	ModelSuggest int `json:"model_suggested"`
+}
+
+type agreementTotals struct {
+	Evaluated int     `json:"evaluated"` // Outcomes that had a suggestion
+	Top1      int     `json:"top1"`
+	Top1Rate  float64 `json:"top1_rate"`
+	Top3      int     `json:"top3,omitempty"`
+	Top3Rate  float64 `json:"top3_rate,omitempty"`
+}
+
+type confusionCell struct {
+	Confirmed string `json:"confirmed"`
+	Suggested string `json:"suggested"`
+	Count     int    `json:"count"`
+}
+
+func rate(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of)
+}
+
+// GetDiagnosisAgreement รายงานความสอดคล้องระหว่างการวินิจฉัยที่แนะนำ (กฎและโมเดล) กับการวินิจฉัยที่ยืนยันแล้ว (?from=&to= ตามวันที่ยืนยัน)
+func (h *Handler) GetDiagnosisAgreement(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	filter := bson.M{"outcome.final_diagnosis": bson.M{"$exists": true}}
+	confirmed := bson.M{}
+	if raw := c.Query("from"); raw != "" {
+		from, err := parseAcquiredAt(raw)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "from must be a date (YYYY-MM-DD) or RFC 3339 time"})
+		}
+		confirmed["$gte"] = *from
+	}
+	if raw := c.Query("to"); raw != "" {
+		to, err := parseAcquiredAt(raw)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "to must be a date (YYYY-MM-DD) or RFC 3339 time"})
+		}
+		confirmed["$lte"] = *to
+	}
+	if len(confirmed) > 0 {
+		filter["outcome.confirmed_at"] = confirmed
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, withPatientAccess(filter, user, false))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patients"})
+	}
+	defer cursor.Close(ctx)
+
+	var patients []models.Patient
+	if err := cursor.All(ctx, &patients); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode patients"})
+	}
+
+	var rules, model agreementTotals
+	byDiagnosis := map[string]*diagnosisAgreement{}
+	row := func(name string) *diagnosisAgreement {
+		key := diagnosisKey(name)
+		if byDiagnosis[key] == nil {
+			byDiagnosis[key] = &diagnosisAgreement{Diagnosis: name}
+		}
+		return byDiagnosis[key]
+	}
+	confusion := map[[2]string]int{}
+
+	for _, patient := range patients {
+		outcome := patient.Outcome
+		actual := row(string(outcome.FinalDiagnosis))
+		actual.Confirmed++
+
+		if len(outcome.RuleSuggestions) > 0 {
+			rules.Evaluated++
+			row(outcome.RuleSuggestions[0]).RulesSuggest++
+			confusion[[2]string{actual.Diagnosis, outcome.RuleSuggestions[0]}]++
+			for i, suggestion := range outcome.RuleSuggestions {
+				if !sameDiagnosis(suggestion, string(outcome.FinalDiagnosis)) {
+					continue
+				}
+				if i == 0 {
+					rules.Top1++
+					actual.RulesTop1++
+				}
+				rules.Top3++
+				actual.RulesTop3++
+				break
+			}
+		}
+
+		if outcome.ModelLabel != "" {
+			model.Evaluated++
+			row(outcome.ModelLabel).ModelSuggest++
+			if sameDiagnosis(outcome.ModelLabel, string(outcome.FinalDiagnosis)) {
+				model.Top1++
+				actual.ModelCorrect++
+			}
+		}
+	}
+
+	rules.Top1Rate, rules.Top3Rate = rate(rules.Top1, rules.Evaluated), rate(rules.Top3, rules.Evaluated)
+	model.Top1Rate = rate(model.Top1, model.Evaluated)
+
+	rows := []diagnosisAgreement{}
+	for _, r := range byDiagnosis {
+		rows = append(rows, *r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Confirmed != rows[j].Confirmed {
+			return rows[i].Confirmed > rows[j].Confirmed
+		}
+		return rows[i].Diagnosis < rows[j].Diagnosis
+	})
+
+	cells := []confusionCell{}
+	for pair, count := range confusion {
+		cells = append(cells, confusionCell{Confirmed: pair[0], Suggested: pair[1], Count: count})
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Count != cells[j].Count {
+			return cells[i].Count > cells[j].Count
+		}
+		return cells[i].Confirmed+cells[i].Suggested < cells[j].Confirmed+cells[j].Suggested
+	})
+
+	return c.JSON(fiber.Map{
+		"confirmed":    len(patients),
+		"rules":        rules,
+		"model":        model,
+		"by_diagnosis": rows,
+		"confusion":    cells, // Confirmed diagnosis against the rules' first suggestion
+	})
+}
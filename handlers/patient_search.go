@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// patientSortFields maps the sort keys of /patients to stored fields. Every
+// sort is tie-broken on _id so cursors are stable.
+var patientSortFields = map[string]string{
+	"created_at": "createdAt",
+	"updated_at": "updatedAt",
+	"age":        "age",
+}
+
+// patientIndexes back the access filter combined with the search sorts and
+// the most selective filters. Names are fixed so restarts are no-ops.
+var patientIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "created_by", Value: 1}, {Key: "deleted_at", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetName("owner_created"),
+	},
+	{
+		Keys:    bson.D{{Key: "hospital", Value: 1}, {Key: "hospital_access", Value: 1}, {Key: "deleted_at", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetName("hospital_created"),
+	},
+	{
+		Keys:    bson.D{{Key: "deleted_at", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetName("created"),
+	},
+	{
+		Keys:    bson.D{{Key: "deleted_at", Value: 1}, {Key: "updatedAt", Value: -1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetName("updated"),
+	},
+	{
+		Keys:    bson.D{{Key: "deleted_at", Value: 1}, {Key: "gender", Value: 1}, {Key: "number_of_lesions", Value: 1}, {Key: "age", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("clinical_age"),
+	},
+}
+
+// EnsurePatientIndexes creates the indexes patient search relies on.
+func (h *Handler) EnsurePatientIndexes(ctx context.Context) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	_, err := collection.Indexes().CreateMany(ctx, patientIndexes)
+	return err
+}
+
+// searchCursor is the position after the last patient of a page: its sort
+// value and ID. Clients get it base64-encoded and pass it back unchanged.
+type searchCursor struct {
+	Sort  string             `json:"s"`
+	Time  *time.Time         `json:"t,omitempty"`
+	Int   *int               `json:"n,omitempty"`
+	After primitive.ObjectID `json:"id"`
+}
+
+func encodeCursor(cursor searchCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a cursor given back for sort (as in the query, e.g.
+// "-age"). The cursor must be for that sort and hold the kind of value the
+// sort field has.
+func decodeCursor(value, sort string) (searchCursor, bool) {
+	var cursor searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(data, &cursor) != nil || cursor.After.IsZero() || cursor.Sort != sort {
+		return cursor, false
+	}
+	switch strings.TrimPrefix(sort, "-") {
+	case "created_at", "updated_at":
+		return cursor, cursor.Time != nil && cursor.Int == nil
+	case "age":
+		return cursor, cursor.Int != nil && cursor.Time == nil
+	}
+	return cursor, false
+}
+
+// enumFilter reads a comma-separated list of allowed values of an enumerated
+// field and matches any of them.
+func (e *fieldErrors) enumFilter(filter bson.M, c *fiber.Ctx, param, field string) {
+	raw := c.Query(param)
+	if raw == "" {
+		return
+	}
+	var values []string
+	for _, value := range strings.Split(raw, ",") {
+		before := len(*e)
+		e.checkEnum(param, &value)
+		if len(*e) == before && value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) > 0 {
+		filter[field] = bson.M{"$in": values}
+	}
+}
+
+// patientSearchFilter builds the filter of a /patients query from its
+// parameters.
+func patientSearchFilter(c *fiber.Ctx) (bson.M, fieldErrors) {
+	filter := bson.M{}
+	var errs fieldErrors
+
+	errs.enumFilter(filter, c, "gender", "gender")
+	errs.enumFilter(filter, c, "expansion", "expansion")
+	errs.enumFilter(filter, c, "number_of_lesions", "number_of_lesions")
+	errs.enumFilter(filter, c, "duration_of_lesion", "duration_of_lesion")
+
+	age := bson.M{}
+	for _, bound := range []struct{ param, op string }{{"age_min", "$gte"}, {"age_max", "$lte"}} {
+		if raw := c.Query(bound.param); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil || value < 0 || value > maxPatientAge {
+				errs.add(bound.param, "Must be a whole number between 0 and 120")
+				continue
+			}
+			age[bound.op] = value
+		}
+	}
+	if len(age) > 0 {
+		filter["age"] = age
+	}
+
+	if raw := c.Query("paresthesia"); raw != "" {
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			errs.add("paresthesia", "Must be true or false")
+		} else {
+			filter["paresthesia"] = value
+		}
+	}
+
+	// A plain date in created_to includes that whole day
+	created := bson.M{}
+	if raw := c.Query("created_from"); raw != "" {
+		if from, err := parseAcquiredAt(raw); err != nil {
+			errs.add("created_from", "Must be a date (2006-01-02) or an RFC 3339 timestamp")
+		} else {
+			created["$gte"] = *from
+		}
+	}
+	if raw := c.Query("created_to"); raw != "" {
+		if to, err := parseAcquiredAt(raw); err != nil {
+			errs.add("created_to", "Must be a date (2006-01-02) or an RFC 3339 timestamp")
+		} else if len(raw) == len("2006-01-02") {
+			created["$lt"] = to.AddDate(0, 0, 1)
+		} else {
+			created["$lte"] = *to
+		}
+	}
+	if len(created) > 0 {
+		filter["createdAt"] = created
+	}
+
+	return filter, errs
+}
+
+// SearchPatients ค้นหาผู้ป่วยที่มีสิทธิ์เข้าถึงตามเงื่อนไข เรียงลำดับ และแบ่งหน้าด้วย cursor
+func (h *Handler) SearchPatients(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	filter, errs := patientSearchFilter(c)
+
+	// sort=age ascending, sort=-created_at descending (the default)
+	sort := c.Query("sort", "-created_at")
+	direction := 1
+	if strings.HasPrefix(sort, "-") {
+		sort, direction = sort[1:], -1
+	}
+	field, ok := patientSortFields[sort]
+	if !ok {
+		errs.add("sort", "Must be created_at, updated_at or age, optionally prefixed with -")
+	}
+
+	limit := defaultSearchLimit
+	if raw := c.Query("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			errs.add("limit", "Must be between 1 and 100")
+		}
+	}
+
+	var after *searchCursor
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, ok := decodeCursor(raw, c.Query("sort", "-created_at"))
+		if !ok {
+			errs.add("cursor", "Is not valid for this sort")
+		}
+		after = &cursor
+	}
+
+	if len(errs) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid search parameters", "fields": errs})
+	}
+
+	conditions := []bson.M{filter, patientAccessFilter(user, false)}
+	if after != nil {
+		// Continue strictly after the last patient of the previous page
+		op := "$gt"
+		if direction < 0 {
+			op = "$lt"
+		}
+		// decodeCursor checked the value matches the sort field
+		var value interface{}
+		if after.Time != nil {
+			value = *after.Time
+		} else {
+			value = *after.Int
+		}
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{field: bson.M{op: value}},
+			{field: value, "_id": bson.M{op: after.After}},
+		}})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// One extra document tells whether there is a next page
+	opts := options.Find().
+		SetSort(bson.D{{Key: field, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := collection.Find(ctx, bson.M{"$and": conditions}, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patients"})
+	}
+	defer cursor.Close(ctx)
+
+	patients := []models.Patient{}
+	if err = cursor.All(ctx, &patients); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode patients"})
+	}
+
+	var next string
+	if len(patients) > limit {
+		patients = patients[:limit]
+		last := patients[limit-1]
+		position := searchCursor{Sort: c.Query("sort", "-created_at"), After: last.ID}
+		switch sort {
+		case "created_at":
+			position.Time = &last.CreatedAt
+		case "updated_at":
+			position.Time = &last.UpdatedAt
+		case "age":
+			position.Int = &last.Age
+		}
+		next = encodeCursor(position)
+	}
+
+	return c.JSON(fiber.Map{
+		"patients":    patients,
+		"next_cursor": next,
+		"limit":       limit,
+	})
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	id := primitive.NewObjectID()
+	when := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	age := 42
+	raw := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+		sort   string
+		ok     bool
+	}{
+		{"time for created_at", encodeCursor(searchCursor{Sort: "-created_at", Time: &when, After: id}), "-created_at", true},
+		{"time for updated_at", encodeCursor(searchCursor{Sort: "updated_at", Time: &when, After: id}), "updated_at", true},
+		{"int for age", encodeCursor(searchCursor{Sort: "-age", Int: &age, After: id}), "-age", true},
+		{"time for age", raw(`{"s":"age","t":"2024-01-01T00:00:00Z","id":"` + id.Hex() + `"}`), "age", false},
+		{"int for created_at", encodeCursor(searchCursor{Sort: "created_at", Int: &age, After: id}), "created_at", false},
+		{"both values", encodeCursor(searchCursor{Sort: "age", Int: &age, Time: &when, After: id}), "age", false},
+		{"no value", encodeCursor(searchCursor{Sort: "age", After: id}), "age", false},
+		{"other direction", encodeCursor(searchCursor{Sort: "age", Int: &age, After: id}), "-age", false},
+		{"unknown sort", encodeCursor(searchCursor{Sort: "name", Int: &age, After: id}), "name", false},
+		{"no id", encodeCursor(searchCursor{Sort: "age", Int: &age}), "age", false},
+		{"not base64", "!!", "age", false},
+		{"not json", raw("age"), "age", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := decodeCursor(tt.cursor, tt.sort); ok != tt.ok {
+				t.Errorf("decodeCursor ok = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSearchPatientsRejectsMismatchedCursor(t *testing.T) {
+	client, db := testDatabase(t)
+	user := models.User{ID: primitive.NewObjectID(), Username: "doctor", Role: "Faculty of Dentistry", Status: "Active"}
+	if _, err := db.Collection("users").InsertOne(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(client)
+	app := fiber.New()
+	app.Get("/patients", asUser(user.ID), h.SearchPatients)
+
+	// A time where sort=age needs an int
+	cursor := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"age","t":"2024-01-01T00:00:00Z","id":"` + primitive.NewObjectID().Hex() + `"}`))
+	resp, err := app.Test(httptest.NewRequest("GET", "/patients?sort=age&cursor="+cursor, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultStatsAgeBand = 10
+	statsCacheLimit     = 500 // Entries kept before the cache starts over
+	statsCounterID      = "patient-stats"
+)
+
+var statsIntervals = []string{"none", "day", "week", "month", "quarter", "year"}
+
+// statsReport is one distribution of patients: what they are grouped by
+// (a Mongo expression over a patient) and how a group is called.
+type statsReport struct {
+	group func(ageBand int) interface{}
+	label func(value interface{}, ageBand int) string
+	order func(a, b interface{}) bool
+}
+
+var statsReports = map[string]statsReport{
+	"age-groups": {
+		group: func(ageBand int) interface{} {
+			return bson.M{"$multiply": bson.A{bson.M{"$floor": bson.M{"$divide": bson.A{"$age", ageBand}}}, ageBand}}
+		},
+		label: func(value interface{}, ageBand int) string {
+			low := statsInt(value)
+			return fmt.Sprintf("%d-%d", low, low+ageBand-1)
+		},
+		order: func(a, b interface{}) bool { return statsInt(a) < statsInt(b) },
+	},
+	"gender":       enumReport("gender"),
+	"expansion":    enumReport("expansion"),
+	"multiplicity": enumReport("number_of_lesions"),
+	"paresthesia": {
+		group: func(int) interface{} { return "$paresthesia" },
+		label: func(value interface{}, _ int) string {
+			if value == true {
+				return "Yes"
+			}
+			return "No"
+		},
+		order: func(a, b interface{}) bool { return a == true && b != true },
+	},
+}
+
+// enumReport groups by an enumerated field, in the order of patientEnums.
+// Patients without a value (no expansion) are "None".
+func enumReport(field string) statsReport {
+	rank := func(value interface{}) int {
+		for i, allowed := range patientEnums[field] {
+			if value == allowed {
+				return i
+			}
+		}
+		return len(patientEnums[field])
+	}
+	return statsReport{
+		group: func(int) interface{} { return bson.M{"$ifNull": bson.A{"$" + field, ""}} },
+		label: func(value interface{}, _ int) string {
+			if s, _ := value.(string); s != "" {
+				return s
+			}
+			return "None"
+		},
+		order: func(a, b interface{}) bool { return rank(a) < rank(b) },
+	}
+}
+
+// statsInt reads a number from an aggregation result, whichever BSON type
+// it came back as.
+func statsInt(value interface{}) int {
+	switch n := value.(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+type statsRow struct {
+	Period   *time.Time `json:"period,omitempty"` // Start of the bucket, in the report's time zone
+	Category string     `json:"category"`
+	Count    int        `json:"count"`
+}
+
+type statsTotal struct {
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+}
+
+type patientStats struct {
+	Report      string       `json:"report"`
+	Interval    string       `json:"interval"`
+	Timezone    string       `json:"timezone"`
+	AgeBand     int          `json:"age_band,omitempty"`
+	Total       int          `json:"total"`
+	Totals      []statsTotal `json:"totals"`
+	Rows        []statsRow   `json:"rows"`
+	GeneratedAt time.Time    `json:"generated_at"`
+	Cached      bool         `json:"cached"`
+}
+
+// statsCache keeps computed reports until the next write to patients. The
+// generation lives in Mongo, so a write on any replica invalidates them all.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[string]statsCacheEntry
+}
+
+type statsCacheEntry struct {
+	generation int64
+	stats      patientStats
+}
+
+func newStatsCache() *statsCache {
+	return &statsCache{entries: map[string]statsCacheEntry{}}
+}
+
+func (s *statsCache) get(key string, generation int64) (patientStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || entry.generation != generation {
+		return patientStats{}, false
+	}
+	return entry.stats, true
+}
+
+func (s *statsCache) put(key string, generation int64, stats patientStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) >= statsCacheLimit {
+		s.entries = map[string]statsCacheEntry{}
+	}
+	s.entries[key] = statsCacheEntry{generation, stats}
+}
+
+// statsGeneration is bumped by every write that can change a report.
+func (h *Handler) statsGeneration(ctx context.Context) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("counters").FindOne(ctx, bson.M{"_id": statsCounterID}).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return counter.Seq, err
+}
+
+// invalidatePatientStats drops the cached reports after patients were
+// created, edited, deleted or restored.
+func (h *Handler) invalidatePatientStats(ctx context.Context) {
+	_, err := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("counters").UpdateOne(ctx,
+		bson.M{"_id": statsCounterID},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		fmt.Printf("Error invalidating patient statistics: %v\n", err)
+	}
+}
+
+// statsCacheKey identifies a report for a user. Non-admins see different
+// patients depending on who they are and their hospital.
+func statsCacheKey(c *fiber.Ctx, user *models.User) string {
+	scope := "admin"
+	if !isAdmin(user) {
+		scope = user.ID.Hex() + "@" + user.Hospital
+	}
+	args := c.Request().URI().QueryArgs()
+	var params []string
+	args.VisitAll(func(key, value []byte) {
+		if string(key) != "format" {
+			params = append(params, string(key)+"="+string(value))
+		}
+	})
+	sort.Strings(params)
+	return scope + "|" + c.Params("report") + "|" + strings.Join(params, "&")
+}
+
+// GetPatientStats รายงานจำนวนผู้ป่วยตามกลุ่มอายุ เพศ การขยายตัว อาการชา หรือจำนวนรอยโรค แยกตามช่วงเวลา (?interval=&timezone=&age_band=&format=csv และตัวกรองเดียวกับการค้นหาผู้ป่วย)
+func (h *Handler) GetPatientStats(c *fiber.Ctx) error {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	name := c.Params("report")
+	report, ok := statsReports[name]
+	if !ok {
+		names := make([]string, 0, len(statsReports))
+		for name := range statsReports {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Unknown report, use one of: " + strings.Join(names, ", ")})
+	}
+
+	filter, errs := patientSearchFilter(c)
+	interval := c.Query("interval", "month")
+	if !containsString(statsIntervals, interval) {
+		errs.add("interval", "Must be one of: "+strings.Join(statsIntervals, ", "))
+	}
+	timezone := c.Query("timezone", os.Getenv("STATS_TIMEZONE"))
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		errs.add("timezone", "Must be an IANA time zone, e.g. Asia/Bangkok")
+	}
+	ageBand := 0
+	if name == "age-groups" {
+		ageBand, err = strconv.Atoi(c.Query("age_band", strconv.Itoa(defaultStatsAgeBand)))
+		if err != nil || ageBand < 1 || ageBand > maxPatientAge {
+			errs.add("age_band", "Must be between 1 and 120")
+		}
+	}
+	format := c.Query("format", "json")
+	if format != "json" && format != "csv" {
+		errs.add("format", "Must be json or csv")
+	}
+	if len(errs) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid report parameters", "fields": errs})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	generation, err := h.statsGeneration(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch statistics"})
+	}
+	key := statsCacheKey(c, user)
+	stats, cached := h.stats.get(key, generation)
+	if !cached {
+		stats, err = h.computePatientStats(ctx, withPatientAccess(filter, user, false), report, interval, location, ageBand)
+		if err != nil {
+			fmt.Printf("Error computing patient statistics %s: %v\n", name, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot compute statistics"})
+		}
+		stats.Report = name
+		h.stats.put(key, generation, stats)
+	}
+	stats.Cached = cached
+
+	if format == "csv" {
+		return sendStatsCSV(c, stats, location)
+	}
+	return c.JSON(stats)
+}
+
+func (h *Handler) computePatientStats(ctx context.Context, filter bson.M, report statsReport, interval string, location *time.Location, ageBand int) (patientStats, error) {
+	group := bson.M{"value": report.group(ageBand)}
+	if interval != "none" {
+		group["period"] = bson.M{"$dateTrunc": bson.M{
+			"date":        "$createdAt",
+			"unit":        interval,
+			"timezone":    location.String(),
+			"startOfWeek": "monday",
+		}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": group, "count": bson.M{"$sum": 1}}}},
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return patientStats{}, err
+	}
+	var groups []struct {
+		ID struct {
+			Period *time.Time  `bson:"period"`
+			Value  interface{} `bson:"value"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return patientStats{}, err
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i].ID, groups[j].ID
+		if a.Period != nil && b.Period != nil && !a.Period.Equal(*b.Period) {
+			return a.Period.Before(*b.Period)
+		}
+		return report.order(a.Value, b.Value)
+	})
+
+	stats := patientStats{
+		Interval:    interval,
+		Timezone:    location.String(),
+		AgeBand:     ageBand,
+		Totals:      []statsTotal{},
+		Rows:        []statsRow{},
+		GeneratedAt: time.Now(),
+	}
+	// Totals per category, in the report's order
+	totals := map[string]int{}
+	var values []interface{}
+	for _, g := range groups {
+		row := statsRow{Category: report.label(g.ID.Value, ageBand), Count: g.Count}
+		if g.ID.Period != nil {
+			period := g.ID.Period.In(location)
+			row.Period = &period
+		}
+		stats.Rows = append(stats.Rows, row)
+		stats.Total += g.Count
+		if _, seen := totals[row.Category]; !seen {
+			values = append(values, g.ID.Value)
+		}
+		totals[row.Category] += g.Count
+	}
+	sort.SliceStable(values, func(i, j int) bool { return report.order(values[i], values[j]) })
+	for _, value := range values {
+		category := report.label(value, ageBand)
+		stats.Totals = append(stats.Totals, statsTotal{Category: category, Count: totals[category]})
+	}
+	return stats, nil
+}
+
+func sendStatsCSV(c *fiber.Ctx, stats patientStats, location *time.Location) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"period", "category", "count"})
+	for _, row := range stats.Rows {
+		period := ""
+		if row.Period != nil {
+			period = row.Period.In(location).Format("2006-01-02")
+		}
+		w.Write([]string{period, row.Category, strconv.Itoa(row.Count)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot write CSV"})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="patients-%s-%s.csv"`, stats.Report, stats.GeneratedAt.In(location).Format("20060102")))
+	return c.Send(buf.Bytes())
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// patientFields are the JSON keys clients may edit. A PUT must send all of
+// them except hospital_access, which keeps its value when left out.
+var patientFields = []string{"confirm", "age", "gender", "duration_of_lesion", "expansion", "paresthesia", "number_of_lesions"}
+
+// readOnlyPatientFields are the other keys a fetched patient has. Both PUT
+// and PATCH accept them back unchanged (clients often send what they
+// fetched) but reject any change; every other key is unknown.
+var readOnlyPatientFields = map[string]bool{
+	"id": true, "created_by": true, "hospital": true, "created_at": true, "updated_at": true, "images": true, "revision": true, "predictions": true,
+	"outcome": true, "follow_ups": true, "deleted_at": true, "deleted_by": true, "consent_scopes": true, "merged_into": true, "merged_from": true,
+}
+
+var errPatientChanged = errors.New("patient changed concurrently")
+
+// mergePatch applies an RFC 7386 JSON Merge Patch: objects merge
+// recursively, null removes a key and anything else replaces it.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// decodePatient unmarshals a patient document, reporting type mismatches
+// against the field they concern.
+func decodePatient(data []byte, patient *models.Patient) fieldErrors {
+	var errs fieldErrors
+	if err := json.Unmarshal(data, patient); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			errs.add(typeErr.Field, "Must be a "+typeErr.Type.String())
+		} else {
+			errs.add("", "Body must be a JSON object")
+		}
+	}
+	return errs
+}
+
+// checkPatientChange rejects edits of read-only fields and of the sharing
+// setting by anyone but the owner or an admin.
+func checkPatientChange(current, next *models.Patient, user *models.User) fieldErrors {
+	var errs fieldErrors
+	if next.ID != current.ID {
+		errs.add("id", "Cannot be changed")
+	}
+	if next.CreatedBy != current.CreatedBy {
+		errs.add("created_by", "Cannot be changed")
+	}
+	if next.Hospital != current.Hospital {
+		errs.add("hospital", "Cannot be changed")
+	}
+	if !next.CreatedAt.Equal(current.CreatedAt) {
+		errs.add("created_at", "Cannot be changed")
+	}
+	if !sameJSON(next.Images, current.Images) {
+		errs.add("images", "Is managed through /patients/:id/images")
+	}
+	if !sameJSON(next.Predictions, current.Predictions) {
+		errs.add("predictions", "Is written by the classifier")
+	}
+	// image_name follows the image series once there is one
+	if len(current.Images) > 0 && next.ImageName != current.ImageName {
+		errs.add("image_name", "Is managed through /patients/:id/images")
+	}
+	if next.HospitalAccess != current.HospitalAccess && current.CreatedBy != user.ID && !isAdmin(user) {
+		errs.add("hospital_access", "Only the owner can change sharing")
+	}
+	if !sameJSON(next.Outcome, current.Outcome) {
+		errs.add("outcome", "Is managed through /patients/:id/outcome")
+	}
+	if !sameJSON(next.FollowUps, current.FollowUps) {
+		errs.add("follow_ups", "Is managed through /patients/:id/follow-ups")
+	}
+	if !sameJSON(next.DeletedAt, current.DeletedAt) {
+		errs.add("deleted_at", "Is managed through the recycle bin")
+	}
+	if !sameJSON(next.DeletedBy, current.DeletedBy) {
+		errs.add("deleted_by", "Is managed through the recycle bin")
+	}
+	if !sameJSON(next.ConsentScopes, current.ConsentScopes) {
+		errs.add("consent_scopes", "Is managed through /patients/:id/consents")
+	}
+	if !sameJSON(next.MergedInto, current.MergedInto) {
+		errs.add("merged_into", "Is managed through /admin/patients/:id/merge")
+	}
+	if !sameJSON(next.MergedFrom, current.MergedFrom) {
+		errs.add("merged_from", "Is managed through /admin/patients/:id/merge")
+	}
+	return errs
+}
+
+// sameJSON reports whether a and b serialize to the same JSON, for fields
+// compared as a whole rather than member by member.
+func sameJSON(a, b interface{}) bool {
+	encodedA, _ := json.Marshal(a)
+	encodedB, _ := json.Marshal(b)
+	return bytes.Equal(encodedA, encodedB)
+}
+
+// patientVersion matches the updatedAt patient was read with, so a write
+// fails when someone else changed the record in between.
+func patientVersion(patient *models.Patient) interface{} {
+	// Records from before updatedAt was kept have none to compare against
+	if patient.UpdatedAt.IsZero() {
+		return bson.M{"$in": bson.A{nil, patient.UpdatedAt}}
+	}
+	return patient.UpdatedAt
+}
+
+// savePatient writes the editable fields of next, provided nobody else
+// changed the patient since current was read, and logs the change as the
+// next revision.
+func (h *Handler) savePatient(ctx context.Context, current, next *models.Patient, user *models.User, action string, restoredFrom *int) error {
+	if current.Revision == 0 {
+		if err := h.recordBaseline(ctx, current); err != nil {
+			return err
+		}
+	}
+
+	next.UpdatedAt = time.Now()
+	next.Revision = current.Revision + 1
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	filter := withPatientAccess(bson.M{"_id": current.ID, "updatedAt": patientVersion(current)}, user, true)
+	return h.recordRevision(ctx, next, action, patientDiff(current, next), user.ID, restoredFrom, func() error {
+		result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+			"image_name":         next.ImageName,
+			"confirm":            next.Confirmation,
+			"age":                next.Age,
+			"gender":             next.Gender,
+			"duration_of_lesion": next.DurationOfLesion,
+			"expansion":          next.Expansion,
+			"paresthesia":        next.Paresthesia,
+			"number_of_lesions":  next.NumberOfLesions,
+			"hospital_access":    next.HospitalAccess,
+			"updatedAt":          next.UpdatedAt,
+			"revision":           next.Revision,
+		}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errPatientChanged
+		}
+		h.invalidatePatientStats(ctx)
+		return nil
+	})
+}
+
+// checkPatientKeys rejects keys a patient doesn't have and, for a PUT
+// (replace), a request missing any of patientFields.
+func checkPatientKeys(body map[string]interface{}, replace bool) fieldErrors {
+	var errs fieldErrors
+	known := map[string]bool{"image_name": true, "hospital_access": true}
+	for _, field := range patientFields {
+		known[field] = true
+		if _, ok := body[field]; replace && !ok {
+			errs.add(field, "Is required (use PATCH to change only some fields)")
+		}
+	}
+	for field := range body {
+		if !known[field] && !readOnlyPatientFields[field] {
+			errs.add(field, "Unknown field")
+		}
+	}
+	return errs
+}
+
+// applyPatientBody applies a PUT (replace) or PATCH body on top of current.
+// Read-only fields the body leaves out keep their stored values.
+func applyPatientBody(current *models.Patient, body map[string]interface{}, replace bool) (*models.Patient, fieldErrors) {
+	var document interface{}
+	stored, _ := json.Marshal(current)
+	json.Unmarshal(stored, &document)
+	if replace {
+		for field, value := range body {
+			document.(map[string]interface{})[field] = value
+		}
+	} else {
+		document = mergePatch(document, body)
+	}
+	merged, _ := json.Marshal(document)
+
+	// updated_at and revision are only echoed back by clients; the server sets them
+	next := &models.Patient{}
+	if errs := decodePatient(merged, next); len(errs) > 0 {
+		return nil, errs
+	}
+	next.UpdatedAt, next.Revision = current.UpdatedAt, current.Revision
+	return next, nil
+}
+
+// updatePatient handles PUT (replace) and PATCH (merge patch) of the patient
+// in :id. Both start from the stored record, so fields the request can't
+// touch keep their values.
+func (h *Handler) updatePatient(c *fiber.Ctx, replace bool) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(c.Body(), &body); err != nil || body == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	current, err := h.findPatient(ctx, objectID, user, true)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+
+	if errs := checkPatientKeys(body, replace); len(errs) > 0 {
+		return errs.respond(c)
+	}
+	next, errs := applyPatientBody(current, body, replace)
+	if len(errs) > 0 {
+		return errs.respond(c)
+	}
+
+	errs = append(checkPatientChange(current, next, user), validatePatient(next)...)
+	if len(errs) > 0 {
+		return errs.respond(c)
+	}
+
+	if err := h.savePatient(ctx, current, next, user, models.RevisionUpdate, nil); err != nil {
+		if err == errPatientChanged {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient was changed by someone else, please retry"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update patient"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Patient updated successfully", "patient": next})
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMergePatch(t *testing.T) {
+	// The examples of RFC 7386, appendix A
+	tests := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		var target, patch, want interface{}
+		for _, v := range []struct {
+			raw string
+			to  *interface{}
+		}{{tt.target, &target}, {tt.patch, &patch}, {tt.want, &want}} {
+			if err := json.Unmarshal([]byte(v.raw), v.to); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+			t.Errorf("mergePatch(%s, %s) = %v, want %s", tt.target, tt.patch, got, tt.want)
+		}
+	}
+}
+
+// testPatient is a patient with every read-only field set, as GET returns it.
+func testPatient() *models.Patient {
+	when := time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC)
+	deletedBy := primitive.NewObjectID()
+	imageID := primitive.NewObjectID()
+	return &models.Patient{
+		ID:               primitive.NewObjectID(),
+		ImageName:        imageID.Hex(),
+		Images:           []models.PatientImageEntry{{ImageID: imageID, Caption: "left mandible"}},
+		Confirmation:     models.ConfirmationAgree,
+		Age:              42,
+		Gender:           models.GenderFemale,
+		DurationOfLesion: models.DurationMonths,
+		Expansion:        models.ExpansionBuccolingual,
+		NumberOfLesions:  models.LesionsSingle,
+		CreatedBy:        primitive.NewObjectID(),
+		Hospital:         "Siriraj",
+		HospitalAccess:   models.HospitalAccessRead,
+		CreatedAt:        when,
+		UpdatedAt:        when.Add(time.Hour),
+		Revision:         3,
+		DeletedBy:        &deletedBy,
+		Predictions:      []models.ImagePrediction{{ImageID: imageID, Label: "ameloblastoma", Confidence: 0.87, CreatedAt: when}},
+		Outcome:          &models.PatientOutcome{FinalDiagnosis: "ameloblastoma", ConfirmedAt: when},
+		FollowUps:        []models.FollowUp{{ID: primitive.NewObjectID(), Date: when, Status: models.FollowUpHealing}},
+		ConsentScopes:    []string{"treatment"},
+		MergedFrom:       []primitive.ObjectID{primitive.NewObjectID()},
+	}
+}
+
+// fetched returns patient as a request body, the way GET sends it.
+func fetched(t *testing.T, patient *models.Patient) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(patient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestCheckPatientKeys(t *testing.T) {
+	full := fetched(t, testPatient())
+	tests := []struct {
+		name    string
+		body    map[string]interface{}
+		replace bool
+		want    []string
+	}{
+		{"PUT of a fetched patient", full, true, nil},
+		{"PATCH of a fetched patient", full, false, nil},
+		{"PATCH of one field", map[string]interface{}{"age": 43}, false, nil},
+		{"PATCH of a read-only field", map[string]interface{}{"consent_scopes": nil}, false, nil},
+		{"PUT missing fields", map[string]interface{}{"age": 43, "gender": "Male", "confirm": "Agree", "expansion": "", "paresthesia": false}, true, []string{"duration_of_lesion", "number_of_lesions"}},
+		{"PUT with an unknown field", withKey(full, "ward", "B"), true, []string{"ward"}},
+		{"PATCH with an unknown field", map[string]interface{}{"ward": "B"}, false, []string{"ward"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, err := range checkPatientKeys(tt.body, tt.replace) {
+				got = append(got, err.Field)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("errors on %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// withKey returns a copy of body with key set to value.
+func withKey(body map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	copied := map[string]interface{}{key: value}
+	for k, v := range body {
+		if k != key {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+func TestApplyPatientBody(t *testing.T) {
+	current := testPatient()
+	owner := &models.User{ID: current.CreatedBy}
+	full := fetched(t, current)
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+		want string // Field rejected by checkPatientChange, if any
+	}{
+		{"echo", full, ""},
+		{"editable field", withKey(full, "age", 43), ""},
+		{"server-set fields", withKey(withKey(full, "revision", 99), "updated_at", "2030-01-01T00:00:00Z"), ""},
+		{"id", withKey(full, "id", primitive.NewObjectID().Hex()), "id"},
+		{"created_by", withKey(full, "created_by", primitive.NewObjectID().Hex()), "created_by"},
+		{"hospital", withKey(full, "hospital", "Ramathibodi"), "hospital"},
+		{"created_at", withKey(full, "created_at", "2020-01-01T00:00:00Z"), "created_at"},
+		{"images", withKey(full, "images", []interface{}{}), "images"},
+		{"predictions", withKey(full, "predictions", []interface{}{}), "predictions"},
+		{"outcome", withKey(full, "outcome", map[string]interface{}{"final_diagnosis": "odontogenic keratocyst"}), "outcome"},
+		{"follow_ups", withKey(full, "follow_ups", []interface{}{}), "follow_ups"},
+		{"deleted_at", withKey(full, "deleted_at", "2024-04-01T00:00:00Z"), "deleted_at"},
+		{"deleted_by", withKey(full, "deleted_by", primitive.NewObjectID().Hex()), "deleted_by"},
+		{"consent_scopes", withKey(full, "consent_scopes", []interface{}{"treatment", "research"}), "consent_scopes"},
+		{"merged_into", withKey(full, "merged_into", primitive.NewObjectID().Hex()), "merged_into"},
+		{"merged_from", withKey(full, "merged_from", []interface{}{}), "merged_from"},
+	}
+	for _, verb := range []struct {
+		name    string
+		replace bool
+	}{{"PUT", true}, {"PATCH", false}} {
+		for _, tt := range tests {
+			t.Run(verb.name+" "+tt.name, func(t *testing.T) {
+				next, errs := applyPatientBody(current, tt.body, verb.replace)
+				if len(errs) > 0 {
+					t.Fatalf("applyPatientBody: %v", errs)
+				}
+				if next.UpdatedAt != current.UpdatedAt || next.Revision != current.Revision {
+					t.Errorf("updated_at, revision = %v, %d; want the stored %v, %d", next.UpdatedAt, next.Revision, current.UpdatedAt, current.Revision)
+				}
+				var got []string
+				for _, err := range checkPatientChange(current, next, owner) {
+					got = append(got, err.Field)
+				}
+				switch {
+				case tt.want == "" && len(got) > 0:
+					t.Errorf("rejected %v", got)
+				case tt.want != "" && !reflect.DeepEqual(got, []string{tt.want}):
+					t.Errorf("rejected %v, want [%s]", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestApplyPatientBodyPatchRemovesReadOnlyField(t *testing.T) {
+	current := testPatient()
+	next, errs := applyPatientBody(current, map[string]interface{}{"outcome": nil}, false)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if errs := checkPatientChange(current, next, &models.User{ID: current.CreatedBy}); len(errs) != 1 || errs[0].Field != "outcome" {
+		t.Errorf("errors = %v, want one on outcome", errs)
+	}
+}
+
+func TestApplyPatientBodyPutKeepsOmittedFields(t *testing.T) {
+	current := testPatient()
+	body := map[string]interface{}{
+		"confirm": "Agree", "age": 43, "gender": "Female", "duration_of_lesion": "months",
+		"expansion": "", "paresthesia": true, "number_of_lesions": "Single lesion",
+	}
+	next, errs := applyPatientBody(current, body, true)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if errs := checkPatientChange(current, next, &models.User{ID: current.CreatedBy}); len(errs) > 0 {
+		t.Errorf("errors = %v", errs)
+	}
+	if next.HospitalAccess != current.HospitalAccess || next.Age != 43 || !next.Paresthesia {
+		t.Errorf("hospital_access, age, paresthesia = %q, %d, %v", next.HospitalAccess, next.Age, next.Paresthesia)
+	}
+}
+
+func TestUpdatePatientVerbs(t *testing.T) {
+	client, db := testDatabase(t)
+	user := models.User{ID: primitive.NewObjectID(), Username: "doctor", Role: "Faculty of Dentistry", Status: "Active", Hospital: "Siriraj"}
+	if _, err := db.Collection("users").InsertOne(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	stored := testPatient()
+	stored.CreatedBy, stored.Hospital, stored.DeletedBy = user.ID, user.Hospital, nil
+	stored.Images, stored.ImageName, stored.Predictions = nil, "", nil
+	stored.CreatedAt = stored.CreatedAt.Truncate(time.Millisecond)
+	stored.UpdatedAt = stored.UpdatedAt.Truncate(time.Millisecond)
+	if _, err := db.Collection("patients").InsertOne(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(client)
+	app := fiber.New()
+	app.Put("/patients/:id", asUser(user.ID), h.UpdatePatient)
+	app.Patch("/patients/:id", asUser(user.ID), h.PatchPatient)
+
+	send := func(method string, body map[string]interface{}) (int, map[string]interface{}) {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, "/patients/"+stored.ID.Hex(), bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Patient map[string]interface{} `json:"patient"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.Patient
+	}
+
+	for i, method := range []string{"PUT", "PATCH"} {
+		age := 50 + i
+		// Every response echoes the current record, revision included
+		var current models.Patient
+		if err := db.Collection("patients").FindOne(context.Background(), bson.M{"_id": stored.ID}).Decode(&current); err != nil {
+			t.Fatal(err)
+		}
+		echo := fetched(t, &current)
+
+		if status, _ := send(method, withKey(echo, "ward", "B")); status != fiber.StatusBadRequest {
+			t.Errorf("%s with an unknown field: status = %d, want 400", method, status)
+		}
+		if status, _ := send(method, withKey(echo, "deleted_at", "2024-04-01T00:00:00Z")); status != fiber.StatusBadRequest {
+			t.Errorf("%s setting deleted_at: status = %d, want 400", method, status)
+		}
+		if status, _ := send(method, withKey(echo, "consent_scopes", []string{"treatment", "research"})); status != fiber.StatusBadRequest {
+			t.Errorf("%s setting consent_scopes: status = %d, want 400", method, status)
+		}
+		status, patient := send(method, withKey(echo, "age", age))
+		if status != fiber.StatusOK {
+			t.Fatalf("%s of the fetched patient: status = %d, want 200", method, status)
+		}
+		if _, ok := patient["deleted_at"]; ok || patient["age"] != float64(age) {
+			t.Errorf("%s response = %v", method, patient)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+)
+
+const maxPatientAge = 120
+
+// fieldError is one problem with one field of a request body, named by its
+// JSON key.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type fieldErrors []fieldError
+
+func (e *fieldErrors) add(field, message string) {
+	*e = append(*e, fieldError{Field: field, Message: message})
+}
+
+// respond writes the shared validation error body.
+func (e fieldErrors) respond(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient data", "fields": e})
+}
+
+// patientEnums are the allowed values of the enumerated fields, in the
+// spelling that is stored.
+var patientEnums = map[string][]string{
+	"gender":             {models.GenderMale, models.GenderFemale},
+	"expansion":          {models.ExpansionBuccolingual, models.ExpansionAnteroposterior},
+	"duration_of_lesion": {models.DurationWeeks, models.DurationMonths, models.DurationYears},
+	"number_of_lesions":  {models.LesionsSingle, models.LesionsMultiple},
+	"confirm":            {models.ConfirmationAgree, models.ConfirmationDisagree},
+}
+
+// checkEnum normalises value to the stored spelling of an allowed value,
+// ignoring case and surrounding spaces. Empty values are left to the
+// required-field rules.
+func (e *fieldErrors) checkEnum(field string, value *string) {
+	*value = strings.TrimSpace(*value)
+	if *value == "" {
+		return
+	}
+	for _, allowed := range patientEnums[field] {
+		if strings.EqualFold(*value, allowed) {
+			*value = allowed
+			return
+		}
+	}
+	e.add(field, "Must be one of: "+strings.Join(patientEnums[field], ", "))
+}
+
+// validatePatient checks the clinical fields of a full patient document and
+// normalises the enumerated ones in place. Expansion may be empty when the
+// lesion shows none.
+func validatePatient(patient *models.Patient) fieldErrors {
+	var errs fieldErrors
+
+	errs.checkEnum("gender", &patient.Gender)
+	errs.checkEnum("expansion", &patient.Expansion)
+	errs.checkEnum("duration_of_lesion", &patient.DurationOfLesion)
+	errs.checkEnum("number_of_lesions", &patient.NumberOfLesions)
+	errs.checkEnum("confirm", &patient.Confirmation)
+
+	for _, required := range []struct{ field, value string }{
+		{"gender", patient.Gender},
+		{"duration_of_lesion", patient.DurationOfLesion},
+		{"number_of_lesions", patient.NumberOfLesions},
+		{"confirm", patient.Confirmation},
+	} {
+		if required.value == "" {
+			errs.add(required.field, "Is required")
+		}
+	}
+
+	// Data may only be stored with the patient's consent
+	if patient.Confirmation == models.ConfirmationDisagree {
+		errs.add("confirm", "Patient consent (Agree) is required to store data")
+	}
+
+	if patient.Age < 0 || patient.Age > maxPatientAge {
+		errs.add("age", "Must be between 0 and 120")
+	}
+
+	if !validHospitalAccess(patient.HospitalAccess) {
+		errs.add("hospital_access", "Must be none, read or write")
+	}
+
+	return errs
+}
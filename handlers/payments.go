@@ -0,0 +1,502 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/payments"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// paymentStatuses are the values of Payment.Status. A payment whose amount
+// didn't match what was charged ends as paymentAmountMismatch without
+// activating anything.
+var paymentStatuses = []string{"pending", "paid", "failed", "expired", "refunded", paymentAmountMismatch}
+
+const paymentAmountMismatch = "amount_mismatch"
+
+// CreateCheckout เริ่มการชำระเงินเพื่ออัปเกรดแพ็กเกจ
+func (h *Handler) CreateCheckout(c *fiber.Ctx) error {
+	if h.paymentProvider == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Payments are not configured"})
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	var checkoutRequest struct {
+		Package   string `json:"package"`
+		Method    string `json:"method"` // "promptpay" or "card"
+		ReturnURL string `json:"return_url,omitempty"`
+		PromoCode string `json:"promo_code,omitempty"` // Percent or fixed discount code
+	}
+	if err := c.BodyParser(&checkoutRequest); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+	if checkoutRequest.Method != "promptpay" && checkoutRequest.Method != "card" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Method must be promptpay or card"})
+	}
+
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var pkg models.Package
+	if err := db.Collection("packages").FindOne(ctx, bson.M{"name": checkoutRequest.Package}).Decode(&pkg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Package not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch package"})
+	}
+	if pkg.Price <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Package is not for sale"})
+	}
+
+	amount := pkg.Price
+	var promo *models.PromoCode
+	if checkoutRequest.PromoCode != "" {
+		promo, err = h.findPromo(ctx, checkoutRequest.PromoCode, pkg.Name)
+		if err != nil {
+			return promoError(c, err)
+		}
+		if promo.Type == "trial" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Trial codes are redeemed, not used at checkout"})
+		}
+		amount = discountedPrice(promo, pkg.Price)
+		if amount == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "This code makes the package free, redeem it instead"})
+		}
+		if err := h.claimPromo(ctx, promo, userID, pkg.Name); err != nil {
+			return promoError(c, err)
+		}
+	}
+
+	now := time.Now()
+	payment := models.Payment{
+		ID:           primitive.NewObjectID(),
+		UserID:       userID,
+		Package:      pkg.Name,
+		Amount:       amount,
+		Currency:     models.Currency,
+		Method:       checkoutRequest.Method,
+		Provider:     h.paymentProvider.Name(),
+		Status:       "pending",
+		DurationDays: pkg.DurationDays,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if promo != nil {
+		payment.PromoCode = promo.Code
+		payment.Discount = pkg.Price - amount
+	}
+	if _, err := db.Collection("payments").InsertOne(ctx, payment); err != nil {
+		if promo != nil {
+			h.releasePromo(ctx, promo, userID)
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot create payment"})
+	}
+
+	checkout, err := h.paymentProvider.CreateCheckout(ctx, payments.CheckoutRequest{
+		Reference:   payment.ID.Hex(),
+		Amount:      payment.Amount,
+		Currency:    payment.Currency,
+		Method:      payment.Method,
+		Description: fmt.Sprintf("%s package", pkg.Name),
+		ReturnURL:   checkoutRequest.ReturnURL,
+	})
+	if err != nil {
+		fmt.Printf("Error creating checkout: %v\n", err)
+		db.Collection("payments").UpdateOne(ctx, bson.M{"_id": payment.ID}, bson.M{"$set": bson.M{"status": "failed", "updated_at": time.Now()}})
+		if promo != nil {
+			h.releasePromo(ctx, promo, userID)
+		}
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Cannot create checkout with payment provider"})
+	}
+
+	payment.ProviderRef = checkout.ProviderRef
+	payment.CheckoutURL = checkout.URL
+	payment.QRPayload = checkout.QRPayload
+	set := bson.M{
+		"provider_ref": payment.ProviderRef,
+		"checkout_url": payment.CheckoutURL,
+		"qr_payload":   payment.QRPayload,
+	}
+	if !checkout.ExpiresAt.IsZero() {
+		payment.ExpiresAt = &checkout.ExpiresAt
+		set["expires_at"] = payment.ExpiresAt
+	}
+	_, err = db.Collection("payments").UpdateOne(ctx, bson.M{"_id": payment.ID}, bson.M{"$set": set})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update payment"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(payment)
+}
+
+// GetPayment ดูสถานะการชำระเงินของผู้ใช้
+func (h *Handler) GetPayment(c *fiber.Ctx) error {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid payment ID"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("payments")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var payment models.Payment
+	err = collection.FindOne(ctx, bson.M{"_id": objectID, "user_id": userID}).Decode(&payment)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Payment not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch payment"})
+	}
+
+	return c.JSON(payment)
+}
+
+// PaymentWebhook รับการแจ้งผลจากผู้ให้บริการชำระเงิน
+func (h *Handler) PaymentWebhook(c *fiber.Ctx) error {
+	if h.paymentProvider == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Payments are not configured"})
+	}
+
+	event, err := h.paymentProvider.VerifyWebhook(c.Body(), c.Get(h.paymentProvider.SignatureHeader()))
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid webhook signature"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("webhook_events")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// Providers retry webhooks, so each event ID is processed only once
+	record := models.WebhookEvent{
+		ID:         fmt.Sprintf("%s:%s", h.paymentProvider.Name(), event.ID),
+		Type:       event.Type,
+		Reference:  event.Reference,
+		ReceivedAt: time.Now(),
+	}
+	if _, err := collection.InsertOne(ctx, record); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(fiber.Map{"message": "Event already processed"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot record webhook event"})
+	}
+
+	switch event.Type {
+	case payments.EventPaymentSucceeded:
+		err = h.activatePayment(ctx, event)
+	case payments.EventPaymentFailed:
+		err = h.failPayment(ctx, event)
+	case payments.EventRefundSucceeded:
+		err = h.refundPayment(ctx, event.Reference)
+	}
+	if err != nil {
+		fmt.Printf("Error processing webhook %s: %v\n", record.ID, err)
+		// Forget the event so the provider's retry gets another chance
+		collection.DeleteOne(ctx, bson.M{"_id": record.ID})
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot process webhook event"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Event processed"})
+}
+
+// activatePayment marks a pending payment as paid and switches the user to the
+// purchased package. An expired payment is activated too, since the user was
+// charged; other payments are left alone.
+func (h *Handler) activatePayment(ctx context.Context, event *payments.Event) error {
+	objectID, err := primitive.ObjectIDFromHex(event.Reference)
+	if err != nil {
+		return fmt.Errorf("invalid payment reference %q", event.Reference)
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("payments")
+	now := time.Now()
+
+	var payment models.Payment
+	err = collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": objectID, "status": bson.M{"$in": bson.A{"pending", "expired"}}},
+		bson.M{"$set": bson.M{"status": "paid", "paid_at": now, "updated_at": now}},
+	).Decode(&payment)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// A retry won't fix a wrong amount, so park the payment as
+	// amount_mismatch for an admin (GET /admin/payments) to refund instead of
+	// failing the webhook. The expiry job only looks at pending payments.
+	if math.Abs(event.Amount-payment.Amount) > 0.001 {
+		log.Printf("Payment %s: paid amount %.2f does not match %.2f", payment.ID.Hex(), event.Amount, payment.Amount)
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": payment.ID}, bson.M{"$set": bson.M{"status": paymentAmountMismatch, "paid_amount": event.Amount}})
+		return err
+	}
+
+	var expiresAt *time.Time
+	if payment.DurationDays > 0 {
+		expiry := now.Add(time.Hour * 24 * time.Duration(payment.DurationDays))
+		expiresAt = &expiry
+	}
+
+	providerRef := payment.ProviderRef
+	if providerRef == "" {
+		providerRef = event.ProviderRef
+	}
+
+	sub, _, err := h.changePackage(ctx, packageChange{
+		UserID:           payment.UserID,
+		Package:          payment.Package,
+		ExpiresAt:        expiresAt,
+		Price:            &payment.Amount,
+		PaymentReference: providerRef,
+		PromoCode:        payment.PromoCode,
+		Reason:           "payment",
+	})
+	if err != nil {
+		// Put the payment back so the retried webhook activates it
+		collection.UpdateOne(ctx, bson.M{"_id": payment.ID}, bson.M{"$set": bson.M{"status": "pending", "paid_at": nil}})
+		return err
+	}
+
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": payment.ID}, bson.M{
+		"$set": bson.M{"subscription_id": sub.ID, "provider_ref": providerRef},
+	})
+	return err
+}
+
+// failPayment marks a pending payment as failed and gives back the promo code
+// claimed for it at checkout.
+func (h *Handler) failPayment(ctx context.Context, event *payments.Event) error {
+	objectID, err := primitive.ObjectIDFromHex(event.Reference)
+	if err != nil {
+		return fmt.Errorf("invalid payment reference %q", event.Reference)
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("payments")
+	var payment models.Payment
+	err = collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": objectID, "status": "pending"},
+		bson.M{"$set": bson.M{"status": "failed", "updated_at": time.Now()}},
+	).Decode(&payment)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h.releasePaymentPromo(ctx, &payment)
+	return nil
+}
+
+// ExpirePendingPayments marks the payments still pending grace after their
+// checkout expired as expired, gives back their promo codes and returns how
+// many there were. Payments from before checkouts recorded their expiry
+// expire a day after they were created.
+func (h *Handler) ExpirePendingPayments(ctx context.Context, grace time.Duration) (int, error) {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("payments")
+	cutoff := time.Now().Add(-grace)
+	cursor, err := collection.Find(ctx, bson.M{
+		"status": "pending",
+		"$or": []bson.M{
+			{"expires_at": bson.M{"$lte": cutoff}},
+			{"expires_at": nil, "created_at": bson.M{"$lte": cutoff.Add(-24 * time.Hour)}},
+		},
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var pending []models.Payment
+	if err := cursor.All(ctx, &pending); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, p := range pending {
+		// Paid or failed in the meantime is left alone
+		var payment models.Payment
+		err := collection.FindOneAndUpdate(ctx,
+			bson.M{"_id": p.ID, "status": "pending"},
+			bson.M{"$set": bson.M{"status": "expired", "updated_at": time.Now()}},
+		).Decode(&payment)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		h.releasePaymentPromo(ctx, &payment)
+		expired++
+	}
+	return expired, nil
+}
+
+// releasePaymentPromo gives back the promo code of a payment that didn't go
+// through.
+func (h *Handler) releasePaymentPromo(ctx context.Context, payment *models.Payment) {
+	if payment.PromoCode == "" {
+		return
+	}
+	var promo models.PromoCode
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("promo_codes")
+	if err := collection.FindOne(ctx, bson.M{"code": payment.PromoCode}).Decode(&promo); err != nil {
+		fmt.Printf("Error releasing promo code %s of payment %s: %v\n", payment.PromoCode, payment.ID.Hex(), err)
+		return
+	}
+	h.releasePromo(ctx, &promo, payment.UserID)
+}
+
+// refundPayment marks a paid or amount_mismatch payment as refunded and, if
+// its subscription is still the user's current one, downgrades the user to
+// free.
+func (h *Handler) refundPayment(ctx context.Context, reference string) error {
+	objectID, err := primitive.ObjectIDFromHex(reference)
+	if err != nil {
+		return fmt.Errorf("invalid payment reference %q", reference)
+	}
+
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	now := time.Now()
+
+	var payment models.Payment
+	err = db.Collection("payments").FindOneAndUpdate(ctx,
+		bson.M{"_id": objectID, "status": bson.M{"$in": bson.A{"paid", paymentAmountMismatch}}},
+		bson.M{"$set": bson.M{"status": "refunded", "refunded_at": now, "updated_at": now}},
+	).Decode(&payment)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// A mismatched payment activated nothing, but still holds its promo code
+	if payment.Status == paymentAmountMismatch {
+		h.releasePaymentPromo(ctx, &payment)
+		return nil
+	}
+
+	var sub models.Subscription
+	err = db.Collection("subscriptions").FindOne(ctx, bson.M{"_id": payment.SubscriptionID}).Decode(&sub)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	if err == nil && sub.Status == "active" {
+		free := 0.0
+		if _, _, err := h.changePackage(ctx, packageChange{
+			UserID:  payment.UserID,
+			Package: "free",
+			Price:   &free,
+			Reason:  "refund",
+		}); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Collection("subscriptions").UpdateOne(ctx,
+		bson.M{"_id": payment.SubscriptionID},
+		bson.M{"$set": bson.M{"status": "refunded"}},
+	)
+	return err
+}
+
+// AdminRefundPayment คืนเงินและลดแพ็กเกจกลับเป็น free
+func (h *Handler) AdminRefundPayment(c *fiber.Ctx) error {
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can refund payments"})
+	}
+
+	if h.paymentProvider == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Payments are not configured"})
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid payment ID"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("payments")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var payment models.Payment
+	if err := collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&payment); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Payment not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch payment"})
+	}
+	if payment.Status != "paid" && payment.Status != paymentAmountMismatch {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Only paid payments can be refunded"})
+	}
+
+	amount := payment.Amount
+	if payment.Status == paymentAmountMismatch {
+		amount = payment.PaidAmount
+	}
+	if err := h.paymentProvider.Refund(ctx, payment.ProviderRef, amount); err != nil {
+		fmt.Printf("Error refunding payment: %v\n", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Payment provider refused the refund"})
+	}
+
+	if err := h.refundPayment(ctx, payment.ID.Hex()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update payment"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Payment refunded successfully"})
+}
+
+// AdminGetPayments รายการการชำระเงินตามสถานะ (?status=, ค่าเริ่มต้น amount_mismatch ที่รอ admin ตรวจสอบ)
+func (h *Handler) AdminGetPayments(c *fiber.Ctx) error {
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can list payments"})
+	}
+
+	status := c.Query("status", paymentAmountMismatch)
+	if !containsString(paymentStatuses, status) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Status must be pending, paid, failed, expired, refunded or amount_mismatch"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("payments")
+	cursor, err := collection.Find(ctx, bson.M{"status": status}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch payments"})
+	}
+	list := []models.Payment{}
+	if err := cursor.All(ctx, &list); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode payments"})
+	}
+	return c.JSON(list)
+}
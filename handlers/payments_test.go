@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/payments"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// postWebhook signs event with provider and posts it to the webhook handler,
+// returning the status and body of the reply.
+func postWebhook(t *testing.T, app *fiber.App, provider *payments.FakeProvider, event payments.Event) (int, string) {
+	t.Helper()
+	payload, signature, err := provider.SignedEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(string(payload)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(provider.SignatureHeader(), signature)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	client, db := testDatabase(t)
+	ctx := context.Background()
+
+	provider, err := payments.NewFakeProvider("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(client)
+	h.SetPaymentProvider(provider)
+	app := fiber.New()
+	app.Post("/webhook", h.PaymentWebhook)
+
+	user := models.User{ID: primitive.NewObjectID(), Username: "buyer", Package: "free", Status: "Active"}
+	if _, err := db.Collection("users").InsertOne(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	payment := models.Payment{
+		ID:           primitive.NewObjectID(),
+		UserID:       user.ID,
+		Package:      "Plus",
+		Amount:       199,
+		Currency:     "THB",
+		Method:       "promptpay",
+		Provider:     provider.Name(),
+		ProviderRef:  "fake_chrg_1",
+		Status:       "pending",
+		DurationDays: 30,
+		CreatedAt:    time.Now(),
+	}
+	if _, err := db.Collection("payments").InsertOne(ctx, payment); err != nil {
+		t.Fatal(err)
+	}
+
+	userPackage := func() string {
+		t.Helper()
+		var got models.User
+		if err := db.Collection("users").FindOne(ctx, bson.M{"_id": user.ID}).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got.Package
+	}
+	paymentStatus := func() string {
+		t.Helper()
+		var got models.Payment
+		if err := db.Collection("payments").FindOne(ctx, bson.M{"_id": payment.ID}).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got.Status
+	}
+
+	t.Run("invalid signature", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/webhook", strings.NewReader(`{"id":"evt_0"}`))
+		req.Header.Set(provider.SignatureHeader(), "00")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	paid := payments.Event{
+		ID:          "evt_paid",
+		Type:        payments.EventPaymentSucceeded,
+		Reference:   payment.ID.Hex(),
+		ProviderRef: payment.ProviderRef,
+		Amount:      payment.Amount,
+	}
+
+	t.Run("payment succeeded", func(t *testing.T) {
+		if status, body := postWebhook(t, app, provider, paid); status != fiber.StatusOK || !strings.Contains(body, "Event processed") {
+			t.Fatalf("webhook = %d %s", status, body)
+		}
+		if got := paymentStatus(); got != "paid" {
+			t.Errorf("payment status = %q, want paid", got)
+		}
+		if got := userPackage(); got != "Plus" {
+			t.Errorf("user package = %q, want Plus", got)
+		}
+	})
+
+	t.Run("same event again", func(t *testing.T) {
+		before, err := db.Collection("subscriptions").CountDocuments(ctx, bson.M{"user_id": user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, body := postWebhook(t, app, provider, paid); status != fiber.StatusOK || !strings.Contains(body, "Event already processed") {
+			t.Fatalf("webhook = %d %s", status, body)
+		}
+		after, err := db.Collection("subscriptions").CountDocuments(ctx, bson.M{"user_id": user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after != before {
+			t.Errorf("replayed event created %d subscriptions", after-before)
+		}
+	})
+
+	t.Run("refund succeeded", func(t *testing.T) {
+		refund := payments.Event{
+			ID:          "evt_refund",
+			Type:        payments.EventRefundSucceeded,
+			Reference:   payment.ID.Hex(),
+			ProviderRef: payment.ProviderRef,
+			Amount:      payment.Amount,
+		}
+		if status, body := postWebhook(t, app, provider, refund); status != fiber.StatusOK || !strings.Contains(body, "Event processed") {
+			t.Fatalf("webhook = %d %s", status, body)
+		}
+		if got := paymentStatus(); got != "refunded" {
+			t.Errorf("payment status = %q, want refunded", got)
+		}
+		if got := userPackage(); got != "free" {
+			t.Errorf("user package = %q, want free", got)
+		}
+
+		var paidFor models.Payment
+		if err := db.Collection("payments").FindOne(ctx, bson.M{"_id": payment.ID}).Decode(&paidFor); err != nil {
+			t.Fatal(err)
+		}
+		var sub models.Subscription
+		if err := db.Collection("subscriptions").FindOne(ctx, bson.M{"_id": paidFor.SubscriptionID}).Decode(&sub); err != nil {
+			t.Fatal(err)
+		}
+		if sub.Status != "refunded" {
+			t.Errorf("subscription status = %q, want refunded", sub.Status)
+		}
+	})
+}
+
+func TestPaymentWebhookAmountMismatch(t *testing.T) {
+	client, db := testDatabase(t)
+	ctx := context.Background()
+
+	provider, err := payments.NewFakeProvider("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(client)
+	h.SetPaymentProvider(provider)
+	app := fiber.New()
+	app.Post("/webhook", h.PaymentWebhook)
+
+	user := models.User{ID: primitive.NewObjectID(), Username: "buyer", Package: "free", Status: "Active"}
+	admin := models.User{ID: primitive.NewObjectID(), Username: "admin", Role: "admin", Status: "Active"}
+	if _, err := db.Collection("users").InsertMany(ctx, []interface{}{user, admin}); err != nil {
+		t.Fatal(err)
+	}
+	app.Get("/admin/payments", asUser(admin.ID), h.AdminGetPayments)
+
+	expired := time.Now().Add(-48 * time.Hour)
+	payment := models.Payment{
+		ID:           primitive.NewObjectID(),
+		UserID:       user.ID,
+		Package:      "Plus",
+		Amount:       199,
+		Currency:     "THB",
+		Method:       "promptpay",
+		Provider:     provider.Name(),
+		ProviderRef:  "fake_chrg_1",
+		Status:       "pending",
+		DurationDays: 30,
+		CreatedAt:    expired,
+		ExpiresAt:    &expired,
+	}
+	if _, err := db.Collection("payments").InsertOne(ctx, payment); err != nil {
+		t.Fatal(err)
+	}
+
+	underpaid := payments.Event{
+		ID:          "evt_underpaid",
+		Type:        payments.EventPaymentSucceeded,
+		Reference:   payment.ID.Hex(),
+		ProviderRef: payment.ProviderRef,
+		Amount:      1,
+	}
+	if status, body := postWebhook(t, app, provider, underpaid); status != fiber.StatusOK {
+		t.Fatalf("webhook = %d %s", status, body)
+	}
+
+	// The expiry job leaves it for an admin
+	if _, err := h.ExpirePendingPayments(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	var got models.Payment
+	if err := db.Collection("payments").FindOne(ctx, bson.M{"_id": payment.ID}).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "amount_mismatch" || got.PaidAmount != 1 {
+		t.Errorf("payment status, paid amount = %q, %v; want amount_mismatch, 1", got.Status, got.PaidAmount)
+	}
+	var buyer models.User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": user.ID}).Decode(&buyer); err != nil {
+		t.Fatal(err)
+	}
+	if buyer.Package != "free" {
+		t.Errorf("user package = %q, want free", buyer.Package)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/admin/payments?status=amount_mismatch", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []models.Payment
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != payment.ID {
+		t.Errorf("GET /admin/payments = %+v, want the mismatched payment", listed)
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+
+	"github.com/piyawat001/user-auth-api/dicom"
+	"github.com/piyawat001/user-auth-api/models"
+)
+
+const (
+	previewSize   = 1024
+	thumbnailSize = 256
+
+	// maxDecodedPixels bounds the images decoded in memory (4 bytes a pixel
+	// for RGBA), well above the largest panoramic or cephalometric film
+	maxDecodedPixels = 50_000_000
+)
+
+// decodeImage decodes a PNG or JPEG after checking from its header that it
+// has at most maxDecodedPixels, so a small file claiming huge dimensions
+// can't exhaust memory.
+func decodeImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPixels(config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	return src, err
+}
+
+func checkPixels(width, height int) error {
+	if width*height > maxDecodedPixels {
+		return fmt.Errorf("%d×%d image is over %d pixels", width, height, maxDecodedPixels)
+	}
+	return nil
+}
+
+type rendition struct {
+	key  *string
+	name string
+	size int
+}
+
+func derivedKey(sum, name string) string {
+	return fmt.Sprintf("images/derived/%s/%s/%s", sum[:2], sum, name)
+}
+
+// storePreviews renders the PNG preview (DICOM only, browsers already show
+// PNG and JPEG) and thumbnail of an upload and records their keys and the
+// image size on img. Files that can't be decoded are kept without renderings.
+// It returns the decoded image, or nil.
+func (h *Handler) storePreviews(ctx context.Context, img *models.PatientImage, data []byte, file *dicom.File) image.Image {
+	var (
+		src image.Image
+		err error
+	)
+	if file != nil {
+		if err = checkPixels(file.Uint16(dicom.TagColumns), file.Uint16(dicom.TagRows)); err == nil {
+			src, err = file.Image()
+		}
+	} else {
+		src, err = decodeImage(data)
+	}
+	if err != nil {
+		fmt.Printf("Error rendering preview for %s: %v\n", img.SHA256, err)
+		return nil
+	}
+
+	if img.Width == 0 {
+		img.Width, img.Height = src.Bounds().Dx(), src.Bounds().Dy()
+	}
+
+	renditions := []rendition{{&img.ThumbnailKey, "thumbnail.png", thumbnailSize}}
+	if file != nil {
+		renditions = append(renditions, rendition{&img.PreviewKey, "preview.png", previewSize})
+	}
+
+	for _, r := range renditions {
+		key := derivedKey(img.SHA256, r.name)
+		exists, err := h.blobs.Exists(ctx, key)
+		if err != nil {
+			fmt.Printf("Error checking preview %s: %v\n", key, err)
+			continue
+		}
+		if !exists {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, fitImage(src, r.size)); err != nil {
+				fmt.Printf("Error encoding preview %s: %v\n", key, err)
+				continue
+			}
+			if err := h.blobs.Put(ctx, key, &buf, int64(buf.Len()), "image/png"); err != nil {
+				fmt.Printf("Error storing preview %s: %v\n", key, err)
+				continue
+			}
+		}
+		*r.key = key
+	}
+	return src
+}
+
+// fitImage scales src down to fit in a limit x limit box by averaging the source
+// pixels under each output pixel. Smaller images are returned unchanged.
+func fitImage(src image.Image, limit int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= limit && h <= limit {
+		return src
+	}
+
+	dw, dh := limit, h*limit/w
+	if h > w {
+		dw, dh = w*limit/h, limit
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	_, gray := src.(*image.Gray)
+	var dst interface {
+		image.Image
+		Set(x, y int, c color.Color)
+	}
+	if gray {
+		dst = image.NewGray(image.Rect(0, 0, dw, dh))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, dw, dh))
+	}
+
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
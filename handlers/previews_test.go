@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// pngClaiming returns a 1×1 PNG whose header claims width×height pixels.
+func pngClaiming(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8-byte signature: length, type, data, CRC
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestDecodeImage(t *testing.T) {
+	if src, err := decodeImage(pngClaiming(t, 1, 1)); err != nil || src.Bounds().Dx() != 1 {
+		t.Errorf("decodeImage of a 1×1 PNG = %v, %v", src, err)
+	}
+	if _, err := decodeImage(pngClaiming(t, 100000, 100000)); err == nil {
+		t.Error("decodeImage of a PNG claiming 100000×100000 pixels succeeded")
+	}
+	if _, err := decodeImage([]byte("not an image")); err == nil {
+		t.Error("decodeImage of garbage succeeded")
+	}
+}
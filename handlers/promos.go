@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errPromoInvalid     = errors.New("promo code invalid or expired")
+	errPromoPackage     = errors.New("promo code not valid for package")
+	errPromoUsedUp      = errors.New("promo code usage limit reached")
+	errPromoAlreadyUsed = errors.New("promo code already used by user")
+)
+
+// EnsurePromoIndexes makes promo codes unique, so two admins creating the
+// same code at once can't both succeed.
+func (h *Handler) EnsurePromoIndexes(ctx context.Context) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("promo_codes")
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetName("code_unique").SetUnique(true),
+	})
+	return err
+}
+
+// promoError writes the response for the errors returned by findPromo and claimPromo.
+func promoError(c *fiber.Ctx, err error) error {
+	switch err {
+	case errPromoInvalid:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Promo code is invalid or has expired"})
+	case errPromoPackage:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Promo code cannot be used for this package"})
+	case errPromoUsedUp:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Promo code has reached its usage limit"})
+	case errPromoAlreadyUsed:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "You have already used this promo code"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot apply promo code"})
+}
+
+// findPromo loads an active code that is valid now for pkg.
+func (h *Handler) findPromo(ctx context.Context, code, pkg string) (*models.PromoCode, error) {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("promo_codes")
+	now := time.Now()
+
+	var promo models.PromoCode
+	err := collection.FindOne(ctx, bson.M{"code": strings.ToUpper(strings.TrimSpace(code)), "active": true}).Decode(&promo)
+	if err == mongo.ErrNoDocuments {
+		return nil, errPromoInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if (promo.ValidFrom != nil && now.Before(*promo.ValidFrom)) || (promo.ValidUntil != nil && now.After(*promo.ValidUntil)) {
+		return nil, errPromoInvalid
+	}
+	if len(promo.Packages) > 0 {
+		allowed := false
+		for _, p := range promo.Packages {
+			if p == pkg {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, errPromoPackage
+		}
+	}
+	if promo.MaxUses > 0 && promo.UsedCount >= promo.MaxUses {
+		return nil, errPromoUsedUp
+	}
+
+	return &promo, nil
+}
+
+// claimPromo uses up one redemption of promo for the user. The usage counter
+// is only incremented while below MaxUses, so concurrent redeems can't exceed it.
+func (h *Handler) claimPromo(ctx context.Context, promo *models.PromoCode, userID primitive.ObjectID, pkg string) error {
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+
+	redemption := models.PromoRedemption{
+		ID:         fmt.Sprintf("%s:%s", promo.ID.Hex(), userID.Hex()),
+		CodeID:     promo.ID,
+		UserID:     userID,
+		Package:    pkg,
+		RedeemedAt: time.Now(),
+	}
+	if _, err := db.Collection("promo_redemptions").InsertOne(ctx, redemption); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return errPromoAlreadyUsed
+		}
+		return err
+	}
+
+	filter := bson.M{"_id": promo.ID}
+	if promo.MaxUses > 0 {
+		filter["used_count"] = bson.M{"$lt": promo.MaxUses}
+	}
+	result, err := db.Collection("promo_codes").UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"used_count": 1}})
+	if err == nil && result.ModifiedCount == 0 {
+		err = errPromoUsedUp
+	}
+	if err != nil {
+		db.Collection("promo_redemptions").DeleteOne(ctx, bson.M{"_id": redemption.ID})
+		return err
+	}
+
+	return nil
+}
+
+// releasePromo undoes claimPromo when the purchase it was used for failed.
+func (h *Handler) releasePromo(ctx context.Context, promo *models.PromoCode, userID primitive.ObjectID) {
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	result, err := db.Collection("promo_redemptions").DeleteOne(ctx, bson.M{"_id": fmt.Sprintf("%s:%s", promo.ID.Hex(), userID.Hex())})
+	if err != nil {
+		fmt.Printf("Error releasing promo code: %v\n", err)
+		return
+	}
+	if result.DeletedCount == 0 {
+		return // Already released
+	}
+	if _, err := db.Collection("promo_codes").UpdateOne(ctx, bson.M{"_id": promo.ID}, bson.M{"$inc": bson.M{"used_count": -1}}); err != nil {
+		fmt.Printf("Error releasing promo code: %v\n", err)
+	}
+}
+
+// discountedPrice applies a percent or fixed discount, never going below zero.
+func discountedPrice(promo *models.PromoCode, price float64) float64 {
+	switch promo.Type {
+	case "percent":
+		price -= price * promo.Value / 100
+	case "fixed":
+		price -= promo.Value
+	}
+	return math.Max(0, math.Round(price*100)/100)
+}
+
+// RedeemPromoCode ใช้โค้ดทดลองใช้ฟรี หรือโค้ดส่วนลด 100%
+// Codes that only reduce the price are applied at checkout instead.
+func (h *Handler) RedeemPromoCode(c *fiber.Ctx) error {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	var redeemRequest struct {
+		Code    string `json:"code"`
+		Package string `json:"package"`
+	}
+	if err := c.BodyParser(&redeemRequest); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var pkg models.Package
+	if err := db.Collection("packages").FindOne(ctx, bson.M{"name": redeemRequest.Package}).Decode(&pkg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Package not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch package"})
+	}
+
+	promo, err := h.findPromo(ctx, redeemRequest.Code, pkg.Name)
+	if err != nil {
+		return promoError(c, err)
+	}
+
+	var user models.User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	var change packageChange
+	switch {
+	case promo.Type == "trial":
+		// A trial must not cut short a package the user already pays for
+		if user.Package != "free" {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Trials are only available on the free package"})
+		}
+		// Trials end through the same expiry field as AdminSetPackage, so the
+		// package expiry job downgrades them back to free
+		expiry := time.Now().Add(time.Hour * 24 * time.Duration(promo.TrialDays))
+		free := 0.0
+		change = packageChange{ExpiresAt: &expiry, Price: &free, Trial: true, Reason: "trial"}
+	case discountedPrice(promo, pkg.Price) == 0:
+		var expiresAt *time.Time
+		if pkg.DurationDays > 0 {
+			expiry := time.Now().Add(time.Hour * 24 * time.Duration(pkg.DurationDays))
+			expiresAt = &expiry
+		}
+		free := 0.0
+		change = packageChange{ExpiresAt: expiresAt, Price: &free, Reason: "promo"}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "This code gives a discount, use it as promo_code at checkout"})
+	}
+
+	if err := h.claimPromo(ctx, promo, userID, pkg.Name); err != nil {
+		return promoError(c, err)
+	}
+
+	change.UserID = userID
+	change.Package = pkg.Name
+	change.PromoCode = promo.Code
+	sub, _, err := h.changePackage(ctx, change)
+	if err != nil {
+		h.releasePromo(ctx, promo, userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot activate package"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Promo code redeemed successfully", "subscription": sub})
+}
+
+// GetPromoQuote คำนวณราคาหลังใช้โค้ดส่วนลด (ยังไม่ใช้สิทธิ์)
+func (h *Handler) GetPromoQuote(c *fiber.Ctx) error {
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var pkg models.Package
+	if err := db.Collection("packages").FindOne(ctx, bson.M{"name": c.Query("package")}).Decode(&pkg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Package not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch package"})
+	}
+
+	promo, err := h.findPromo(ctx, c.Params("code"), pkg.Name)
+	if err != nil {
+		return promoError(c, err)
+	}
+
+	quote := fiber.Map{
+		"code":    promo.Code,
+		"type":    promo.Type,
+		"package": pkg.Name,
+		"price":   pkg.Price,
+	}
+	if promo.Type == "trial" {
+		quote["trial_days"] = promo.TrialDays
+	} else {
+		quote["total"] = discountedPrice(promo, pkg.Price)
+	}
+
+	return c.JSON(quote)
+}
+
+// AdminCreatePromoCode สร้างโค้ดส่วนลดหรือโค้ดทดลองใช้
+func (h *Handler) AdminCreatePromoCode(c *fiber.Ctx) error {
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can create promo codes"})
+	}
+
+	var promo models.PromoCode
+	if err := c.BodyParser(&promo); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+
+	promo.Code = strings.ToUpper(strings.TrimSpace(promo.Code))
+	if promo.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Code is required"})
+	}
+	switch promo.Type {
+	case "percent":
+		if promo.Value <= 0 || promo.Value > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Percent discount must be between 0 and 100"})
+		}
+	case "fixed":
+		if promo.Value <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Fixed discount must be positive"})
+		}
+	case "trial":
+		if promo.TrialDays <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Trial days must be positive"})
+		}
+		if len(promo.Packages) != 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "A trial code must name exactly one package"})
+		}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Type must be percent, fixed or trial"})
+	}
+	if promo.MaxUses < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Max uses cannot be negative"})
+	}
+
+	promo.ID = primitive.NilObjectID
+	promo.UsedCount = 0
+	promo.Active = true
+	promo.CreatedBy = admin.ID
+	promo.CreatedAt = time.Now()
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("promo_codes")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The unique index on code rejects a code that already exists
+	result, err := collection.InsertOne(ctx, promo)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Promo code already exists"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot create promo code"})
+	}
+	promo.ID = result.InsertedID.(primitive.ObjectID)
+
+	return c.Status(fiber.StatusCreated).JSON(promo)
+}
+
+// AdminGetPromoCodes ดึงโค้ดทั้งหมด
+func (h *Handler) AdminGetPromoCodes(c *fiber.Ctx) error {
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can list promo codes"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("promo_codes")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch promo codes"})
+	}
+	defer cursor.Close(ctx)
+
+	promos := []models.PromoCode{}
+	if err = cursor.All(ctx, &promos); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode promo codes"})
+	}
+
+	return c.JSON(promos)
+}
+
+// AdminDeactivatePromoCode ปิดการใช้งานโค้ด (ไม่ลบ เพื่อเก็บประวัติ)
+func (h *Handler) AdminDeactivatePromoCode(c *fiber.Ctx) error {
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can deactivate promo codes"})
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid promo code ID"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("promo_codes")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, bson.M{"$set": bson.M{"active": false}})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update promo code"})
+	}
+
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Promo code not found"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Promo code deactivated successfully"})
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/trash"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxQuestionImages = 10
+
+// EnsureQuestionIndexes creates the index the questions of a patient are
+// listed with.
+func (h *Handler) EnsureQuestionIndexes(ctx context.Context) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("questions")
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "patient_id", Value: 1}, {Key: "created_at", Value: -1}},
+		Options: options.Index().SetName("patient_created").SetPartialFilterExpression(bson.M{"patient_id": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// questionDetail is a question with a summary of the patient it is about,
+// for users who may read that patient.
+type questionDetail struct {
+	models.Question
+	Patient *questionPatient `json:"patient,omitempty"`
+}
+
+// questionPatient is what a question shows of its patient: the clinical
+// fields and the images the question refers to.
+type questionPatient struct {
+	ID               primitive.ObjectID `json:"id"`
+	Age              int                `json:"age"`
+	Gender           string             `json:"gender"`
+	DurationOfLesion string             `json:"duration_of_lesion"`
+	Expansion        string             `json:"expansion"`
+	Paresthesia      bool               `json:"paresthesia"`
+	NumberOfLesions  string             `json:"number_of_lesions"`
+	Hospital         string             `json:"hospital,omitempty"`
+	Images           []questionImage    `json:"images,omitempty"`
+}
+
+type questionImage struct {
+	ImageID      primitive.ObjectID `json:"image_id"`
+	ViewType     string             `json:"view_type,omitempty"`
+	Caption      string             `json:"caption,omitempty"`
+	AcquiredAt   *time.Time         `json:"acquired_at,omitempty"`
+	ThumbnailURL string             `json:"thumbnail_url,omitempty"` // Signed, see signedFileURL
+}
+
+// checkQuestionPatient validates the patient and images question refers to
+// against what the asker may read and what the patient consented to: a
+// question shares the case for teaching. A nil error with ok false means
+// the response was written.
+func (h *Handler) checkQuestionPatient(c *fiber.Ctx, question *models.Question) (ok bool, err error) {
+	var errs fieldErrors
+	if question.PatientID == nil {
+		if len(question.ImageIDs) > 0 {
+			errs.add("image_ids", "Need a patient_id")
+			return false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid question data", "fields": errs})
+		}
+		return true, nil
+	}
+
+	var images []primitive.ObjectID
+	for _, id := range question.ImageIDs {
+		if !containsID(images, id) {
+			images = append(images, id)
+		}
+	}
+	question.ImageIDs = images
+	if len(images) > maxQuestionImages {
+		errs.add("image_ids", fmt.Sprintf("At most %d images", maxQuestionImages))
+		return false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid question data", "fields": errs})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	patient, err := h.findPatient(ctx, *question.PatientID, user, false)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Patient not found"})
+		}
+		return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch patient"})
+	}
+	if !hasConsent(patient, models.ConsentScopeTeaching) {
+		return false, consentRequired(c, models.ConsentScopeTeaching)
+	}
+
+	if len(images) > 0 {
+		collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images")
+		count, err := collection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": images}, "patient_id": *question.PatientID})
+		if err != nil {
+			return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot check images"})
+		}
+		if count != int64(len(images)) {
+			errs.add("image_ids", "Must be images of the patient")
+			return false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid question data", "fields": errs})
+		}
+	}
+	return true, nil
+}
+
+// questionPatientSummary summarises the patient of question for the user of
+// the request, or returns nil when the request is anonymous, the user can't
+// read the patient (any more) or the patient has withdrawn their consent to
+// teaching.
+func (h *Handler) questionPatientSummary(ctx context.Context, c *fiber.Ctx, question *models.Question) *questionPatient {
+	user, err := h.currentUser(c)
+	if err != nil {
+		return nil
+	}
+	patient, err := h.findPatient(ctx, *question.PatientID, user, false)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			fmt.Printf("Error fetching patient of question %s: %v\n", question.ID.Hex(), err)
+		}
+		return nil
+	}
+	if !hasConsent(patient, models.ConsentScopeTeaching) {
+		return nil
+	}
+
+	summary := &questionPatient{
+		ID:               patient.ID,
+		Age:              patient.Age,
+		Gender:           patient.Gender,
+		DurationOfLesion: patient.DurationOfLesion,
+		Expansion:        patient.Expansion,
+		Paresthesia:      patient.Paresthesia,
+		NumberOfLesions:  patient.NumberOfLesions,
+		Hospital:         patient.Hospital,
+	}
+	if len(question.ImageIDs) == 0 {
+		return summary
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patient_images")
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": question.ImageIDs}, "patient_id": patient.ID})
+	if err != nil {
+		fmt.Printf("Error fetching images of question %s: %v\n", question.ID.Hex(), err)
+		return summary
+	}
+	var images []models.PatientImage
+	if err := cursor.All(ctx, &images); err != nil {
+		fmt.Printf("Error decoding images of question %s: %v\n", question.ID.Hex(), err)
+		return summary
+	}
+
+	// In the order the asker gave, leaving out images deleted since
+	for _, id := range question.ImageIDs {
+		for _, image := range images {
+			if image.ID != id {
+				continue
+			}
+			view := questionImage{ImageID: id}
+			for _, entry := range patient.Images {
+				if entry.ImageID == id {
+					view.ViewType, view.Caption, view.AcquiredAt = entry.ViewType, string(entry.Caption), entry.AcquiredAt
+				}
+			}
+			if image.ThumbnailKey != "" {
+				view.ThumbnailURL, _ = signedFileURL(id, variantThumbnail)
+			}
+			summary.Images = append(summary.Images, view)
+		}
+	}
+	return summary
+}
+
+// AdminGetPatientQuestions ดึงคำถามทั้งหมดที่อ้างถึงผู้ป่วย :id เรียงจากล่าสุด
+func (h *Handler) AdminGetPatientQuestions(c *fiber.Ctx) error {
+	patientID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid patient ID"})
+	}
+
+	user, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can list the questions of a patient"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("questions")
+	cursor, err := collection.Find(ctx,
+		trash.NotDeleted(bson.M{"patient_id": patientID}),
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch questions"})
+	}
+	defer cursor.Close(ctx)
+
+	questions := []models.Question{}
+	if err = cursor.All(ctx, &questions); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode questions"})
+	}
+
+	return c.JSON(questions)
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/trash"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	usageQuestions = "questions"
+	usagePatients  = "patients"
+)
+
+// defaultQuotas is used when the packages collection has no quota for a package.
+var defaultQuotas = map[string]models.Quota{
+	"free":    {QuestionsPerMonth: 3, PatientsPerMonth: 3},
+	"plus":    {QuestionsPerMonth: 30, PatientsPerMonth: 30},
+	"premium": {QuestionsPerMonth: models.QuotaUnlimited, PatientsPerMonth: models.QuotaUnlimited},
+}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+func usagePeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+func quotaLimit(q models.Quota, kind string) int {
+	if kind == usageQuestions {
+		return q.QuestionsPerMonth
+	}
+	return q.PatientsPerMonth
+}
+
+// quotaFor resolves the effective quota of a user: an admin override wins,
+// then the quota stored on the package, then the built-in default.
+func (h *Handler) quotaFor(ctx context.Context, user models.User) (models.Quota, error) {
+	if user.QuotaOverride != nil {
+		return *user.QuotaOverride, nil
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("packages")
+	var pkg models.Package
+	err := collection.FindOne(ctx, bson.M{"name": user.Package}).Decode(&pkg)
+	if err == nil && pkg.Quota != nil {
+		return *pkg.Quota, nil
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return models.Quota{}, err
+	}
+
+	if q, ok := defaultQuotas[user.Package]; ok {
+		return q, nil
+	}
+	return defaultQuotas["free"], nil
+}
+
+// reserveQuota atomically counts one more record of kind for the user in the
+// current period, or returns errQuotaExceeded when the limit is reached.
+func (h *Handler) reserveQuota(ctx context.Context, userID primitive.ObjectID, kind string) error {
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+
+	var user models.User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		return err
+	}
+
+	quota, err := h.quotaFor(ctx, user)
+	if err != nil {
+		return err
+	}
+	limit := quotaLimit(quota, kind)
+	if limit == 0 {
+		return errQuotaExceeded
+	}
+
+	period := usagePeriod(time.Now())
+	filter := bson.M{"_id": fmt.Sprintf("%s:%s", userID.Hex(), period)}
+	if limit >= 0 {
+		filter[kind] = bson.M{"$lt": limit}
+	}
+	update := bson.M{
+		"$inc":         bson.M{kind: 1},
+		"$setOnInsert": bson.M{"user_id": userID, "period": period},
+	}
+
+	// When the counter is already at the limit the filter doesn't match and the
+	// upsert collides with the existing _id, which means the quota is used up.
+	_, err = db.Collection("usage").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return errQuotaExceeded
+	}
+	return err
+}
+
+// releaseQuota gives back a reservation when the record could not be created.
+func (h *Handler) releaseQuota(ctx context.Context, userID primitive.ObjectID, kind string) {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("usage")
+	id := fmt.Sprintf("%s:%s", userID.Hex(), usagePeriod(time.Now()))
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{kind: -1}}); err != nil {
+		fmt.Printf("Error releasing quota: %v\n", err)
+	}
+}
+
+// quotaError writes the response for a failed reserveQuota call.
+func quotaError(c *fiber.Ctx, err error) error {
+	if err == errQuotaExceeded {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Monthly quota exceeded for your package"})
+	}
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot check quota"})
+}
+
+// GetMyUsage ดูการใช้งานและโควต้าของผู้ใช้ในเดือนปัจจุบัน
+func (h *Handler) GetMyUsage(c *fiber.Ctx) error {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch user"})
+	}
+
+	quota, err := h.quotaFor(ctx, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch quota"})
+	}
+
+	period := usagePeriod(time.Now())
+	usage := models.Usage{UserID: userID, Period: period}
+	err = db.Collection("usage").FindOne(ctx, bson.M{"_id": fmt.Sprintf("%s:%s", userID.Hex(), period)}).Decode(&usage)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch usage"})
+	}
+
+	return c.JSON(fiber.Map{
+		"package":    user.Package,
+		"period":     period,
+		"quota":      quota,
+		"usage":      usage,
+		"overridden": user.QuotaOverride != nil,
+	})
+}
+
+// AdminSetUserQuota กำหนดโควต้าเฉพาะผู้ใช้ (แทนค่าของแพ็กเกจ)
+func (h *Handler) AdminSetUserQuota(c *fiber.Ctx) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	var quota models.Quota
+	if err := c.BodyParser(&quota); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot parse JSON"})
+	}
+	if quota.QuestionsPerMonth < models.QuotaUnlimited || quota.PatientsPerMonth < models.QuotaUnlimited {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Quota must be -1 (unlimited) or greater"})
+	}
+
+	return h.setQuotaOverride(c, objectID, bson.M{"$set": bson.M{"quota_override": quota, "updatedAt": time.Now()}})
+}
+
+// AdminClearUserQuota ยกเลิกโควต้าเฉพาะผู้ใช้ กลับไปใช้ค่าของแพ็กเกจ
+func (h *Handler) AdminClearUserQuota(c *fiber.Ctx) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	return h.setQuotaOverride(c, objectID, bson.M{"$unset": bson.M{"quota_override": ""}, "$set": bson.M{"updatedAt": time.Now()}})
+}
+
+func (h *Handler) setQuotaOverride(c *fiber.Ctx, userID primitive.ObjectID, update bson.M) error {
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can change quotas"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := collection.UpdateOne(ctx, trash.NotDeleted(bson.M{"_id": userID}), update)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot update user"})
+	}
+
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	return c.JSON(fiber.Map{"message": "User quota updated successfully"})
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestQuotaFor(t *testing.T) {
+	client, db := testDatabase(t)
+	ctx := context.Background()
+	h := NewHandler(client)
+
+	for _, pkg := range []models.Package{
+		{Name: "plus"},
+		{Name: "closed", Quota: &models.Quota{}},
+	} {
+		if _, err := db.Collection("packages").InsertOne(ctx, pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	override := models.Quota{QuestionsPerMonth: 7, PatientsPerMonth: 7}
+	tests := []struct {
+		name string
+		user models.User
+		want models.Quota
+	}{
+		{"package without a quota", models.User{Package: "plus"}, defaultQuotas["plus"]},
+		{"package with a zero quota", models.User{Package: "closed"}, models.Quota{}},
+		{"unknown package", models.User{Package: "gold"}, defaultQuotas["free"]},
+		{"override", models.User{Package: "closed", QuotaOverride: &override}, override},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.quotaFor(ctx, tt.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("quotaFor = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	user := models.User{ID: primitive.NewObjectID(), Package: "closed"}
+	if _, err := db.Collection("users").InsertOne(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.reserveQuota(ctx, user.ID, usagePatients); err != errQuotaExceeded {
+		t.Errorf("reserveQuota on a zero quota = %v, want errQuotaExceeded", err)
+	}
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/pdf"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// packageChange describes a switch of a user to a new package. Every change
+// ends the current subscription, starts a new one and, when something was
+// paid, issues an invoice.
+type packageChange struct {
+	UserID           primitive.ObjectID
+	Package          string
+	ExpiresAt        *time.Time
+	Price            *float64 // nil means the current price of the package
+	GrantedBy        primitive.ObjectID
+	PaymentReference string
+	PromoCode        string
+	Trial            bool
+	Reason           string // Recorded in package_history
+	Set              bson.M // Extra user fields to set, e.g. role
+}
+
+func (h *Handler) changePackage(ctx context.Context, change packageChange) (*models.Subscription, *models.Invoice, error) {
+	db := h.client.Database(os.Getenv("DATABASE_NAME"))
+	now := time.Now()
+
+	var user models.User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": change.UserID}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil, errUserNotFound
+		}
+		return nil, nil, err
+	}
+
+	set := bson.M{
+		"package":   change.Package,
+		"expiry":    change.ExpiresAt,
+		"updatedAt": now,
+	}
+	for k, v := range change.Set {
+		set[k] = v
+	}
+	update := bson.M{
+		"$set": set,
+		// A new expiry date needs a new reminder from the expiry job
+		"$unset": bson.M{"expiry_reminder_sent_at": ""},
+	}
+	if _, err := db.Collection("users").UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+		return nil, nil, err
+	}
+
+	price := 0.0
+	if change.Price != nil {
+		price = *change.Price
+	} else {
+		var pkg models.Package
+		err := db.Collection("packages").FindOne(ctx, bson.M{"name": change.Package}).Decode(&pkg)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, nil, err
+		}
+		price = pkg.Price
+	}
+
+	_, err := db.Collection("subscriptions").UpdateMany(ctx,
+		bson.M{"user_id": user.ID, "status": "active"},
+		bson.M{"$set": bson.M{"status": "ended", "end_at": now}},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sub := models.Subscription{
+		UserID:           user.ID,
+		Package:          change.Package,
+		Status:           "active",
+		StartAt:          now,
+		ExpiresAt:        change.ExpiresAt,
+		Price:            price,
+		Currency:         models.Currency,
+		GrantedBy:        change.GrantedBy,
+		PaymentReference: change.PaymentReference,
+		PromoCode:        change.PromoCode,
+		Trial:            change.Trial,
+		CreatedAt:        now,
+	}
+	result, err := db.Collection("subscriptions").InsertOne(ctx, sub)
+	if err != nil {
+		return nil, nil, err
+	}
+	sub.ID = result.InsertedID.(primitive.ObjectID)
+
+	changedBy := "system"
+	if !change.GrantedBy.IsZero() {
+		changedBy = change.GrantedBy.Hex()
+	}
+	history := models.PackageHistory{
+		UserID:      user.ID,
+		FromPackage: user.Package,
+		ToPackage:   change.Package,
+		Reason:      change.Reason,
+		ChangedBy:   changedBy,
+		ChangedAt:   now,
+	}
+	if _, err := db.Collection("package_history").InsertOne(ctx, history); err != nil {
+		return nil, nil, err
+	}
+
+	if price <= 0 {
+		return &sub, nil, nil
+	}
+
+	invoice, err := h.issueInvoice(ctx, user, sub)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &sub, invoice, nil
+}
+
+// nextInvoiceNumber hands out increasing numbers per year, e.g.
+// INV-2024-000001. A number is used up even if the invoice then fails to
+// save, so the sequence can have gaps.
+func (h *Handler) nextInvoiceNumber(ctx context.Context, year int) (string, error) {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("counters")
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": fmt.Sprintf("invoice-%d", year)},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		opts,
+	).Decode(&counter)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("INV-%d-%06d", year, counter.Seq), nil
+}
+
+func (h *Handler) issueInvoice(ctx context.Context, user models.User, sub models.Subscription) (*models.Invoice, error) {
+	number, err := h.nextInvoiceNumber(ctx, sub.StartAt.Year())
+	if err != nil {
+		return nil, err
+	}
+
+	description := fmt.Sprintf("%s package", sub.Package)
+	if sub.ExpiresAt != nil {
+		description += fmt.Sprintf(" (%s - %s)", sub.StartAt.Format("2006-01-02"), sub.ExpiresAt.Format("2006-01-02"))
+	}
+	if sub.PromoCode != "" {
+		description += ", promo code " + sub.PromoCode
+	}
+
+	invoice := models.Invoice{
+		Number:           number,
+		UserID:           user.ID,
+		SubscriptionID:   sub.ID,
+		BillTo:           user.Username,
+		Hospital:         user.Hospital,
+		Items:            []models.InvoiceItem{{Description: description, Amount: sub.Price}},
+		Total:            sub.Price,
+		Currency:         sub.Currency,
+		PaymentReference: sub.PaymentReference,
+		IssuedAt:         sub.StartAt,
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("invoices")
+	result, err := collection.InsertOne(ctx, invoice)
+	if err != nil {
+		return nil, err
+	}
+	invoice.ID = result.InsertedID.(primitive.ObjectID)
+
+	return &invoice, nil
+}
+
+// GetMySubscriptions ดึงประวัติแพ็กเกจของผู้ใช้
+func (h *Handler) GetMySubscriptions(c *fiber.Ctx) error {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	return h.listSubscriptions(c, userID)
+}
+
+// AdminGetUserSubscriptions ดึงประวัติแพ็กเกจของผู้ใช้ที่ระบุ
+func (h *Handler) AdminGetUserSubscriptions(c *fiber.Ctx) error {
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can view other users' subscriptions"})
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+	return h.listSubscriptions(c, objectID)
+}
+
+func (h *Handler) listSubscriptions(c *fiber.Ctx, userID primitive.ObjectID) error {
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("subscriptions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "start_at", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch subscriptions"})
+	}
+	defer cursor.Close(ctx)
+
+	subscriptions := []models.Subscription{}
+	if err = cursor.All(ctx, &subscriptions); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode subscriptions"})
+	}
+
+	return c.JSON(subscriptions)
+}
+
+// GetMyInvoices ดึงใบแจ้งหนี้ทั้งหมดของผู้ใช้
+func (h *Handler) GetMyInvoices(c *fiber.Ctx) error {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("invoices")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "issued_at", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch invoices"})
+	}
+	defer cursor.Close(ctx)
+
+	invoices := []models.Invoice{}
+	if err = cursor.All(ctx, &invoices); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode invoices"})
+	}
+
+	return c.JSON(invoices)
+}
+
+// GetMyInvoice ดึงใบแจ้งหนี้ของผู้ใช้ (JSON)
+func (h *Handler) GetMyInvoice(c *fiber.Ctx) error {
+	invoice, err := h.findMyInvoice(c)
+	if err != nil {
+		return err
+	}
+	if invoice == nil {
+		return nil
+	}
+	return c.JSON(invoice)
+}
+
+// GetMyInvoicePDF ดาวน์โหลดใบแจ้งหนี้เป็นไฟล์ PDF
+func (h *Handler) GetMyInvoicePDF(c *fiber.Ctx) error {
+	invoice, err := h.findMyInvoice(c)
+	if err != nil {
+		return err
+	}
+	if invoice == nil {
+		return nil
+	}
+
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.pdf"`, invoice.Number))
+	return c.Send(renderInvoice(invoice, h.pdfFont))
+}
+
+// findMyInvoice loads the invoice in the :id param if it belongs to the caller.
+// When it returns a nil invoice the error response has already been written.
+func (h *Handler) findMyInvoice(c *fiber.Ctx) (*models.Invoice, error) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid invoice ID"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("invoices")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var invoice models.Invoice
+	err = collection.FindOne(ctx, bson.M{"_id": objectID, "user_id": userID}).Decode(&invoice)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invoice not found"})
+		}
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch invoice"})
+	}
+
+	return &invoice, nil
+}
+
+func renderInvoice(invoice *models.Invoice, font *pdf.Font) []byte {
+	doc := pdf.Document{Font: font}
+	doc.Heading("Invoice " + invoice.Number)
+	doc.Blank()
+	doc.Text("Issued: " + invoice.IssuedAt.Format("2006-01-02"))
+	doc.Text("Bill to: " + invoice.BillTo)
+	if invoice.Hospital != "" {
+		doc.Text("Hospital: " + invoice.Hospital)
+	}
+	if invoice.PaymentReference != "" {
+		doc.Text("Payment reference: " + invoice.PaymentReference)
+	}
+	doc.Blank()
+	for _, item := range invoice.Items {
+		doc.Text(fmt.Sprintf("%s    %.2f %s", item.Description, item.Amount, invoice.Currency))
+	}
+	doc.Blank()
+	doc.Text(fmt.Sprintf("Total: %.2f %s", invoice.Total, invoice.Currency))
+	return doc.Bytes()
+}
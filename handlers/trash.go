@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/trash"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// softDelete is the update that moves a user or question to the recycle bin,
+// noting who did it when the request is authenticated.
+func softDelete(c *fiber.Ctx) bson.M {
+	set := bson.M{"deleted_at": time.Now()}
+	if userID, err := currentUserID(c); err == nil {
+		set["deleted_by"] = userID
+	}
+	return bson.M{"$set": set}
+}
+
+// setPatientDeleted moves patient to the recycle bin, or back out of it, as a
+// new revision so the history shows who did it and when.
+func (h *Handler) setPatientDeleted(ctx context.Context, patient *models.Patient, userID primitive.ObjectID, deleted bool) error {
+	if patient.Revision == 0 {
+		if err := h.recordBaseline(ctx, patient); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	filter := bson.M{"_id": patient.ID, "updatedAt": patientVersion(patient)}
+	set := bson.M{"updatedAt": now, "revision": patient.Revision + 1}
+	update := bson.M{"$set": set}
+	action := models.RevisionUndelete
+	if deleted {
+		trash.NotDeleted(filter)
+		set["deleted_at"] = now
+		set["deleted_by"] = userID
+		action = models.RevisionDelete
+	} else {
+		trash.Deleted(filter)
+		update["$unset"] = bson.M{"deleted_at": "", "deleted_by": ""}
+	}
+
+	next := *patient
+	next.UpdatedAt = now
+	next.Revision++
+	next.DeletedAt, next.DeletedBy = nil, nil
+	if deleted {
+		next.DeletedAt, next.DeletedBy = &now, &userID
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection("patients")
+	err := h.recordRevision(ctx, &next, action, nil, userID, nil, func() error {
+		result, err := collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errPatientChanged
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	h.invalidatePatientStats(ctx)
+	*patient = next
+	return nil
+}
+
+// trashParams reads :type and :id of a recycle bin route. A nil error with
+// ok false means the response was written.
+func trashParams(c *fiber.Ctx) (kind string, id primitive.ObjectID, ok bool, err error) {
+	kind = c.Params("type")
+	if !trash.Valid(kind) {
+		return "", id, false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Type must be patients, users or questions"})
+	}
+	id, err = primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return "", id, false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+	return kind, id, true, nil
+}
+
+// AdminGetTrash ดึงรายการในถังขยะตามชนิด (?type=patients|users|questions) เรียงจากที่ลบล่าสุด
+func (h *Handler) AdminGetTrash(c *fiber.Ctx) error {
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can view the recycle bin"})
+	}
+
+	kind := c.Query("type")
+	if !trash.Valid(kind) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Type must be patients, users or questions"})
+	}
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection(kind)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "deleted_at", Value: -1}})
+	cursor, err := collection.Find(ctx, trash.Deleted(bson.M{}), opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch recycle bin"})
+	}
+	defer cursor.Close(ctx)
+
+	records := []bson.M{}
+	if err = cursor.All(ctx, &records); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot decode recycle bin"})
+	}
+
+	// Filter out sensitive information
+	for i := range records {
+		delete(records[i], "password")
+	}
+
+	return c.JSON(records)
+}
+
+// AdminRestoreFromTrash กู้คืนข้อมูลจากถังขยะ (ผู้ป่วยจะบันทึกเป็นเวอร์ชันใหม่ในประวัติ)
+func (h *Handler) AdminRestoreFromTrash(c *fiber.Ctx) error {
+	kind, id, ok, err := trashParams(c)
+	if !ok {
+		return err
+	}
+
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can restore from the recycle bin"})
+	}
+	adminID := admin.ID
+
+	collection := h.client.Database(os.Getenv("DATABASE_NAME")).Collection(kind)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if kind == trash.Patients {
+		var patient models.Patient
+		if err := collection.FindOne(ctx, trash.Deleted(bson.M{"_id": id})).Decode(&patient); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Not found in recycle bin"})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot fetch recycle bin"})
+		}
+		// Its images and the rest now belong to the record it was merged into
+		if patient.MergedInto != nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient was merged into " + patient.MergedInto.Hex() + " and cannot be restored"})
+		}
+		if err := h.setPatientDeleted(ctx, &patient, adminID, false); err != nil {
+			if err == errPatientChanged {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Patient was changed by someone else, please retry"})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot restore patient"})
+		}
+		return c.JSON(fiber.Map{"message": "Patient restored successfully", "patient": patient})
+	}
+
+	result, err := collection.UpdateOne(ctx,
+		trash.Deleted(bson.M{"_id": id}),
+		bson.M{"$unset": bson.M{"deleted_at": "", "deleted_by": ""}},
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot restore record"})
+	}
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Not found in recycle bin"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Record restored successfully"})
+}
+
+// AdminPurgeFromTrash ลบข้อมูลในถังขยะถาวร (รวมภาพ คำอธิบายประกอบ และประวัติของผู้ป่วย)
+func (h *Handler) AdminPurgeFromTrash(c *fiber.Ctx) error {
+	kind, id, ok, err := trashParams(c)
+	if !ok {
+		return err
+	}
+
+	admin, err := h.currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+	}
+	if !isAdmin(admin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only admins can purge the recycle bin"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = trash.Purge(ctx, h.client.Database(os.Getenv("DATABASE_NAME")), h.blobs, kind, id)
+	if err == trash.ErrNotDeleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Not found in recycle bin"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Cannot purge record"})
+	}
+	// Purging also removes a patient's revisions, so the server log is what
+	// records who did it
+	log.Printf("trash: %s %s purged by admin %s (%s)", kind, id.Hex(), admin.ID.Hex(), admin.Username)
+
+	return c.JSON(fiber.Map{"message": "Record purged successfully"})
+}
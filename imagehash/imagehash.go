@@ -0,0 +1,127 @@
+// Package imagehash computes perceptual hashes of radiographs: 64-bit
+// fingerprints that stay close when the same image is re-exported,
+// rescaled, recompressed or slightly adjusted in brightness, unlike a
+// checksum of the bytes.
+package imagehash
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+const (
+	sampleSize = 32 // The image is reduced to sampleSize x sampleSize gray levels
+	lowFreq    = 8  // of which the lowFreq x lowFreq lowest DCT frequencies make the hash
+	cellPoints = 4  // Source pixels averaged per sample, along each axis
+)
+
+// BandBits is the width of the bands Bands splits a hash into. Two hashes
+// at most 64/BandBits-1 bits apart share at least one band.
+const BandBits = 8
+
+// PHash returns the DCT-based perceptual hash of img: bit i is set when the
+// i-th low frequency coefficient, row by row, is above their median.
+func PHash(img image.Image) uint64 {
+	var pixels [sampleSize][sampleSize]float64
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return 0
+	}
+	for y := 0; y < sampleSize; y++ {
+		for x := 0; x < sampleSize; x++ {
+			// Average a few points spread over the cell rather than every
+			// pixel under it, which is plenty at this resolution
+			var sum float64
+			for sy := 0; sy < cellPoints; sy++ {
+				for sx := 0; sx < cellPoints; sx++ {
+					px := bounds.Min.X + (x*cellPoints+sx)*w/(sampleSize*cellPoints)
+					py := bounds.Min.Y + (y*cellPoints+sy)*h/(sampleSize*cellPoints)
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			pixels[y][x] = sum / (cellPoints * cellPoints)
+		}
+	}
+
+	// Separable 2-D DCT-II, computing only the frequencies that are kept
+	var rows [sampleSize][lowFreq]float64
+	for y := 0; y < sampleSize; y++ {
+		for u := 0; u < lowFreq; u++ {
+			var sum float64
+			for x := 0; x < sampleSize; x++ {
+				sum += pixels[y][x] * cosine[u][x]
+			}
+			rows[y][u] = sum
+		}
+	}
+	var coeffs [lowFreq * lowFreq]float64
+	for v := 0; v < lowFreq; v++ {
+		for u := 0; u < lowFreq; u++ {
+			var sum float64
+			for y := 0; y < sampleSize; y++ {
+				sum += rows[y][u] * cosine[v][y]
+			}
+			coeffs[v*lowFreq+u] = sum
+		}
+	}
+
+	// The DC term is the mean brightness, which says nothing about content
+	sorted := make([]float64, len(coeffs)-1)
+	copy(sorted, coeffs[1:])
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(63-i)
+		}
+	}
+	return hash
+}
+
+var cosine = func() (table [lowFreq][sampleSize]float64) {
+	for u := 0; u < lowFreq; u++ {
+		for x := 0; x < sampleSize; x++ {
+			table[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * sampleSize))
+		}
+	}
+	return table
+}()
+
+// Distance returns the number of bits in which a and b differ, from 0 for
+// the same picture to around 32 for unrelated ones.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Format returns hash as 16 hex digits.
+func Format(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// Parse reads a hash written by Format.
+func Parse(value string) (uint64, error) {
+	if len(value) != 16 {
+		return 0, fmt.Errorf("imagehash: %q is not 16 hex digits", value)
+	}
+	return strconv.ParseUint(value, 16, 64)
+}
+
+// Bands splits hash into labelled BandBits-wide pieces for an index lookup
+// of near matches: a query for any of the bands of a hash finds every
+// stored hash close enough to share one, to be checked with Distance.
+func Bands(hash uint64) []string {
+	bands := make([]string, 64/BandBits)
+	for i := range bands {
+		piece := hash >> uint(64-(i+1)*BandBits) & (1<<BandBits - 1)
+		bands[i] = fmt.Sprintf("%d:%02x", i, piece)
+	}
+	return bands
+}
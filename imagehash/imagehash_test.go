@@ -0,0 +1,201 @@
+package imagehash
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// radiograph draws a w×h grayscale picture with a soft background gradient
+// and bright ellipses at the given centres, roughly like teeth on a film.
+func radiograph(w, h int, centres ...image.Point) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 40 + 60*float64(x)/float64(w)
+			for _, c := range centres {
+				dx := float64(x-c.X*w/100) / (0.08 * float64(w))
+				dy := float64(y-c.Y*h/100) / (0.2 * float64(h))
+				if d := dx*dx + dy*dy; d < 1 {
+					v += 140 * (1 - d)
+				}
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(math.Min(v, 255))})
+		}
+	}
+	return img
+}
+
+var teeth = []image.Point{{20, 50}, {40, 45}, {60, 55}, {80, 50}}
+
+// resize scales img to w×h by nearest neighbour.
+func resize(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			out.Set(x, y, img.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h))
+		}
+	}
+	return out
+}
+
+// brighten adds delta to every gray level.
+func brighten(img *image.Gray, delta int) image.Image {
+	out := image.NewGray(img.Bounds())
+	for i, v := range img.Pix {
+		out.Pix[i] = uint8(min(int(v)+delta, 255))
+	}
+	return out
+}
+
+// recompress round-trips img through JPEG at the given quality.
+func recompress(t *testing.T, img image.Image, quality int) image.Image {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// offset returns img moved so its bounds don't start at the origin.
+func offset(img *image.Gray) image.Image {
+	out := image.NewGray(img.Bounds().Add(image.Pt(37, -11)))
+	copy(out.Pix, img.Pix)
+	return out
+}
+
+func TestPHashSameImage(t *testing.T) {
+	original := radiograph(320, 160, teeth...)
+	hash := PHash(original)
+	if hash == 0 {
+		t.Fatal("PHash = 0")
+	}
+
+	tests := []struct {
+		name    string
+		img     image.Image
+		maxBits int
+	}{
+		{"identical", radiograph(320, 160, teeth...), 0},
+		{"moved bounds", offset(original), 0},
+		{"half size", resize(original, 160, 80), 4},
+		{"double size", resize(original, 640, 320), 4},
+		{"JPEG quality 60", recompress(t, original, 60), 4},
+		{"brighter", brighten(original, 20), 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := Distance(hash, PHash(tt.img)); d > tt.maxBits {
+				t.Errorf("Distance = %d, want at most %d", d, tt.maxBits)
+			}
+		})
+	}
+}
+
+func TestPHashDifferentImage(t *testing.T) {
+	hash := PHash(radiograph(320, 160, teeth...))
+	others := map[string]image.Image{
+		"other teeth": radiograph(320, 160, image.Pt(30, 30), image.Pt(70, 70)),
+		"teeth moved": radiograph(320, 160, image.Pt(80, 50), image.Pt(60, 45), image.Pt(40, 55)),
+		"blank":       radiograph(320, 160),
+	}
+	for name, img := range others {
+		if d := Distance(hash, PHash(img)); d <= 12 {
+			t.Errorf("%s: Distance = %d, want more than 12", name, d)
+		}
+	}
+}
+
+func TestPHashEmpty(t *testing.T) {
+	if got := PHash(image.NewGray(image.Rect(0, 0, 0, 10))); got != 0 {
+		t.Errorf("PHash of an empty image = %x, want 0", got)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFF, 0},
+		{0, 0xFFFFFFFFFFFFFFFF, 64},
+		{0x8000000000000001, 0, 2},
+		{0xF0F0F0F0F0F0F0F0, 0x0F0F0F0F0F0F0F0F, 64},
+		{0x00FF, 0x0F0F, 8},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("Distance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Distance(tt.b, tt.a); got != tt.want {
+			t.Errorf("Distance(%x, %x) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestFormatParse(t *testing.T) {
+	for _, hash := range []uint64{0, 1, 0xDEADBEEF00C0FFEE, math.MaxUint64} {
+		formatted := Format(hash)
+		if len(formatted) != 16 {
+			t.Errorf("Format(%x) = %q, want 16 digits", hash, formatted)
+		}
+		if got, err := Parse(formatted); err != nil || got != hash {
+			t.Errorf("Parse(%q) = %x, %v; want %x", formatted, got, err, hash)
+		}
+	}
+	for _, bad := range []string{"", "abc", "deadbeef00c0ffee0", "deadbeef00c0ffeg"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestBands(t *testing.T) {
+	hash := uint64(0x0123456789ABCDEF)
+	bands := Bands(hash)
+	want := []string{"0:01", "1:23", "2:45", "3:67", "4:89", "5:ab", "6:cd", "7:ef"}
+	if len(bands) != len(want) {
+		t.Fatalf("Bands = %v, want %v", bands, want)
+	}
+	for i := range want {
+		if bands[i] != want[i] {
+			t.Errorf("Bands = %v, want %v", bands, want)
+			break
+		}
+	}
+
+	shared := func(a, b uint64) int {
+		in := map[string]bool{}
+		for _, band := range Bands(a) {
+			in[band] = true
+		}
+		n := 0
+		for _, band := range Bands(b) {
+			if in[band] {
+				n++
+			}
+		}
+		return n
+	}
+	// One flipped bit in each of 7 bands leaves the eighth to find it by
+	var near uint64
+	for i := 0; i < 64/BandBits-1; i++ {
+		near |= 1 << uint(i*BandBits)
+	}
+	if n := shared(hash, hash^near); n != 1 {
+		t.Errorf("hashes %d bits apart share %d bands, want 1", Distance(hash, hash^near), n)
+	}
+	if n := shared(hash, hash^(near|1<<63)); n != 0 {
+		t.Errorf("hashes differing in every band share %d bands, want 0", n)
+	}
+}
@@ -0,0 +1,150 @@
+// Package inference runs a lesion classifier on patient radiographs. The
+// API calls the configured provider in the background after an image is
+// stored and keeps its predictions on the patient.
+package inference
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLabels are the classes of the lesion classifier, in output order.
+var DefaultLabels = []string{
+	"ameloblastoma",
+	"odontogenic_keratocyst",
+	"dentigerous_cyst",
+	"radicular_cyst",
+	"other",
+}
+
+type Score struct {
+	Label      string
+	Confidence float64 // 0–1
+}
+
+type Result struct {
+	ModelVersion string
+	Scores       []Score     // Every class, highest first
+	Heatmap      image.Image // Where the model looked, nil when it doesn't say
+}
+
+type Provider interface {
+	Name() string
+	Predict(ctx context.Context, img image.Image) (*Result, error)
+}
+
+// FromEnv builds the provider selected by INFERENCE_PROVIDER ("stub" or
+// "onnx"). It returns nil when inference is not configured.
+func FromEnv() (Provider, error) {
+	labels := DefaultLabels
+	if v := os.Getenv("INFERENCE_LABELS"); v != "" {
+		labels = strings.Split(v, ",")
+	}
+
+	switch os.Getenv("INFERENCE_PROVIDER") {
+	case "":
+		return nil, nil
+	case "stub":
+		return NewStubProvider(labels), nil
+	case "onnx":
+		size, _ := strconv.Atoi(os.Getenv("ONNX_INPUT_SIZE"))
+		channels, _ := strconv.Atoi(os.Getenv("ONNX_INPUT_CHANNELS"))
+		softmax, err := strconv.ParseBool(os.Getenv("ONNX_APPLY_SOFTMAX"))
+		if err != nil {
+			softmax = true
+		}
+		return NewONNXProvider(ONNXConfig{
+			ServerURL:     os.Getenv("ONNX_SERVER_URL"),
+			Model:         os.Getenv("ONNX_MODEL_NAME"),
+			Version:       os.Getenv("ONNX_MODEL_VERSION"),
+			Input:         os.Getenv("ONNX_INPUT_NAME"),
+			Output:        os.Getenv("ONNX_OUTPUT_NAME"),
+			HeatmapOutput: os.Getenv("ONNX_HEATMAP_OUTPUT"),
+			Size:          size,
+			Channels:      channels,
+			ApplySoftmax:  softmax,
+			Labels:        labels,
+		})
+	default:
+		return nil, fmt.Errorf("unknown INFERENCE_PROVIDER %q", os.Getenv("INFERENCE_PROVIDER"))
+	}
+}
+
+// grayscale resamples img to size x size luminance values in 0–1, row by
+// row, averaging the source pixels that fall in each cell.
+func grayscale(img image.Image, size int) []float32 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	out := make([]float32, size*size)
+	for y := 0; y < size; y++ {
+		y0, y1 := bounds.Min.Y+y*h/size, bounds.Min.Y+(y+1)*h/size
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < size; x++ {
+			x0, x1 := bounds.Min.X+x*w/size, bounds.Min.X+(x+1)*w/size
+			if x1 == x0 {
+				x1++
+			}
+			var sum float64
+			for sy := y0; sy < y1 && sy < bounds.Max.Y; sy++ {
+				for sx := x0; sx < x1 && sx < bounds.Max.X; sx++ {
+					r, g, b, _ := img.At(sx, sy).RGBA()
+					sum += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 0xffff
+				}
+			}
+			out[y*size+x] = float32(sum / float64((y1-y0)*(x1-x0)))
+		}
+	}
+	return out
+}
+
+func softmax(logits []float64) []float64 {
+	top := math.Inf(-1)
+	for _, v := range logits {
+		top = math.Max(top, v)
+	}
+	out := make([]float64, len(logits))
+	var sum float64
+	for i, v := range logits {
+		out[i] = math.Exp(v - top)
+		sum += out[i]
+	}
+	for i := range out {
+		out[i] /= sum
+	}
+	return out
+}
+
+// ranked pairs labels with their confidences, highest first.
+func ranked(labels []string, confidences []float64) []Score {
+	scores := make([]Score, len(labels))
+	for i, label := range labels {
+		scores[i] = Score{Label: label, Confidence: confidences[i]}
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].Confidence > scores[j].Confidence
+	})
+	return scores
+}
+
+// heatmapImage scales values to 0–255 gray, the hottest value white.
+func heatmapImage(values []float64, width, height int) *image.Gray {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	heatmap := image.NewGray(image.Rect(0, 0, width, height))
+	for i, v := range values {
+		if hi > lo {
+			heatmap.Pix[i] = uint8(255 * (v - lo) / (hi - lo))
+		}
+	}
+	return heatmap
+}
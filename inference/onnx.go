@@ -0,0 +1,161 @@
+package inference
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ONNXConfig configures the adapter for an ONNX model served on CPU by an
+// inference server that speaks the KServe v2 REST protocol (ONNX Runtime
+// Server, Triton with the onnxruntime backend, ...).
+type ONNXConfig struct {
+	ServerURL     string // e.g. http://localhost:8000
+	Model         string
+	Version       string // Empty lets the server pick
+	Input         string // Input tensor, default "input"
+	Output        string // Class scores, default "output"
+	HeatmapOutput string // Optional [1,1,H,W], [1,H,W] or [H,W] saliency output
+	Size          int    // Input is Size x Size, default 224
+	Channels      int    // 1 for grayscale models, 3 to repeat gray over RGB; default 1
+	ApplySoftmax  bool   // The model outputs logits
+	Labels        []string
+}
+
+// ONNXProvider sends each image as one NCHW FP32 tensor scaled to 0–1.
+type ONNXProvider struct {
+	config ONNXConfig
+	http   *http.Client
+}
+
+func NewONNXProvider(config ONNXConfig) (*ONNXProvider, error) {
+	if config.ServerURL == "" || config.Model == "" {
+		return nil, errors.New("ONNX_SERVER_URL and ONNX_MODEL_NAME are required")
+	}
+	if len(config.Labels) == 0 {
+		return nil, errors.New("INFERENCE_LABELS must not be empty")
+	}
+	if config.Input == "" {
+		config.Input = "input"
+	}
+	if config.Output == "" {
+		config.Output = "output"
+	}
+	if config.Size <= 0 {
+		config.Size = 224
+	}
+	if config.Channels != 3 {
+		config.Channels = 1
+	}
+	config.ServerURL = strings.TrimRight(config.ServerURL, "/")
+	return &ONNXProvider{config: config, http: &http.Client{Timeout: time.Minute}}, nil
+}
+
+func (o *ONNXProvider) Name() string { return "onnx" }
+
+type tensor struct {
+	Name     string    `json:"name"`
+	Shape    []int     `json:"shape,omitempty"`
+	Datatype string    `json:"datatype,omitempty"`
+	Data     []float64 `json:"data,omitempty"`
+}
+
+type inferRequest struct {
+	Inputs  []tensor `json:"inputs"`
+	Outputs []tensor `json:"outputs"`
+}
+
+type inferResponse struct {
+	ModelName    string   `json:"model_name"`
+	ModelVersion string   `json:"model_version"`
+	Outputs      []tensor `json:"outputs"`
+	Error        string   `json:"error"`
+}
+
+func (o *ONNXProvider) Predict(ctx context.Context, img image.Image) (*Result, error) {
+	size, channels := o.config.Size, o.config.Channels
+	pixels := grayscale(img, size)
+	data := make([]float64, 0, channels*len(pixels))
+	for c := 0; c < channels; c++ {
+		for _, v := range pixels {
+			data = append(data, float64(v))
+		}
+	}
+
+	request := inferRequest{
+		Inputs:  []tensor{{Name: o.config.Input, Shape: []int{1, channels, size, size}, Datatype: "FP32", Data: data}},
+		Outputs: []tensor{{Name: o.config.Output}},
+	}
+	if o.config.HeatmapOutput != "" {
+		request.Outputs = append(request.Outputs, tensor{Name: o.config.HeatmapOutput})
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	url := o.config.ServerURL + "/v2/models/" + o.config.Model
+	if o.config.Version != "" {
+		url += "/versions/" + o.config.Version
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/infer", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("inference server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var response inferResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("inference server: cannot decode response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inference server: status %d: %s", resp.StatusCode, response.Error)
+	}
+
+	result := &Result{ModelVersion: o.config.Model}
+	if response.ModelVersion != "" {
+		result.ModelVersion += ":" + response.ModelVersion
+	} else if o.config.Version != "" {
+		result.ModelVersion += ":" + o.config.Version
+	}
+
+	for _, output := range response.Outputs {
+		switch output.Name {
+		case o.config.Output:
+			if len(output.Data) != len(o.config.Labels) {
+				return nil, fmt.Errorf("model returned %d scores for %d labels", len(output.Data), len(o.config.Labels))
+			}
+			confidences := output.Data
+			if o.config.ApplySoftmax {
+				confidences = softmax(confidences)
+			}
+			result.Scores = ranked(o.config.Labels, confidences)
+		case o.config.HeatmapOutput:
+			if len(output.Shape) < 2 {
+				return nil, fmt.Errorf("heatmap output has shape %v", output.Shape)
+			}
+			height, width := output.Shape[len(output.Shape)-2], output.Shape[len(output.Shape)-1]
+			if height*width != len(output.Data) {
+				return nil, fmt.Errorf("heatmap output has shape %v but %d values", output.Shape, len(output.Data))
+			}
+			result.Heatmap = heatmapImage(output.Data, width, height)
+		}
+	}
+	if result.Scores == nil {
+		return nil, fmt.Errorf("model returned no %q output", o.config.Output)
+	}
+	return result, nil
+}
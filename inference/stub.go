@@ -0,0 +1,53 @@
+package inference
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"image"
+)
+
+// stubSize is the grid the stub looks at, and the size of its heatmap.
+const stubSize = 32
+
+// StubProvider is a deterministic stand-in for local development and demos:
+// the same image always gets the same scores, derived from a hash of its
+// downsampled pixels. Its heatmap marks the darkest (most radiolucent)
+// areas. It knows nothing about lesions.
+type StubProvider struct {
+	labels []string
+}
+
+func NewStubProvider(labels []string) *StubProvider {
+	return &StubProvider{labels: labels}
+}
+
+func (s *StubProvider) Name() string { return "stub" }
+
+func (s *StubProvider) Predict(ctx context.Context, img image.Image) (*Result, error) {
+	pixels := grayscale(img, stubSize)
+
+	hash := sha256.New()
+	for _, v := range pixels {
+		hash.Write([]byte{uint8(v * 255)})
+	}
+	sum := hash.Sum(nil)
+
+	logits := make([]float64, len(s.labels))
+	for i := range logits {
+		// Two hash bytes per class, cycling if there are many classes
+		offset := (2 * i) % (len(sum) - 1)
+		logits[i] = float64(binary.BigEndian.Uint16(sum[offset:])) / 0xffff * 4
+	}
+
+	heat := make([]float64, len(pixels))
+	for i, v := range pixels {
+		heat[i] = 1 - float64(v)
+	}
+
+	return &Result{
+		ModelVersion: "stub-1",
+		Scores:       ranked(s.labels, softmax(logits)),
+		Heatmap:      heatmapImage(heat, stubSize, stubSize),
+	}, nil
+}
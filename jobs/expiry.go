@@ -0,0 +1,183 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PackageExpiryJob downgrades users whose package expiry has passed back to the
+// free package and reminds users whose package is about to expire.
+//
+// Environment:
+//
+//	PACKAGE_EXPIRY_INTERVAL  how often the job runs (default 1h)
+//	PACKAGE_REMINDER_DAYS    days before expiry to send a reminder (default 3)
+func PackageExpiryJob() Job {
+	reminderDays := 3
+	if v, err := strconv.Atoi(os.Getenv("PACKAGE_REMINDER_DAYS")); err == nil && v >= 0 {
+		reminderDays = v
+	}
+
+	return Job{
+		Name:     "package_expiry",
+		Interval: envDuration("PACKAGE_EXPIRY_INTERVAL", time.Hour),
+		Run: func(ctx context.Context, db *mongo.Database) error {
+			if err := downgradeExpired(ctx, db); err != nil {
+				return err
+			}
+			return remindExpiring(ctx, db, time.Duration(reminderDays)*24*time.Hour)
+		},
+	}
+}
+
+func downgradeExpired(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection("users")
+	now := time.Now()
+
+	cursor, err := users.Find(ctx, bson.M{
+		"package":    bson.M{"$ne": "free"},
+		"expiry":     bson.M{"$ne": nil, "$lte": now},
+		"deleted_at": nil,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot fetch expired users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var expired []models.User
+	if err = cursor.All(ctx, &expired); err != nil {
+		return fmt.Errorf("cannot decode expired users: %w", err)
+	}
+
+	// Priced like the free package is when changePackage grants it
+	var freePackage models.Package
+	err = db.Collection("packages").FindOne(ctx, bson.M{"name": "free"}).Decode(&freePackage)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return fmt.Errorf("cannot fetch free package: %w", err)
+	}
+
+	for _, user := range expired {
+		// Match on the package and expiry we read so a concurrent admin change
+		// (e.g. an extension) is never overwritten by the downgrade.
+		result, err := users.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "package": user.Package, "expiry": user.Expiry},
+			bson.M{
+				"$set": bson.M{
+					"package":   "free",
+					"expiry":    nil,
+					"updatedAt": now,
+				},
+				"$unset": bson.M{"expiry_reminder_sent_at": ""},
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("cannot downgrade user %s: %w", user.ID.Hex(), err)
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+
+		// Close the paid subscription and open a free one so the subscription
+		// history has no gaps.
+		_, err = db.Collection("subscriptions").UpdateMany(ctx,
+			bson.M{"user_id": user.ID, "status": "active"},
+			bson.M{"$set": bson.M{"status": "expired", "end_at": now}},
+		)
+		if err != nil {
+			return fmt.Errorf("cannot expire subscription for %s: %w", user.ID.Hex(), err)
+		}
+		free := models.Subscription{
+			UserID:    user.ID,
+			Package:   "free",
+			Status:    "active",
+			StartAt:   now,
+			Price:     freePackage.Price,
+			Currency:  models.Currency,
+			CreatedAt: now,
+		}
+		if _, err := db.Collection("subscriptions").InsertOne(ctx, free); err != nil {
+			return fmt.Errorf("cannot start free subscription for %s: %w", user.ID.Hex(), err)
+		}
+
+		history := models.PackageHistory{
+			UserID:      user.ID,
+			FromPackage: user.Package,
+			ToPackage:   "free",
+			Reason:      "expired",
+			ChangedBy:   "system",
+			ChangedAt:   now,
+		}
+		if _, err := db.Collection("package_history").InsertOne(ctx, history); err != nil {
+			return fmt.Errorf("cannot record package history for %s: %w", user.ID.Hex(), err)
+		}
+
+		notify(ctx, db, user.ID, "package_expired",
+			fmt.Sprintf("Your %s package has expired and was changed to free", user.Package))
+	}
+
+	return nil
+}
+
+func remindExpiring(ctx context.Context, db *mongo.Database, before time.Duration) error {
+	users := db.Collection("users")
+	now := time.Now()
+
+	cursor, err := users.Find(ctx, bson.M{
+		"package":                 bson.M{"$ne": "free"},
+		"expiry":                  bson.M{"$gt": now, "$lte": now.Add(before)},
+		"expiry_reminder_sent_at": bson.M{"$exists": false},
+		"deleted_at":              nil,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot fetch expiring users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var expiring []models.User
+	if err = cursor.All(ctx, &expiring); err != nil {
+		return fmt.Errorf("cannot decode expiring users: %w", err)
+	}
+
+	for _, user := range expiring {
+		// Mark first so a reminder is sent at most once per expiry date.
+		result, err := users.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "expiry_reminder_sent_at": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"expiry_reminder_sent_at": now}},
+		)
+		if err != nil {
+			return fmt.Errorf("cannot mark reminder for %s: %w", user.ID.Hex(), err)
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+
+		notify(ctx, db, user.ID, "package_expiry_reminder",
+			fmt.Sprintf("Your %s package expires on %s", user.Package, user.Expiry.Format("2006-01-02")))
+	}
+
+	return nil
+}
+
+func notify(ctx context.Context, db *mongo.Database, userID primitive.ObjectID, kind, message string) {
+	notification := models.Notification{
+		ReceiverID:  userID,
+		SenderID:    primitive.NilObjectID,
+		Type:        kind,
+		Message:     message,
+		IsRead:      false,
+		CreatedAt:   time.Now(),
+		RedirectURL: "/packages",
+	}
+
+	if _, err := db.Collection("notifications").InsertOne(ctx, notification); err != nil {
+		fmt.Printf("Error creating notification: %v\n", err)
+	}
+}
@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// acquireLease tries to take (or renew) the named lease for owner. It returns
+// false without error when another replica currently holds an unexpired lease.
+// A lease is a job_leases document {_id: job name, owner, expires_at}, held
+// by one replica at a time so background jobs don't run twice.
+func acquireLease(ctx context.Context, db *mongo.Database, name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id": name,
+		"$or": []bson.M{
+			{"owner": owner},
+			{"expires_at": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"owner":      owner,
+			"expires_at": now.Add(ttl),
+		},
+	}
+
+	// The upsert only inserts when no lease document exists yet; if one exists
+	// but is held by someone else the insert hits the _id unique index.
+	_, err := db.Collection("job_leases").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,33 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PaymentExpiryJob expires checkouts that were never paid, so the promo codes
+// claimed for them can be used again. expire does the work (see
+// handlers.Handler.ExpirePendingPayments).
+//
+// Environment:
+//
+//	PAYMENT_EXPIRY_INTERVAL  how often the job runs (default 15m)
+//	PAYMENT_EXPIRY_GRACE     how long after its checkout expired a payment stays pending, for late webhooks (default 1h)
+func PaymentExpiryJob(expire func(ctx context.Context, grace time.Duration) (int, error)) Job {
+	grace := envDuration("PAYMENT_EXPIRY_GRACE", time.Hour)
+
+	return Job{
+		Name:     "payment_expiry",
+		Interval: envDuration("PAYMENT_EXPIRY_INTERVAL", 15*time.Minute),
+		Run: func(ctx context.Context, db *mongo.Database) error {
+			expired, err := expire(ctx, grace)
+			if expired > 0 {
+				log.Printf("job payment_expiry: expired %d pending payments", expired)
+			}
+			return err
+		},
+	}
+}
@@ -0,0 +1,92 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/fieldcrypt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ReencryptJob reseals the encrypted fields of collections with the current
+// data key after a rotation, then retires the older keys. Documents changed
+// while it ran are left for the next run.
+//
+// Environment:
+//
+//	FIELD_REENCRYPT_INTERVAL  how often the job runs (default 1h)
+func ReencryptJob(keyring *fieldcrypt.Keyring, collections ...string) Job {
+	return Job{
+		Name:     "field_reencrypt",
+		Interval: envDuration("FIELD_REENCRYPT_INTERVAL", time.Hour),
+		Run: func(ctx context.Context, db *mongo.Database) error {
+			if err := keyring.Refresh(ctx); err != nil {
+				return err
+			}
+			keys, err := keyring.Keys(ctx)
+			if err != nil {
+				return err
+			}
+			var old []primitive.ObjectID
+			for _, key := range keys {
+				if !key.Current && key.RetiredAt == nil {
+					old = append(old, key.ID)
+				}
+			}
+			if len(old) == 0 {
+				return nil
+			}
+
+			resealed, left := 0, 0
+			for _, name := range collections {
+				collection := db.Collection(name)
+				cursor, err := collection.Find(ctx, bson.M{})
+				if err != nil {
+					return err
+				}
+				for cursor.Next(ctx) {
+					stale, next, err := keyring.Reseal(cursor.Current)
+					if err != nil {
+						log.Printf("job field_reencrypt: %s %s: %v", name, cursor.Current.Lookup("_id"), err)
+						left++
+						continue
+					}
+					if len(stale) == 0 {
+						continue
+					}
+
+					filter := bson.M{"_id": cursor.Current.Lookup("_id")}
+					for path, value := range stale {
+						filter[path] = value
+					}
+					result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": next})
+					if err != nil {
+						cursor.Close(ctx)
+						return err
+					}
+					if result.MatchedCount == 0 {
+						left++
+					} else {
+						resealed++
+					}
+				}
+				if err := cursor.Err(); err != nil {
+					cursor.Close(ctx)
+					return err
+				}
+				cursor.Close(ctx)
+			}
+
+			if resealed > 0 || left > 0 {
+				log.Printf("job field_reencrypt: resealed %d documents, %d left for the next run", resealed, left)
+			}
+			if left > 0 {
+				return nil
+			}
+			return keyring.Retire(ctx, old)
+		},
+	}
+}
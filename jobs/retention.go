@@ -0,0 +1,40 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/storage"
+	"github.com/piyawat001/user-auth-api/trash"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TrashRetentionJob purges patients, users and questions that have been in
+// the recycle bin longer than the retention period.
+//
+// Environment:
+//
+//	TRASH_RETENTION_INTERVAL  how often the job runs (default 24h)
+//	TRASH_RETENTION_DAYS      days a deleted record stays restorable (default 30)
+func TrashRetentionJob(blobs storage.Storage) Job {
+	retentionDays := 30
+	if v, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS")); err == nil && v >= 0 {
+		retentionDays = v
+	}
+
+	return Job{
+		Name:     "trash_retention",
+		Interval: envDuration("TRASH_RETENTION_INTERVAL", 24*time.Hour),
+		Run: func(ctx context.Context, db *mongo.Database) error {
+			cutoff := time.Now().Add(-time.Duration(retentionDays) * 24 * time.Hour)
+			purged, err := trash.PurgeExpired(ctx, db, blobs, cutoff)
+			if purged > 0 {
+				log.Printf("job trash_retention: purged %d records deleted before %s", purged, cutoff.Format(time.RFC3339))
+			}
+			return err
+		},
+	}
+}
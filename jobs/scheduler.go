@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Job is a periodic background task. Only one replica runs a job per interval:
+// the runner must hold the job's lease in Mongo before calling Run.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context, db *mongo.Database) error
+}
+
+type Scheduler struct {
+	db    *mongo.Database
+	owner string
+	jobs  []Job
+}
+
+func NewScheduler(client *mongo.Client) *Scheduler {
+	hostname, _ := os.Hostname()
+	return &Scheduler{
+		db:    client.Database(os.Getenv("DATABASE_NAME")),
+		owner: hostname + "-" + primitive.NewObjectID().Hex(),
+	}
+}
+
+func (s *Scheduler) Add(job Job) {
+	s.jobs = append(s.jobs, job)
+}
+
+// Start runs every registered job in its own goroutine until ctx is cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, job := range s.jobs {
+		go s.loop(ctx, job)
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.runOnce(ctx, job)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) runOnce(ctx context.Context, job Job) {
+	// The lease is kept for the whole interval (not released after the run) so
+	// that other replicas ticking slightly later skip this round.
+	ok, err := acquireLease(ctx, s.db, job.Name, s.owner, job.Interval)
+	if err != nil {
+		log.Printf("job %s: cannot acquire lease: %v", job.Name, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, job.Interval)
+	defer cancel()
+
+	if err := job.Run(runCtx, s.db); err != nil {
+		log.Printf("job %s: %v", job.Name, err)
+	}
+}
+
+// envDuration reads a duration like "1h" or "30m" from the environment.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/fieldcrypt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SealPlaintextJob seals the values written in plaintext before field
+// encryption was enabled, at the given paths of each collection (see
+// Keyring.SealPlaintext). Once everything is sealed a run is one query per
+// collection that finds nothing. Documents changed while it ran are left for
+// the next run.
+//
+// Environment:
+//
+//	FIELD_SEAL_INTERVAL  how often the job runs (default 1h)
+func SealPlaintextJob(keyring *fieldcrypt.Keyring, paths map[string][]string) Job {
+	return Job{
+		Name:     "field_seal",
+		Interval: envDuration("FIELD_SEAL_INTERVAL", time.Hour),
+		Run: func(ctx context.Context, db *mongo.Database) error {
+			sealed, left := 0, 0
+			for name, fields := range paths {
+				// A query path reaches into arrays without naming an index
+				var plaintext bson.A
+				for _, field := range fields {
+					query := strings.ReplaceAll(strings.ReplaceAll(field, ".*", ""), "*.", "")
+					plaintext = append(plaintext, bson.M{query: bson.M{"$type": "string"}})
+				}
+
+				collection := db.Collection(name)
+				cursor, err := collection.Find(ctx, bson.M{"$or": plaintext})
+				if err != nil {
+					return err
+				}
+				for cursor.Next(ctx) {
+					plain, next, err := keyring.SealPlaintext(cursor.Current, fields)
+					if err != nil {
+						log.Printf("job field_seal: %s %s: %v", name, cursor.Current.Lookup("_id"), err)
+						left++
+						continue
+					}
+					if len(plain) == 0 {
+						continue
+					}
+
+					filter := bson.M{"_id": cursor.Current.Lookup("_id")}
+					for path, value := range plain {
+						filter[path] = value
+					}
+					result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": next})
+					if err != nil {
+						cursor.Close(ctx)
+						return err
+					}
+					if result.MatchedCount == 0 {
+						left++
+					} else {
+						sealed++
+					}
+				}
+				if err := cursor.Err(); err != nil {
+					cursor.Close(ctx)
+					return err
+				}
+				cursor.Close(ctx)
+			}
+
+			if sealed > 0 || left > 0 {
+				log.Printf("job field_seal: sealed %d documents, %d left for the next run", sealed, left)
+			}
+			return nil
+		},
+	}
+}
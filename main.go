@@ -4,15 +4,25 @@ import (
 	"context"
 	"log"
 	"os"
+	"reflect"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/piyawat001/user-auth-api/fieldcrypt"
 	"github.com/piyawat001/user-auth-api/handlers"
+	"github.com/piyawat001/user-auth-api/inference"
+	"github.com/piyawat001/user-auth-api/jobs"
+	"github.com/piyawat001/user-auth-api/middleware"
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/payments"
+	"github.com/piyawat001/user-auth-api/pdf"
+	"github.com/piyawat001/user-auth-api/storage"
 )
 
 var client *mongo.Client
@@ -24,22 +34,40 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	// Field encryption (FIELD_ENCRYPTION_KEYFILE, ไม่ตั้งค่า = เก็บข้อมูลแบบไม่เข้ารหัส)
+	// codec ต้องลงทะเบียนก่อนเชื่อมต่อ ส่วน data key โหลดหลังเชื่อมต่อแล้ว
+	keyring, err := fieldcrypt.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientOptions := options.Client().ApplyURI(os.Getenv("MONGODB_URI"))
+	if keyring != nil {
+		registry := bson.NewRegistry()
+		keyring.Register(registry, reflect.TypeOf(models.Sensitive("")))
+		clientOptions.SetRegistry(registry)
+	}
+
 	// Connect to MongoDB
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI(os.Getenv("MONGODB_URI")))
+	client, err = mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer client.Disconnect(ctx)
+	if keyring != nil {
+		if err := keyring.Load(ctx, client.Database(os.Getenv("DATABASE_NAME")).Collection("encryption_keys")); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// Initialize Fiber app
-	app := fiber.New()
+	// Initialize Fiber app (BodyLimit รองรับการอัปโหลดภาพรังสี, ขนาดไฟล์ตรวจสอบอีกครั้งใน handler)
+	app := fiber.New(fiber.Config{BodyLimit: 64 << 20})
 
 	// เพิ่ม CORS Middleware
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "*", // อนุญาตทุกแหล่งที่มา
-		AllowMethods:     "GET,POST,PUT,DELETE",
+		AllowMethods:     "GET,POST,PUT,PATCH,DELETE",
 		AllowHeaders:     "Content-Type,Authorization",
 		AllowCredentials: false, // ไม่รองรับ cookies หรือ headers
 	}))
@@ -47,38 +75,179 @@ func main() {
 	// Set up handlers with MongoDB client
 	h := handlers.NewHandler(client)
 
+	// Payment provider (PAYMENT_PROVIDER=gateway|fake, ไม่ตั้งค่า = ปิดการชำระเงิน)
+	paymentProvider, err := payments.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.SetPaymentProvider(paymentProvider)
+
+	// File storage (STORAGE_DRIVER=local|s3)
+	blobs, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.SetStorage(blobs)
+	h.SetKeyring(keyring)
+
+	// Lesion classifier (INFERENCE_PROVIDER=stub|onnx, ไม่ตั้งค่า = ไม่รันโมเดล)
+	classifier, err := inference.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.SetInferenceProvider(classifier)
+
+	// ฟอนต์ของใบแจ้งหนี้ PDF (PDF_FONT_FILE เช่น Sarabun-Regular.ttf, ไม่ตั้งค่า = Helvetica ซึ่งแสดงภาษาไทยไม่ได้)
+	pdfFont, err := pdf.FontFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.SetPDFFont(pdfFont)
+
+	// Indexes สำหรับการค้นหาผู้ป่วย เวอร์ชันของกฎวินิจฉัย ประวัติความยินยอม การตรวจหาผู้ป่วยซ้ำ คำถามของผู้ป่วย และโค้ดส่วนลดที่ห้ามซ้ำ (สร้างซ้ำได้ ไม่มีผลถ้ามีอยู่แล้ว)
+	if err := h.EnsurePatientIndexes(ctx); err != nil {
+		log.Printf("Cannot create patient indexes: %v", err)
+	}
+	if err := h.EnsureDiagnosisIndexes(ctx); err != nil {
+		log.Printf("Cannot create diagnosis rule indexes: %v", err)
+	}
+	if err := h.EnsureConsentIndexes(ctx); err != nil {
+		log.Printf("Cannot create consent indexes: %v", err)
+	}
+	if err := h.EnsureDuplicateIndexes(ctx); err != nil {
+		log.Printf("Cannot create duplicate detection indexes: %v", err)
+	}
+	if err := h.EnsureQuestionIndexes(ctx); err != nil {
+		log.Printf("Cannot create question indexes: %v", err)
+	}
+	if err := h.EnsurePromoIndexes(ctx); err != nil {
+		log.Printf("Cannot create promo code indexes: %v", err)
+	}
+
 	//create users
 	app.Post("/register", h.Register) 
 	app.Post("/login", h.Login) 
 
 	//user
 	app.Get("/users", h.GetAllUsers)       // ดึงข้อมูลผู้ใช้ทั้งหมด
-	app.Delete("/users/:id", h.DeleteUser) // ลบผู้ใช้
+	app.Delete("/users/:id", h.DeleteUser) // ย้ายผู้ใช้ไปถังขยะ
+	app.Get("/me/usage", middleware.Auth, h.GetMyUsage) // ดูการใช้งานและโควต้าเดือนนี้
+	app.Get("/me/subscriptions", middleware.Auth, h.GetMySubscriptions) // ประวัติแพ็กเกจของฉัน
+	app.Get("/me/invoices", middleware.Auth, h.GetMyInvoices)           // ใบแจ้งหนี้ของฉัน
+	app.Get("/me/invoices/:id", middleware.Auth, h.GetMyInvoice)        // รายละเอียดใบแจ้งหนี้
+	app.Get("/me/invoices/:id/pdf", middleware.Auth, h.GetMyInvoicePDF) // ดาวน์โหลดใบแจ้งหนี้ PDF
 
 	//Admin Routes
 	app.Post("/admin/approve", h.ApproveUser)           // อนุมัติผู้ใช้
-	app.Post("/admin/set-package", h.AdminSetPackage)   // ตั้งค่าชุดแพ็กเกจ
+	app.Post("/admin/set-package", middleware.Auth, h.AdminSetPackage) // ตั้งค่าชุดแพ็กเกจ (บันทึกผู้อนุมัติ)
 	app.Get("/pendingQuestions", h.GetPendingQuestions) // ดึงคำถามที่ยังไม่ได้ตอบ
 	app.Post("/admin/approve", h.ApproveUser)
-
+	app.Put("/admin/users/:id/quota", middleware.Auth, h.AdminSetUserQuota)      // กำหนดโควต้าเฉพาะผู้ใช้
+	app.Delete("/admin/users/:id/quota", middleware.Auth, h.AdminClearUserQuota) // ยกเลิกโควต้าเฉพาะผู้ใช้
+	app.Get("/admin/users/:id/subscriptions", middleware.Auth, h.AdminGetUserSubscriptions) // ประวัติแพ็กเกจของผู้ใช้
+	app.Get("/admin/payments", middleware.Auth, h.AdminGetPayments)                         // รายการการชำระเงินตามสถานะ (?status=amount_mismatch)
+	app.Post("/admin/payments/:id/refund", middleware.Auth, h.AdminRefundPayment)           // คืนเงินและลดแพ็กเกจ
+	app.Post("/admin/promo-codes", middleware.Auth, h.AdminCreatePromoCode)           // สร้างโค้ดส่วนลด/ทดลองใช้
+	app.Get("/admin/promo-codes", middleware.Auth, h.AdminGetPromoCodes)               // ดึงโค้ดทั้งหมด
+	app.Delete("/admin/promo-codes/:id", middleware.Auth, h.AdminDeactivatePromoCode) // ปิดการใช้งานโค้ด
+	app.Get("/admin/trash", middleware.Auth, h.AdminGetTrash)                             // รายการในถังขยะ (?type=patients|users|questions)
+	app.Post("/admin/trash/:type/:id/restore", middleware.Auth, h.AdminRestoreFromTrash) // กู้คืนจากถังขยะ
+	app.Delete("/admin/trash/:type/:id", middleware.Auth, h.AdminPurgeFromTrash)         // ลบถาวร
+	app.Get("/admin/research-export", middleware.Auth, h.AdminExportResearchData)        // ส่งออกข้อมูลผู้ป่วยแบบไม่ระบุตัวตนสำหรับงานวิจัย (zip)
+	app.Get("/admin/research-exports", middleware.Auth, h.AdminGetResearchExports)       // ประวัติการส่งออกข้อมูลวิจัย
+	app.Get("/admin/encryption-keys", middleware.Auth, h.AdminGetEncryptionKeys)           // รายการ data key ที่ใช้เข้ารหัสข้อมูลผู้ป่วย
+	app.Post("/admin/encryption-keys/rotate", middleware.Auth, h.AdminRotateEncryptionKey) // หมุน data key (เข้ารหัสข้อมูลเดิมใหม่ในเบื้องหลัง)
+	app.Get("/admin/duplicates", middleware.Auth, h.AdminGetDuplicates)                    // รายการผู้ป่วยที่อาจซ้ำกัน (?status=open|merged|dismissed)
+	app.Post("/admin/duplicates/:id/dismiss", middleware.Auth, h.AdminDismissDuplicate)    // ยืนยันว่าไม่ใช่รายเดียวกัน
+	app.Post("/admin/patients/:id/merge", middleware.Auth, h.AdminMergePatients)           // รวมผู้ป่วยที่ส่งซ้ำ (duplicate_id) เข้ากับ :id
+	app.Get("/admin/patients/:id/questions", middleware.Auth, h.AdminGetPatientQuestions)  // คำถามทั้งหมดที่อ้างถึงผู้ป่วย
+
+	//Payment Routes
+	app.Post("/payments/checkout", middleware.Auth, h.CreateCheckout) // เริ่มชำระเงิน (PromptPay QR / บัตร)
+	app.Get("/payments/:id", middleware.Auth, h.GetPayment)           // ดูสถานะการชำระเงิน
+	app.Post("/payments/webhook", h.PaymentWebhook)                   // รับผลจากผู้ให้บริการชำระเงิน
+	app.Post("/promo-codes/redeem", middleware.Auth, h.RedeemPromoCode) // ใช้โค้ดทดลองใช้ฟรี
+	app.Get("/promo-codes/:code", h.GetPromoQuote)                      // ดูราคาหลังหักส่วนลด (?package=)
 
 	//Patient Routes
-	app.Post("/patients", h.CreatePatient)       // สร้างข้อมูลผู้ป่วยใหม่
-	app.Put("/patients/:id", h.UpdatePatient)    // แก้ไขข้อมูลผู้ป่วย
-	app.Delete("/patients/:id", h.DeletePatient) // ลบข้อมูลผู้ป่วย
-	app.Get("/allpatients", h.GetAllPatients)    // ดึงข้อมูลผู้ป่วยทั้งหมด
+	app.Post("/patients", middleware.Auth, h.CreatePatient) // สร้างข้อมูลผู้ป่วยใหม่ (นับโควต้า)
+	app.Put("/patients/:id", middleware.Auth, h.UpdatePatient)    // แก้ไขข้อมูลผู้ป่วยทั้งเอกสาร (เจ้าของ/โรงพยาบาลที่ได้รับสิทธิ์/admin)
+	app.Patch("/patients/:id", middleware.Auth, h.PatchPatient)   // แก้ไขข้อมูลผู้ป่วยบางฟิลด์ (JSON Merge Patch)
+	app.Delete("/patients/:id", middleware.Auth, h.DeletePatient) // ย้ายข้อมูลผู้ป่วยไปถังขยะ
+	app.Get("/allpatients", middleware.Auth, h.GetAllPatients)    // ดึงข้อมูลผู้ป่วยที่มีสิทธิ์เข้าถึง
+	app.Get("/patients", middleware.Auth, h.SearchPatients)       // ค้นหา/กรอง/เรียงผู้ป่วยแบบแบ่งหน้า (cursor)
+	app.Get("/patients/:id/history", middleware.Auth, h.GetPatientHistory)                         // ประวัติการแก้ไข
+	app.Get("/patients/:id/history/:revision", middleware.Auth, h.GetPatientRevision)              // ข้อมูลทั้งชุดของเวอร์ชันที่ระบุ
+	app.Post("/patients/:id/history/:revision/restore", middleware.Auth, h.RestorePatientRevision) // คืนค่าเป็นเวอร์ชันที่ระบุ
+	app.Post("/patients/:id/images", middleware.Auth, h.UploadPatientImage)                // อัปโหลดภาพรังสี
+	app.Get("/patients/:id/images", middleware.Auth, h.GetPatientImages)                   // ดึงรายการภาพ
+	app.Get("/patients/:id/images/:imageId/url", middleware.Auth, h.GetPatientImageURL)    // ขอลิงก์ดาวน์โหลดชั่วคราว (original/preview/thumbnail/heatmap)
+	app.Put("/patients/:id/images/order", middleware.Auth, h.ReorderPatientImages)         // จัดลำดับชุดภาพ
+	app.Patch("/patients/:id/images/:imageId", middleware.Auth, h.UpdatePatientImageEntry) // แก้ไขชนิดภาพ/คำบรรยาย
+	app.Delete("/patients/:id/images/:imageId", middleware.Auth, h.DeletePatientImage)     // ลบภาพ
+	app.Get("/files/:id", h.DownloadFile)                                                  // ดาวน์โหลดไฟล์ด้วยลิงก์ที่มีลายเซ็น
+	app.Get("/patients/:id/images/:imageId/annotations", middleware.Auth, h.GetImageAnnotations)                             // คำอธิบายประกอบล่าสุดบนภาพ
+	app.Post("/patients/:id/images/:imageId/annotations", middleware.Auth, h.CreateImageAnnotation)                          // วาด polygon/ellipse/arrow/text/measurement
+	app.Put("/patients/:id/images/:imageId/annotations/:annotationId", middleware.Auth, h.UpdateImageAnnotation)             // แก้ไข (เวอร์ชันใหม่ เฉพาะผู้วาด)
+	app.Delete("/patients/:id/images/:imageId/annotations/:annotationId", middleware.Auth, h.DeleteImageAnnotation)          // ลบ (ผู้วาดหรือ admin)
+	app.Get("/patients/:id/images/:imageId/annotations/:annotationId/history", middleware.Auth, h.GetImageAnnotationHistory) // ประวัติทุกเวอร์ชัน
+	app.Get("/patients/:id/annotations/coco", middleware.Auth, h.ExportPatientAnnotationsCOCO)                               // ส่งออก COCO JSON
+	app.Get("/patients/:id/differential", middleware.Auth, h.GetPatientDifferential)                                         // การวินิจฉัยแยกโรคที่เป็นไปได้ (เรียงตามคะแนน)
+	app.Put("/patients/:id/outcome", middleware.Auth, h.SetPatientOutcome)                                                   // บันทึกการวินิจฉัยสุดท้าย/ผลชิ้นเนื้อ/การรักษา
+	app.Post("/patients/:id/follow-ups", middleware.Auth, h.AddPatientFollowUp)                                              // บันทึกการติดตามผล
+	app.Get("/patients/:id/consents", middleware.Auth, h.GetPatientConsents)                                                 // ประวัติความยินยอม (รวมที่ถอนแล้ว)
+	app.Post("/patients/:id/consents", middleware.Auth, h.RecordPatientConsent)                                              // บันทึกความยินยอม (treatment/teaching/research)
+	app.Post("/patients/:id/consents/withdraw", middleware.Auth, h.WithdrawPatientConsent)                                   // ถอนความยินยอมตามขอบเขต
+	app.Get("/patients/:id/duplicates", middleware.Auth, h.GetPatientDuplicates)                                             // ผู้ป่วยที่อาจเป็นรายเดียวกัน (ยังไม่ได้ตรวจสอบ)
+	app.Get("/reports/diagnosis-agreement", middleware.Auth, h.GetDiagnosisAgreement)                                        // ความสอดคล้องของคำแนะนำกับการวินิจฉัยที่ยืนยัน
+	app.Get("/reports/patients/:report", middleware.Auth, h.GetPatientStats)                                                 // สถิติผู้ป่วย (age-groups/gender/expansion/paresthesia/multiplicity) แยกตามช่วงเวลา ส่งออก CSV ได้
+
+	//Diagnosis Rule Routes
+	app.Get("/diagnosis-rules", middleware.Auth, h.GetDiagnosisRules)                // ชุดกฎที่ใช้อยู่
+	app.Get("/diagnosis-rules/history", middleware.Auth, h.GetDiagnosisRuleHistory)  // ทุกเวอร์ชันของชุดกฎ
+	app.Get("/diagnosis-rules/:version", middleware.Auth, h.GetDiagnosisRuleVersion) // ชุดกฎตามเวอร์ชัน
+	app.Put("/diagnosis-rules", middleware.Auth, h.SaveDiagnosisRules)               // บันทึกเวอร์ชันใหม่ (คณาจารย์/admin)
 
 	//Question Routes
-	app.Post("/questions", h.CreateQuestion)                                        // สร้างคำถามใหม่
+	app.Post("/questions", middleware.Auth, h.CreateQuestion)                       // สร้างคำถามใหม่ (นับโควต้า)
 	app.Get("/questions/user/:userId", h.GetMyQuestions)                            // ดึงประวัติคำถามของผู้ใช้
-	app.Get("/questions/:id", h.GetQuestionDetail)                                  // ดึงรายละเอียดคำถามเฉพาะข้อ
+	app.Get("/questions/:id", middleware.OptionalAuth, h.GetQuestionDetail)         // ดึงรายละเอียดคำถามเฉพาะข้อ (รวมสรุปข้อมูลผู้ป่วยที่อ้างถึง เมื่อมีสิทธิ์ดู)
 	app.Put("/questions/:id", h.UpdateQuestion)                                     // อัปเดตคำถาม (หรือการตอบคำถาม)
 	app.Put("/questions/notification-bell/:userId", h.UpdateNotificationBellStatus) // อัปเดตสถานะแจ้งเตือน
-	app.Delete("/questions/:id", h.DeleteQuestion)                                  // ลบคำถาม
+	app.Delete("/questions/:id", h.DeleteQuestion)                                  // ย้ายคำถามไปถังขยะ
 
 	app.Get("/notifications/:id", h.GetNotificationCount)        // นับจำนวนการแจ้งเตือน
 	app.Put("/notifications/:id/read", h.MarkNotificationAsRead) // ทำเครื่องหมายว่าแจ้งเตือนถูกอ่านแล้ว
 
+	//FHIR Routes
+	app.Get("/fhir/metadata", h.FHIRMetadata)                                  // CapabilityStatement ของ FHIR API
+	app.Get("/fhir/StructureDefinition/:id", h.FHIRGetStructureDefinition)     // โปรไฟล์ที่ใช้ตรวจสอบ
+	app.Get("/fhir/ValueSet/:id", h.FHIRGetValueSet)                           // ชุดรหัสของโปรไฟล์
+	app.Post("/fhir/:type/$validate", h.FHIRValidate)                          // ตรวจสอบ resource กับโปรไฟล์
+	app.Post("/fhir", middleware.Auth, h.FHIRImportBundle)                     // นำเข้าผู้ป่วยจาก Bundle (transaction/batch)
+	app.Get("/fhir/Patient", middleware.Auth, h.FHIRSearchPatients)            // ค้นหา Patient
+	app.Get("/fhir/Patient/:id", middleware.Auth, h.FHIRReadPatient)           // อ่าน Patient
+	app.Get("/fhir/Observation", middleware.Auth, h.FHIRSearchObservations)    // ค้นหา Observation ของผู้ป่วย
+	app.Get("/fhir/Observation/:id", middleware.Auth, h.FHIRReadObservation)   // อ่าน Observation
+	app.Get("/fhir/ImagingStudy", middleware.Auth, h.FHIRSearchImagingStudies) // ค้นหา ImagingStudy ของผู้ป่วย
+	app.Get("/fhir/ImagingStudy/:id", middleware.Auth, h.FHIRReadImagingStudy) // อ่าน ImagingStudy
+	app.Get("/fhir/Media", middleware.Auth, h.FHIRSearchMedia)                 // ค้นหา Media ของผู้ป่วย
+	app.Get("/fhir/Media/:id", middleware.Auth, h.FHIRReadMedia)               // อ่าน Media
+
+	// Background jobs (ใช้ lease ใน MongoDB จึงรันหลาย replica ได้)
+	jobCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	scheduler := jobs.NewScheduler(client)
+	scheduler.Add(jobs.PackageExpiryJob())                        // ลดแพ็กเกจที่หมดอายุเป็น free และแจ้งเตือนก่อนหมดอายุ
+	scheduler.Add(jobs.TrashRetentionJob(blobs))                  // ลบข้อมูลในถังขยะถาวรเมื่อเกิน TRASH_RETENTION_DAYS
+	scheduler.Add(jobs.PaymentExpiryJob(h.ExpirePendingPayments)) // ยกเลิกการชำระเงินที่หมดเวลาและคืนสิทธิ์โค้ดส่วนลด
+	if keyring != nil {
+		scheduler.Add(jobs.ReencryptJob(keyring, "patients", "patient_revisions", "patient_consents")) // เข้ารหัสใหม่ด้วย data key ล่าสุดหลังหมุนกุญแจ
+		scheduler.Add(jobs.SealPlaintextJob(keyring, models.SensitivePaths))                          // เข้ารหัสข้อมูลที่บันทึกไว้ก่อนเปิดการเข้ารหัส
+		go keyring.Watch(jobCtx, time.Minute)                                                          // รับ data key ใหม่ที่ replica อื่นสร้าง
+	}
+	scheduler.Start(jobCtx)
+
 	// Start server
 	log.Fatal(app.Listen(":3000"))
 }
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"os"
 	"strings"
 
@@ -14,20 +15,40 @@ func Auth(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Missing authorization header"})
 	}
 
+	claims, err := parseToken(authHeader)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Locals("user_id", claims["user_id"])
+	return c.Next()
+}
+
+// OptionalAuth identifies the user like Auth when the request carries a
+// valid token, and lets it through anonymously otherwise, for routes that
+// show more to signed-in users.
+func OptionalAuth(c *fiber.Ctx) error {
+	if authHeader := c.Get("Authorization"); authHeader != "" {
+		if claims, err := parseToken(authHeader); err == nil {
+			c.Locals("user_id", claims["user_id"])
+		}
+	}
+	return c.Next()
+}
+
+func parseToken(authHeader string) (jwt.MapClaims, error) {
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return []byte(os.Getenv("JWT_SECRET")), nil
 	})
 
 	if err != nil || !token.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired token"})
+		return nil, errors.New("Invalid or expired token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+		return nil, errors.New("Invalid token claims")
 	}
-
-	c.Locals("user_id", claims["user_id"])
-	return c.Next()
-}
\ No newline at end of file
+	return claims, nil
+}
@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/piyawat001/user-auth-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// BackfillPatientOwner assigns patients created before ownership existed to
+// owner and owner's hospital. Patients that already have an owner are left
+// untouched, so the migration can be run more than once.
+func BackfillPatientOwner(ctx context.Context, db *mongo.Database, ownerID primitive.ObjectID, access string) (int64, error) {
+	var owner models.User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": ownerID}).Decode(&owner); err != nil {
+		return 0, fmt.Errorf("cannot load owner %s: %w", ownerID.Hex(), err)
+	}
+
+	set := bson.M{"created_by": owner.ID}
+	if owner.Hospital != "" {
+		set["hospital"] = owner.Hospital
+	}
+	if access != "" {
+		set["hospital_access"] = access
+	}
+
+	result, err := db.Collection("patients").UpdateMany(ctx,
+		bson.M{"created_by": bson.M{"$exists": false}},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
@@ -15,8 +15,15 @@ type User struct {
 	Status    string             `json:"status" bson:"status"` // Active, Inactive, etc.
 	Package   string             `json:"package" bson:"package"` // Basic, Plus, Premium
 	Hospital  string             `json:"hospital" bson:"hospital"` // Hospital name
+	Expiry    *time.Time         `json:"expiry,omitempty" bson:"expiry,omitempty"` // Package expiry, nil means no expiry
 	CreatedAt time.Time          `json:"created_at" bson:"createdAt"`
 	UpdatedAt time.Time          `json:"updated_at" bson:"updatedAt"`
+
+	QuotaOverride        *Quota     `json:"quota_override,omitempty" bson:"quota_override,omitempty"` // Set by admin, replaces the package quota
+	ExpiryReminderSentAt *time.Time `json:"-" bson:"expiry_reminder_sent_at,omitempty"`
+
+	DeletedAt *time.Time          `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"` // Set while the user is in the recycle bin
+	DeletedBy *primitive.ObjectID `json:"deleted_by,omitempty" bson:"deleted_by,omitempty"`
 }
 
 type Package struct {
@@ -25,30 +32,352 @@ type Package struct {
 	Description string             `json:"description" bson:"description"`
 	Price       float64            `json:"price" bson:"price"`
 	Features    []string           `json:"features" bson:"features"`
+	Quota       *Quota             `json:"quota,omitempty" bson:"quota,omitempty"` // Unset uses the built-in default; zero limits block creating records
+	DurationDays int               `json:"duration_days" bson:"duration_days"` // Length of a purchased period, 0 means no expiry
+}
+
+// Currency is what package prices, subscriptions and payments are in.
+const Currency = "THB"
+
+// Quota limits how many records a user may create per calendar month.
+// A negative value (QuotaUnlimited) means no limit.
+type Quota struct {
+	QuestionsPerMonth int `json:"questions_per_month" bson:"questions_per_month"`
+	PatientsPerMonth  int `json:"patients_per_month" bson:"patients_per_month"`
+}
+
+const QuotaUnlimited = -1
+
+// Usage counts what a user created in one period ("2006-01").
+type Usage struct {
+	ID        string             `json:"-" bson:"_id"` // "<user id>:<period>"
+	UserID    primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Period    string             `json:"period" bson:"period"`
+	Questions int                `json:"questions" bson:"questions"`
+	Patients  int                `json:"patients" bson:"patients"`
 }
 
 
 type Patient struct {
-	ID               primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	ImageName        string             `json:"image_name" bson:"image_name"`
-	Confirmation     string             `json:"confirm" bson:"confirm"`                       // Agree or Disagree
-	Age              int                `json:"age" bson:"age"`                               // Consider using int for age
-	Gender           string             `json:"gender" bson:"gender"`                         // Male or Female
-	DurationOfLesion string             `json:"duration_of_lesion" bson:"duration_of_lesion"` // weeks, months, years
-	Expansion        string             `json:"expansion" bson:"expansion"`                   // Buccolingual, Anteroposterior
-	Paresthesia      bool               `json:"paresthesia" bson:"paresthesia"`               // Yes or No
-	NumberOfLesions  string             `json:"number_of_lesions" bson:"number_of_lesions"`   // Single lesion, Multiple lesions
-	CreatedAt        time.Time          `json:"created_at" bson:"createdAt"`
-	UpdatedAt        time.Time          `json:"updated_at" bson:"updatedAt"`
+	ID               primitive.ObjectID  `json:"id,omitempty" bson:"_id,omitempty"`
+	ImageName        string              `json:"image_name" bson:"image_name"`                 // Deprecated: ID of the first entry in Images, kept for older clients
+	Images           []PatientImageEntry `json:"images" bson:"images,omitempty"`               // Ordered image series, managed through /patients/:id/images
+	Confirmation     string              `json:"confirm" bson:"confirm"`                       // Agree or Disagree to storing the data; uses need a ConsentRecord
+	Age              int                 `json:"age" bson:"age"`                               // Consider using int for age
+	Gender           string              `json:"gender" bson:"gender"`                         // Male or Female
+	DurationOfLesion string              `json:"duration_of_lesion" bson:"duration_of_lesion"` // weeks, months, years
+	Expansion        string              `json:"expansion" bson:"expansion"`                   // Buccolingual, Anteroposterior
+	Paresthesia      bool                `json:"paresthesia" bson:"paresthesia"`               // Yes or No
+	NumberOfLesions  string              `json:"number_of_lesions" bson:"number_of_lesions"`   // Single lesion, Multiple lesions
+	CreatedBy        primitive.ObjectID  `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	Hospital         string              `json:"hospital,omitempty" bson:"hospital,omitempty"`               // Hospital of the creator
+	HospitalAccess   string              `json:"hospital_access,omitempty" bson:"hospital_access,omitempty"` // What colleagues at the same hospital may do: "none" (or empty), "read" or "write"
+	CreatedAt        time.Time           `json:"created_at" bson:"createdAt"`
+	UpdatedAt        time.Time           `json:"updated_at" bson:"updatedAt"`
+	Revision         int                 `json:"revision" bson:"revision"`                         // Latest entry in patient_revisions, 0 for records from before the log
+	DeletedAt        *time.Time          `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"` // Set while the patient is in the recycle bin
+	DeletedBy        *primitive.ObjectID `json:"deleted_by,omitempty" bson:"deleted_by,omitempty"`
+	Predictions      []ImagePrediction   `json:"predictions,omitempty" bson:"predictions,omitempty"` // Classifier output per image and model version, written in the background
+	Outcome          *PatientOutcome     `json:"outcome,omitempty" bson:"outcome,omitempty"`         // Confirmed diagnosis, managed through /patients/:id/outcome
+	FollowUps        []FollowUp          `json:"follow_ups,omitempty" bson:"follow_ups,omitempty"`
+	ConsentScopes    []string            `json:"consent_scopes,omitempty" bson:"consent_scopes,omitempty"` // Scopes with an active ConsentRecord, managed through /patients/:id/consents
+	MergedInto       *primitive.ObjectID `json:"merged_into,omitempty" bson:"merged_into,omitempty"`       // Set, with DeletedAt, on a duplicate merged into another record
+	MergedFrom       []primitive.ObjectID `json:"merged_from,omitempty" bson:"merged_from,omitempty"`      // Duplicates merged into this record, whose history it shows
+}
+
+// Sensitive is free text about a patient. It is encrypted at rest when
+// field encryption is configured (see package fieldcrypt) and plain text
+// everywhere else, JSON included.
+type Sensitive string
+
+// SensitivePaths are where each collection stores Sensitive values, as
+// dotted paths with * for any array index, so values written before field
+// encryption was enabled can be found and sealed. A revision holds the
+// patient in its snapshot and, in its changes, the old and new value of
+// each changed field.
+var SensitivePaths = map[string][]string{
+	"patients": {
+		"outcome.final_diagnosis", "outcome.biopsy_result", "outcome.treatment",
+		"follow_ups.*.notes", "images.*.caption", "images.*.annotations.*",
+	},
+	"patient_revisions": {
+		"snapshot.outcome.final_diagnosis", "snapshot.outcome.biopsy_result", "snapshot.outcome.treatment",
+		"snapshot.follow_ups.*.notes", "snapshot.images.*.caption", "snapshot.images.*.annotations.*",
+		"changes.*.from.final_diagnosis", "changes.*.from.biopsy_result", "changes.*.from.treatment",
+		"changes.*.to.final_diagnosis", "changes.*.to.biopsy_result", "changes.*.to.treatment",
+		"changes.*.from.*.notes", "changes.*.from.*.caption", "changes.*.from.*.annotations.*",
+		"changes.*.to.*.notes", "changes.*.to.*.caption", "changes.*.to.*.annotations.*",
+	},
+	"patient_consents": {"signer_name", "withdrawal_reason"},
+}
+
+// PatientOutcome is the confirmed diagnosis of a patient and what was
+// suggested when it was confirmed, so suggestions can be evaluated later.
+type PatientOutcome struct {
+	FinalDiagnosis Sensitive          `json:"final_diagnosis" bson:"final_diagnosis"`
+	BiopsyResult   Sensitive          `json:"biopsy_result,omitempty" bson:"biopsy_result,omitempty"` // Histopathology report
+	BiopsyDate     *time.Time         `json:"biopsy_date,omitempty" bson:"biopsy_date,omitempty"`
+	Treatment      Sensitive          `json:"treatment,omitempty" bson:"treatment,omitempty"`
+	ConfirmedBy    primitive.ObjectID `json:"confirmed_by" bson:"confirmed_by"`
+	ConfirmedAt    time.Time          `json:"confirmed_at" bson:"confirmed_at"`
+
+	RuleSuggestions []string `json:"rule_suggestions,omitempty" bson:"rule_suggestions,omitempty"` // Top differential diagnoses, best first
+	RulesVersion    int      `json:"rules_version,omitempty" bson:"rules_version,omitempty"`
+	ModelLabel      string   `json:"model_label,omitempty" bson:"model_label,omitempty"` // Most confident classifier prediction
+	ModelVersion    string   `json:"model_version,omitempty" bson:"model_version,omitempty"`
+}
+
+type FollowUp struct {
+	ID         primitive.ObjectID `json:"id" bson:"id"`
+	Date       time.Time          `json:"date" bson:"date"`
+	Status     string             `json:"status" bson:"status"` // One of the FollowUp* constants
+	Notes      Sensitive          `json:"notes,omitempty" bson:"notes,omitempty"`
+	RecordedBy primitive.ObjectID `json:"recorded_by" bson:"recorded_by"`
+	RecordedAt time.Time          `json:"recorded_at" bson:"recorded_at"`
+}
+
+const (
+	FollowUpHealing      = "healing"
+	FollowUpNoRecurrence = "no_recurrence"
+	FollowUpRecurrence   = "recurrence"
+	FollowUpLost         = "lost_to_follow_up"
+)
+
+// ConsentRecord is one consent a patient (or their representative) signed
+// for a use of their data. Records are never changed except to withdraw
+// them, so they stay as evidence of what was agreed and when.
+type ConsentRecord struct {
+	ID               primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	PatientID        primitive.ObjectID  `json:"patient_id" bson:"patient_id"`
+	Scope            string              `json:"scope" bson:"scope"`               // One of the ConsentScope* constants
+	TextVersion      string              `json:"text_version" bson:"text_version"` // Version of the consent form that was signed
+	SignerName       Sensitive           `json:"signer_name" bson:"signer_name"`
+	SignerRelation   string              `json:"signer_relation" bson:"signer_relation"` // One of the Signer* constants
+	SignedAt         time.Time           `json:"signed_at" bson:"signed_at"`
+	RecordedBy       primitive.ObjectID  `json:"recorded_by" bson:"recorded_by"`
+	RecordedAt       time.Time           `json:"recorded_at" bson:"recorded_at"`
+	WithdrawnAt      *time.Time          `json:"withdrawn_at,omitempty" bson:"withdrawn_at,omitempty"`
+	WithdrawnBy      *primitive.ObjectID `json:"withdrawn_by,omitempty" bson:"withdrawn_by,omitempty"`
+	WithdrawalReason Sensitive           `json:"withdrawal_reason,omitempty" bson:"withdrawal_reason,omitempty"`
+}
+
+const (
+	ConsentScopeTreatment = "treatment"
+	ConsentScopeTeaching  = "teaching"
+	ConsentScopeResearch  = "research"
+)
+
+const (
+	SignerSelf           = "self"
+	SignerParent         = "parent"
+	SignerGuardian       = "guardian"
+	SignerRepresentative = "representative"
+)
+
+// DuplicateCandidate flags two patients that look like the same case
+// submitted twice, until an admin merges or dismisses them. PatientID is the
+// newer record.
+type DuplicateCandidate struct {
+	ID                primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	PatientID         primitive.ObjectID  `json:"patient_id" bson:"patient_id"`
+	CandidateID       primitive.ObjectID  `json:"candidate_id" bson:"candidate_id"`
+	FeatureSimilarity float64             `json:"feature_similarity,omitempty" bson:"feature_similarity,omitempty"` // 0–1 over the clinical fields
+	ImageDistance     *int                `json:"image_distance,omitempty" bson:"image_distance,omitempty"`         // Bits between the closest perceptual hashes of their images, out of 64
+	Status            string              `json:"status" bson:"status"`                                             // One of the Duplicate* constants
+	DetectedAt        time.Time           `json:"detected_at" bson:"detected_at"`
+	ResolvedBy        *primitive.ObjectID `json:"resolved_by,omitempty" bson:"resolved_by,omitempty"`
+	ResolvedAt        *time.Time          `json:"resolved_at,omitempty" bson:"resolved_at,omitempty"`
+}
+
+const (
+	DuplicateOpen      = "open"
+	DuplicateMerged    = "merged"
+	DuplicateDismissed = "dismissed" // Not the same case; detecting the pair again doesn't reopen it
+)
+
+// ImagePrediction is what the lesion classifier made of one image.
+type ImagePrediction struct {
+	ImageID      primitive.ObjectID `json:"image_id" bson:"image_id"`
+	Label        string             `json:"label" bson:"label"`                       // Top class
+	Confidence   float64            `json:"confidence" bson:"confidence"`             // 0–1
+	Scores       []LabelScore       `json:"scores,omitempty" bson:"scores,omitempty"` // Every class, highest first
+	Provider     string             `json:"provider" bson:"provider"`
+	ModelVersion string             `json:"model_version" bson:"model_version"`
+	HeatmapKey   string             `json:"heatmap_key,omitempty" bson:"heatmap_key,omitempty"` // Storage key of the PNG heatmap
+	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type LabelScore struct {
+	Label      string  `json:"label" bson:"label"`
+	Confidence float64 `json:"confidence" bson:"confidence"`
+}
+
+// PatientRevision is one entry of a patient's append-only change log. It
+// keeps the whole record as it was after the change so any version can be
+// viewed or restored.
+type PatientRevision struct {
+	ID           primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientID    primitive.ObjectID `json:"patient_id" bson:"patient_id"`
+	Revision     int                `json:"revision" bson:"revision"`
+	Action       string             `json:"action" bson:"action"` // One of the Revision* constants
+	Changes      []FieldChange      `json:"changes,omitempty" bson:"changes,omitempty"`
+	Snapshot     *Patient           `json:"snapshot,omitempty" bson:"snapshot,omitempty"`
+	RestoredFrom *int               `json:"restored_from,omitempty" bson:"restored_from,omitempty"`
+	ChangedBy    primitive.ObjectID `json:"changed_by" bson:"changed_by"`
+	ChangedAt    time.Time          `json:"changed_at" bson:"changed_at"`
+}
+
+type FieldChange struct {
+	Field string      `json:"field" bson:"field"`
+	From  interface{} `json:"from" bson:"from"`
+	To    interface{} `json:"to" bson:"to"`
+}
+
+const (
+	RevisionBaseline = "baseline" // State of a record from before the log, saved on its first change
+	RevisionCreate   = "create"
+	RevisionUpdate   = "update"
+	RevisionRestore  = "restore"
+	RevisionDelete   = "delete"   // Moved to the recycle bin
+	RevisionUndelete = "undelete" // Brought back from the recycle bin
+	RevisionMerge    = "merge"    // A duplicate was merged into the record, or the record into another
+)
+
+// PatientImage is an uploaded file attached to a patient. The bytes live in
+// blob storage under StorageKey, which is derived from the SHA-256 so that
+// identical uploads share one blob.
+type PatientImage struct {
+	ID           primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	PatientID    primitive.ObjectID `json:"patient_id" bson:"patient_id"`
+	StorageKey   string             `json:"-" bson:"storage_key"`
+	SHA256       string             `json:"sha256" bson:"sha256"`
+	ContentType  string             `json:"content_type" bson:"content_type"`
+	Size         int64              `json:"size" bson:"size"`
+	OriginalName string             `json:"original_name" bson:"original_name"`
+	UploadedBy   primitive.ObjectID `json:"uploaded_by" bson:"uploaded_by"`
+	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
+	// PNG renderings for clients that can't display the original (DICOM)
+	PreviewKey   string         `json:"-" bson:"preview_key,omitempty"`
+	ThumbnailKey string         `json:"-" bson:"thumbnail_key,omitempty"`
+	DICOM        *DICOMMetadata `json:"dicom,omitempty" bson:"dicom,omitempty"`
+	Deidentified bool           `json:"deidentified,omitempty" bson:"deidentified,omitempty"`
+	Width        int            `json:"width,omitempty" bson:"width,omitempty"` // Pixels, when the image could be decoded
+	Height       int            `json:"height,omitempty" bson:"height,omitempty"`
+	HeatmapKey   string         `json:"-" bson:"heatmap_key,omitempty"` // Of the latest prediction, served as the "heatmap" variant
+	PHash        string         `json:"phash,omitempty" bson:"phash,omitempty"` // Perceptual hash (see package imagehash), when the image could be decoded
+	PHashBands   []string       `json:"-" bson:"phash_bands,omitempty"`
+}
+
+// PatientImageEntry places an uploaded image in a patient's series.
+type PatientImageEntry struct {
+	ImageID     primitive.ObjectID `json:"image_id" bson:"image_id"`
+	ViewType    string             `json:"view_type,omitempty" bson:"view_type,omitempty"` // One of the View* constants
+	AcquiredAt  *time.Time         `json:"acquired_at,omitempty" bson:"acquired_at,omitempty"`
+	Caption     Sensitive          `json:"caption,omitempty" bson:"caption,omitempty"`
+	Annotations []Sensitive        `json:"annotations,omitempty" bson:"annotations,omitempty"`
+}
+
+const (
+	ViewPanoramic     = "panoramic"
+	ViewPeriapical    = "periapical"
+	ViewBitewing      = "bitewing"
+	ViewOcclusal      = "occlusal"
+	ViewCephalometric = "cephalometric"
+	ViewCBCT          = "cbct"
+	ViewClinicalPhoto = "photo"
+	ViewOther         = "other"
+)
+
+// ImageAnnotation is a shape drawn on a patient image, in image pixel
+// coordinates. Edits never change a stored version: each edit (and the
+// deletion) adds a version with the same AnnotationID, and only the newest
+// one has Latest set.
+type ImageAnnotation struct {
+	ID           primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	AnnotationID primitive.ObjectID `json:"annotation_id" bson:"annotation_id"`
+	Version      int                `json:"version" bson:"version"`
+	Latest       bool               `json:"latest" bson:"latest"`
+	Deleted      bool               `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	PatientID    primitive.ObjectID `json:"patient_id" bson:"patient_id"`
+	ImageID      primitive.ObjectID `json:"image_id" bson:"image_id"`
+	Type         string             `json:"type" bson:"type"`   // One of the Annotation* constants
+	Label        string             `json:"label" bson:"label"` // What is marked, e.g. "lesion"
+	// Polygon: the outline; arrow and measurement: start and end; text: the anchor
+	Points []Point `json:"points,omitempty" bson:"points,omitempty"`
+	// Ellipse: centre, radii and clockwise rotation in degrees
+	Center   *Point  `json:"center,omitempty" bson:"center,omitempty"`
+	RadiusX  float64 `json:"radius_x,omitempty" bson:"radius_x,omitempty"`
+	RadiusY  float64 `json:"radius_y,omitempty" bson:"radius_y,omitempty"`
+	Rotation float64 `json:"rotation,omitempty" bson:"rotation,omitempty"`
+	Text     string  `json:"text,omitempty" bson:"text,omitempty"`
+	// Computed from the points and, for mm, the image's pixel spacing
+	LengthPx  float64            `json:"length_px,omitempty" bson:"length_px,omitempty"`
+	LengthMM  *float64           `json:"length_mm,omitempty" bson:"length_mm,omitempty"`
+	AreaPx    float64            `json:"area_px,omitempty" bson:"area_px,omitempty"`
+	AreaMM2   *float64           `json:"area_mm2,omitempty" bson:"area_mm2,omitempty"`
+	Author    primitive.ObjectID `json:"author" bson:"author"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
 }
 
+type Point struct {
+	X float64 `json:"x" bson:"x"`
+	Y float64 `json:"y" bson:"y"`
+}
+
+const (
+	AnnotationPolygon     = "polygon"
+	AnnotationEllipse     = "ellipse"
+	AnnotationArrow       = "arrow"
+	AnnotationText        = "text"
+	AnnotationMeasurement = "measurement"
+)
+
+// DICOMMetadata is what the API keeps from a DICOM upload's header.
+type DICOMMetadata struct {
+	Modality       string     `json:"modality" bson:"modality"`
+	StudyDate      *time.Time `json:"study_date,omitempty" bson:"study_date,omitempty"`
+	BodyPart       string     `json:"body_part,omitempty" bson:"body_part,omitempty"`
+	PixelSpacing   []float64  `json:"pixel_spacing,omitempty" bson:"pixel_spacing,omitempty"` // mm, row then column
+	Rows           int        `json:"rows" bson:"rows"`
+	Columns        int        `json:"columns" bson:"columns"`
+	Frames         int        `json:"frames" bson:"frames"`
+	TransferSyntax string     `json:"transfer_syntax" bson:"transfer_syntax"`
+}
+
+// Allowed values of the patient clinical fields
+const (
+	GenderMale   = "Male"
+	GenderFemale = "Female"
+
+	ExpansionBuccolingual    = "Buccolingual"
+	ExpansionAnteroposterior = "Anteroposterior"
+
+	DurationWeeks  = "weeks"
+	DurationMonths = "months"
+	DurationYears  = "years"
+
+	LesionsSingle   = "Single lesion"
+	LesionsMultiple = "Multiple lesions"
+
+	ConfirmationAgree    = "Agree"
+	ConfirmationDisagree = "Disagree"
+)
+
+const (
+	HospitalAccessNone  = "none"
+	HospitalAccessRead  = "read"
+	HospitalAccessWrite = "write"
+)
+
 type Question struct {
 	ID           primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
 	UserID       primitive.ObjectID `json:"user_id" bson:"user_id"`
 	AdminID      primitive.ObjectID `json:"admin_id,omitempty" bson:"admin_id,omitempty"`
 	Title        string             `json:"title" bson:"title"`
 	Content      string             `json:"content" bson:"content"`
-	Status       string             `json:"status" bson:"status"` // "pending", "inProgress", "answered", "closed", "deleted"
+	PatientID    *primitive.ObjectID  `json:"patient_id,omitempty" bson:"patient_id,omitempty"` // Case the question is about; the asker must be able to read it
+	ImageIDs     []primitive.ObjectID `json:"image_ids,omitempty" bson:"image_ids,omitempty"`   // Images of that patient the question refers to
+	Status       string             `json:"status" bson:"status"` // "pending", "inProgress", "answered", "closed"; deleting sets DeletedAt and keeps the status
 	Answer       string             `json:"answer,omitempty" bson:"answer,omitempty"`
 	IsEdited     bool               `json:"is_edited" bson:"is_edited"`
 	EditHistory  []EditEntry        `json:"edit_history,omitempty" bson:"edit_history,omitempty"`
@@ -59,6 +388,9 @@ type Question struct {
 		Admin            bool `json:"admin" bson:"admin"`
 		NotificationBell bool `json:"notification_bell" bson:"notification_bell"`
 	} `json:"read_status" bson:"read_status"`
+
+	DeletedAt *time.Time          `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"` // Set while the question is in the recycle bin
+	DeletedBy *primitive.ObjectID `json:"deleted_by,omitempty" bson:"deleted_by,omitempty"`
 }
 
 type EditEntry struct {
@@ -79,3 +411,165 @@ type Notification struct {
 	RedirectURL string             `json:"redirect_url" bson:"redirect_url"`
 }
 
+type PackageHistory struct {
+	ID          primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID      primitive.ObjectID `json:"user_id" bson:"user_id"`
+	FromPackage string             `json:"from_package" bson:"from_package"`
+	ToPackage   string             `json:"to_package" bson:"to_package"`
+	Reason      string             `json:"reason" bson:"reason"`         // "expired", "admin_set", ...
+	ChangedBy   string             `json:"changed_by" bson:"changed_by"` // Admin ID or "system"
+	ChangedAt   time.Time          `json:"changed_at" bson:"changed_at"`
+}
+
+// Subscription is one period during which a user held a package.
+type Subscription struct {
+	ID               primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID           primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Package          string             `json:"package" bson:"package"`
+	Status           string             `json:"status" bson:"status"` // "active", "ended", "expired", "refunded"
+	StartAt          time.Time          `json:"start_at" bson:"start_at"`
+	EndAt            *time.Time         `json:"end_at,omitempty" bson:"end_at,omitempty"`         // Actual end, set when the subscription stops
+	ExpiresAt        *time.Time         `json:"expires_at,omitempty" bson:"expires_at,omitempty"` // Planned end, nil means no expiry
+	Price            float64            `json:"price" bson:"price"` // Price at purchase time
+	Currency         string             `json:"currency" bson:"currency"`
+	GrantedBy        primitive.ObjectID `json:"granted_by,omitempty" bson:"granted_by,omitempty"` // Admin who set the package
+	PaymentReference string             `json:"payment_reference,omitempty" bson:"payment_reference,omitempty"`
+	PromoCode        string             `json:"promo_code,omitempty" bson:"promo_code,omitempty"`
+	Trial            bool               `json:"trial" bson:"trial"`
+	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type Invoice struct {
+	ID               primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Number           string             `json:"number" bson:"number"` // Sequential, e.g. INV-2024-000001
+	UserID           primitive.ObjectID `json:"user_id" bson:"user_id"`
+	SubscriptionID   primitive.ObjectID `json:"subscription_id" bson:"subscription_id"`
+	BillTo           string             `json:"bill_to" bson:"bill_to"`
+	Hospital         string             `json:"hospital" bson:"hospital"`
+	Items            []InvoiceItem      `json:"items" bson:"items"`
+	Total            float64            `json:"total" bson:"total"`
+	Currency         string             `json:"currency" bson:"currency"`
+	PaymentReference string             `json:"payment_reference,omitempty" bson:"payment_reference,omitempty"`
+	IssuedAt         time.Time          `json:"issued_at" bson:"issued_at"`
+}
+
+type InvoiceItem struct {
+	Description string  `json:"description" bson:"description"`
+	Amount      float64 `json:"amount" bson:"amount"`
+}
+
+// Payment is one checkout for a package, from creation to paid or refunded.
+type Payment struct {
+	ID             primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID         primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Package        string             `json:"package" bson:"package"`
+	Amount         float64            `json:"amount" bson:"amount"`
+	Currency       string             `json:"currency" bson:"currency"`
+	Method         string             `json:"method" bson:"method"` // "promptpay" or "card"
+	Provider       string             `json:"provider" bson:"provider"`
+	ProviderRef    string             `json:"provider_ref,omitempty" bson:"provider_ref,omitempty"`
+	Status         string             `json:"status" bson:"status"` // "pending", "paid", "failed", "expired", "refunded", "amount_mismatch"
+	CheckoutURL    string             `json:"checkout_url,omitempty" bson:"checkout_url,omitempty"`
+	QRPayload      string             `json:"qr_payload,omitempty" bson:"qr_payload,omitempty"`
+	DurationDays   int                `json:"duration_days" bson:"duration_days"`
+	PromoCode      string             `json:"promo_code,omitempty" bson:"promo_code,omitempty"`
+	Discount       float64            `json:"discount,omitempty" bson:"discount,omitempty"`
+	SubscriptionID primitive.ObjectID `json:"subscription_id,omitempty" bson:"subscription_id,omitempty"`
+	CreatedAt      time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at" bson:"updated_at"`
+	PaidAt         *time.Time         `json:"paid_at,omitempty" bson:"paid_at,omitempty"`
+	PaidAmount     float64            `json:"paid_amount,omitempty" bson:"paid_amount,omitempty"` // What the provider reported, set when it didn't match Amount
+	ExpiresAt      *time.Time         `json:"expires_at,omitempty" bson:"expires_at,omitempty"` // Of the checkout; a pending payment expires some time after
+	RefundedAt     *time.Time         `json:"refunded_at,omitempty" bson:"refunded_at,omitempty"`
+}
+
+// WebhookEvent records processed webhook events so retries are ignored.
+type WebhookEvent struct {
+	ID         string    `json:"id" bson:"_id"` // "<provider>:<event id>"
+	Type       string    `json:"type" bson:"type"`
+	Reference  string    `json:"reference" bson:"reference"`
+	ReceivedAt time.Time `json:"received_at" bson:"received_at"`
+}
+
+type PromoCode struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Code       string             `json:"code" bson:"code"` // Stored upper case
+	Type       string             `json:"type" bson:"type"` // "percent", "fixed" or "trial"
+	Value      float64            `json:"value" bson:"value"` // Percent off or THB off; unused for trials
+	TrialDays  int                `json:"trial_days,omitempty" bson:"trial_days,omitempty"`
+	Packages   []string           `json:"packages,omitempty" bson:"packages,omitempty"` // Empty means any package
+	MaxUses    int                `json:"max_uses" bson:"max_uses"` // 0 means unlimited
+	UsedCount  int                `json:"used_count" bson:"used_count"`
+	ValidFrom  *time.Time         `json:"valid_from,omitempty" bson:"valid_from,omitempty"`
+	ValidUntil *time.Time         `json:"valid_until,omitempty" bson:"valid_until,omitempty"`
+	Active     bool               `json:"active" bson:"active"`
+	CreatedBy  primitive.ObjectID `json:"created_by" bson:"created_by"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// PromoRedemption records that a user used a code; each user may use a code once.
+type PromoRedemption struct {
+	ID         string             `json:"id" bson:"_id"` // "<code id>:<user id>"
+	CodeID     primitive.ObjectID `json:"code_id" bson:"code_id"`
+	UserID     primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Package    string             `json:"package" bson:"package"`
+	RedeemedAt time.Time          `json:"redeemed_at" bson:"redeemed_at"`
+}
+
+// DiagnosisRuleSet is one version of the differential diagnosis rules.
+// Saving never changes a stored version: it adds the next one, and the
+// highest version is the one in use.
+type DiagnosisRuleSet struct {
+	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Version   int                `json:"version" bson:"version"`
+	Note      string             `json:"note,omitempty" bson:"note,omitempty"` // What changed and why
+	Diagnoses []DiagnosisRule    `json:"diagnoses,omitempty" bson:"diagnoses"`
+	CreatedBy primitive.ObjectID `json:"created_by,omitempty" bson:"created_by,omitempty"` // Empty for the built-in rules
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// DiagnosisRule scores one candidate diagnosis: its prior plus the weight of
+// every factor the patient matches.
+type DiagnosisRule struct {
+	Name    string            `json:"name" bson:"name"`
+	Prior   float64           `json:"prior" bson:"prior"`
+	Factors []DiagnosisFactor `json:"factors" bson:"factors"`
+}
+
+// DiagnosisFactor matches one patient field. Age uses Min and Max
+// (inclusive); the other fields match any of Values, in their stored
+// spelling, "true"/"false" for paresthesia and "" for no expansion.
+type DiagnosisFactor struct {
+	Field  string   `json:"field" bson:"field"` // Patient JSON key
+	Values []string `json:"values,omitempty" bson:"values,omitempty"`
+	Min    *int     `json:"min,omitempty" bson:"min,omitempty"`
+	Max    *int     `json:"max,omitempty" bson:"max,omitempty"`
+	Weight float64  `json:"weight" bson:"weight"` // Negative when the finding argues against the diagnosis
+	Label  string   `json:"label" bson:"label"`   // Shown to clinicians as the reason
+}
+
+// ResearchExport records who downloaded a de-identified dataset, with what
+// parameters and which data files (images are only listed in the manifest).
+type ResearchExport struct {
+	ID          primitive.ObjectID       `json:"id,omitempty" bson:"_id,omitempty"`
+	Parameters  ResearchExportParameters `json:"parameters" bson:"parameters"`
+	Records     int                      `json:"records" bson:"records"`
+	Files       []ExportFile             `json:"files" bson:"files"`
+	RequestedBy primitive.ObjectID       `json:"requested_by" bson:"requested_by"`
+	CreatedAt   time.Time                `json:"created_at" bson:"created_at"`
+}
+
+type ResearchExportParameters struct {
+	Formats      []string   `json:"formats" bson:"formats"`               // jsonl, csv, parquet
+	AgeBandWidth int        `json:"age_band_width" bson:"age_band_width"` // Years per band, 90 and over is one band
+	Pseudonyms   string     `json:"pseudonyms" bson:"pseudonyms"`         // "stable" across exports or "random" per export
+	Images       bool       `json:"images" bson:"images"`
+	CreatedFrom  *time.Time `json:"created_from,omitempty" bson:"created_from,omitempty"`
+	CreatedTo    *time.Time `json:"created_to,omitempty" bson:"created_to,omitempty"`
+}
+
+type ExportFile struct {
+	Name   string `json:"name" bson:"name"`
+	Size   int64  `json:"size" bson:"size"`
+	SHA256 string `json:"sha256" bson:"sha256"`
+}
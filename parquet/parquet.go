@@ -0,0 +1,297 @@
+// Package parquet writes flat tables as Apache Parquet files: one row
+// group, one uncompressed PLAIN-encoded data page per column. That's enough
+// for research exports of a few thousand rows that pandas, Arrow or DuckDB
+// read directly; nested columns, dictionaries and compression aren't
+// supported.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+type Type int
+
+const (
+	Boolean Type = iota
+	Int32
+	Int64
+	Double
+	String
+)
+
+// Physical types, encodings and other enums from parquet.thrift.
+const (
+	physicalBoolean   = 0
+	physicalInt32     = 1
+	physicalInt64     = 2
+	physicalDouble    = 5
+	physicalByteArray = 6
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	convertedUTF8 = 0
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	pageData          = 0
+)
+
+var physicalTypes = map[Type]int32{
+	Boolean: physicalBoolean,
+	Int32:   physicalInt32,
+	Int64:   physicalInt64,
+	Double:  physicalDouble,
+	String:  physicalByteArray,
+}
+
+type Column struct {
+	Name     string
+	Type     Type
+	Optional bool // Allows nil values
+}
+
+type chunk struct {
+	offset int64 // Of the page header
+	size   int64 // Header and page
+	values int
+}
+
+// Write writes rows, each holding one value per column in column order:
+// bool, int32 (or int), int64, float64 or string to match the column type,
+// or nil in optional columns.
+func Write(w io.Writer, columns []Column, rows [][]interface{}) error {
+	out := &counter{w: w}
+	if _, err := io.WriteString(out, "PAR1"); err != nil {
+		return err
+	}
+
+	chunks := make([]chunk, len(columns))
+	for i, column := range columns {
+		page, err := encodePage(column, i, rows)
+		if err != nil {
+			return err
+		}
+
+		var header compact
+		header.begin()
+		header.i32(1, pageData)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.structField(5)
+		header.i32(1, int32(len(rows)))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.end()
+		header.end()
+
+		chunks[i] = chunk{offset: out.n, size: int64(header.buf.Len() + len(page)), values: len(rows)}
+		if _, err := out.Write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := out.Write(page); err != nil {
+			return err
+		}
+	}
+
+	meta := fileMetadata(columns, chunks, len(rows))
+	if _, err := out.Write(meta); err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(meta)))
+	if _, err := out.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "PAR1")
+	return err
+}
+
+// encodePage returns the definition levels (optional columns only) and the
+// PLAIN values of column i.
+func encodePage(column Column, i int, rows [][]interface{}) ([]byte, error) {
+	var values bytes.Buffer
+	var bits []bool
+	defined := make([]bool, len(rows))
+
+	for r, row := range rows {
+		if len(row) <= i {
+			return nil, fmt.Errorf("parquet: row %d has %d values", r, len(row))
+		}
+		v := row[i]
+		if v == nil {
+			if !column.Optional {
+				return nil, fmt.Errorf("parquet: column %s is required but row %d is null", column.Name, r)
+			}
+			continue
+		}
+		defined[r] = true
+
+		var err error
+		switch column.Type {
+		case Boolean:
+			b, ok := v.(bool)
+			if !ok {
+				err = typeError(column, r, v)
+			}
+			bits = append(bits, b)
+		case Int32:
+			switch n := v.(type) {
+			case int32:
+				binary.Write(&values, binary.LittleEndian, n)
+			case int:
+				binary.Write(&values, binary.LittleEndian, int32(n))
+			default:
+				err = typeError(column, r, v)
+			}
+		case Int64:
+			n, ok := v.(int64)
+			if !ok {
+				err = typeError(column, r, v)
+			}
+			binary.Write(&values, binary.LittleEndian, n)
+		case Double:
+			f, ok := v.(float64)
+			if !ok {
+				err = typeError(column, r, v)
+			}
+			binary.Write(&values, binary.LittleEndian, math.Float64bits(f))
+		case String:
+			s, ok := v.(string)
+			if !ok {
+				err = typeError(column, r, v)
+			}
+			binary.Write(&values, binary.LittleEndian, uint32(len(s)))
+			values.WriteString(s)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Booleans are bit-packed, least significant bit first
+	if column.Type == Boolean {
+		packed := make([]byte, (len(bits)+7)/8)
+		for j, b := range bits {
+			if b {
+				packed[j/8] |= 1 << (j % 8)
+			}
+		}
+		values.Write(packed)
+	}
+
+	var page bytes.Buffer
+	if column.Optional {
+		levels := definitionLevels(defined)
+		binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+		page.Write(levels)
+	}
+	page.Write(values.Bytes())
+	return page.Bytes(), nil
+}
+
+func typeError(column Column, row int, v interface{}) error {
+	return fmt.Errorf("parquet: column %s has unexpected %T in row %d", column.Name, v, row)
+}
+
+// definitionLevels encodes 0 (null) and 1 (set) for each row as runs of the
+// RLE/bit-packing hybrid with a bit width of 1.
+func definitionLevels(defined []bool) []byte {
+	var out []byte
+	var b [binary.MaxVarintLen64]byte
+	for start := 0; start < len(defined); {
+		end := start
+		for end < len(defined) && defined[end] == defined[start] {
+			end++
+		}
+		out = append(out, b[:binary.PutUvarint(b[:], uint64(end-start)<<1)]...)
+		if defined[start] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		start = end
+	}
+	return out
+}
+
+func fileMetadata(columns []Column, chunks []chunk, rows int) []byte {
+	var t compact
+	t.begin()
+	t.i32(1, 1)
+
+	t.list(2, typeStruct, len(columns)+1)
+	t.begin()
+	t.string(4, "schema")
+	t.i32(5, int32(len(columns)))
+	t.end()
+	for _, column := range columns {
+		t.begin()
+		t.i32(1, physicalTypes[column.Type])
+		if column.Optional {
+			t.i32(3, repetitionOptional)
+		} else {
+			t.i32(3, repetitionRequired)
+		}
+		t.string(4, column.Name)
+		if column.Type == String {
+			t.i32(6, convertedUTF8)
+		}
+		t.end()
+	}
+
+	t.i64(3, int64(rows))
+
+	var total int64
+	for _, c := range chunks {
+		total += c.size
+	}
+	t.list(4, typeStruct, 1)
+	t.begin()
+	t.list(1, typeStruct, len(columns))
+	for i, column := range columns {
+		c := chunks[i]
+		t.begin()
+		t.i64(2, c.offset)
+		t.structField(3)
+		t.i32(1, physicalTypes[column.Type])
+		t.list(2, typeI32, 2)
+		t.zigzag(encodingPlain)
+		t.zigzag(encodingRLE)
+		t.list(3, typeBinary, 1)
+		t.binary(column.Name)
+		t.i32(4, codecUncompressed)
+		t.i64(5, int64(c.values))
+		t.i64(6, c.size)
+		t.i64(7, c.size)
+		t.i64(9, c.offset)
+		t.end()
+		t.end()
+	}
+	t.i64(2, total)
+	t.i64(3, int64(rows))
+	t.end()
+
+	t.string(6, "user-auth-api")
+	t.end()
+	return t.buf.Bytes()
+}
+
+// counter tracks the file offset for the column chunk metadata.
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,264 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// reader decodes the Thrift compact protocol into maps of field id to value,
+// enough to check the metadata Write produces.
+type reader struct {
+	buf []byte
+	pos int
+}
+
+func (r *reader) varint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		panic("bad varint")
+	}
+	r.pos += n
+	return v
+}
+
+func (r *reader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *reader) value(typ byte) interface{} {
+	switch typ {
+	case typeI32, typeI64:
+		return r.zigzag()
+	case typeBinary:
+		n := int(r.varint())
+		r.pos += n
+		return string(r.buf[r.pos-n : r.pos])
+	case typeList:
+		header := r.buf[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case typeStruct:
+		fields := map[int16]interface{}{}
+		var id int16
+		for {
+			header := r.buf[r.pos]
+			r.pos++
+			if header == 0 {
+				return fields
+			}
+			if delta := int16(header >> 4); delta != 0 {
+				id += delta
+			} else {
+				id = int16(r.zigzag())
+			}
+			fields[id] = r.value(header & 0x0f)
+		}
+	}
+	panic(fmt.Sprintf("unexpected thrift type %d", typ))
+}
+
+func (r *reader) structure() map[int16]interface{} {
+	return r.value(typeStruct).(map[int16]interface{})
+}
+
+// read decodes a file written by Write back into its column names and rows.
+func read(t *testing.T, data []byte) ([]Column, [][]interface{}) {
+	t.Helper()
+	if string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		t.Fatalf("missing PAR1 magic")
+	}
+	length := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := &reader{buf: data[len(data)-8-length : len(data)-8]}
+	meta := footer.structure()
+	if footer.pos != length {
+		t.Fatalf("footer is %d bytes, metadata used %d", length, footer.pos)
+	}
+
+	schema := meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	if root[5].(int64) != int64(len(schema)-1) {
+		t.Fatalf("schema root has %d children, want %d", root[5], len(schema)-1)
+	}
+	types := map[int64]Type{}
+	for typ, physical := range physicalTypes {
+		types[int64(physical)] = typ
+	}
+	var columns []Column
+	for _, element := range schema[1:] {
+		e := element.(map[int16]interface{})
+		columns = append(columns, Column{
+			Name:     e[4].(string),
+			Type:     types[e[1].(int64)],
+			Optional: e[3].(int64) == repetitionOptional,
+		})
+	}
+
+	rowCount := int(meta[3].(int64))
+	rows := make([][]interface{}, rowCount)
+	for i := range rows {
+		rows[i] = make([]interface{}, len(columns))
+	}
+
+	groups := meta[4].([]interface{})
+	if len(groups) != 1 {
+		t.Fatalf("%d row groups, want 1", len(groups))
+	}
+	chunks := groups[0].(map[int16]interface{})[1].([]interface{})
+	for i, column := range columns {
+		chunkMeta := chunks[i].(map[int16]interface{})[3].(map[int16]interface{})
+		if name := chunkMeta[3].([]interface{})[0]; name != column.Name {
+			t.Fatalf("chunk %d is for %v, want %s", i, name, column.Name)
+		}
+		if chunkMeta[5].(int64) != int64(rowCount) {
+			t.Fatalf("chunk %s has %d values, want %d", column.Name, chunkMeta[5], rowCount)
+		}
+
+		page := &reader{buf: data, pos: int(chunkMeta[9].(int64))}
+		header := page.structure()
+		end := page.pos + int(header[3].(int64))
+		if int64(end)-chunkMeta[9].(int64) != chunkMeta[6].(int64) {
+			t.Fatalf("chunk %s size %d doesn't match its page", column.Name, chunkMeta[6])
+		}
+
+		defined := make([]bool, rowCount)
+		for r := range defined {
+			defined[r] = true
+		}
+		if column.Optional {
+			levels := int(binary.LittleEndian.Uint32(data[page.pos:]))
+			page.pos += 4
+			runs := &reader{buf: data[page.pos : page.pos+levels]}
+			for r := 0; runs.pos < levels; {
+				run := runs.varint()
+				if run&1 != 0 {
+					t.Fatalf("chunk %s has a bit-packed run", column.Name)
+				}
+				value := runs.buf[runs.pos]
+				runs.pos++
+				for n := 0; n < int(run>>1); n++ {
+					defined[r] = value == 1
+					r++
+				}
+			}
+			page.pos += levels
+		}
+
+		values := data[page.pos:end]
+		bit := 0
+		for r := range rows {
+			if !defined[r] {
+				continue
+			}
+			switch column.Type {
+			case Boolean:
+				rows[r][i] = values[bit/8]&(1<<(bit%8)) != 0
+				bit++
+			case Int32:
+				rows[r][i] = int32(binary.LittleEndian.Uint32(values))
+				values = values[4:]
+			case Int64:
+				rows[r][i] = int64(binary.LittleEndian.Uint64(values))
+				values = values[8:]
+			case Double:
+				rows[r][i] = math.Float64frombits(binary.LittleEndian.Uint64(values))
+				values = values[8:]
+			case String:
+				n := int(binary.LittleEndian.Uint32(values))
+				rows[r][i] = string(values[4 : 4+n])
+				values = values[4+n:]
+			}
+		}
+		if column.Type == Boolean {
+			values = values[(bit+7)/8:]
+		}
+		if len(values) != 0 {
+			t.Fatalf("chunk %s has %d bytes left over", column.Name, len(values))
+		}
+	}
+	return columns, rows
+}
+
+func TestWrite(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: String},
+		{Name: "age", Type: Int32},
+		{Name: "size_mm", Type: Double, Optional: true},
+		{Name: "paresthesia", Type: Boolean},
+		{Name: "created", Type: Int64, Optional: true},
+		{Name: "note", Type: String, Optional: true},
+	}
+	rows := [][]interface{}{
+		{"a", 30, 1.5, true, int64(1700000000000), nil},
+		{"b", int32(-4), nil, false, nil, "แผล"},
+		{"c", 0, nil, true, nil, nil},
+	}
+	// Enough booleans to span several bytes
+	for i := 0; i < 20; i++ {
+		rows = append(rows, []interface{}{fmt.Sprint(i), i, float64(i), i%3 == 0, int64(i), nil})
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, columns, rows); err != nil {
+		t.Fatal(err)
+	}
+	gotColumns, gotRows := read(t, buf.Bytes())
+	if !reflect.DeepEqual(gotColumns, columns) {
+		t.Errorf("columns = %+v, want %+v", gotColumns, columns)
+	}
+
+	for _, row := range rows {
+		if n, ok := row[1].(int); ok {
+			row[1] = int32(n)
+		}
+	}
+	if !reflect.DeepEqual(gotRows, rows) {
+		t.Errorf("rows = %v, want %v", gotRows, rows)
+	}
+}
+
+func TestWriteManyColumns(t *testing.T) {
+	// 15 or more list items use the long form of the list header
+	var columns []Column
+	row := []interface{}{}
+	for i := 0; i < 16; i++ {
+		columns = append(columns, Column{Name: fmt.Sprintf("c%d", i), Type: Int64})
+		row = append(row, int64(i))
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, columns, [][]interface{}{row}); err != nil {
+		t.Fatal(err)
+	}
+	gotColumns, gotRows := read(t, buf.Bytes())
+	if len(gotColumns) != 16 || !reflect.DeepEqual(gotRows[0], row) {
+		t.Errorf("read %d columns and %v, want 16 and %v", len(gotColumns), gotRows[0], row)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	columns := []Column{{Name: "id", Type: String}, {Name: "age", Type: Int32}}
+	tests := map[string][]interface{}{
+		"is required":  {nil, 1},
+		"unexpected":   {"a", "30"},
+		"has 1 values": {"a"},
+	}
+	for want, row := range tests {
+		err := Write(&bytes.Buffer{}, columns, [][]interface{}{row})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Write(%v) error = %v, want %q", row, err, want)
+		}
+	}
+}
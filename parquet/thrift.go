@@ -0,0 +1,88 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Thrift compact protocol types, as used in Parquet metadata.
+const (
+	typeI32    = 5
+	typeI64    = 6
+	typeBinary = 8
+	typeList   = 9
+	typeStruct = 12
+)
+
+// compact writes Thrift compact protocol structs. Fields must be written
+// in increasing id order within each struct.
+type compact struct {
+	buf  bytes.Buffer
+	last []int16 // Previous field id of each open struct
+}
+
+func (t *compact) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *compact) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *compact) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+// begin opens a struct: the top-level one, a list element or, after
+// field(id, typeStruct), a nested field.
+func (t *compact) begin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *compact) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *compact) i32(id int16, v int32) {
+	t.field(id, typeI32)
+	t.zigzag(int64(v))
+}
+
+func (t *compact) i64(id int16, v int64) {
+	t.field(id, typeI64)
+	t.zigzag(v)
+}
+
+func (t *compact) binary(v string) {
+	t.varint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
+
+func (t *compact) string(id int16, v string) {
+	t.field(id, typeBinary)
+	t.binary(v)
+}
+
+func (t *compact) list(id int16, elem byte, size int) {
+	t.field(id, typeList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *compact) structField(id int16) {
+	t.field(id, typeStruct)
+	t.begin()
+}
@@ -0,0 +1,77 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FakeProvider is an in-memory provider for local development and tests. It
+// never talks to a real gateway; webhooks for it can be produced with
+// SignedEvent and posted to the webhook endpoint.
+type FakeProvider struct {
+	secret string
+
+	mu      sync.Mutex
+	seq     int
+	Refunds map[string]float64 // provider ref -> refunded amount
+}
+
+func NewFakeProvider(secret string) (*FakeProvider, error) {
+	if secret == "" {
+		return nil, errors.New("PAYMENT_WEBHOOK_SECRET is required")
+	}
+	return &FakeProvider{secret: secret, Refunds: map[string]float64{}}, nil
+}
+
+func (f *FakeProvider) Name() string { return "fake" }
+
+func (f *FakeProvider) SignatureHeader() string { return "X-Fake-Signature" }
+
+func (f *FakeProvider) CreateCheckout(ctx context.Context, req CheckoutRequest) (*Checkout, error) {
+	f.mu.Lock()
+	f.seq++
+	ref := fmt.Sprintf("fake_chrg_%d", f.seq)
+	f.mu.Unlock()
+
+	checkout := &Checkout{
+		ProviderRef: ref,
+		URL:         "fake://checkout/" + req.Reference,
+		ExpiresAt:   time.Now().Add(15 * time.Minute),
+	}
+	if req.Method == "promptpay" {
+		checkout.QRPayload = PromptPayPayload("0000000000000", req.Amount)
+	}
+	return checkout, nil
+}
+
+func (f *FakeProvider) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	if err := verify(f.secret, payload, signature); err != nil {
+		return nil, err
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("cannot decode webhook: %w", err)
+	}
+	return &event, nil
+}
+
+func (f *FakeProvider) Refund(ctx context.Context, providerRef string, amount float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Refunds[providerRef] += amount
+	return nil
+}
+
+// SignedEvent encodes event as a webhook body and returns it with its signature.
+func (f *FakeProvider) SignedEvent(event Event) ([]byte, string, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, sign(f.secret, payload), nil
+}
@@ -0,0 +1,143 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GatewayConfig configures the card / PromptPay gateway adapter.
+type GatewayConfig struct {
+	BaseURL       string // e.g. https://api.gateway.example/v1
+	SecretKey     string // Sent as HTTP basic auth user
+	WebhookSecret string // Shared secret for webhook HMAC signatures
+	PromptPayID   string // Merchant PromptPay ID, used when the gateway returns no QR payload
+}
+
+// GatewayProvider talks to a Thai payment gateway that supports card charges
+// via a hosted authorize page and PromptPay QR charges. Amounts are sent in
+// satang, as Thai gateways expect.
+type GatewayProvider struct {
+	config GatewayConfig
+	http   *http.Client
+}
+
+func NewGatewayProvider(config GatewayConfig) (*GatewayProvider, error) {
+	if config.BaseURL == "" || config.SecretKey == "" || config.WebhookSecret == "" {
+		return nil, errors.New("PAYMENT_GATEWAY_URL, PAYMENT_GATEWAY_SECRET_KEY and PAYMENT_WEBHOOK_SECRET are required")
+	}
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	return &GatewayProvider{config: config, http: &http.Client{Timeout: 15 * time.Second}}, nil
+}
+
+func (g *GatewayProvider) Name() string { return "gateway" }
+
+func (g *GatewayProvider) SignatureHeader() string { return "X-Gateway-Signature" }
+
+func (g *GatewayProvider) CreateCheckout(ctx context.Context, req CheckoutRequest) (*Checkout, error) {
+	body := map[string]interface{}{
+		"amount":      toSatang(req.Amount),
+		"currency":    strings.ToLower(req.Currency),
+		"source":      req.Method,
+		"reference":   req.Reference,
+		"description": req.Description,
+		"return_uri":  req.ReturnURL,
+	}
+
+	var charge struct {
+		ID           string    `json:"id"`
+		AuthorizeURI string    `json:"authorize_uri"`
+		QRPayload    string    `json:"qr_payload"`
+		ExpiresAt    time.Time `json:"expires_at"`
+	}
+	if err := g.do(ctx, http.MethodPost, "/charges", body, &charge); err != nil {
+		return nil, err
+	}
+
+	checkout := &Checkout{
+		ProviderRef: charge.ID,
+		URL:         charge.AuthorizeURI,
+		QRPayload:   charge.QRPayload,
+		ExpiresAt:   charge.ExpiresAt,
+	}
+	if req.Method == "promptpay" && checkout.QRPayload == "" && g.config.PromptPayID != "" {
+		checkout.QRPayload = PromptPayPayload(g.config.PromptPayID, req.Amount)
+	}
+	return checkout, nil
+}
+
+func (g *GatewayProvider) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	if err := verify(g.config.WebhookSecret, payload, signature); err != nil {
+		return nil, err
+	}
+
+	var hook struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			ID        string `json:"id"`
+			Reference string `json:"reference"`
+			Amount    int64  `json:"amount"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &hook); err != nil {
+		return nil, fmt.Errorf("cannot decode webhook: %w", err)
+	}
+
+	return &Event{
+		ID:          hook.ID,
+		Type:        hook.Type,
+		Reference:   hook.Data.Reference,
+		ProviderRef: hook.Data.ID,
+		Amount:      float64(hook.Data.Amount) / 100,
+	}, nil
+}
+
+func (g *GatewayProvider) Refund(ctx context.Context, providerRef string, amount float64) error {
+	return g.do(ctx, http.MethodPost, "/charges/"+providerRef+"/refunds", map[string]interface{}{
+		"amount": toSatang(amount),
+	}, nil)
+}
+
+func (g *GatewayProvider) do(ctx context.Context, method, path string, in, out interface{}) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, g.config.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(g.config.SecretKey, "")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("gateway %s %s: %d %s", method, path, resp.StatusCode, apiErr.Message)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func toSatang(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
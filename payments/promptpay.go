@@ -0,0 +1,54 @@
+package payments
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PromptPayPayload builds the EMVCo merchant-presented QR payload for a
+// PromptPay transfer of amount THB to id (a mobile number, national ID or
+// tax ID, or an e-wallet ID).
+func PromptPayPayload(id string, amount float64) string {
+	id = strings.NewReplacer("-", "", " ", "").Replace(id)
+
+	var target string
+	switch {
+	case len(id) == 10 && strings.HasPrefix(id, "0"):
+		// Mobile numbers are sent as 0066 + number without the leading 0
+		target = tlv("01", "0066"+id[1:])
+	case len(id) == 13:
+		target = tlv("02", id)
+	default:
+		target = tlv("03", id)
+	}
+
+	payload := tlv("00", "01") +
+		tlv("01", "12") + // dynamic QR, valid for one payment
+		tlv("29", tlv("00", "A000000677010111")+target) +
+		tlv("53", "764") + // THB
+		tlv("54", fmt.Sprintf("%.2f", amount)) +
+		tlv("58", "TH") +
+		"6304"
+
+	return payload + fmt.Sprintf("%04X", crc16(payload))
+}
+
+func tlv(tag, value string) string {
+	return fmt.Sprintf("%s%02d%s", tag, len(value), value)
+}
+
+// crc16 is CRC-16/CCITT-FALSE as required by the EMVCo QR specification.
+func crc16(s string) uint16 {
+	crc := uint16(0xFFFF)
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,49 @@
+package payments
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	// The CRC-16/CCITT-FALSE check value
+	if got := crc16("123456789"); got != 0x29B1 {
+		t.Fatalf("crc16(123456789) = %04X, want 29B1", got)
+	}
+}
+
+func TestPromptPayPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		amount float64
+		target string
+		amt    string
+	}{
+		{"mobile", "081-234-5678", 150, "01130066812345678", "150.00"},
+		{"national ID", "1234567890123", 99.5, "02131234567890123", "99.50"},
+		{"e-wallet", "123456789012345", 0.01, "0315123456789012345", "0.01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := PromptPayPayload(tt.id, tt.amount)
+
+			merchant := "0016A000000677010111" + tt.target
+			want := "000201" + "010212" +
+				fmt.Sprintf("29%02d%s", len(merchant), merchant) +
+				"5303764" +
+				fmt.Sprintf("54%02d%s", len(tt.amt), tt.amt) +
+				"5802TH" + "6304"
+			if !strings.HasPrefix(payload, want) {
+				t.Fatalf("payload = %s, want prefix %s", payload, want)
+			}
+			if len(payload) != len(want)+4 {
+				t.Fatalf("payload = %s, want a 4 digit CRC after %s", payload, want)
+			}
+			if crc := fmt.Sprintf("%04X", crc16(want)); payload[len(want):] != crc {
+				t.Errorf("CRC = %s, want %s", payload[len(want):], crc)
+			}
+		})
+	}
+}
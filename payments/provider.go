@@ -0,0 +1,101 @@
+// Package payments abstracts the payment gateway used to buy packages.
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+	EventRefundSucceeded  = "refund.succeeded"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+type CheckoutRequest struct {
+	Reference   string // Our payment ID, echoed back in webhooks
+	Amount      float64
+	Currency    string
+	Method      string // "promptpay" or "card"
+	Description string
+	ReturnURL   string
+}
+
+type Checkout struct {
+	ProviderRef string // The gateway's charge ID
+	URL         string // Hosted page for card payments
+	QRPayload   string // EMVCo payload to render as a PromptPay QR code
+	ExpiresAt   time.Time
+}
+
+// Event is a verified webhook notification.
+type Event struct {
+	ID          string  `json:"id"` // Unique per event, used to process each event once
+	Type        string  `json:"type"`
+	Reference   string  `json:"reference"`
+	ProviderRef string  `json:"provider_ref"`
+	Amount      float64 `json:"amount"`
+}
+
+type Provider interface {
+	Name() string
+	CreateCheckout(ctx context.Context, req CheckoutRequest) (*Checkout, error)
+	// SignatureHeader is the request header carrying the webhook signature.
+	SignatureHeader() string
+	// VerifyWebhook checks the signature and decodes the event.
+	VerifyWebhook(payload []byte, signature string) (*Event, error)
+	Refund(ctx context.Context, providerRef string, amount float64) error
+}
+
+// FromEnv builds the provider selected by PAYMENT_PROVIDER ("gateway" or
+// "fake"). It returns nil when payments are not configured.
+func FromEnv() (Provider, error) {
+	switch os.Getenv("PAYMENT_PROVIDER") {
+	case "":
+		return nil, nil
+	case "fake":
+		fake, err := NewFakeProvider(os.Getenv("PAYMENT_WEBHOOK_SECRET"))
+		if err != nil {
+			return nil, err
+		}
+		return fake, nil
+	case "gateway":
+		gateway, err := NewGatewayProvider(GatewayConfig{
+			BaseURL:       os.Getenv("PAYMENT_GATEWAY_URL"),
+			SecretKey:     os.Getenv("PAYMENT_GATEWAY_SECRET_KEY"),
+			WebhookSecret: os.Getenv("PAYMENT_WEBHOOK_SECRET"),
+			PromptPayID:   os.Getenv("PROMPTPAY_ID"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return gateway, nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", os.Getenv("PAYMENT_PROVIDER"))
+	}
+}
+
+// sign returns the hex HMAC-SHA256 of payload, the scheme both providers use
+// for webhook signatures.
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(secret string, payload []byte, signature string) error {
+	expected, _ := hex.DecodeString(sign(secret, payload))
+	got, err := hex.DecodeString(signature)
+	if err != nil || secret == "" || !hmac.Equal(expected, got) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// newFakeProvider returns a FakeProvider signing with secret.
+func newFakeProvider(t *testing.T, secret string) *FakeProvider {
+	t.Helper()
+	provider, err := NewFakeProvider(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestFakeProviderVerifyWebhook(t *testing.T) {
+	provider := newFakeProvider(t, "secret")
+	event := Event{ID: "evt_1", Type: EventPaymentSucceeded, Reference: "ref", Amount: 199}
+	payload, signature, err := provider.SignedEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := provider.VerifyWebhook(payload, signature)
+	if err != nil {
+		t.Fatalf("VerifyWebhook: %v", err)
+	}
+	if *got != event {
+		t.Errorf("VerifyWebhook = %+v, want %+v", *got, event)
+	}
+
+	tampered := bytes.Replace(payload, []byte(`"amount":199`), []byte(`"amount":1`), 1)
+	if bytes.Equal(tampered, payload) {
+		t.Fatalf("payload %s has no amount to tamper with", payload)
+	}
+	invalid := []struct {
+		name      string
+		provider  *FakeProvider
+		payload   []byte
+		signature string
+	}{
+		{"tampered payload", provider, tampered, signature},
+		{"other secret", newFakeProvider(t, "other"), payload, signature},
+		{"missing signature", provider, payload, ""},
+		{"not hex", provider, payload, "zz" + signature[2:]},
+		{"truncated", provider, payload, signature[:len(signature)-2]},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.provider.VerifyWebhook(tt.payload, tt.signature); !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("VerifyWebhook error = %v, want ErrInvalidSignature", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRequiresSecret(t *testing.T) {
+	payload := []byte(`{"id":"evt_1"}`)
+	if err := verify("", payload, sign("", payload)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("verify with no secret = %v, want ErrInvalidSignature", err)
+	}
+	if _, err := NewFakeProvider(""); err == nil {
+		t.Error("NewFakeProvider with no secret succeeded")
+	}
+}
+
+func TestFakeProviderCheckoutAndRefund(t *testing.T) {
+	provider := newFakeProvider(t, "secret")
+	ctx := context.Background()
+
+	checkout, err := provider.CreateCheckout(ctx, CheckoutRequest{Reference: "ref", Amount: 99, Method: "promptpay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkout.QRPayload != PromptPayPayload("0000000000000", 99) {
+		t.Errorf("QRPayload = %q", checkout.QRPayload)
+	}
+	card, err := provider.CreateCheckout(ctx, CheckoutRequest{Reference: "ref", Amount: 99, Method: "card"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.QRPayload != "" || card.ProviderRef == checkout.ProviderRef {
+		t.Errorf("card checkout = %+v, want no QR and a new provider ref", card)
+	}
+
+	provider.Refund(ctx, checkout.ProviderRef, 40)
+	provider.Refund(ctx, checkout.ProviderRef, 59)
+	if got := provider.Refunds[checkout.ProviderRef]; got != 99 {
+		t.Errorf("refunded %v, want 99", got)
+	}
+}
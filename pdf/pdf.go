@@ -0,0 +1,214 @@
+// Package pdf writes simple single-page text documents such as invoices.
+// Text is set in the built-in Helvetica, which is limited to Latin-1, unless
+// the document has an embedded Font.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	pageWidth  = 595 // A4 in points
+	pageHeight = 842
+	margin     = 56
+)
+
+type line struct {
+	text string
+	size int
+}
+
+// Document is a page of left-aligned lines written top to bottom.
+type Document struct {
+	Font  *Font // Embedded and used for all text; nil uses Helvetica
+	lines []line
+}
+
+func (d *Document) Heading(text string) {
+	d.lines = append(d.lines, line{text: text, size: 18})
+}
+
+func (d *Document) Text(text string) {
+	d.lines = append(d.lines, line{text: text, size: 11})
+}
+
+func (d *Document) Blank() {
+	d.lines = append(d.lines, line{size: 11})
+}
+
+// Bytes renders the document as a PDF file.
+func (d *Document) Bytes() []byte {
+	var content bytes.Buffer
+	used := map[uint16]rune{}
+	y := pageHeight - margin
+	for _, l := range d.lines {
+		y -= l.size + l.size/2
+		if l.text == "" {
+			continue
+		}
+		if d.Font == nil {
+			fmt.Fprintf(&content, "BT /F1 %d Tf %d %d Td (%s) Tj ET\n", l.size, margin, y, escape(l.text))
+			continue
+		}
+		fmt.Fprintf(&content, "BT %d %d Td %sET\n", margin, y, d.encode(l.text, l.size, used))
+	}
+
+	fonts := "/F1 4 0 R"
+	if d.Font != nil {
+		fonts += " /F2 6 0 R"
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << %s >> >> /Contents 5 0 R >>", pageWidth, pageHeight, fonts),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		stream("", content.Bytes()),
+	}
+	if d.Font != nil {
+		objects = append(objects, d.Font.objects(used)...)
+	}
+
+	var out bytes.Buffer
+	// The comment's high bytes mark the file as binary for transfer tools
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return out.Bytes()
+}
+
+// encode shows text in the embedded font (F2) as hex glyph IDs, noting the
+// character each glyph stands for. Runs of characters the font lacks but
+// Helvetica (F1) has are shown in Helvetica, so a Thai-only font still works
+// for mixed text.
+func (d *Document) encode(text string, size int, used map[uint16]rune) string {
+	var b strings.Builder
+	helvetica, open := false, false
+	end := func() {
+		switch {
+		case !open:
+		case helvetica:
+			b.WriteString(") Tj ")
+		default:
+			b.WriteString("> Tj ")
+		}
+	}
+	for _, r := range text {
+		if r < 32 {
+			r = '?'
+		}
+		_, has := d.Font.glyphs[r]
+		if next := !has && r <= 255; !open || next != helvetica {
+			end()
+			if next {
+				fmt.Fprintf(&b, "/F1 %d Tf (", size)
+			} else {
+				fmt.Fprintf(&b, "/F2 %d Tf <", size)
+			}
+			helvetica, open = next, true
+		}
+
+		if helvetica {
+			b.WriteString(escape(string(r)))
+			continue
+		}
+		gid, shown := d.Font.glyph(r)
+		if _, ok := used[gid]; !ok {
+			used[gid] = shown
+		}
+		fmt.Fprintf(&b, "%04X", gid)
+	}
+	end()
+	return b.String()
+}
+
+// objects returns objects 6 to 10 of a document with the embedded font: the
+// Type 0 font, its CID font with the widths of the used glyphs, their
+// descriptor, the font file and the ToUnicode map that lets readers copy and
+// search the text.
+func (f *Font) objects(used map[uint16]rune) []string {
+	gids := make([]int, 0, len(used))
+	for gid := range used {
+		gids = append(gids, int(gid))
+	}
+	sort.Ints(gids)
+
+	var widths strings.Builder
+	for _, gid := range gids {
+		fmt.Fprintf(&widths, "%d [%d] ", gid, f.scale(int(f.advances[gid])))
+	}
+
+	var cmap bytes.Buffer
+	cmap.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	for start := 0; start < len(gids); start += 100 {
+		// At most 100 entries per block
+		block := gids[start:min(start+100, len(gids))]
+		fmt.Fprintf(&cmap, "%d beginbfchar\n", len(block))
+		for _, gid := range block {
+			fmt.Fprintf(&cmap, "<%04X> <", gid)
+			for _, unit := range utf16.Encode([]rune{used[uint16(gid)]}) {
+				fmt.Fprintf(&cmap, "%04X", unit)
+			}
+			cmap.WriteString(">\n")
+		}
+		cmap.WriteString("endbfchar\n")
+	}
+	cmap.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+
+	var file bytes.Buffer
+	w := zlib.NewWriter(&file)
+	w.Write(f.data)
+	w.Close()
+
+	return []string{
+		fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [7 0 R] /ToUnicode 10 0 R >>", f.name),
+		fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor 8 0 R /W [%s] /CIDToGIDMap /Identity >>",
+			f.name, strings.TrimSpace(widths.String())),
+		fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags 32 /FontBBox [%d %d %d %d] /ItalicAngle %g /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 9 0 R >>",
+			f.name, f.scale(f.bbox[0]), f.scale(f.bbox[1]), f.scale(f.bbox[2]), f.scale(f.bbox[3]),
+			f.italic, f.scale(f.ascent), f.scale(f.descent), f.scale(f.capHeight)),
+		stream(fmt.Sprintf(" /Length1 %d /Filter /FlateDecode", len(f.data)), file.Bytes()),
+		stream("", cmap.Bytes()),
+	}
+}
+
+// stream formats a stream object with extra dictionary entries.
+func stream(entries string, data []byte) string {
+	return fmt.Sprintf("<< /Length %d%s >>\nstream\n%s\nendstream", len(data), entries, data)
+}
+
+// escape quotes PDF string delimiters and replaces characters Helvetica
+// cannot show (e.g. Thai, without a Font) with '?'.
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 255:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,209 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// checkXref checks that every xref entry points at its object.
+func checkXref(t *testing.T, data []byte) {
+	t.Helper()
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(data)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	lines := strings.Split(string(data[xref:]), "\n")
+	count, _ := strconv.Atoi(strings.Fields(lines[1])[1])
+	for i := 1; i < count; i++ {
+		offset, _ := strconv.Atoi(lines[2+i][:10])
+		if want := fmt.Sprintf("%d 0 obj\n", i); !bytes.HasPrefix(data[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i, data[offset:offset+10])
+		}
+	}
+}
+
+// object returns the body of object n.
+func object(t *testing.T, data []byte, n int) string {
+	t.Helper()
+	start := bytes.Index(data, []byte(fmt.Sprintf("\n%d 0 obj\n", n)))
+	if start < 0 {
+		t.Fatalf("no object %d", n)
+	}
+	body := data[start:]
+	return string(body[:bytes.Index(body, []byte("\nendobj\n"))])
+}
+
+func TestHelvetica(t *testing.T) {
+	var doc Document
+	doc.Heading("Invoice (1)")
+	doc.Blank()
+	doc.Text(`Bill to: สมชาย \ café`)
+	data := doc.Bytes()
+
+	checkXref(t, data)
+	content := object(t, data, 5)
+	for _, want := range []string{"(Invoice \\(1\\)) Tj", "(Bill to: ????? \\\\ caf\xe9) Tj"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("content has no %q:\n%s", want, content)
+		}
+	}
+	if !strings.Contains(object(t, data, 4), "/BaseFont /Helvetica") {
+		t.Error("font 4 is not Helvetica")
+	}
+}
+
+// testFont loads PDF_TEST_FONT, or DejaVu Sans where it is installed.
+func testFont(t *testing.T) (*Font, []byte) {
+	t.Helper()
+	path := os.Getenv("PDF_TEST_FONT")
+	if path == "" {
+		path = "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Skipf("no font at %s; set PDF_TEST_FONT to a .ttf file", path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	font, err := ParseFont(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return font, data
+}
+
+func TestEmbeddedFont(t *testing.T) {
+	font, file := testFont(t)
+	var doc Document
+	doc.Font = font
+	doc.Heading("AΩ")
+	doc.Text("A\x00")
+	data := doc.Bytes()
+	checkXref(t, data)
+
+	a, _ := font.glyph('A')
+	q, _ := font.glyph('?')
+	omega, shown := font.glyph('Ω')
+	if shown != 'Ω' {
+		t.Skip("font has no Ω")
+	}
+	content := object(t, data, 5)
+	for _, want := range []string{fmt.Sprintf("/F2 18 Tf <%04X%04X> Tj", a, omega), fmt.Sprintf("/F2 11 Tf <%04X%04X> Tj", a, q)} {
+		if !strings.Contains(content, want) {
+			t.Errorf("content has no %q:\n%s", want, content)
+		}
+	}
+
+	if !strings.Contains(object(t, data, 6), "/Subtype /Type0 /BaseFont /"+font.name+" /Encoding /Identity-H") {
+		t.Errorf("font 6 = %s", object(t, data, 6))
+	}
+	width := fmt.Sprintf("%d [%d]", omega, font.scale(int(font.advances[omega])))
+	if !strings.Contains(object(t, data, 7), width) {
+		t.Errorf("widths have no %q: %s", width, object(t, data, 7))
+	}
+	toUnicode := object(t, data, 10)
+	for _, want := range []string{fmt.Sprintf("<%04X> <03A9>", omega), fmt.Sprintf("<%04X> <003F>", q)} {
+		if !strings.Contains(toUnicode, want) {
+			t.Errorf("ToUnicode has no %q:\n%s", want, toUnicode)
+		}
+	}
+
+	fontFile := object(t, data, 9)
+	stream := fontFile[strings.Index(fontFile, "stream\n")+7 : strings.LastIndex(fontFile, "\nendstream")]
+	r, err := zlib.NewReader(strings.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(embedded, file) {
+		t.Errorf("embedded font file differs from the original (%v)", err)
+	}
+}
+
+func TestEmbeddedFontFallback(t *testing.T) {
+	font, _ := testFont(t)
+	var missing rune
+	for r := rune(0x0E01); r < 0x0E5B; r++ {
+		if _, ok := font.glyphs[r]; !ok {
+			missing = r
+			break
+		}
+	}
+	if missing == 0 {
+		t.Skip("font has all of Thai")
+	}
+	q, _ := font.glyph('?')
+	if gid, shown := font.glyph(missing); gid != q || shown != '?' {
+		t.Errorf("glyph(%q) = %d, %q; want %d, '?'", missing, gid, shown, q)
+	}
+}
+
+func TestEmbeddedFontHelveticaRuns(t *testing.T) {
+	font, _ := testFont(t)
+	// A Thai-only font: Latin text falls back to Helvetica
+	thaiOnly := &Font{data: font.data, name: font.name, unitsPerEm: font.unitsPerEm, advances: font.advances, glyphs: map[rune]uint16{}}
+	omega, _ := font.glyph('Ω')
+	thaiOnly.glyphs['Ω'] = omega
+
+	got := (&Document{Font: thaiOnly}).encode("a(Ω)é", 11, map[uint16]rune{})
+	want := fmt.Sprintf("/F1 11 Tf (a\\() Tj /F2 11 Tf <%04X> Tj /F1 11 Tf (\\)\xe9) Tj ", omega)
+	if got != want {
+		t.Errorf("encode = %q, want %q", got, want)
+	}
+}
+
+// TestCmapFormat4 reads a hand-made format 4 subtable with one segment of
+// each kind: mapped by delta, and mapped through the glyph ID array.
+func TestCmapFormat4(t *testing.T) {
+	u16 := func(values ...int) []byte {
+		b := make([]byte, 2*len(values))
+		for i, v := range values {
+			binary.BigEndian.PutUint16(b[2*i:], uint16(v))
+		}
+		return b
+	}
+	var sub bytes.Buffer
+	sub.Write(u16(4, 0, 0, 6, 0, 0, 0))   // format, length, language, segCountX2, search fields
+	sub.Write(u16(0x43, 0x62, 0xFFFF, 0)) // endCode, reservedPad
+	sub.Write(u16(0x41, 0x61, 0xFFFF))    // startCode
+	sub.Write(u16(-0x40, 1, 1))           // idDelta: A-C are glyphs 1-3
+	sub.Write(u16(0, 4, 0))               // idRangeOffset: a-b read glyphIdArray
+	sub.Write(u16(7, 0))                  // glyphIdArray: a is 7+1, b is missing
+
+	var table bytes.Buffer
+	table.Write(u16(0, 1, 3, 1, 0, 12)) // version, one (3, 1) record at offset 12
+	table.Write(sub.Bytes())
+
+	glyphs, err := readCmap(&fontReader{data: table.Bytes()}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[rune]uint16{'A': 1, 'B': 2, 'C': 3, 'a': 8}
+	if fmt.Sprint(glyphs) != fmt.Sprint(want) {
+		t.Errorf("glyphs = %v, want %v", glyphs, want)
+	}
+}
+
+func TestParseFontRejects(t *testing.T) {
+	if _, err := ParseFont([]byte("not a font")); err == nil {
+		t.Error("ParseFont accepted garbage")
+	}
+	if _, err := ParseFont([]byte{0, 1, 0, 0, 0, 9}); err == nil {
+		t.Error("ParseFont accepted a truncated table directory")
+	}
+	if font, data := testFont(t); font != nil {
+		if _, err := ParseFont(data[:len(data)/2]); err == nil {
+			t.Error("ParseFont accepted half a font")
+		}
+	}
+}
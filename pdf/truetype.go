@@ -0,0 +1,260 @@
+package pdf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+var errBadFont = errors.New("pdf: not a TrueType font")
+
+// Font is a TrueType font embedded whole in the documents that use it, for
+// text Helvetica cannot show, such as Thai; characters it lacks fall back to
+// Helvetica. Glyphs are placed one after the other without shaping, which
+// fonts with zero-width combining marks (Thai fonts such as Sarabun or Noto
+// Sans Thai) render correctly enough.
+type Font struct {
+	data       []byte
+	name       string
+	unitsPerEm int
+	ascent     int
+	descent    int
+	capHeight  int
+	bbox       [4]int
+	italic     float64
+	glyphs     map[rune]uint16
+	advances   []uint16
+}
+
+// LoadFont reads a TrueType (.ttf) font file.
+func LoadFont(path string) (*Font, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	font, err := ParseFont(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return font, nil
+}
+
+// FontFromEnv loads the font in PDF_FONT_FILE. It returns nil when none is
+// configured; documents then use Helvetica.
+func FontFromEnv() (*Font, error) {
+	path := os.Getenv("PDF_FONT_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	return LoadFont(path)
+}
+
+// fontReader reads big-endian values from a font file, remembering the first
+// out-of-range read instead of panicking.
+type fontReader struct {
+	data []byte
+	err  error
+}
+
+func (r *fontReader) check(off, n int) bool {
+	if r.err == nil && (off < 0 || off+n > len(r.data)) {
+		r.err = errBadFont
+	}
+	return r.err == nil
+}
+
+func (r *fontReader) u16(off int) uint16 {
+	if !r.check(off, 2) {
+		return 0
+	}
+	return binary.BigEndian.Uint16(r.data[off:])
+}
+
+func (r *fontReader) i16(off int) int {
+	return int(int16(r.u16(off)))
+}
+
+func (r *fontReader) u32(off int) uint32 {
+	if !r.check(off, 4) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(r.data[off:])
+}
+
+// ParseFont reads the metrics, character map and name of a TrueType font.
+// OpenType fonts with CFF outlines are not supported.
+func ParseFont(data []byte) (*Font, error) {
+	r := &fontReader{data: data}
+	if v := r.u32(0); v != 0x00010000 && v != 0x74727565 { // 1.0 or "true"
+		return nil, errBadFont
+	}
+	tables := map[string]int{}
+	for i, n := 0, int(r.u16(4)); i < n; i++ {
+		entry := 12 + 16*i
+		if !r.check(entry, 16) {
+			return nil, r.err
+		}
+		tables[string(data[entry:entry+4])] = int(r.u32(entry + 8))
+	}
+	for _, tag := range []string{"head", "hhea", "hmtx", "maxp", "cmap", "glyf"} {
+		if _, ok := tables[tag]; !ok {
+			return nil, fmt.Errorf("pdf: font has no %s table", tag)
+		}
+	}
+
+	head, hhea := tables["head"], tables["hhea"]
+	f := &Font{
+		data:       data,
+		name:       "Embedded",
+		unitsPerEm: int(r.u16(head + 18)),
+		ascent:     r.i16(hhea + 4),
+		descent:    r.i16(hhea + 6),
+		bbox:       [4]int{r.i16(head + 36), r.i16(head + 38), r.i16(head + 40), r.i16(head + 42)},
+	}
+	if f.unitsPerEm == 0 {
+		return nil, errBadFont
+	}
+	f.capHeight = f.ascent
+	if os2, ok := tables["OS/2"]; ok && r.u16(os2) >= 2 {
+		f.capHeight = r.i16(os2 + 88)
+	}
+	if post, ok := tables["post"]; ok {
+		f.italic = float64(int32(r.u32(post+4))) / 65536
+	}
+	if name, ok := tables["name"]; ok {
+		if s := postScriptName(r, name); s != "" {
+			f.name = s
+		}
+	}
+
+	numGlyphs := int(r.u16(tables["maxp"] + 4))
+	metrics := int(r.u16(hhea + 34))
+	if metrics == 0 || metrics > numGlyphs {
+		return nil, errBadFont
+	}
+	f.advances = make([]uint16, numGlyphs)
+	for i := range f.advances {
+		// Glyphs past the last metric repeat its advance
+		f.advances[i] = r.u16(tables["hmtx"] + 4*min(i, metrics-1))
+	}
+
+	var err error
+	if f.glyphs, err = readCmap(r, tables["cmap"]); err != nil {
+		return nil, err
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return f, nil
+}
+
+// postScriptName returns name ID 6 of the name table, keeping only the
+// characters a PDF name may hold unescaped.
+func postScriptName(r *fontReader, table int) string {
+	count, storage := int(r.u16(table+2)), table+int(r.u16(table+4))
+	for i := 0; i < count; i++ {
+		record := table + 6 + 12*i
+		platform, id := r.u16(record), r.u16(record+6)
+		length, off := int(r.u16(record+8)), storage+int(r.u16(record+10))
+		if id != 6 || !r.check(off, length) {
+			continue
+		}
+		raw := r.data[off : off+length]
+		var name string
+		if platform == 1 {
+			name = string(raw)
+		} else {
+			units := make([]uint16, length/2)
+			for j := range units {
+				units[j] = binary.BigEndian.Uint16(raw[2*j:])
+			}
+			name = string(utf16.Decode(units))
+		}
+		return strings.Map(func(c rune) rune {
+			if c <= ' ' || c > '~' || strings.ContainsRune("()<>[]{}/%#", c) {
+				return -1
+			}
+			return c
+		}, name)
+	}
+	return ""
+}
+
+// readCmap maps characters to glyphs from the Unicode subtable of the cmap
+// table: format 12 for the full range, else format 4 for the BMP.
+func readCmap(r *fontReader, table int) (map[rune]uint16, error) {
+	best, bestFormat := -1, uint16(0)
+	for i, n := 0, int(r.u16(table+2)); i < n; i++ {
+		record := table + 4 + 8*i
+		platform, encoding := r.u16(record), r.u16(record+2)
+		if platform != 0 && !(platform == 3 && (encoding == 1 || encoding == 10)) {
+			continue
+		}
+		sub := table + int(r.u32(record+4))
+		if format := r.u16(sub); format == 12 || format == 4 && bestFormat != 12 {
+			best, bestFormat = sub, format
+		}
+	}
+	if best < 0 || r.err != nil {
+		return nil, errors.New("pdf: font has no Unicode character map")
+	}
+
+	glyphs := map[rune]uint16{}
+	if bestFormat == 12 {
+		for i, n := 0, int(r.u32(best+12)); i < n && r.err == nil; i++ {
+			group := best + 16 + 12*i
+			start, end, gid := r.u32(group), r.u32(group+4), r.u32(group+8)
+			if end < start || end > 0x10FFFF {
+				return nil, errBadFont
+			}
+			for c := start; c <= end; c++ {
+				glyphs[rune(c)] = uint16(gid + c - start)
+			}
+		}
+		return glyphs, r.err
+	}
+
+	segments := int(r.u16(best+6)) / 2
+	ends := best + 14
+	starts := ends + 2*segments + 2
+	deltas := starts + 2*segments
+	offsets := deltas + 2*segments
+	for i := 0; i < segments && r.err == nil; i++ {
+		start, end := int(r.u16(starts+2*i)), int(r.u16(ends+2*i))
+		delta, rangeOffset := int(r.u16(deltas+2*i)), int(r.u16(offsets+2*i))
+		for c := start; c <= end && c != 0xFFFF; c++ {
+			gid := (c + delta) & 0xFFFF
+			if rangeOffset != 0 {
+				// The offset is from the idRangeOffset entry itself
+				gid = int(r.u16(offsets + 2*i + rangeOffset + 2*(c-start)))
+				if gid != 0 {
+					gid = (gid + delta) & 0xFFFF
+				}
+			}
+			if gid != 0 {
+				glyphs[rune(c)] = uint16(gid)
+			}
+		}
+	}
+	return glyphs, r.err
+}
+
+// glyph returns the glyph for r and the character it shows, falling back to
+// '?' and then .notdef for characters the font lacks.
+func (f *Font) glyph(r rune) (uint16, rune) {
+	if gid, ok := f.glyphs[r]; ok && int(gid) < len(f.advances) {
+		return gid, r
+	}
+	if gid, ok := f.glyphs['?']; ok && int(gid) < len(f.advances) {
+		return gid, '?'
+	}
+	return 0, '?'
+}
+
+// scale converts font units to the 1000-unit text space PDF metrics use.
+func (f *Font) scale(v int) int {
+	return v * 1000 / f.unitsPerEm
+}
@@ -0,0 +1,48 @@
+// Package storage keeps uploaded files (radiographs and derived images) in a
+// blob store addressed by key.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns ErrNotFound when the key doesn't exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// FromEnv builds the store selected by STORAGE_DRIVER ("local", the default,
+// or "s3").
+func FromEnv() (Storage, error) {
+	switch os.Getenv("STORAGE_DRIVER") {
+	case "", "local":
+		dir := os.Getenv("STORAGE_LOCAL_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return NewLocal(dir)
+	case "s3":
+		s3, err := NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", os.Getenv("STORAGE_DRIVER"))
+	}
+}
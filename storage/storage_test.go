@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore runs the behaviour every Storage must share against s, using keys
+// under prefix.
+func testStore(t *testing.T, s Storage, prefix string) {
+	ctx := context.Background()
+	// Spaces and non-ASCII names must survive the S3 path encoding
+	key := prefix + "/images/ฟัน 1.png"
+	data := []byte("\x89PNG not really")
+
+	if ok, err := s.Exists(ctx, key); err != nil || ok {
+		t.Fatalf("Exists before Put = %v, %v; want false", ok, err)
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get before Put error = %v, want ErrNotFound", err)
+	}
+
+	if err := s.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if ok, err := s.Exists(ctx, key); err != nil || !ok {
+		t.Fatalf("Exists after Put = %v, %v; want true", ok, err)
+	}
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get = %q, %v; want %q", got, err, data)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if ok, err := s.Exists(ctx, key); err != nil || ok {
+		t.Fatalf("Exists after Delete = %v, %v; want false", ok, err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	s, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s, "test")
+
+	if err := s.Put(context.Background(), "../escape", bytes.NewReader(nil), 0, ""); err == nil {
+		t.Error("Put accepted a key outside the directory")
+	}
+}
+
+// TestS3 runs against a MinIO (or other S3-compatible) server when
+// S3_TEST_ENDPOINT is set, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	mc mb local/test
+//	S3_TEST_ENDPOINT=http://localhost:9000 go test ./storage
+//
+// S3_TEST_BUCKET (default "test") must exist. S3_TEST_ACCESS_KEY and
+// S3_TEST_SECRET_KEY default to MinIO's minioadmin.
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	s, err := NewS3(S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_TEST_REGION"),
+		Bucket:    envOr("S3_TEST_BUCKET", "test"),
+		AccessKey: envOr("S3_TEST_ACCESS_KEY", "minioadmin"),
+		SecretKey: envOr("S3_TEST_SECRET_KEY", "minioadmin"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s, "storage-test-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func TestUriEncode(t *testing.T) {
+	tests := map[string]string{
+		"/bucket/a/b.png":   "/bucket/a/b.png",
+		"/bucket/a b+c.png": "/bucket/a%20b%2Bc.png",
+		"/bucket/ฟ":         "/bucket/%E0%B8%9F",
+		"/bucket/~x_y-z":    "/bucket/~x_y-z",
+	}
+	for in, want := range tests {
+		if got := uriEncode(in); got != want {
+			t.Errorf("uriEncode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestS3SignsRequests(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer server.Close()
+
+	s, err := NewS3(S3Config{Endpoint: server.URL + "/", Bucket: "bucket", AccessKey: "AKID", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(context.Background(), "/a b.png", bytes.NewReader([]byte("x")), 1, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Method != http.MethodPut || got.URL.EscapedPath() != "/bucket/a%20b.png" {
+		t.Errorf("request = %s %s, want PUT /bucket/a%%20b.png", got.Method, got.URL.EscapedPath())
+	}
+	auth := got.Header.Get("Authorization")
+	date := got.Header.Get("X-Amz-Date")
+	prefix := "AWS4-HMAC-SHA256 Credential=AKID/" + date[:8] + "/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="
+	if !strings.HasPrefix(auth, prefix) || len(auth) != len(prefix)+64 {
+		t.Errorf("Authorization = %q, want %q + 64 hex digits", auth, prefix)
+	}
+	if got.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+		t.Errorf("X-Amz-Content-Sha256 = %q", got.Header.Get("X-Amz-Content-Sha256"))
+	}
+}
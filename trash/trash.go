@@ -0,0 +1,165 @@
+// Package trash purges soft-deleted records. Deleting a patient, user or
+// question only sets its deleted_at; the record stays restorable from the
+// recycle bin until an admin purges it or the retention job does.
+package trash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/piyawat001/user-auth-api/models"
+	"github.com/piyawat001/user-auth-api/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of records that go through the recycle bin, named by their collection.
+const (
+	Patients  = "patients"
+	Users     = "users"
+	Questions = "questions"
+)
+
+var Kinds = []string{Patients, Users, Questions}
+
+// ErrNotDeleted is returned when purging a record that is not in the bin.
+var ErrNotDeleted = errors.New("record is not in the recycle bin")
+
+// Valid reports whether kind is one of Kinds.
+func Valid(kind string) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// NotDeleted adds the condition that hides soft-deleted records to filter.
+func NotDeleted(filter bson.M) bson.M {
+	filter["deleted_at"] = nil
+	return filter
+}
+
+// Deleted adds the condition that matches only soft-deleted records to filter.
+func Deleted(filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$ne": nil}
+	return filter
+}
+
+// Purge removes a soft-deleted record for good, along with what only exists
+// because of it: a patient's images, annotations, duplicate flags and
+// revisions, a user's usage counters and a question's notifications.
+// Payments, invoices and subscriptions are financial records and are kept,
+// as are patient consent records, which show the data was used lawfully. A
+// patient merged into another keeps its revisions, which are part of the
+// other's history.
+func Purge(ctx context.Context, db *mongo.Database, blobs storage.Storage, kind string, id primitive.ObjectID) error {
+	var record struct {
+		MergedInto *primitive.ObjectID `bson:"merged_into"`
+	}
+	err := db.Collection(kind).FindOneAndDelete(ctx, Deleted(bson.M{"_id": id}),
+		options.FindOneAndDelete().SetProjection(bson.M{"merged_into": 1}),
+	).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotDeleted
+	}
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case Patients:
+		if err := purgeImages(ctx, db, blobs, id); err != nil {
+			return err
+		}
+		if _, err := db.Collection("image_annotations").DeleteMany(ctx, bson.M{"patient_id": id}); err != nil {
+			return fmt.Errorf("cannot delete annotations of %s: %w", id.Hex(), err)
+		}
+		if _, err := db.Collection("patient_duplicates").DeleteMany(ctx, bson.M{"$or": []bson.M{{"patient_id": id}, {"candidate_id": id}}}); err != nil {
+			return fmt.Errorf("cannot delete duplicate flags of %s: %w", id.Hex(), err)
+		}
+		if record.MergedInto != nil {
+			break
+		}
+		if _, err := db.Collection("patient_revisions").DeleteMany(ctx, bson.M{"patient_id": id}); err != nil {
+			return fmt.Errorf("cannot delete revisions of %s: %w", id.Hex(), err)
+		}
+	case Users:
+		if _, err := db.Collection("usage").DeleteMany(ctx, bson.M{"user_id": id}); err != nil {
+			return fmt.Errorf("cannot delete usage of %s: %w", id.Hex(), err)
+		}
+	case Questions:
+		if _, err := db.Collection("notifications").DeleteMany(ctx, bson.M{"question_id": id}); err != nil {
+			return fmt.Errorf("cannot delete notifications of %s: %w", id.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// purgeImages deletes the images of a patient, and their files when no other
+// image shares them.
+func purgeImages(ctx context.Context, db *mongo.Database, blobs storage.Storage, patientID primitive.ObjectID) error {
+	collection := db.Collection("patient_images")
+	cursor, err := collection.Find(ctx, bson.M{"patient_id": patientID})
+	if err != nil {
+		return fmt.Errorf("cannot fetch images of %s: %w", patientID.Hex(), err)
+	}
+	var images []models.PatientImage
+	if err := cursor.All(ctx, &images); err != nil {
+		return fmt.Errorf("cannot decode images of %s: %w", patientID.Hex(), err)
+	}
+
+	if _, err := collection.DeleteMany(ctx, bson.M{"patient_id": patientID}); err != nil {
+		return fmt.Errorf("cannot delete images of %s: %w", patientID.Hex(), err)
+	}
+
+	for _, image := range images {
+		remaining, err := collection.CountDocuments(ctx, bson.M{"storage_key": image.StorageKey})
+		if err != nil || remaining > 0 || blobs == nil {
+			continue
+		}
+		for _, key := range []string{image.StorageKey, image.PreviewKey, image.ThumbnailKey, image.HeatmapKey} {
+			if key == "" {
+				continue
+			}
+			if err := blobs.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				fmt.Printf("Error deleting blob %s: %v\n", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeExpired purges every record of every kind deleted before cutoff and
+// returns how many were purged.
+func PurgeExpired(ctx context.Context, db *mongo.Database, blobs storage.Storage, cutoff time.Time) (int, error) {
+	purged := 0
+	for _, kind := range Kinds {
+		cursor, err := db.Collection(kind).Find(ctx, bson.M{"deleted_at": bson.M{"$lte": cutoff}})
+		if err != nil {
+			return purged, fmt.Errorf("cannot fetch deleted %s: %w", kind, err)
+		}
+		var records []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &records); err != nil {
+			return purged, fmt.Errorf("cannot decode deleted %s: %w", kind, err)
+		}
+
+		for _, record := range records {
+			if err := Purge(ctx, db, blobs, kind, record.ID); err != nil {
+				if err == ErrNotDeleted {
+					continue // Restored in the meantime
+				}
+				return purged, fmt.Errorf("cannot purge %s %s: %w", kind, record.ID.Hex(), err)
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}